@@ -22,7 +22,8 @@ class AdminAction extends React.Component {
       currentRequest: {},
       invalid: false,
       adminToken: "",
-      note: ""
+      note: "",
+      expiresInDays: ""
     };
   }
   componentDidMount() {
@@ -80,18 +81,27 @@ class AdminAction extends React.Component {
       match: { params }
     } = this.props;
     let note = this.state.note;
+    // The decision only applies if no other op decided since the request was loaded
+    let version = this.state.currentRequest.version;
     let promise;
     if (newStatus === "Denied") {
       promise = RequestsService.denyRequest(
         params.id,
         this.state.adminToken,
+        version,
         note
       );
     } else {
+      let expiresIn;
+      if (this.state.expiresInDays) {
+        expiresIn = this.state.expiresInDays + "d";
+      }
       promise = RequestsService.approveRequest(
         params.id,
         this.state.adminToken,
-        note
+        version,
+        note,
+        expiresIn
       );
     }
     promise
@@ -105,6 +115,10 @@ class AdminAction extends React.Component {
         if (error.response) {
           if (error.response.status === 400) {
             alert(i18next.t("Action.InvalidTokenErrMsg"));
+          } else if (error.response.status === 409) {
+            // Another op decided on the request first
+            alert(error.response.data.message);
+            window.location.reload();
           } else {
             alert(i18next.t("Action.InternalErrMsg"));
           }
@@ -157,6 +171,16 @@ class AdminAction extends React.Component {
                 onChange={this.handleInputChange}
               />
             </FormGroup>
+            <FormGroup>
+              <Input
+                type="number"
+                min="1"
+                name="expiresInDays"
+                placeholder={i18next.t("Action.ExpiresInPlaceHolder")}
+                value={this.state.expiresInDays}
+                onChange={this.handleInputChange}
+              />
+            </FormGroup>
           </Form>
           <Button
             className="actionButton"
@@ -11,41 +11,43 @@ import {
 import Title from "./Title";
 import moment from "moment";
 import i18next from "i18next";
-let _ = require("lodash");
+import RequestsService from "../../../service/RequestsService";
 
 function _createData(time, amount) {
   return { time, amount };
 }
 
 export default function Chart(props) {
-  let data = [];
-  // Create a clone of props so that modifications here will not bubbled up
-  let requests = JSON.parse(JSON.stringify(props.requests));
-  // Group all requests by date -> [request]
-  let groupedResults = _.groupBy(requests, request =>
-    moment
-      .parseZone(request["timestamp"])
-      .local()
-      .format("MM/DD/YYYY")
-  );
-  let daysAgo = [];
-  for (let i = 4; i >= 0; i--) {
-    daysAgo.push(
-      moment()
-        .subtract(i, "days")
-        .format("MM/DD/YYYY")
-    );
-  }
-  // Append data for last 5 days in order to display in chart
-  for (let i = 0; i < daysAgo.length; i++) {
-    let date = daysAgo[i];
-    if (Object.prototype.hasOwnProperty.call(groupedResults, date)) {
-      data.push(_createData(date, groupedResults[date].length));
-    } else {
-      // If no new requests for today, set graph line height to zero
-      data.push(_createData(date, 0));
+  const [data, setData] = React.useState([]);
+  const { config } = props;
+
+  React.useEffect(() => {
+    // Count the new requests of each of the last 5 days. Only the totals are needed, so ask the
+    // server for a single request per day instead of loading every request
+    let days = [];
+    for (let i = 4; i >= 0; i--) {
+      days.push(moment().subtract(i, "days"));
     }
-  }
+    Promise.all(
+      days.map(day =>
+        RequestsService.getRequests(config, {
+          from: day.clone().startOf("day").toISOString(),
+          to: day.clone().endOf("day").toISOString(),
+          pageSize: 1
+        })
+      )
+    )
+      .then(responses => {
+        setData(
+          responses.map((res, i) =>
+            _createData(days[i].format("MM/DD/YYYY"), res.data.total)
+          )
+        );
+      })
+      .catch(() => {
+        // The table redirects to login when the session expired, keep the chart empty
+      });
+  }, [config]);
 
   return (
     <React.Fragment>
@@ -17,15 +17,53 @@ import DialogActions from "@material-ui/core/DialogActions";
 import DialogContent from "@material-ui/core/DialogContent";
 import DialogContentText from "@material-ui/core/DialogContentText";
 import DialogTitle from "@material-ui/core/DialogTitle";
+import TextField from "@material-ui/core/TextField";
 import { CSVLink } from "react-csv";
 
+// Columns the server can sort the requests by
+const sortKeys = ["timestamp", "username", "email", "status", "admin"];
+
+// Transform timestamp and null value to be human-readable
+function formatRequest(item) {
+  item.timestamp = moment
+    .parseZone(item.timestamp)
+    .local()
+    .format("MM/DD/YYYY HH:mm");
+  // In Golang, time.Time zero value corresponds to a certain timestamp in mongodb
+  if (item.processedTimestamp === "0001-01-01T00:00:00Z") {
+    item.processedTimestamp = "N/A";
+  } else {
+    item.processedTimestamp = moment
+      .parseZone(item.processedTimestamp)
+      .local()
+      .format("MM/DD/YYYY HH:mm");
+  }
+  if (item.lastUpdatedTimestamp === "0001-01-01T00:00:00Z") {
+    item.lastUpdatedTimestamp = "N/A";
+  } else {
+    item.lastUpdatedTimestamp = moment
+      .parseZone(item.lastUpdatedTimestamp)
+      .local()
+      .format("MM/DD/YYYY HH:mm");
+  }
+  item.admin = item.admin || "N/A";
+  return item;
+}
+
 class Table extends React.Component {
   constructor(props) {
     super(props);
     this.download = this.download.bind(this);
+    this.tableRef = React.createRef();
+    // Cursors of the pages following the pages already fetched, by page index
+    this.cursors = {};
+    this.cursorQuery = null;
     this.state = {
       open: false,
-      dataToDownload: []
+      dataToDownload: [],
+      banReason: "",
+      banDurationDays: "",
+      expiresInDays: ""
     };
   }
 
@@ -36,34 +74,27 @@ class Table extends React.Component {
   handleClose = () => {
     this.setState({ open: false });
   };
-  onStatusChange = (request, newStatus) => {
+  onStatusChange = (request, newStatus, extra) => {
     let requestID = request._id;
     RequestsService.handleStatusChangeByAdmin(
       requestID,
       this.props.config,
-      newStatus
+      request.version,
+      newStatus,
+      extra
     )
       .then(res => {
         if (res.status === 200) {
-          let processedTimestamp = request.processedTimestamp;
-          if (processedTimestamp === "N/A") {
-            processedTimestamp = new Date().toISOString();
-          }
-          this.props.handleChangeRequestStatus({
-            requestID: requestID,
-            // Mock the updated request here to update the parent state
-            request: {
-              ...request,
-              status: newStatus,
-              processedTimestamp: processedTimestamp,
-              lastUpdatedTimestamp: new Date().toISOString()
-            }
-          });
+          // Reload the page so the updated request carries the new version for the next change
+          this.refresh();
         }
       })
       .catch(error => {
         if (error.response) {
-          if (error.response.status === 500) {
+          if (error.response.status === 409) {
+            // Someone else changed the request since it was loaded
+            alert(error.response.data.message || error.response.data);
+          } else if (error.response.status === 500) {
             alert("Internal Server Error");
           } else if (error.response.status === 401) {
             alert("Login session expired. Please login again");
@@ -77,24 +108,111 @@ class Table extends React.Component {
       });
   };
 
+  // fetchPage loads one page of requests from the server. The page after a fetched one is loaded
+  // with the cursor of the previous page, other pages are loaded by their number
+  fetchPage = query => {
+    let params = {
+      pageSize: query.pageSize,
+      sort:
+        query.orderBy && sortKeys.includes(query.orderBy.field)
+          ? query.orderBy.field
+          : "timestamp",
+      order: query.orderDirection === "asc" ? "asc" : "desc"
+    };
+    if (query.search) {
+      params.q = query.search;
+    }
+    // Cursors are only valid for the sort order and search they were created with
+    let cursorQuery = JSON.stringify(params);
+    if (cursorQuery !== this.cursorQuery) {
+      this.cursors = {};
+      this.cursorQuery = cursorQuery;
+    }
+    if (this.cursors[query.page]) {
+      params.cursor = this.cursors[query.page];
+    } else {
+      params.page = query.page + 1;
+    }
+    return RequestsService.getRequests(this.props.config, params)
+      .then(res => {
+        if (res.data.nextCursor) {
+          this.cursors[query.page + 1] = res.data.nextCursor;
+        }
+        return {
+          data: res.data.requests.map(formatRequest),
+          page: query.page,
+          totalCount: res.data.total
+        };
+      })
+      .catch(error => {
+        if (error.response && error.response.status === 401) {
+          // In the case that localstorage has expired / invalid token, clear that up
+          localStorage.clear();
+          this.props.history.push("/login");
+        }
+        throw error;
+      });
+  };
+
+  // refresh reloads the current page, e.g. after the status of a request changed
+  refresh = () => {
+    this.cursors = {};
+    if (this.tableRef.current) {
+      this.tableRef.current.onQueryChange();
+    }
+  };
+
   // onAttempt will open up the confirmation dialog for each corresponding actions
   onAttemptAction = (rowData, newStatus) => {
     this.setState({
       open: true,
       rowData: rowData,
-      attemptedNewStatus: newStatus
+      attemptedNewStatus: newStatus,
+      banReason: "",
+      banDurationDays: "",
+      expiresInDays: ""
     });
   };
 
   onConfirmAction = () => {
-    this.onStatusChange(this.state.rowData, this.state.attemptedNewStatus);
+    let extra = {};
+    if (this.state.attemptedNewStatus === "Banned") {
+      extra.banReason = this.state.banReason;
+      if (this.state.banDurationDays) {
+        extra.banDuration = this.state.banDurationDays + "d";
+      }
+    } else if (
+      this.state.attemptedNewStatus === "Approved" &&
+      this.state.expiresInDays
+    ) {
+      extra.expiresIn = this.state.expiresInDays + "d";
+    }
+    this.onStatusChange(
+      this.state.rowData,
+      this.state.attemptedNewStatus,
+      extra
+    );
     this.setState({ open: false });
   };
 
+  handleInputChange = event => {
+    const { value, name } = event.target;
+    this.setState({
+      [name]: value
+    });
+  };
+
   getActionConfirmMsg = () => {
     let attemptedNewStatus = this.state.attemptedNewStatus;
-    if (attemptedNewStatus === "Banned") {
-      return "You are about to ban the player permanately on your server. Are you sure about this?";
+    if (attemptedNewStatus === "Approved") {
+      return "The player will be whitelisted on your server. Leave the expiry empty to approve the player permanently.";
+    } else if (attemptedNewStatus === "Banned") {
+      return "You are about to ban the player on your server. Leave the duration empty to ban the player permanently. Are you sure about this?";
+    } else if (
+      attemptedNewStatus === "Deactivated" &&
+      this.state.rowData.status === "Banned"
+    ) {
+      return "The ban will be lifted and the player will be able to submit new application again. The player will not be whitelisted.";
     } else if (attemptedNewStatus === "Deactivated") {
       return "By deactivating, the player will be unwhitelisted from your server and unable to play. However the user will be able to submit new application again in the future.";
     }
@@ -125,34 +243,6 @@ class Table extends React.Component {
     if (!this.props || this.props.config == null) {
       return <div>Loading...</div>;
     }
-    // Create a clone of props so that modifications here will not bubbled up
-    let requests = JSON.parse(JSON.stringify(this.props.requests));
-    // Transform timestamp and null value to be human-readable
-    requests = requests.map(function(item) {
-      item.timestamp = moment
-        .parseZone(item.timestamp)
-        .local()
-        .format("MM/DD/YYYY HH:mm");
-      // In Golang, time.Time zero value corresponds to a certain timestamp in mongodb
-      if (item.processedTimestamp === "0001-01-01T00:00:00Z") {
-        item.processedTimestamp = "N/A";
-      } else {
-        item.processedTimestamp = moment
-          .parseZone(item.processedTimestamp)
-          .local()
-          .format("MM/DD/YYYY HH:mm");
-      }
-      if (item.lastUpdatedTimestamp === "0001-01-01T00:00:00Z") {
-        item.lastUpdatedTimestamp = "N/A";
-      } else {
-        item.lastUpdatedTimestamp = moment
-          .parseZone(item.lastUpdatedTimestamp)
-          .local()
-          .format("MM/DD/YYYY HH:mm");
-      }
-      item.admin = item.admin || "N/A";
-      return item;
-    });
     return (
       <div>
         <div>
@@ -167,6 +257,40 @@ class Table extends React.Component {
               <DialogContentText id="alert-dialog-description">
                 {this.getActionConfirmMsg()}
               </DialogContentText>
+              {this.state.attemptedNewStatus === "Banned" && (
+                <div>
+                  <TextField
+                    margin="dense"
+                    name="banReason"
+                    label="Reason (Optional)"
+                    value={this.state.banReason}
+                    onChange={this.handleInputChange}
+                    fullWidth
+                  />
+                  <TextField
+                    margin="dense"
+                    name="banDurationDays"
+                    label="Duration in days (Optional)"
+                    type="number"
+                    inputProps={{ min: 1 }}
+                    value={this.state.banDurationDays}
+                    onChange={this.handleInputChange}
+                    fullWidth
+                  />
+                </div>
+              )}
+              {this.state.attemptedNewStatus === "Approved" && (
+                <TextField
+                  margin="dense"
+                  name="expiresInDays"
+                  label="Expires in days (Optional)"
+                  type="number"
+                  inputProps={{ min: 1 }}
+                  value={this.state.expiresInDays}
+                  onChange={this.handleInputChange}
+                  fullWidth
+                />
+              )}
             </DialogContent>
             <DialogActions>
               <Button onClick={this.handleClose} color="primary">
@@ -188,6 +312,7 @@ class Table extends React.Component {
         />
 
         <MaterialTable
+          tableRef={this.tableRef}
           title={i18next.t("Dashboard.Table.AllRequests")}
           columns={[
             { title: i18next.t("Dashboard.Table.ID"), field: "_id" },
@@ -199,7 +324,15 @@ class Table extends React.Component {
               title: i18next.t("Dashboard.Table.Submitted"),
               field: "timestamp"
             },
-            { title: i18next.t("Dashboard.Table.Status"), field: "status" },
+            {
+              title: i18next.t("Dashboard.Table.Status"),
+              field: "status",
+              // Show ops when the game servers rejected the commands, e.g. for an unknown player
+              render: rowData =>
+                rowData.failure
+                  ? `${rowData.status} (${rowData.failure})`
+                  : rowData.status
+            },
             {
               title: i18next.t("Dashboard.Table.Processed"),
               field: "processedTimestamp"
@@ -214,7 +347,7 @@ class Table extends React.Component {
               field: "assignees"
             }
           ]}
-          data={requests}
+          data={this.fetchPage}
           detailPanel={rowData => {
             return (
               <div>
@@ -246,7 +379,7 @@ class Table extends React.Component {
               icon: "check",
               tooltip: i18next.t("Dashboard.Table.ApproveTooltip"),
               onClick: (event, rowData) =>
-                this.onStatusChange(rowData, "Approved"),
+                this.onAttemptAction(rowData, "Approved"),
               hidden: rowData.status !== "Pending"
             }),
             rowData => ({
@@ -269,15 +402,31 @@ class Table extends React.Component {
               onClick: (event, rowData) =>
                 this.onAttemptAction(rowData, "Banned"),
               hidden: rowData.status !== "Approved"
+            }),
+            rowData => ({
+              icon: "replay",
+              tooltip: "Approve the user again",
+              onClick: (event, rowData) =>
+                this.onAttemptAction(rowData, "Approved"),
+              hidden: rowData.status !== "Deactivated"
+            }),
+            rowData => ({
+              icon: "undo",
+              tooltip: "Lift the ban",
+              onClick: (event, rowData) =>
+                this.onAttemptAction(rowData, "Deactivated"),
+              hidden: rowData.status !== "Banned"
             })
           ]}
           options={{
             actionsColumnIndex: -1,
             exportButton: true,
+            // Exports the requests of the current page
             exportCsv: (columns, data) => {
               this.download(data);
             },
-            grouping: true
+            pageSize: 50,
+            pageSizeOptions: [20, 50, 100]
           }}
         />
       </div>
@@ -6,7 +6,6 @@ import Grid from "@material-ui/core/Grid";
 import Paper from "@material-ui/core/Paper";
 import Chart from "./Chart";
 import Table from "./Table";
-import RequestsService from "../../../service/RequestsService";
 import { withRouter } from "react-router-dom";
 
 const useStyles = theme => ({
@@ -29,7 +28,7 @@ class Landing extends React.Component {
   constructor(props) {
     super(props);
     this.state = {
-      requests: null
+      auth_header: null
     };
   }
 
@@ -41,44 +40,18 @@ class Landing extends React.Component {
       return;
     }
 
-    // such request will go through the auth middleware to check the validity of token implicitly
-    // So if status code returned is 401 we could redirect user to login
+    // Requests of the chart and the table go through the auth middleware to check the validity of token implicitly
+    // So if status code returned is 401 the table redirects user to login
     let config = {
       headers: {
         Authorization: `Bearer ${token.value}`
       }
     };
     this.setState({ auth_header: config });
-    RequestsService.getAllRequests(config)
-      .then(res => {
-        if (res.status === 200) {
-          this.setState({
-            requests: res.data.requests
-          });
-        }
-      })
-      .catch(error => {
-        // direct unauthenticated to login
-        // In the case that localstorage has expired / invalid token, clear that up
-        localStorage.clear();
-        this.props.history.push("/login");
-        return;
-      });
   }
 
-  handleChangeRequestStatus = requestIDandUpdatedRequest => {
-    let requestID = requestIDandUpdatedRequest.requestID;
-    let updatedRequest = requestIDandUpdatedRequest.request;
-    let requests = this.state.requests;
-    for (var i = 0; i < requests.length; i++) {
-      if (requests[i]._id === requestID) {
-        requests[i] = updatedRequest;
-      }
-    }
-    this.setState({ requests });
-  };
   render() {
-    if (this.state.requests == null) {
+    if (this.state.auth_header == null) {
       return <div>Loading...</div>;
     }
     const { classes } = this.props;
@@ -89,18 +62,15 @@ class Landing extends React.Component {
           {/* Chart */}
           <Grid item xs={12} md={12} lg={12}>
             <Paper className={fixedHeightPaper}>
-              <Chart requests={this.state.requests} />
+              <Chart config={this.state.auth_header} />
             </Paper>
           </Grid>
           {/* Whitelist request table-view */}
           <Grid item xs={12}>
             <Paper className={classes.paper}>
               <Table
-                requests={this.state.requests}
                 config={this.state.auth_header}
-                handleChangeRequestStatus={requestID =>
-                  this.handleChangeRequestStatus(requestID)
-                }
+                history={this.props.history}
               />
             </Paper>
           </Grid>
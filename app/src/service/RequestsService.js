@@ -6,13 +6,20 @@ const API_HOST = process.env.REACT_APP_API_HOST
 
 class RequestsService {
   // config: axios config containing auth bearer header
-  getAllRequests(config) {
-    return axios.get(`${API_HOST}/api/v1/internal/requests`, config);
+  // params: paging, sorting and filters, e.g. page or cursor, pageSize, sort, order, from, to and q
+  getRequests(config, params) {
+    return axios.get(`${API_HOST}/api/v1/internal/requests`, {
+      ...config,
+      params: params
+    });
   }
 
-  handleStatusChangeByAdmin(requestID, config, newStatus) {
-    let update = {};
+  // version: the version of the request the admin saw, the server rejects the change if it was updated since
+  // extra: optional fields sent along with the status, e.g. banReason and banDuration
+  handleStatusChangeByAdmin(requestID, config, version, newStatus, extra) {
+    let update = { ...extra };
     update.status = newStatus;
+    update.version = version;
     return axios.patch(
       `${API_HOST}/api/v1/internal/requests/${requestID}`,
       update,
@@ -33,22 +40,28 @@ class RequestsService {
     return axios.get(`${API_HOST}/api/v1/requests/${encodedID}`);
   }
 
-  approveRequest(requestID, admToken, note) {
+  approveRequest(requestID, admToken, version, note, expiresIn) {
+    let change = {
+      status: "Approved",
+      note: note,
+      version: version
+    };
+    if (expiresIn) {
+      change.expiresIn = expiresIn;
+    }
     return axios.patch(
       `${API_HOST}/api/v1/requests/${requestID}?adm=${admToken}`,
-      {
-        status: "Approved",
-        note: note
-      }
+      change
     );
   }
 
-  denyRequest(requestID, admToken, note) {
+  denyRequest(requestID, admToken, version, note) {
     return axios.patch(
       `${API_HOST}/api/v1/requests/${requestID}?adm=${admToken}`,
       {
         status: "Denied",
-        note: note
+        note: note,
+        version: version
       }
     );
   }
@@ -1,39 +1,55 @@
 package broker
 
 import (
-	"bytes"
-	"encoding/json"
 	"errors"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/sirupsen/logrus"
 
 	"github.com/spf13/viper"
 	"github.com/streadway/amqp"
-	"github.com/tywin1104/mc-gatekeeper/types"
 	try "gopkg.in/matryer/try.v1"
 )
 
-// Service represents broker(message queue) service
+// Service is the RabbitMQ implementation of TaskQueue
 type Service struct {
-	conn             *amqp.Connection
-	channel          *amqp.Channel
+	// mu guards conn, channel and the notification channels which are replaced on reconnect
+	mu      sync.RWMutex
+	conn    *amqp.Connection
+	channel *amqp.Channel
+	// channel is in confirm mode. publishMu serializes publishes so confirmations
+	// arrive in publishing order and publishTag is the delivery tag of the last one
+	publishMu        sync.Mutex
+	publishTag       uint64
+	confirms         chan amqp.Confirmation
+	returns          chan amqp.Return
 	log              *logrus.Logger
 	rabbitCloseError chan *amqp.Error
+	closed           chan struct{}
 }
 
 func (s *Service) GetConn() *amqp.Connection {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
 	return s.conn
 }
 func (s *Service) GetChannel() *amqp.Channel {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
 	return s.channel
 }
 
 //WatchForReconnect watch for unexpected connection loss to rabbitMQ and re-establish connection
 func (s *Service) WatchForReconnect() {
 	for {
-		rabbitErr := <-s.rabbitCloseError
+		var rabbitErr *amqp.Error
+		select {
+		case rabbitErr = <-s.rabbitCloseError:
+		case <-s.closed:
+			return
+		}
 		if rabbitErr != nil {
 			s.log.Warning("Broker connection with message queue closed unexpectedly. About to reconnect")
 			s.rabbitCloseError = make(chan *amqp.Error)
@@ -42,7 +58,7 @@ func (s *Service) WatchForReconnect() {
 			// From then on, the newly created channel will be used to
 			// do message publishing
 			s.connectToRabbitMQ()
-			s.conn.NotifyClose(s.rabbitCloseError)
+			s.GetConn().NotifyClose(s.rabbitCloseError)
 			err := s.setup()
 			if err != nil {
 				s.log.WithFields(logrus.Fields{
@@ -58,6 +74,7 @@ func NewService(log *logrus.Logger, rabbitCloseError chan *amqp.Error) *Service
 	s := new(Service)
 	s.log = log
 	s.rabbitCloseError = rabbitCloseError
+	s.closed = make(chan struct{})
 	s.connectToRabbitMQ()
 	err := s.setup()
 	if err != nil {
@@ -70,9 +87,10 @@ func NewService(log *logrus.Logger, rabbitCloseError chan *amqp.Error) *Service
 }
 
 // Close connection and channel associated with the broker
-func (s *Service) Close() {
-	s.channel.Close()
-	s.conn.Close()
+func (s *Service) Close() error {
+	close(s.closed)
+	s.GetChannel().Close()
+	return s.GetConn().Close()
 }
 
 // Connect to message queue with retries, update conn field
@@ -88,9 +106,11 @@ func (s *Service) connectToRabbitMQ() {
 			s.log.WithFields(logrus.Fields{
 				"addr": strings.Split(viper.GetString("rabbitMQConn"), "@")[1],
 			}).Info("Broker-message queue connection established")
+			s.mu.Lock()
 			s.conn = conn
+			s.mu.Unlock()
 		}
-		return attempt < 3, e
+		return attempt < 3 && e != ErrPublishTimeout, e
 	})
 	if err != nil {
 		s.log.WithFields(logrus.Fields{
@@ -101,7 +121,7 @@ func (s *Service) connectToRabbitMQ() {
 
 // Setup queue declaration and update conn property
 func (s *Service) setup() error {
-	ch, err := s.conn.Channel()
+	ch, err := s.GetConn().Channel()
 	if err != nil {
 		return errors.New("Failed to open a channel")
 	}
@@ -160,13 +180,69 @@ func (s *Service) setup() error {
 	if err != nil {
 		return errors.New("Failed to declare the queue")
 	}
+
+	// Declare a delay queue for every retry delay. Tasks wait there until their TTL
+	// expires and are then dead-lettered back to the task queue
+	for _, delay := range retryDelays() {
+		if err = declareRetryQueue(ch, delay); err != nil {
+			return err
+		}
+	}
+	// Let the broker confirm every message once it is persisted
+	if err = ch.Confirm(false); err != nil {
+		return errors.New("Failed to put the channel into confirm mode")
+	}
+	s.publishMu.Lock()
+	s.mu.Lock()
 	s.channel = ch
+	s.confirms = ch.NotifyPublish(make(chan amqp.Confirmation, 16))
+	s.returns = ch.NotifyReturn(make(chan amqp.Return, 16))
+	s.publishTag = 0
+	s.mu.Unlock()
+	s.publishMu.Unlock()
+	return nil
+}
+
+// declareRetryQueue declares the delay queue for the given retry delay. Tasks wait there until
+// their TTL expires and are then dead-lettered back to the task queue
+func declareRetryQueue(ch *amqp.Channel, delay time.Duration) error {
+	_, err := ch.QueueDeclare(
+		retryQueueName(delay), // name
+		true,                  // durable
+		false,                 // delete when unused
+		false,                 // exclusive
+		false,                 // no-wait
+		amqp.Table{
+			"x-message-ttl":             int64(delay / time.Millisecond),
+			"x-dead-letter-exchange":    "",
+			"x-dead-letter-routing-key": viper.GetString("taskQueueName"),
+		}, // arguments
+	)
+	if err != nil {
+		return errors.New("Failed to declare the retry queue " + retryQueueName(delay))
+	}
 	return nil
 }
 
-// Publish a whitelistRequest message for the queue to consume
-func (s *Service) Publish(message types.WhitelistRequest) error {
-	encodedMessage, err := serialize(message)
+// ensureRetryQueue declares the delay queue for the given retry delay if it does not exist yet.
+// The retry settings can change while running, so the delay queues declared at setup may not
+// cover every delay. A dedicated channel is used since a failed declaration closes the channel
+func (s *Service) ensureRetryQueue(delay time.Duration) error {
+	ch, err := s.GetConn().Channel()
+	if err != nil {
+		return err
+	}
+	defer ch.Close()
+	return declareRetryQueue(ch, delay)
+}
+
+// Publish a task for the queue to consume. It only succeeds once the broker confirmed
+// that the task was routed to the task queue and persisted. A task that timed out waiting for
+// the confirmation may still have been persisted, so it is not published again here: the
+// ErrPublishTimeout is returned and the outbox relay publishes the entry on its next pass,
+// with the worker recognising a duplicate by the idempotency key of the task
+func (s *Service) Publish(task Task) error {
+	encodedMessage, err := serialize(task)
 	if err != nil {
 		return err
 	}
@@ -175,24 +251,256 @@ func (s *Service) Publish(message types.WhitelistRequest) error {
 		if attempt > 1 {
 			s.log.Infof("Trying to publish message to broker [%d/3]\n", attempt)
 		}
-		e := s.channel.Publish(
+		e := s.publish(
 			"",                               // exchange
 			viper.GetString("taskQueueName"), // routing key
-			false,                            // mandatory
-			false,
 			amqp.Publishing{
 				DeliveryMode: amqp.Persistent,
 				ContentType:  "application/json",
+				Type:         task.Type,
+				MessageId:    newMessageID(),
 				Body:         []byte(encodedMessage),
 			})
-		return attempt < 3, e
+		return attempt < 3 && e != ErrPublishTimeout, e
 	})
 	return err
 }
 
-func serialize(msg types.WhitelistRequest) ([]byte, error) {
-	var b bytes.Buffer
-	encoder := json.NewEncoder(&b)
-	err := encoder.Encode(msg)
-	return b.Bytes(), err
+// Consume delivers the messages of the task queue, up to Prefetch of them unacknowledged.
+// Consuming resumes on the new connection after a reconnect
+func (s *Service) Consume() (<-chan Delivery, error) {
+	msgs, err := s.consume()
+	if err != nil {
+		return nil, err
+	}
+	deliveries := make(chan Delivery)
+	go func() {
+		defer close(deliveries)
+		for {
+			for d := range msgs {
+				select {
+				case deliveries <- s.newAMQPDelivery(d):
+				case <-s.closed:
+					// Unacknowledged messages are requeued by RabbitMQ once the channel is closed
+					return
+				}
+			}
+			// The amqp delivery channel is closed when the connection is lost.
+			// Wait for WatchForReconnect to establish a new one
+			for {
+				select {
+				case <-s.closed:
+					return
+				case <-time.After(time.Second):
+				}
+				if msgs, err = s.consume(); err == nil {
+					s.log.Info("Resumed consuming messages after reconnect")
+					break
+				}
+			}
+		}
+	}()
+	return deliveries, nil
+}
+
+// consume opens a dedicated channel for consuming on the current connection
+func (s *Service) consume() (<-chan amqp.Delivery, error) {
+	ch, err := s.GetConn().Channel()
+	if err != nil {
+		return nil, err
+	}
+	err = ch.Qos(
+		Prefetch(), // prefetch count
+		0,          // prefetch size
+		false,      // global
+	)
+	if err != nil {
+		return nil, err
+	}
+	return ch.Consume(
+		viper.GetString("taskQueueName"), // queue
+		"",                               // consumer
+		false,                            // auto-ack
+		false,                            // exclusive
+		false,                            // no-local
+		false,                            // no-wait
+		nil,                              // args
+	)
+}
+
+func (s *Service) newAMQPDelivery(d amqp.Delivery) Delivery {
+	deadLetter := func(reason string) error {
+		// Publish a copy carrying the failure reason since RabbitMQ only records
+		// the reason "rejected" when the message is dead-lettered by a nack
+		err := s.publish(
+			"dead.letter.ex", // exchange
+			"",               // routing key
+			amqp.Publishing{
+				DeliveryMode: amqp.Persistent,
+				ContentType:  d.ContentType,
+				MessageId:    d.MessageId,
+				Headers:      amqp.Table(deadLetterHeaders(d.Headers, reason)),
+				Body:         d.Body,
+			})
+		if err != nil {
+			s.log.WithFields(logrus.Fields{
+				"err": err.Error(),
+			}).Warn("Unable to publish dead letter. Falling back to nack")
+			return d.Nack(false, false)
+		}
+		return d.Ack(false)
+	}
+	return Delivery{
+		MessageID:  d.MessageId,
+		Headers:    d.Headers,
+		Body:       d.Body,
+		ack:        func() error { return d.Ack(false) },
+		nack:       func(requeue bool) error { return d.Nack(false, requeue) },
+		deadLetter: deadLetter,
+		retry: func(delay time.Duration, headers map[string]interface{}) error {
+			err := s.ensureRetryQueue(delay)
+			if err == nil {
+				err = s.publish(
+					"",                    // exchange
+					retryQueueName(delay), // routing key
+					amqp.Publishing{
+						DeliveryMode: amqp.Persistent,
+						ContentType:  d.ContentType,
+						MessageId:    d.MessageId,
+						Headers:      amqp.Table(headers),
+						Body:         d.Body,
+					})
+			}
+			if err != nil {
+				// Requeueing would deliver the task again right away, over and over
+				s.log.WithFields(logrus.Fields{
+					"err": err.Error(),
+				}).Warn("Unable to publish task for retry. Moving it to the dead letter queue")
+				reason, _ := headers[HeaderFailureReason].(string)
+				if dlErr := deadLetter(reason); dlErr != nil {
+					return dlErr
+				}
+				return err
+			}
+			return d.Ack(false)
+		},
+	}
+}
+
+// DeadLetters returns up to limit messages of the dead letter queue after skipping the first offset, oldest first
+func (s *Service) DeadLetters(offset, limit int) ([]DeadLetter, error) {
+	deadLetters := []DeadLetter{}
+	if limit <= 0 {
+		return deadLetters, nil
+	}
+	err := s.withDeadLetters(func(ch *amqp.Channel, d amqp.Delivery) (bool, error) {
+		if offset > 0 {
+			offset--
+			return true, nil
+		}
+		deadLetters = append(deadLetters, newDeadLetter(d.MessageId, d.Headers, d.Body))
+		return len(deadLetters) < limit, nil
+	})
+	return deadLetters, err
+}
+
+// DeadLetter returns the dead letter with the given ID or ErrDeadLetterNotFound
+func (s *Service) DeadLetter(id string) (DeadLetter, error) {
+	var deadLetter *DeadLetter
+	err := s.withDeadLetters(func(ch *amqp.Channel, d amqp.Delivery) (bool, error) {
+		if d.MessageId != id {
+			return true, nil
+		}
+		found := newDeadLetter(d.MessageId, d.Headers, d.Body)
+		deadLetter = &found
+		return false, nil
+	})
+	if err != nil {
+		return DeadLetter{}, err
+	}
+	if deadLetter == nil {
+		return DeadLetter{}, ErrDeadLetterNotFound
+	}
+	return *deadLetter, nil
+}
+
+// ReplayDeadLetters moves the given dead letters back to the task queue and returns the IDs that were moved
+func (s *Service) ReplayDeadLetters(ids []string) ([]string, error) {
+	replayed := []string{}
+	err := s.withDeadLetters(func(ch *amqp.Channel, d amqp.Delivery) (bool, error) {
+		if !contains(ids, d.MessageId) {
+			return true, nil
+		}
+		// Publish on the confirmed channel so the dead letter is only removed once the task is back in the queue
+		err := s.publish(
+			"",                               // exchange
+			viper.GetString("taskQueueName"), // routing key
+			amqp.Publishing{
+				DeliveryMode: amqp.Persistent,
+				ContentType:  d.ContentType,
+				MessageId:    d.MessageId,
+				Headers:      amqp.Table(replayHeaders(d.Headers)),
+				Body:         d.Body,
+			})
+		if err != nil {
+			return false, err
+		}
+		replayed = append(replayed, d.MessageId)
+		return len(replayed) < len(ids), d.Ack(false)
+	})
+	return replayed, err
+}
+
+// DiscardDeadLetters deletes the given dead letters and returns the IDs that were deleted
+func (s *Service) DiscardDeadLetters(ids []string) ([]string, error) {
+	discarded := []string{}
+	err := s.withDeadLetters(func(ch *amqp.Channel, d amqp.Delivery) (bool, error) {
+		if !contains(ids, d.MessageId) {
+			return true, nil
+		}
+		discarded = append(discarded, d.MessageId)
+		return len(discarded) < len(ids), d.Ack(false)
+	})
+	return discarded, err
+}
+
+// DiscardRequestDeadLetters deletes the dead letters whose task is for one of the given requests
+func (s *Service) DiscardRequestDeadLetters(requestIDs []string) ([]string, error) {
+	discarded := []string{}
+	err := s.withDeadLetters(func(ch *amqp.Channel, d amqp.Delivery) (bool, error) {
+		if !newDeadLetter(d.MessageId, d.Headers, d.Body).forRequest(requestIDs) {
+			return true, nil
+		}
+		discarded = append(discarded, d.MessageId)
+		return true, d.Ack(false)
+	})
+	return discarded, err
+}
+
+// withDeadLetters fetches the messages of the dead letter queue on a dedicated channel until f returns
+// false or the queue is exhausted. The fetched messages are held until then, so f should stop as soon as
+// it can. Messages that are not acknowledged by f are put back when the channel is closed
+func (s *Service) withDeadLetters(f func(ch *amqp.Channel, d amqp.Delivery) (bool, error)) error {
+	ch, err := s.GetConn().Channel()
+	if err != nil {
+		return err
+	}
+	defer ch.Close()
+	for {
+		d, ok, err := ch.Get("dead.letter.queue", false)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			return nil
+		}
+		if d.MessageId == "" {
+			// Messages published before message IDs were introduced are identified by their content
+			d.MessageId = legacyMessageID(d.Headers, d.Body)
+		}
+		more, err := f(ch, d)
+		if err != nil || !more {
+			return err
+		}
+	}
 }
@@ -0,0 +1,109 @@
+package broker
+
+import (
+	"errors"
+	"time"
+
+	"github.com/spf13/viper"
+	"github.com/streadway/amqp"
+)
+
+// Errors returned when RabbitMQ did not take over a published message
+var (
+	// ErrPublishNacked means the broker was unable to persist the message
+	ErrPublishNacked = errors.New("Message was rejected by the broker")
+	// ErrPublishUnroutable means no queue is bound for the routing key of the message
+	ErrPublishUnroutable = errors.New("Message could not be routed to a queue")
+	// ErrPublishTimeout means the broker did not confirm the message in time. It may still have been persisted
+	ErrPublishTimeout = errors.New("Timed out waiting for the broker to confirm the message")
+	// ErrPublishChannelClosed means the channel was closed before the broker confirmed the message
+	ErrPublishChannelClosed = errors.New("Channel closed before the broker confirmed the message")
+)
+
+// defaultPublishTimeout is used when publishTimeout is not configured
+const defaultPublishTimeout = 5 * time.Second
+
+// PublishTimeout returns how long to wait for the broker to confirm a published message
+func PublishTimeout() time.Duration {
+	timeout := viper.GetDuration("publishTimeout")
+	if timeout <= 0 {
+		return defaultPublishTimeout
+	}
+	return timeout
+}
+
+// publish sends a mandatory message on the publishing channel and waits until the broker
+// confirmed it. Publishes are serialized so every confirmation can be matched to its message
+func (s *Service) publish(exchange, key string, msg amqp.Publishing) error {
+	s.publishMu.Lock()
+	defer s.publishMu.Unlock()
+	s.mu.RLock()
+	ch, confirms, returns := s.channel, s.confirms, s.returns
+	s.mu.RUnlock()
+
+	err := ch.Publish(
+		exchange,
+		key,
+		true,  // mandatory
+		false, // immediate
+		msg,
+	)
+	if err != nil {
+		return err
+	}
+	s.publishTag++
+	return waitForConfirm(confirms, returns, s.publishTag, msg.MessageId, PublishTimeout())
+}
+
+// waitForConfirm waits for the confirmation of the message published with the given delivery tag.
+// Confirmations of earlier messages that timed out are skipped. A message that is returned
+// as unroutable is still acked by the broker, so the return is checked once the ack arrived
+func waitForConfirm(confirms <-chan amqp.Confirmation, returns <-chan amqp.Return, tag uint64, messageID string, timeout time.Duration) error {
+	var returned *amqp.Return
+	checkReturn := func(r amqp.Return) {
+		if r.MessageId == messageID {
+			returned = &r
+		}
+	}
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	for {
+		select {
+		case r, ok := <-returns:
+			if !ok {
+				returns = nil
+				continue
+			}
+			checkReturn(r)
+		case c, ok := <-confirms:
+			if !ok {
+				return ErrPublishChannelClosed
+			}
+			if c.DeliveryTag < tag {
+				continue
+			}
+			if !c.Ack {
+				return ErrPublishNacked
+			}
+			// The return is sent before the ack, drain it in case select picked the ack first
+		drain:
+			for returned == nil {
+				select {
+				case r, ok := <-returns:
+					if !ok {
+						break drain
+					}
+					checkReturn(r)
+				default:
+					break drain
+				}
+			}
+			if returned != nil {
+				return ErrPublishUnroutable
+			}
+			return nil
+		case <-timer.C:
+			return ErrPublishTimeout
+		}
+	}
+}
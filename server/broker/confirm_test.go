@@ -0,0 +1,52 @@
+package broker_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/streadway/amqp"
+	"github.com/tywin1104/mc-gatekeeper/broker"
+)
+
+func TestWaitForConfirm(t *testing.T) {
+	tests := []struct {
+		name     string
+		confirms []amqp.Confirmation
+		returns  []amqp.Return
+		want     error
+	}{
+		{"acked", []amqp.Confirmation{{DeliveryTag: 2, Ack: true}}, nil, nil},
+		{"nacked", []amqp.Confirmation{{DeliveryTag: 2, Ack: false}}, nil, broker.ErrPublishNacked},
+		{"returned", []amqp.Confirmation{{DeliveryTag: 2, Ack: true}}, []amqp.Return{{MessageId: "msg", ReplyText: "NO_ROUTE"}}, broker.ErrPublishUnroutable},
+		{"return of other message", []amqp.Confirmation{{DeliveryTag: 2, Ack: true}}, []amqp.Return{{MessageId: "other"}}, nil},
+		{"stale confirmation skipped", []amqp.Confirmation{{DeliveryTag: 1, Ack: false}, {DeliveryTag: 2, Ack: true}}, nil, nil},
+		{"timeout", []amqp.Confirmation{{DeliveryTag: 1, Ack: true}}, nil, broker.ErrPublishTimeout},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			confirms := make(chan amqp.Confirmation, len(test.confirms))
+			returns := make(chan amqp.Return, len(test.returns))
+			// Returns are always delivered before the confirmation of the same message
+			for _, r := range test.returns {
+				returns <- r
+			}
+			for _, c := range test.confirms {
+				confirms <- c
+			}
+			err := broker.WaitForConfirm(confirms, returns, 2, "msg", 50*time.Millisecond)
+			if err != test.want {
+				t.Errorf("Expected %v, got %v", test.want, err)
+			}
+		})
+	}
+}
+
+func TestWaitForConfirmChannelClosed(t *testing.T) {
+	confirms := make(chan amqp.Confirmation)
+	returns := make(chan amqp.Return)
+	close(confirms)
+	close(returns)
+	if err := broker.WaitForConfirm(confirms, returns, 1, "msg", time.Second); err != broker.ErrPublishChannelClosed {
+		t.Errorf("Expected %v, got %v", broker.ErrPublishChannelClosed, err)
+	}
+}
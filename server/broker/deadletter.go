@@ -0,0 +1,128 @@
+package broker
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+
+	"github.com/streadway/amqp"
+)
+
+// Headers attached to messages that were moved to the dead letter queue by the worker
+const (
+	// HeaderFailureReason describes why processing the message failed the last time
+	HeaderFailureReason = "x-failure-reason"
+	// HeaderDeathCount counts how many times the message was dead-lettered
+	HeaderDeathCount = "x-death-count"
+)
+
+// ErrDeadLetterNotFound is returned when a dead letter does not exist (anymore)
+var ErrDeadLetterNotFound = errors.New("Dead letter not found")
+
+// DeadLetterQueue gives access to the messages the worker failed to process
+type DeadLetterQueue interface {
+	// DeadLetters returns up to limit messages of the dead letter queue after skipping the first offset, oldest first
+	DeadLetters(offset, limit int) ([]DeadLetter, error)
+	// DeadLetter returns the dead letter with the given ID or ErrDeadLetterNotFound
+	DeadLetter(id string) (DeadLetter, error)
+	// ReplayDeadLetters moves the given dead letters back to the task queue and returns the IDs that were moved
+	ReplayDeadLetters(ids []string) ([]string, error)
+	// DiscardDeadLetters deletes the given dead letters and returns the IDs that were deleted
+	DiscardDeadLetters(ids []string) ([]string, error)
+	// DiscardRequestDeadLetters deletes the dead letters whose task is for one of the given requests and
+	// returns their IDs. The whole queue is read, so it is only meant for erasing personal data
+	DiscardRequestDeadLetters(requestIDs []string) ([]string, error)
+}
+
+// DeadLetter is a message in the dead letter queue
+type DeadLetter struct {
+	MessageID  string                 `json:"messageId"`
+	Reason     string                 `json:"reason"`
+	DeathCount int64                  `json:"deathCount"`
+	Headers    map[string]interface{} `json:"headers"`
+	Body       []byte                 `json:"-"`
+}
+
+// Task decodes the task carried by the dead letter
+func (d DeadLetter) Task() (Task, error) {
+	return DecodeTask(d.Body)
+}
+
+func newDeadLetter(id string, headers map[string]interface{}, body []byte) DeadLetter {
+	d := DeadLetter{MessageID: id, Headers: headers, Body: body}
+	if reason, ok := headers[HeaderFailureReason].(string); ok {
+		d.Reason = reason
+	}
+	d.DeathCount = toInt64(headers[HeaderDeathCount])
+	// Messages dead-lettered by RabbitMQ itself, e.g. because they expired, only carry x-death
+	if deaths, ok := headers["x-death"].([]interface{}); ok && d.DeathCount == 0 {
+		for _, death := range deaths {
+			if table, ok := death.(amqp.Table); ok {
+				if d.Reason == "" {
+					d.Reason, _ = table["reason"].(string)
+				}
+				d.DeathCount += toInt64(table["count"])
+			}
+		}
+	}
+	return d
+}
+
+// legacyMessageID derives the ID of a dead letter published without a message ID from its body and
+// x-death header, which do not change while it is in the dead letter queue. Identical dead letters share the ID
+func legacyMessageID(headers map[string]interface{}, body []byte) string {
+	h := sha256.New()
+	h.Write(body)
+	// Maps are printed in key order
+	fmt.Fprintf(h, "%v", headers["x-death"])
+	return "legacy-" + hex.EncodeToString(h.Sum(nil))[:16]
+}
+
+// deadLetterHeaders returns the headers of a message that is dead-lettered for the given reason
+func deadLetterHeaders(headers map[string]interface{}, reason string) map[string]interface{} {
+	updated := make(map[string]interface{}, len(headers)+2)
+	for k, v := range headers {
+		updated[k] = v
+	}
+	updated[HeaderFailureReason] = reason
+	updated[HeaderDeathCount] = toInt64(headers[HeaderDeathCount]) + 1
+	return updated
+}
+
+// toInt64 converts numeric header values which depend on how the message was encoded
+func toInt64(v interface{}) int64 {
+	switch n := v.(type) {
+	case int64:
+		return n
+	case int32:
+		return int64(n)
+	case int:
+		return int64(n)
+	case float64:
+		return int64(n)
+	}
+	return 0
+}
+
+func newMessageID() string {
+	b := make([]byte, 12)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// forRequest returns whether the task of the dead letter is for one of the given requests
+func (d DeadLetter) forRequest(requestIDs []string) bool {
+	task, err := d.Task()
+	return err == nil && contains(requestIDs, task.Request.ID.Hex())
+}
+
+func contains(ids []string, id string) bool {
+	for _, i := range ids {
+		if i == id {
+			return true
+		}
+	}
+	return false
+}
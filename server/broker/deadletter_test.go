@@ -0,0 +1,31 @@
+package broker_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/streadway/amqp"
+	"github.com/tywin1104/mc-gatekeeper/broker"
+)
+
+func TestLegacyMessageID(t *testing.T) {
+	died := time.Date(2019, 11, 2, 10, 0, 0, 0, time.UTC)
+	headers := func(count int64) map[string]interface{} {
+		return map[string]interface{}{"x-death": []interface{}{
+			amqp.Table{"count": count, "reason": "rejected", "queue": "tasks", "time": died},
+		}}
+	}
+	id := broker.LegacyMessageID(headers(1), []byte(`{"username":"user1"}`))
+	// The ID has to stay the same between listing and replaying the dead letter
+	if again := broker.LegacyMessageID(headers(1), []byte(`{"username":"user1"}`)); again != id {
+		t.Errorf("Expect the same ID for the same dead letter, got %s and %s", id, again)
+	}
+	for _, other := range []string{
+		broker.LegacyMessageID(headers(1), []byte(`{"username":"user2"}`)),
+		broker.LegacyMessageID(headers(2), []byte(`{"username":"user1"}`)),
+	} {
+		if other == id {
+			t.Errorf("Expect different dead letters to have different IDs, got %s for both", id)
+		}
+	}
+}
@@ -0,0 +1,7 @@
+package broker
+
+// WaitForConfirm exposes waitForConfirm to the tests of package broker_test
+var WaitForConfirm = waitForConfirm
+
+// LegacyMessageID exposes legacyMessageID to the tests of package broker_test
+var LegacyMessageID = legacyMessageID
@@ -0,0 +1,375 @@
+package broker
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Directories below the persistence directory of a MemoryQueue
+const (
+	memoryQueueDir      = "queue"
+	memoryDeadLetterDir = "dead-letter"
+)
+
+// ErrQueueClosed is returned when publishing to a closed queue
+var ErrQueueClosed = errors.New("Task queue is closed")
+
+// MemoryQueue is an in-process implementation of TaskQueue for running the server
+// and the worker as a single binary without RabbitMQ. If a directory is configured,
+// every message is kept as a file until it is acknowledged so that unprocessed tasks
+// survive a restart
+type MemoryQueue struct {
+	mu          sync.Mutex
+	dir         string
+	pending     []*memoryMessage
+	deadLetters []*memoryMessage
+	sequence    int64
+	// unacked counts the deliveries that were not settled yet
+	unacked int
+	// notify signals the consumer that messages were added
+	notify chan struct{}
+	closed chan struct{}
+}
+
+type memoryMessage struct {
+	ID      string                 `json:"id"`
+	Headers map[string]interface{} `json:"headers"`
+	Body    []byte                 `json:"body"`
+}
+
+// NewMemoryQueue creates an in-process task queue. Messages are persisted in dir unless it is empty
+func NewMemoryQueue(dir string) (*MemoryQueue, error) {
+	q := &MemoryQueue{
+		dir:    dir,
+		notify: make(chan struct{}, 1),
+		closed: make(chan struct{}),
+	}
+	if dir == "" {
+		return q, nil
+	}
+	for _, sub := range []string{memoryQueueDir, memoryDeadLetterDir} {
+		if err := os.MkdirAll(filepath.Join(dir, sub), 0700); err != nil {
+			return nil, err
+		}
+	}
+	var err error
+	// Messages that were not acknowledged before the last shutdown are delivered again
+	if q.pending, err = q.load(memoryQueueDir); err != nil {
+		return nil, err
+	}
+	if q.deadLetters, err = q.load(memoryDeadLetterDir); err != nil {
+		return nil, err
+	}
+	if len(q.pending) > 0 {
+		q.signal()
+	}
+	return q, nil
+}
+
+// Publish a task for the worker to process
+func (q *MemoryQueue) Publish(task Task) error {
+	body, err := serialize(task)
+	if err != nil {
+		return err
+	}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	select {
+	case <-q.closed:
+		return ErrQueueClosed
+	default:
+	}
+	q.sequence++
+	// IDs sort in publishing order which is used to restore the order after a restart
+	m := &memoryMessage{
+		ID:      fmt.Sprintf("%020d-%06d", time.Now().UnixNano(), q.sequence%1000000),
+		Headers: map[string]interface{}{},
+		Body:    body,
+	}
+	if err := q.persist(memoryQueueDir, m); err != nil {
+		return err
+	}
+	q.pending = append(q.pending, m)
+	q.signal()
+	return nil
+}
+
+// Consume delivers the published messages in order, up to Prefetch of them unacknowledged.
+// The next message is only taken off the queue once the previous one was received
+func (q *MemoryQueue) Consume() (<-chan Delivery, error) {
+	deliveries := make(chan Delivery)
+	go func() {
+		defer close(deliveries)
+		for {
+			m := q.next()
+			if m == nil {
+				select {
+				case <-q.notify:
+					continue
+				case <-q.closed:
+					return
+				}
+			}
+			select {
+			case deliveries <- q.delivery(m):
+			case <-q.closed:
+				return
+			}
+		}
+	}()
+	return deliveries, nil
+}
+
+// Close stops delivering messages. Persisted messages that were not acknowledged
+// are delivered again by the next queue opened on the same directory
+func (q *MemoryQueue) Close() error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	select {
+	case <-q.closed:
+	default:
+		close(q.closed)
+	}
+	return nil
+}
+
+func (q *MemoryQueue) signal() {
+	select {
+	case q.notify <- struct{}{}:
+	default:
+	}
+}
+
+// next takes the first pending message off the queue unless Prefetch deliveries are not settled yet
+func (q *MemoryQueue) next() *memoryMessage {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if len(q.pending) == 0 || q.unacked >= Prefetch() {
+		return nil
+	}
+	m := q.pending[0]
+	q.pending = q.pending[1:]
+	q.unacked++
+	return m
+}
+
+func (q *MemoryQueue) delivery(m *memoryMessage) Delivery {
+	var once sync.Once
+	settle := func(f func() error) error {
+		err := errors.New("Delivery was already acknowledged or rejected")
+		once.Do(func() {
+			err = f()
+			// Make room for the next delivery
+			q.mu.Lock()
+			q.unacked--
+			q.signal()
+			q.mu.Unlock()
+		})
+		return err
+	}
+	return Delivery{
+		MessageID: m.ID,
+		Headers:   m.Headers,
+		Body:      m.Body,
+		ack: func() error {
+			return settle(func() error { return q.remove(memoryQueueDir, m) })
+		},
+		nack: func(requeue bool) error {
+			return settle(func() error {
+				q.mu.Lock()
+				defer q.mu.Unlock()
+				if requeue {
+					q.pending = append([]*memoryMessage{m}, q.pending...)
+					q.signal()
+					return nil
+				}
+				return q.moveToDeadLetters(m)
+			})
+		},
+		deadLetter: func(reason string) error {
+			return settle(func() error {
+				q.mu.Lock()
+				defer q.mu.Unlock()
+				m.Headers = deadLetterHeaders(m.Headers, reason)
+				return q.moveToDeadLetters(m)
+			})
+		},
+		retry: func(delay time.Duration, headers map[string]interface{}) error {
+			return settle(func() error {
+				q.mu.Lock()
+				defer q.mu.Unlock()
+				m.Headers = headers
+				// The delay is not persisted. After a restart the task is delivered right away
+				if err := q.persist(memoryQueueDir, m); err != nil {
+					return err
+				}
+				time.AfterFunc(delay, func() {
+					q.mu.Lock()
+					defer q.mu.Unlock()
+					q.pending = append(q.pending, m)
+					q.signal()
+				})
+				return nil
+			})
+		},
+	}
+}
+
+func (q *MemoryQueue) moveToDeadLetters(m *memoryMessage) error {
+	if err := q.persist(memoryDeadLetterDir, m); err != nil {
+		return err
+	}
+	q.deadLetters = append(q.deadLetters, m)
+	return q.remove(memoryQueueDir, m)
+}
+
+// DeadLetters returns up to limit messages of the dead letter queue after skipping the first offset, oldest first
+func (q *MemoryQueue) DeadLetters(offset, limit int) ([]DeadLetter, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	deadLetters := []DeadLetter{}
+	for i := offset; i < len(q.deadLetters) && len(deadLetters) < limit; i++ {
+		m := q.deadLetters[i]
+		deadLetters = append(deadLetters, newDeadLetter(m.ID, m.Headers, m.Body))
+	}
+	return deadLetters, nil
+}
+
+// DeadLetter returns the dead letter with the given ID or ErrDeadLetterNotFound
+func (q *MemoryQueue) DeadLetter(id string) (DeadLetter, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for _, m := range q.deadLetters {
+		if m.ID == id {
+			return newDeadLetter(m.ID, m.Headers, m.Body), nil
+		}
+	}
+	return DeadLetter{}, ErrDeadLetterNotFound
+}
+
+// ReplayDeadLetters moves the given dead letters back to the task queue and returns the IDs that were moved
+func (q *MemoryQueue) ReplayDeadLetters(ids []string) ([]string, error) {
+	return q.takeDeadLetters(ids, func(m *memoryMessage) error {
+		m.Headers = replayHeaders(m.Headers)
+		if err := q.persist(memoryQueueDir, m); err != nil {
+			return err
+		}
+		q.pending = append(q.pending, m)
+		q.signal()
+		return nil
+	})
+}
+
+// DiscardDeadLetters deletes the given dead letters and returns the IDs that were deleted
+func (q *MemoryQueue) DiscardDeadLetters(ids []string) ([]string, error) {
+	return q.takeDeadLetters(ids, func(m *memoryMessage) error { return nil })
+}
+
+// DiscardRequestDeadLetters deletes the dead letters whose task is for one of the given requests
+func (q *MemoryQueue) DiscardRequestDeadLetters(requestIDs []string) ([]string, error) {
+	q.mu.Lock()
+	ids := []string{}
+	for _, m := range q.deadLetters {
+		if newDeadLetter(m.ID, m.Headers, m.Body).forRequest(requestIDs) {
+			ids = append(ids, m.ID)
+		}
+	}
+	q.mu.Unlock()
+	if len(ids) == 0 {
+		return ids, nil
+	}
+	return q.DiscardDeadLetters(ids)
+}
+
+// takeDeadLetters removes the given dead letters after passing each one to f
+func (q *MemoryQueue) takeDeadLetters(ids []string, f func(m *memoryMessage) error) ([]string, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	taken := []string{}
+	remaining := make([]*memoryMessage, 0, len(q.deadLetters))
+	for i, m := range q.deadLetters {
+		if !contains(ids, m.ID) {
+			remaining = append(remaining, m)
+			continue
+		}
+		err := f(m)
+		if err == nil {
+			err = q.remove(memoryDeadLetterDir, m)
+		}
+		if err != nil {
+			q.deadLetters = append(remaining, q.deadLetters[i:]...)
+			return taken, err
+		}
+		taken = append(taken, m.ID)
+	}
+	q.deadLetters = remaining
+	return taken, nil
+}
+
+func (q *MemoryQueue) path(sub string, m *memoryMessage) string {
+	return filepath.Join(q.dir, sub, m.ID+".json")
+}
+
+// persist writes the message to the given directory. The file is renamed into place
+// so that a crash never leaves a partially written message behind
+func (q *MemoryQueue) persist(sub string, m *memoryMessage) error {
+	if q.dir == "" {
+		return nil
+	}
+	content, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+	tmp := q.path(sub, m) + ".tmp"
+	if err := ioutil.WriteFile(tmp, content, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, q.path(sub, m))
+}
+
+func (q *MemoryQueue) remove(sub string, m *memoryMessage) error {
+	if q.dir == "" {
+		return nil
+	}
+	err := os.Remove(q.path(sub, m))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+// load reads the persisted messages of the given directory in publishing order
+func (q *MemoryQueue) load(sub string) ([]*memoryMessage, error) {
+	files, err := ioutil.ReadDir(filepath.Join(q.dir, sub))
+	if err != nil {
+		return nil, err
+	}
+	names := []string{}
+	for _, f := range files {
+		if strings.HasSuffix(f.Name(), ".json") {
+			names = append(names, f.Name())
+		}
+	}
+	sort.Strings(names)
+	messages := make([]*memoryMessage, 0, len(names))
+	for _, name := range names {
+		content, err := ioutil.ReadFile(filepath.Join(q.dir, sub, name))
+		if err != nil {
+			return nil, err
+		}
+		var m memoryMessage
+		if err := json.Unmarshal(content, &m); err != nil {
+			return nil, fmt.Errorf("Unable to read persisted message %s: %s", name, err.Error())
+		}
+		messages = append(messages, &m)
+	}
+	return messages, nil
+}
@@ -0,0 +1,269 @@
+package broker_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/spf13/viper"
+	"github.com/tywin1104/mc-gatekeeper/broker"
+	"github.com/tywin1104/mc-gatekeeper/types"
+)
+
+func receive(t *testing.T, deliveries <-chan broker.Delivery) (broker.Delivery, types.WhitelistRequest) {
+	select {
+	case d := <-deliveries:
+		task, err := broker.DecodeTask(d.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return d, task.Request
+	case <-time.After(time.Second):
+		t.Fatal("Timed out waiting for a delivery")
+	}
+	return broker.Delivery{}, types.WhitelistRequest{}
+}
+
+func TestMemoryQueue(t *testing.T) {
+	queue, err := broker.NewMemoryQueue("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer queue.Close()
+	deliveries, err := queue.Consume()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, username := range []string{"user1", "user2"} {
+		if err := queue.Publish(broker.NewTask(broker.TaskNewRequest, types.WhitelistRequest{Username: username})); err != nil {
+			t.Fatal(err)
+		}
+	}
+	d, request := receive(t, deliveries)
+	if request.Username != "user1" || d.MessageID == "" {
+		t.Errorf("Expect user1 to be delivered first, got %+v", request)
+	}
+	if err := d.Ack(); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Ack(); err == nil {
+		t.Error("Expect a delivery to be acknowledged only once")
+	}
+	// A requeued message is delivered again
+	d, request = receive(t, deliveries)
+	if err := d.Nack(true); err != nil {
+		t.Fatal(err)
+	}
+	d, requeued := receive(t, deliveries)
+	if requeued.Username != request.Username {
+		t.Errorf("Expect %s to be redelivered, got %s", request.Username, requeued.Username)
+	}
+	d.Ack()
+
+	queue.Close()
+	if _, ok := <-deliveries; ok {
+		t.Error("Expect the delivery channel to be closed")
+	}
+	if err := queue.Publish(broker.NewTask(broker.TaskNewRequest, types.WhitelistRequest{})); err != broker.ErrQueueClosed {
+		t.Errorf("Expect ErrQueueClosed, got %v", err)
+	}
+}
+
+func TestMemoryQueuePersistence(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gatekeeper")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	queue, err := broker.NewMemoryQueue(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, username := range []string{"user1", "user2", "user3"} {
+		if err := queue.Publish(broker.NewTask(broker.TaskNewRequest, types.WhitelistRequest{Username: username})); err != nil {
+			t.Fatal(err)
+		}
+	}
+	deliveries, _ := queue.Consume()
+	d, _ := receive(t, deliveries)
+	d.Ack()
+	d, _ = receive(t, deliveries)
+	d.Nack(false)
+	// user3 is received but the process stops before it is acknowledged
+	receive(t, deliveries)
+	queue.Close()
+
+	deadLetters, _ := filepath.Glob(filepath.Join(dir, "dead-letter", "*.json"))
+	if len(deadLetters) != 1 {
+		t.Errorf("Expect 1 dead letter on disk, got %d", len(deadLetters))
+	}
+	queue, err = broker.NewMemoryQueue(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer queue.Close()
+	deliveries, _ = queue.Consume()
+	d, request := receive(t, deliveries)
+	if request.Username != "user3" {
+		t.Errorf("Expect the unacknowledged user3 to be redelivered, got %s", request.Username)
+	}
+	d.Ack()
+	select {
+	case d := <-deliveries:
+		t.Errorf("Unexpected delivery %s", d.Body)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestMemoryDeadLetters(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gatekeeper")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	queue, err := broker.NewMemoryQueue(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	deliveries, err := queue.Consume()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, username := range []string{"user1", "user2"} {
+		if err := queue.Publish(broker.NewTask(broker.TaskNewRequest, types.WhitelistRequest{Username: username})); err != nil {
+			t.Fatal(err)
+		}
+		d, _ := receive(t, deliveries)
+		if err := d.Reject("RCON unavailable"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	queue.Close()
+
+	// Dead letters survive a restart
+	queue, err = broker.NewMemoryQueue(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer queue.Close()
+	deadLetters, err := queue.DeadLetters(0, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(deadLetters) != 2 {
+		t.Fatalf("Expect 2 dead letters, got %d", len(deadLetters))
+	}
+	if page, _ := queue.DeadLetters(1, 10); len(page) != 1 || page[0].MessageID != deadLetters[1].MessageID {
+		t.Errorf("Expect the page after the first dead letter to hold the second one, got %+v", page)
+	}
+	if page, _ := queue.DeadLetters(0, 1); len(page) != 1 || page[0].MessageID != deadLetters[0].MessageID {
+		t.Errorf("Expect a page of one dead letter to hold the first one, got %+v", page)
+	}
+	if d, err := queue.DeadLetter(deadLetters[1].MessageID); err != nil || d.MessageID != deadLetters[1].MessageID {
+		t.Errorf("Expect to find dead letter %s, got %+v (%v)", deadLetters[1].MessageID, d, err)
+	}
+	if _, err := queue.DeadLetter("unknown"); err != broker.ErrDeadLetterNotFound {
+		t.Errorf("Expect ErrDeadLetterNotFound for an unknown dead letter, got %v", err)
+	}
+	first := deadLetters[0]
+	task, err := first.Task()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if task.Request.Username != "user1" || first.Reason != "RCON unavailable" || first.DeathCount != 1 {
+		t.Errorf("Unexpected dead letter %+v for %s", first, task.Request.Username)
+	}
+
+	replayed, err := queue.ReplayDeadLetters([]string{first.MessageID, "unknown"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(replayed) != 1 || replayed[0] != first.MessageID {
+		t.Errorf("Expect only %s to be replayed, got %v", first.MessageID, replayed)
+	}
+	deliveries, err = queue.Consume()
+	if err != nil {
+		t.Fatal(err)
+	}
+	d, request := receive(t, deliveries)
+	if request.Username != "user1" {
+		t.Errorf("Expect user1 to be replayed, got %s", request.Username)
+	}
+	// Rejecting a replayed message again increases its death count
+	if err := d.Reject("RCON still unavailable"); err != nil {
+		t.Fatal(err)
+	}
+	deadLetters, _ = queue.DeadLetters(0, 10)
+	if len(deadLetters) != 2 || deadLetters[1].DeathCount != 2 || deadLetters[1].Reason != "RCON still unavailable" {
+		t.Errorf("Expect the replayed message to be dead-lettered a second time, got %+v", deadLetters)
+	}
+
+	discarded, err := queue.DiscardDeadLetters([]string{deadLetters[0].MessageID})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(discarded) != 1 {
+		t.Errorf("Expect one dead letter to be discarded, got %v", discarded)
+	}
+	files, _ := ioutil.ReadDir(filepath.Join(dir, "dead-letter"))
+	if len(files) != 1 {
+		t.Errorf("Expect one dead letter to remain on disk, got %d", len(files))
+	}
+
+	// Erasing the data of a request discards the dead letters of its tasks
+	remaining, _ := queue.DeadLetters(0, 10)
+	task, err = remaining[0].Task()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if discarded, _ := queue.DiscardRequestDeadLetters([]string{"unknown"}); len(discarded) != 0 {
+		t.Errorf("Expect no dead letters of an unknown request to be discarded, got %v", discarded)
+	}
+	discarded, err = queue.DiscardRequestDeadLetters([]string{task.Request.ID.Hex()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(discarded) != 1 || discarded[0] != remaining[0].MessageID {
+		t.Errorf("Expect the dead letter of the request to be discarded, got %v", discarded)
+	}
+}
+
+func TestMemoryQueuePrefetch(t *testing.T) {
+	viper.Set("workerPrefetch", 2)
+	defer viper.Set("workerPrefetch", nil)
+	queue, err := broker.NewMemoryQueue("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer queue.Close()
+	deliveries, err := queue.Consume()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, username := range []string{"user1", "user2", "user3", "user4"} {
+		if err := queue.Publish(broker.NewTask(broker.TaskNewRequest, types.WhitelistRequest{Username: username})); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// The task of user1 is busy while the others still make progress
+	busy, _ := receive(t, deliveries)
+	d, _ := receive(t, deliveries)
+	if err := d.Ack(); err != nil {
+		t.Fatal(err)
+	}
+	receive(t, deliveries)
+	select {
+	case d := <-deliveries:
+		t.Errorf("Expect no more than 2 unacknowledged deliveries, got %s", d.MessageID)
+	case <-time.After(100 * time.Millisecond):
+	}
+	if err := busy.Ack(); err != nil {
+		t.Fatal(err)
+	}
+	if _, request := receive(t, deliveries); request.Username != "user4" {
+		t.Errorf("Expect user4 to be delivered once a delivery was settled, got %s", request.Username)
+	}
+}
@@ -0,0 +1,54 @@
+package broker
+
+import (
+	"time"
+
+	"github.com/tywin1104/mc-gatekeeper/db"
+)
+
+// outboxBatchSize is the number of outbox entries relayed per pass
+const outboxBatchSize = 100
+
+// RelayOutbox publishes the pending outbox entries in the order they were stored and marks
+// them as published. Relaying stops at the first entry that can not be published so that
+// tasks of the same request are never reordered. Returns how many entries were published.
+// An entry is published again if the relay stops before marking it or the broker did not confirm it
+// in time, which the worker recognises by the idempotency key of the task
+func RelayOutbox(store db.OutboxStore, publisher Publisher) (int, error) {
+	published := 0
+	for {
+		entries, err := store.PendingOutbox(outboxBatchSize)
+		if err != nil || len(entries) == 0 {
+			return published, err
+		}
+		for _, entry := range entries {
+			if err := publisher.Publish(OutboxTask(entry)); err != nil {
+				if e := store.MarkOutboxFailed(entry.ID, err.Error()); e != nil {
+					return published, e
+				}
+				return published, err
+			}
+			if err := store.MarkOutboxPublished(entry.ID, time.Now()); err != nil {
+				return published, err
+			}
+			published++
+		}
+		if len(entries) < outboxBatchSize {
+			return published, nil
+		}
+	}
+}
+
+// OutboxTask creates the task for an outbox entry
+func OutboxTask(entry db.OutboxEntry) Task {
+	task := NewTask(entry.TaskType, entry.Request)
+	task.CreatedAt = entry.CreatedAt
+	if entry.IdempotencyKey != "" {
+		task.IdempotencyKey = entry.IdempotencyKey
+	}
+	for k, v := range entry.Metadata {
+		task.Metadata[k] = v
+	}
+	task.Metadata["outboxId"] = entry.ID.Hex()
+	return task
+}
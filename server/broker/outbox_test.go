@@ -0,0 +1,78 @@
+package broker_test
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/tywin1104/mc-gatekeeper/broker"
+	"github.com/tywin1104/mc-gatekeeper/db"
+	"github.com/tywin1104/mc-gatekeeper/db/dbtest"
+	"github.com/tywin1104/mc-gatekeeper/types"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// failingPublisher fails once the given number of tasks were published
+type failingPublisher struct {
+	tasks []broker.Task
+	limit int
+}
+
+func (p *failingPublisher) Publish(task broker.Task) error {
+	if len(p.tasks) >= p.limit {
+		return errors.New("broker unavailable")
+	}
+	p.tasks = append(p.tasks, task)
+	return nil
+}
+
+func TestRelayOutbox(t *testing.T) {
+	store := dbtest.NewSQLite(t)
+	defer store.Close()
+	for _, username := range []string{"user1", "user2"} {
+		if _, err := store.CreateRequest(types.WhitelistRequest{Username: username}, db.NewOutboxEntry(broker.TaskNewRequest)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := store.UpdateRequest(bson.M{"username": "user1"}, bson.M{"$set": bson.M{"status": "Approved"}, "$inc": bson.M{"version": 1}},
+		db.NewOutboxEntry(broker.TaskApproval)); err != nil {
+		t.Fatal(err)
+	}
+
+	publisher := &failingPublisher{limit: 1}
+	published, err := broker.RelayOutbox(store, publisher)
+	if err == nil || published != 1 {
+		t.Fatalf("Expect relaying to stop after the first entry, got %d published and %v", published, err)
+	}
+	// The remaining entries are relayed in order once the broker is back
+	publisher.limit = 10
+	published, err = broker.RelayOutbox(store, publisher)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if published != 2 {
+		t.Errorf("Expect the remaining 2 entries to be published, got %d", published)
+	}
+	expected := []string{"user1 " + broker.TaskNewRequest, "user2 " + broker.TaskNewRequest, "user1 " + broker.TaskApproval}
+	for i, task := range publisher.tasks {
+		if got := task.Request.Username + " " + task.Type; got != expected[i] {
+			t.Errorf("Expect task %d to be %s, got %s", i, expected[i], got)
+		}
+	}
+	approval := publisher.tasks[2]
+	if approval.Request.Status != types.StatusApproved || approval.IdempotencyKey != broker.TaskApproval+":"+approval.Request.ID.Hex()+":1" {
+		t.Errorf("Unexpected approval task %+v", approval)
+	}
+	if published, _ = broker.RelayOutbox(store, publisher); published != 0 {
+		t.Errorf("Expect published entries not to be relayed again, got %d", published)
+	}
+}
+
+func TestOutboxTaskKeepsManualKey(t *testing.T) {
+	entry := db.NewOutboxEntry(broker.TaskResendConfirmation)
+	entry.IdempotencyKey = "manual"
+	entry.Metadata = map[string]string{"actor": "admin"}
+	task := broker.OutboxTask(entry)
+	if task.IdempotencyKey != "manual" || task.Metadata["actor"] != "admin" || task.Metadata["outboxId"] != entry.ID.Hex() {
+		t.Errorf("Expect the key and metadata of the entry to be kept, got %+v", task)
+	}
+}
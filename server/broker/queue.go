@@ -0,0 +1,83 @@
+package broker
+
+import (
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+// defaultPrefetch is used when workerPrefetch is not configured
+const defaultPrefetch = 10
+
+// Publisher adds tasks for the worker to the queue
+type Publisher interface {
+	// Publish a task for the worker to process
+	Publish(task Task) error
+}
+
+// Consumer receives the tasks published to the queue
+type Consumer interface {
+	// Consume returns the channel that published tasks are delivered on.
+	// The channel is closed when the queue is closed
+	Consume() (<-chan Delivery, error)
+}
+
+// Prefetch returns how many deliveries a consumer may hold without having settled them
+func Prefetch() int {
+	if prefetch := viper.GetInt("workerPrefetch"); prefetch > 0 {
+		return prefetch
+	}
+	return defaultPrefetch
+}
+
+// TaskQueue is a message queue that tasks are published to by the server and consumed by the worker
+type TaskQueue interface {
+	Publisher
+	Consumer
+	DeadLetterQueue
+	// Close releases the resources held by the queue
+	Close() error
+}
+
+// Delivery is a task received from the queue. Every delivery has to be either acknowledged
+// once processed or rejected
+type Delivery struct {
+	MessageID  string
+	Headers    map[string]interface{}
+	Body       []byte
+	ack        func() error
+	nack       func(requeue bool) error
+	deadLetter func(reason string) error
+	retry      func(delay time.Duration, headers map[string]interface{}) error
+}
+
+// Ack acknowledges that the task was processed and removes it from the queue
+func (d Delivery) Ack() error {
+	return d.ack()
+}
+
+// Nack rejects the task. Unless requeued, the task is moved to the dead letter queue
+func (d Delivery) Nack(requeue bool) error {
+	return d.nack(requeue)
+}
+
+// Reject moves the task to the dead letter queue recording why it could not be processed
+func (d Delivery) Reject(reason string) error {
+	return d.deadLetter(reason)
+}
+
+// Retries returns how many times the task was retried before
+func (d Delivery) Retries() int {
+	return int(toInt64(d.Headers[HeaderRetryCount]))
+}
+
+// Retry delivers the task again after a delay that grows with every attempt. Once the
+// task was retried taskMaxRetries times it is moved to the dead letter queue instead, as is a
+// task that can not be scheduled for retry, along with the error. Returns whether the task was dead-lettered
+func (d Delivery) Retry(reason string) (bool, error) {
+	attempt := d.Retries() + 1
+	if attempt > MaxRetries() {
+		return true, d.Reject(reason)
+	}
+	return false, d.retry(RetryDelay(attempt), retryHeaders(d.Headers, attempt, reason))
+}
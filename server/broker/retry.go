@@ -0,0 +1,74 @@
+package broker
+
+import (
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+// HeaderRetryCount counts how many times a task was retried after failing
+const HeaderRetryCount = "x-retry-count"
+
+// Defaults used when taskRetryDelay or taskMaxRetries are not configured
+const (
+	defaultRetryDelay = 30 * time.Second
+	defaultMaxRetries = 6
+)
+
+// RetryDelay returns how long to wait before the given retry attempt, starting at 1.
+// The delay starts at taskRetryDelay and doubles with every attempt
+func RetryDelay(attempt int) time.Duration {
+	delay := viper.GetDuration("taskRetryDelay")
+	if delay <= 0 {
+		delay = defaultRetryDelay
+	}
+	for i := 1; i < attempt; i++ {
+		delay *= 2
+	}
+	return delay
+}
+
+// MaxRetries returns how many times a failed task is retried before it is dead-lettered
+func MaxRetries() int {
+	if viper.IsSet("taskMaxRetries") {
+		return viper.GetInt("taskMaxRetries")
+	}
+	return defaultMaxRetries
+}
+
+// retryDelays returns the distinct delays of all retry attempts, each one served by its own delay queue
+func retryDelays() []time.Duration {
+	delays := []time.Duration{}
+	for attempt := 1; attempt <= MaxRetries(); attempt++ {
+		delays = append(delays, RetryDelay(attempt))
+	}
+	return delays
+}
+
+// retryQueueName returns the name of the delay queue holding tasks until they are retried
+func retryQueueName(delay time.Duration) string {
+	return viper.GetString("taskQueueName") + ".retry." + delay.String()
+}
+
+// retryHeaders returns the headers of a task that is retried for the given attempt
+func retryHeaders(headers map[string]interface{}, attempt int, reason string) map[string]interface{} {
+	updated := make(map[string]interface{}, len(headers)+2)
+	for k, v := range headers {
+		updated[k] = v
+	}
+	updated[HeaderFailureReason] = reason
+	updated[HeaderRetryCount] = int64(attempt)
+	return updated
+}
+
+// replayHeaders returns the headers of a dead letter that is moved back to the task queue.
+// The retry count is reset so a replayed task gets all its retries again
+func replayHeaders(headers map[string]interface{}) map[string]interface{} {
+	updated := make(map[string]interface{}, len(headers))
+	for k, v := range headers {
+		if k != HeaderRetryCount {
+			updated[k] = v
+		}
+	}
+	return updated
+}
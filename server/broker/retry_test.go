@@ -0,0 +1,71 @@
+package broker_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/spf13/viper"
+	"github.com/tywin1104/mc-gatekeeper/broker"
+	"github.com/tywin1104/mc-gatekeeper/types"
+)
+
+func TestRetryDelay(t *testing.T) {
+	viper.Set("taskRetryDelay", "30s")
+	defer viper.Set("taskRetryDelay", nil)
+	for attempt, expected := range map[int]time.Duration{
+		1: 30 * time.Second,
+		2: time.Minute,
+		4: 4 * time.Minute,
+	} {
+		if delay := broker.RetryDelay(attempt); delay != expected {
+			t.Errorf("Expect retry %d to be delayed by %s, got %s", attempt, expected, delay)
+		}
+	}
+}
+
+func TestMemoryQueueRetry(t *testing.T) {
+	viper.Set("taskRetryDelay", "10ms")
+	viper.Set("taskMaxRetries", 2)
+	defer func() {
+		viper.Set("taskRetryDelay", nil)
+		viper.Set("taskMaxRetries", nil)
+	}()
+	queue, err := broker.NewMemoryQueue("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer queue.Close()
+	deliveries, err := queue.Consume()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := queue.Publish(broker.NewTask(broker.TaskNewRequest, types.WhitelistRequest{Username: "user1"})); err != nil {
+		t.Fatal(err)
+	}
+	for retries := 0; retries <= 2; retries++ {
+		d, _ := receive(t, deliveries)
+		if d.Retries() != retries {
+			t.Errorf("Expect %d retries, got %d", retries, d.Retries())
+		}
+		deadLettered, err := d.Retry("RCON unavailable")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if deadLettered != (retries == 2) {
+			t.Errorf("Expect the task to be dead-lettered only after 2 retries, got %v after %d", deadLettered, retries)
+		}
+	}
+	deadLetters, _ := queue.DeadLetters(0, 10)
+	if len(deadLetters) != 1 || deadLetters[0].Reason != "RCON unavailable" {
+		t.Fatalf("Expect the task to be dead-lettered, got %+v", deadLetters)
+	}
+	// A replayed task gets all its retries again
+	if _, err := queue.ReplayDeadLetters([]string{deadLetters[0].MessageID}); err != nil {
+		t.Fatal(err)
+	}
+	d, _ := receive(t, deliveries)
+	if d.Retries() != 0 {
+		t.Errorf("Expect the retry count to be reset on replay, got %d", d.Retries())
+	}
+	d.Ack()
+}
@@ -0,0 +1,137 @@
+package broker
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/tywin1104/mc-gatekeeper/types"
+)
+
+// TaskSchemaVersion is the version of the task envelope published to the queue.
+// Tasks with a higher version were published by a newer release and are rejected
+const TaskSchemaVersion = 1
+
+// Task types the worker has handlers for
+const (
+	// TaskNewRequest sends the confirmation email to the applicant and dispatches the request to the ops
+	TaskNewRequest = "request.new"
+	// TaskApproval whitelists the player and sends the decision email
+	TaskApproval = "request.approve"
+	// TaskDenial sends the decision email
+	TaskDenial = "request.deny"
+	// TaskDeactivation removes the player from the whitelist
+	TaskDeactivation = "request.deactivate"
+	// TaskBan bans the player from the game server
+	TaskBan = "request.ban"
+	// TaskUnban pardons the player and adds them to or removes them from the whitelist according to the new status
+	TaskUnban = "request.unban"
+	// TaskResendConfirmation sends the confirmation email to the applicant again
+	TaskResendConfirmation = "email.confirmation.resend"
+	// TaskRedispatch sends the action emails for a pending request to the ops again
+	TaskRedispatch = "ops.redispatch"
+	// TaskReapplyWhitelist adds an approved player to the whitelist of the game server again
+	TaskReapplyWhitelist = "whitelist.reapply"
+	// TaskExpiryWarning warns the player that their membership expires soon
+	TaskExpiryWarning = "email.expiry.warning"
+)
+
+// statusTasks maps the status a request transitioned to onto the task that carries out the transition
+var statusTasks = map[string]string{
+	types.StatusPending:     TaskNewRequest,
+	types.StatusApproved:    TaskApproval,
+	types.StatusDenied:      TaskDenial,
+	types.StatusDeactivated: TaskDeactivation,
+	types.StatusBanned:      TaskBan,
+}
+
+// ManualTasks maps the task types that admins can enqueue by hand onto the status
+// the request must have for the task to make sense
+var ManualTasks = map[string]string{
+	TaskResendConfirmation: types.StatusPending,
+	TaskRedispatch:         types.StatusPending,
+	TaskReapplyWhitelist:   types.StatusApproved,
+}
+
+// Task is the envelope of every message published to the task queue
+type Task struct {
+	Type    string `json:"type"`
+	Version int    `json:"version"`
+	// IdempotencyKey identifies the work to be done. Tasks with the same key must only take effect once
+	IdempotencyKey string                 `json:"idempotencyKey"`
+	Request        types.WhitelistRequest `json:"request"`
+	Metadata       map[string]string      `json:"metadata,omitempty"`
+	CreatedAt      time.Time              `json:"createdAt"`
+}
+
+// NewTask creates a task of the given type for a snapshot of the request.
+// The idempotency key is derived from the type and the version of the request
+func NewTask(taskType string, request types.WhitelistRequest) Task {
+	return Task{
+		Type:           taskType,
+		Version:        TaskSchemaVersion,
+		IdempotencyKey: taskType + ":" + request.ID.Hex() + ":" + strconv.FormatInt(request.Version, 10),
+		Request:        request,
+		Metadata:       map[string]string{},
+		CreatedAt:      time.Now(),
+	}
+}
+
+// TaskForStatus creates the task that carries out the transition of the request to its current status
+func TaskForStatus(request types.WhitelistRequest) (Task, error) {
+	taskType, err := TaskTypeForStatus(request.Status)
+	if err != nil {
+		return Task{}, err
+	}
+	return NewTask(taskType, request), nil
+}
+
+// TaskTypeForTransition returns the type of the task that carries out the transition between
+// the two statuses. Leaving the Banned status always lifts the ban first
+func TaskTypeForTransition(from, to string) (string, error) {
+	if from == types.StatusBanned && to != types.StatusBanned {
+		return TaskUnban, nil
+	}
+	return TaskTypeForStatus(to)
+}
+
+// TaskTypeForStatus returns the type of the task that carries out the transition to the status
+func TaskTypeForStatus(status string) (string, error) {
+	taskType, ok := statusTasks[status]
+	if !ok {
+		return "", fmt.Errorf("No task for status %s", status)
+	}
+	return taskType, nil
+}
+
+// DecodeTask decodes a message body into a task. Messages published before task envelopes
+// were introduced only carry the request, their type is inferred from its status
+func DecodeTask(body []byte) (Task, error) {
+	var task Task
+	if err := json.Unmarshal(body, &task); err != nil {
+		return Task{}, err
+	}
+	if task.Type != "" {
+		return task, nil
+	}
+	var request types.WhitelistRequest
+	if err := json.Unmarshal(body, &request); err != nil {
+		return Task{}, err
+	}
+	if request.Status == "" {
+		return Task{}, errors.New("Message is neither a task nor a whitelistRequest")
+	}
+	task, err := TaskForStatus(request)
+	if err != nil {
+		return Task{}, err
+	}
+	task.CreatedAt = time.Time{}
+	task.Metadata["legacy"] = "true"
+	return task, nil
+}
+
+func serialize(task Task) ([]byte, error) {
+	return json.Marshal(task)
+}
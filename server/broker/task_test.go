@@ -0,0 +1,61 @@
+package broker_test
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/tywin1104/mc-gatekeeper/broker"
+	"github.com/tywin1104/mc-gatekeeper/types"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func TestDecodeTask(t *testing.T) {
+	request := types.WhitelistRequest{ID: primitive.NewObjectID(), Username: "user1", Status: types.StatusApproved, Version: 2}
+	task, err := broker.TaskForStatus(request)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if task.Type != broker.TaskApproval || task.Version != broker.TaskSchemaVersion {
+		t.Errorf("Expect an approval task of the current schema version, got %s v%d", task.Type, task.Version)
+	}
+	if task.IdempotencyKey != broker.TaskApproval+":"+request.ID.Hex()+":2" {
+		t.Errorf("Unexpected idempotency key %s", task.IdempotencyKey)
+	}
+	body, _ := json.Marshal(task)
+	decoded, err := broker.DecodeTask(body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if decoded.Type != task.Type || decoded.IdempotencyKey != task.IdempotencyKey || decoded.Request.Username != "user1" {
+		t.Errorf("Expect the task to be decoded unchanged, got %+v", decoded)
+	}
+
+	// Messages published by older releases are a bare whitelistRequest
+	legacy, _ := json.Marshal(types.WhitelistRequest{Username: "user2", Status: types.StatusBanned})
+	decoded, err = broker.DecodeTask(legacy)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if decoded.Type != broker.TaskBan || decoded.Request.Username != "user2" {
+		t.Errorf("Expect the legacy message to be a ban task, got %+v", decoded)
+	}
+
+	for _, body := range []string{`{"username": "user3"}`, `not json`} {
+		if _, err := broker.DecodeTask([]byte(body)); err == nil {
+			t.Errorf("Expect %s not to be decoded into a task", body)
+		}
+	}
+}
+
+func TestTaskTypeForTransition(t *testing.T) {
+	for _, c := range []struct{ from, to, want string }{
+		{types.StatusApproved, types.StatusBanned, broker.TaskBan},
+		{types.StatusBanned, types.StatusDeactivated, broker.TaskUnban},
+		{types.StatusBanned, types.StatusApproved, broker.TaskUnban},
+		{types.StatusDeactivated, types.StatusApproved, broker.TaskApproval},
+	} {
+		if got, err := broker.TaskTypeForTransition(c.from, c.to); err != nil || got != c.want {
+			t.Errorf("Expect %s -> %s to be carried out by %s, got %s (%v)", c.from, c.to, c.want, got, err)
+		}
+	}
+}
@@ -28,7 +28,7 @@ const (
 // Service represents a redis cache that is used to cache API results
 // and store application specific stats
 type Service struct {
-	dbService *db.Service
+	dbService db.RequestStore
 	pool      *redis.Pool
 	sseServer *sse.Broker
 }
@@ -69,7 +69,7 @@ type Performance struct {
 var log = logrus.New()
 
 // NewService creates and initilize a new caching service
-func NewService(db *db.Service, sseServer *sse.Broker) *Service {
+func NewService(db db.RequestStore, sseServer *sse.Broker) *Service {
 	var log = logrus.New()
 	pool := &redis.Pool{
 		MaxIdle:     10,
@@ -96,6 +96,11 @@ func NewService(db *db.Service, sseServer *sse.Broker) *Service {
 	}
 }
 
+// Close releases the connections to redis
+func (svc *Service) Close() error {
+	return svc.pool.Close()
+}
+
 // UpdateAggregateStats will be called at certain time intervals to start calculate and analyze all records
 // and update the aggregateStats field in the Stats cache
 func (svc *Service) UpdateAggregateStats() error {
@@ -120,6 +125,10 @@ func (svc *Service) UpdateAggregateStats() error {
 	}
 	adminPerformance := make(map[string]*Performance)
 	for _, request := range fulfilledRequests {
+		// Imported requests were not decided by an op
+		if request.Source == types.SourceImported {
+			continue
+		}
 		processingTime := request.ProcessedTimestamp.Sub(request.Timestamp).Minutes()
 		if p, ok := adminPerformance[request.Admin]; ok {
 			p.totalResponseTimeInMinutes += processingTime
@@ -245,43 +254,48 @@ func (svc *Service) UpdateRealTimeStats(request types.WhitelistRequest) error {
 		if err != nil {
 			return err
 		}
-		newApprovedCount := stats.Approved
-		newDeniedCount := stats.Denied
-		newPendingCount := stats.Pending
-		newBannedCount := stats.Banned
-		newDeactivatedCount := stats.Deactivated
 		newTotalResponseTimeInMinutes := stats.TotalResponseTimeInMinutes
 		var newAverageResponseTimeInMinutes float64
 		var args = make([]interface{}, 0)
 		args = append(args, statsKey)
-		// Update the values for stats on the cache according to different type of actions being
-		// made for the request
-		switch request.Status {
-		case "Approved":
-			args = append(args, updateAgeGenderStats(request, stats, 1)...)
-			newApprovedCount++
-			newPendingCount--
-			newTotalResponseTimeInMinutes += request.ProcessedTimestamp.Sub(request.Timestamp).Minutes()
-			args = append(args, []interface{}{"pending", newPendingCount, "approved", newApprovedCount, "totalResponseTimeInMinutes", newTotalResponseTimeInMinutes}...)
-		case "Denied":
-			newDeniedCount++
-			newPendingCount--
+		// Update the values for stats on the cache according to the status transition
+		// being made for the request
+		counts := map[string]int64{
+			types.StatusPending:     stats.Pending,
+			types.StatusApproved:    stats.Approved,
+			types.StatusDenied:      stats.Denied,
+			types.StatusBanned:      stats.Banned,
+			types.StatusDeactivated: stats.Deactivated,
+		}
+		previous := previousStatus(request)
+		if _, ok := counts[previous]; ok {
+			counts[previous]--
+		}
+		if _, ok := counts[request.Status]; ok {
+			counts[request.Status]++
+		}
+		// Response time is measured from application to the first decision
+		if previous == types.StatusPending && request.Status != types.StatusPending {
 			newTotalResponseTimeInMinutes += request.ProcessedTimestamp.Sub(request.Timestamp).Minutes()
-			args = append(args, []interface{}{"pending", newPendingCount, "denied", newDeniedCount, "totalResponseTimeInMinutes", newTotalResponseTimeInMinutes}...)
-		case "Pending":
-			newPendingCount++
-			args = append(args, []interface{}{"pending", newPendingCount}...)
-		case "Banned":
-			newBannedCount++
-			newApprovedCount--
-			args = append(args, []interface{}{"approved", newApprovedCount, "banned", newBannedCount}...)
-			args = append(args, updateAgeGenderStats(request, stats, -1)...)
-		case "Deactivated":
-			newApprovedCount--
-			newDeactivatedCount++
-			args = append(args, []interface{}{"approved", newApprovedCount, "deactivated", newDeactivatedCount}...)
+			args = append(args, []interface{}{"totalResponseTimeInMinutes", newTotalResponseTimeInMinutes}...)
+		}
+		// Age and gender stats only cover currently approved players
+		if request.Status == types.StatusApproved && previous != types.StatusApproved {
+			args = append(args, updateAgeGenderStats(request, stats, 1)...)
+		} else if previous == types.StatusApproved && request.Status != types.StatusApproved {
 			args = append(args, updateAgeGenderStats(request, stats, -1)...)
 		}
+		args = append(args, []interface{}{
+			"pending", counts[types.StatusPending],
+			"approved", counts[types.StatusApproved],
+			"denied", counts[types.StatusDenied],
+			"banned", counts[types.StatusBanned],
+			"deactivated", counts[types.StatusDeactivated],
+		}...)
+		newApprovedCount := counts[types.StatusApproved]
+		newDeniedCount := counts[types.StatusDenied]
+		newBannedCount := counts[types.StatusBanned]
+		newDeactivatedCount := counts[types.StatusDeactivated]
 		// Only update the average reponse time stats if the request is being fulfilled
 		if newTotalResponseTimeInMinutes != 0 {
 			newAverageResponseTimeInMinutes = newTotalResponseTimeInMinutes / float64(newApprovedCount+newDeniedCount+newBannedCount+newDeactivatedCount)
@@ -449,6 +463,30 @@ func (svc *Service) SyncStats() error {
 	return errors.New("Unable to sync cache. Give up")
 }
 
+// Resync rebuilds the cached requests and stats from the database and pushes the
+// new stats to listening clients. Used after requests were removed or anonymised
+func (svc *Service) Resync() error {
+	if err := svc.SyncStats(); err != nil {
+		return err
+	}
+	return svc.BroadcastStats()
+}
+
+// previousStatus returns the status the request held before its latest transition.
+// Requests without a matching history entry fall back to the usual predecessor of their status
+func previousStatus(request types.WhitelistRequest) string {
+	if n := len(request.History); n > 0 && request.History[n-1].NewStatus == request.Status {
+		return request.History[n-1].OldStatus
+	}
+	switch request.Status {
+	case types.StatusApproved, types.StatusDenied:
+		return types.StatusPending
+	case types.StatusBanned, types.StatusDeactivated:
+		return types.StatusApproved
+	}
+	return ""
+}
+
 // updateAgeGenderStats takes in a reuqest and make appropriate change to the stats
 func updateAgeGenderStats(request types.WhitelistRequest, stats Stats, delta int64) []interface{} {
 	args := make([]interface{}, 0)
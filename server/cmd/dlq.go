@@ -0,0 +1,104 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strconv"
+
+	"github.com/sirupsen/logrus"
+	"github.com/tywin1104/mc-gatekeeper/broker"
+)
+
+const dlqUsage = "Usage: dlq list [offset] [limit] | dlq show <messageId> | dlq replay <messageId>... | dlq discard <messageId>..."
+
+// runDLQ inspects, replays or discards the tasks the worker failed to process.
+// With the in-process task queue the server has to be stopped while running it
+func runDLQ(args []string) {
+	if len(args) == 0 {
+		log.Fatal(dlqUsage)
+	}
+	taskQueue, err := newTaskQueue()
+	if err != nil {
+		log.Fatal("Unable to set up the task queue: " + err.Error())
+	}
+	defer taskQueue.Close()
+
+	switch command, ids := args[0], args[1:]; command {
+	case "list":
+		// The positional arguments of list are the offset and limit rather than IDs
+		offset, limit := 0, 50
+		var err error
+		if len(ids) > 0 {
+			if offset, err = strconv.Atoi(ids[0]); err != nil || offset < 0 {
+				log.Fatal(dlqUsage)
+			}
+		}
+		if len(ids) > 1 {
+			if limit, err = strconv.Atoi(ids[1]); err != nil || limit < 1 {
+				log.Fatal(dlqUsage)
+			}
+		}
+		deadLetters, err := taskQueue.DeadLetters(offset, limit)
+		if err != nil {
+			log.Fatal("Unable to get dead letters: " + err.Error())
+		}
+		for _, d := range deadLetters {
+			fields := logrus.Fields{
+				"reason":     d.Reason,
+				"deathCount": d.DeathCount,
+			}
+			if task, err := d.Task(); err == nil {
+				fields["taskType"] = task.Type
+				fields["username"] = task.Request.Username
+				fields["status"] = task.Request.Status
+			}
+			log.WithFields(fields).Info(d.MessageID)
+		}
+		log.Infof("%d dead letter(s) from offset %d", len(deadLetters), offset)
+	case "show":
+		if len(ids) != 1 {
+			log.Fatal(dlqUsage)
+		}
+		d, err := taskQueue.DeadLetter(ids[0])
+		if err != nil {
+			log.Fatal(err.Error())
+		}
+		showDeadLetter(d)
+	case "replay", "discard":
+		if len(ids) == 0 {
+			log.Fatal(dlqUsage)
+		}
+		action := taskQueue.ReplayDeadLetters
+		if command == "discard" {
+			action = taskQueue.DiscardDeadLetters
+		}
+		done, err := action(ids)
+		for _, id := range done {
+			log.WithField("action", command).Info(id)
+		}
+		if err != nil {
+			log.Fatal("Unable to " + command + " dead letters: " + err.Error())
+		}
+		if len(done) < len(ids) {
+			log.Warnf("%d of %d dead letter(s) not found", len(ids)-len(done), len(ids))
+		}
+	default:
+		log.Fatal(dlqUsage)
+	}
+}
+
+// showDeadLetter prints the dead letter with the decoded task
+func showDeadLetter(d broker.DeadLetter) {
+	msg := map[string]interface{}{"deadLetter": d}
+	if task, err := d.Task(); err == nil {
+		msg["task"] = task
+	} else {
+		msg["body"] = string(d.Body)
+	}
+	encoder := json.NewEncoder(os.Stdout)
+	encoder.SetIndent("", "  ")
+	if err := encoder.Encode(msg); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+	}
+}
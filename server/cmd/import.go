@@ -0,0 +1,54 @@
+package main
+
+import (
+	"flag"
+
+	"github.com/sirupsen/logrus"
+	"github.com/tywin1104/mc-gatekeeper/cache"
+	"github.com/tywin1104/mc-gatekeeper/importer"
+	"github.com/tywin1104/mc-gatekeeper/server/sse"
+)
+
+// runImport creates requests for the players whitelisted or banned on an existing Minecraft server
+func runImport(args []string) {
+	flags := flag.NewFlagSet("import", flag.ExitOnError)
+	dir := flags.String("dir", ".", "directory of the Minecraft server containing whitelist.json and banned-players.json")
+	includeOps := flags.Bool("ops", false, "also import the players in ops.json as approved")
+	flags.Parse(args)
+
+	files, err := importer.ReadDir(*dir, *includeOps)
+	if err != nil {
+		log.Fatal("Unable to read server files: " + err.Error())
+	}
+	store, err := newRequestStore()
+	if err != nil {
+		log.Fatal("Unable to connect to the database: " + err.Error())
+	}
+	if err = migrate(store); err != nil {
+		log.Fatal("Unable to migrate the database: " + err.Error())
+	}
+	report, err := importer.Import(store, files)
+	for _, p := range report.Imported {
+		log.WithFields(logrus.Fields{
+			"uuid":   p.UUID,
+			"status": p.Status,
+		}).Info("Imported " + p.Name)
+	}
+	for _, p := range report.Skipped {
+		log.WithFields(logrus.Fields{
+			"uuid":   p.UUID,
+			"reason": p.Reason,
+		}).Info("Skipped " + p.Name)
+	}
+	if err != nil {
+		log.Fatal("Unable to import players: " + err.Error())
+	}
+	if len(report.Imported) == 0 {
+		return
+	}
+	// Rebuild the cached requests and stats to include the imported players
+	c := cache.NewService(store, sse.NewServer(log.WithField("origin", "import")))
+	if err = c.SyncStats(); err != nil {
+		log.Fatal("Unable to sync cache values: " + err.Error())
+	}
+}
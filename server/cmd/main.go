@@ -4,7 +4,9 @@ import (
 	"context"
 	"errors"
 	"os"
+	"os/signal"
 	"sync"
+	"syscall"
 	"time"
 
 	"github.com/fsnotify/fsnotify"
@@ -14,6 +16,10 @@ import (
 	"github.com/tywin1104/mc-gatekeeper/broker"
 	"github.com/tywin1104/mc-gatekeeper/cache"
 	"github.com/tywin1104/mc-gatekeeper/db"
+	"github.com/tywin1104/mc-gatekeeper/expiry"
+	"github.com/tywin1104/mc-gatekeeper/gameserver"
+	"github.com/tywin1104/mc-gatekeeper/privacy"
+	"github.com/tywin1104/mc-gatekeeper/reconcile"
 	"github.com/tywin1104/mc-gatekeeper/server"
 	"github.com/tywin1104/mc-gatekeeper/server/sse"
 	"github.com/tywin1104/mc-gatekeeper/worker"
@@ -46,20 +52,32 @@ func main() {
 			"err": err.Error(),
 		}).Fatal("Invalid configuration")
 	}
+	// Standalone commands run against the configured services and exit
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "migrate":
+			runMigrate(os.Args[2:])
+		case "import":
+			runImport(os.Args[2:])
+		case "dlq":
+			runDLQ(os.Args[2:])
+		default:
+			log.Fatal("Unknown command " + os.Args[1])
+		}
+		return
+	}
 	// Watch for configuration changes
 	go watchConfig(log)
 
-	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
-	defer cancel()
-	client, err := mongo.Connect(ctx, options.Client().ApplyURI(viper.GetString("mongodbConn")))
-
+	// Setup database service
+	dbSvc, err := newRequestStore()
 	if err != nil {
-		log.Fatal("Unable to connect to mongodb: " + err.Error())
+		log.Fatal("Unable to connect to the database: " + err.Error())
+	}
+	// Bring the database up to date before anything reads from it
+	if err = migrate(dbSvc); err != nil {
+		log.Fatal("Unable to migrate the database: " + err.Error())
 	}
-	log.Info("Mongodb connection established")
-
-	// Setup database service
-	dbSvc := db.NewService(client)
 
 	// Initilize server side event server for pushing out stats
 	serverLogger := log.WithField("origin", "server")
@@ -70,37 +88,187 @@ func main() {
 	if err != nil {
 		log.Fatal("Unable to sync cache values: " + err.Error())
 	}
+	// Background jobs run until they are stopped on shutdown
+	jobs := newBackgroundJobs()
 	// Start background job to collect aggregate stats at a interval
-	go aggregatingStats(cache)
+	jobs.Go(func(ctx context.Context) { aggregatingStats(ctx, cache) })
+	// Start background job to purge or anonymise old requests
+	jobs.Go(func(ctx context.Context) { retainingRequests(ctx, dbSvc, cache) })
+	// Start background job to remove old records of processed tasks
+	jobs.Go(func(ctx context.Context) { pruningTaskLedger(ctx, dbSvc) })
+	// Start background job to deactivate players whose membership expired
+	jobs.Go(func(ctx context.Context) { expiringRequests(ctx, dbSvc) })
 
 	// Set it running - listening and broadcasting events
 	go sseServer.Listen(cache.BroadcastStats)
 
-	broker := broker.NewService(log, make(chan *amqp.Error))
-	// Watch for unexpected connection loss to rabbitMQ and re-establish connection
-	go broker.WatchForReconnect()
-	defer broker.Close()
+	taskQueue, err := newTaskQueue()
+	if err != nil {
+		log.Fatal("Unable to set up the task queue: " + err.Error())
+	}
+	// Start background job to publish the tasks stored along with request changes
+	jobs.Go(func(ctx context.Context) { relayingOutbox(ctx, dbSvc, taskQueue) })
 
 	wg := sync.WaitGroup{}
 	wg.Add(2)
 	// Start the worker
 	workerLogger := log.WithField("origin", "worker")
-	worker1, err := worker.NewWorker(dbSvc, cache, workerLogger, make(chan *amqp.Error))
+	worker1, err := worker.NewWorker(dbSvc, cache, taskQueue, workerLogger)
 	if err != nil {
 		log.Fatal("Unable to start worker: " + err.Error())
 	}
 	go worker1.Start(&wg)
-	defer worker1.Close()
+	// Start background job to compare the game servers with the requests through the worker's connections
+	reconciler := reconcile.New(dbSvc, worker1)
+	jobs.Go(func(ctx context.Context) { reconcilingGameServers(ctx, reconciler, cache) })
 	// Setup and start the http REST API server
-	httpServer := server.NewService(dbSvc, broker, cache, sseServer, serverLogger)
+	httpServer := server.NewService(dbSvc, taskQueue, cache, sseServer, serverLogger)
+	httpServer.SetReconciler(reconciler)
 	go httpServer.Listen(viper.GetString("port"), &wg)
 	wg.Wait()
 	log.Info("Everything is up.")
-	<-make(chan int)
+
+	// Shut down gracefully on SIGTERM, e.g. during rolling deploys, and on SIGINT
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, os.Interrupt)
+	sig := <-signals
+	log.WithField("signal", sig.String()).Info("Shutting down")
+	shutdown(httpServer, jobs, worker1, taskQueue, cache, dbSvc)
+	log.Info("Shutdown completed")
+}
+
+// shutdown stops the components within shutdownTimeout. The API server stops accepting
+// requests first, then the background jobs and the worker finish their work in progress
+// before the task queue, the cache and the database connections are closed
+func shutdown(httpServer *server.Service, jobs *backgroundJobs, w *worker.Worker, taskQueue broker.TaskQueue, cacheSvc *cache.Service, store db.RequestStore) {
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout())
+	defer cancel()
+	steps := []struct {
+		name string
+		stop func() error
+	}{
+		{"API server", func() error { return httpServer.Shutdown(ctx) }},
+		{"background jobs", func() error { return jobs.Stop(ctx) }},
+		{"worker", func() error { return w.Stop(ctx) }},
+		{"task queue", taskQueue.Close},
+		{"cache", cacheSvc.Close},
+		{"database", store.Close},
+	}
+	for _, step := range steps {
+		if err := step.stop(); err != nil {
+			log.WithFields(logrus.Fields{
+				"err": err.Error(),
+			}).Error("Unable to shut down " + step.name + " gracefully")
+			continue
+		}
+		log.Info(step.name + " shut down")
+	}
+}
+
+// shutdownTimeout returns how long to wait for in-flight requests and tasks when shutting down
+func shutdownTimeout() time.Duration {
+	if timeout := viper.GetDuration("shutdownTimeout"); timeout > 0 {
+		return timeout
+	}
+	return 25 * time.Second
+}
+
+// newRequestStore connects to the storage backend selected in the configuration
+func newRequestStore() (db.RequestStore, error) {
+	switch storage := viper.GetString("storage"); storage {
+	case "", "mongodb":
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		client, err := mongo.Connect(ctx, options.Client().ApplyURI(viper.GetString("mongodbConn")))
+		if err != nil {
+			return nil, err
+		}
+		log.Info("Mongodb connection established")
+		store := db.NewService(client)
+		// Request changes and their tasks in the outbox are only written atomically in a transaction
+		transactions, err := store.SupportsTransactions()
+		if err != nil {
+			return nil, err
+		}
+		if !transactions {
+			if !viper.GetBool("mongodbStandalone") {
+				return nil, errors.New("MongoDB does not support transactions. Run it as a replica set or set mongodbStandalone to accept losing tasks on a crash")
+			}
+			log.Error("MongoDB does not support transactions. A crash between a request change and storing its task can lose the task")
+		}
+		return store, nil
+	case "sqlite", "postgres":
+		driver := storage
+		if storage == "sqlite" {
+			driver = "sqlite3"
+		}
+		store, err := db.NewSQLService(driver, viper.GetString("sqlConn"))
+		if err != nil {
+			return nil, err
+		}
+		log.WithField("driver", driver).Info("SQL database connection established")
+		return store, nil
+	default:
+		return nil, errors.New("Unsupported storage backend " + storage)
+	}
+}
+
+// newTaskQueue sets up the task queue selected in the configuration
+func newTaskQueue() (broker.TaskQueue, error) {
+	switch taskQueue := viper.GetString("taskQueue"); taskQueue {
+	case "", "rabbitmq":
+		rabbitMQ := broker.NewService(log, make(chan *amqp.Error))
+		// Watch for unexpected connection loss to rabbitMQ and re-establish connection
+		go rabbitMQ.WatchForReconnect()
+		return rabbitMQ, nil
+	case "memory":
+		log.WithField("dir", viper.GetString("taskQueueDir")).Info("Using in-process task queue")
+		return broker.NewMemoryQueue(viper.GetString("taskQueueDir"))
+	default:
+		return nil, errors.New("Unsupported task queue " + taskQueue)
+	}
 }
 
 func validateConfig() error {
 	// TODO: add more constraints to fail fast
+	storage := viper.GetString("storage")
+	if storage != "" && storage != "mongodb" && storage != "sqlite" && storage != "postgres" {
+		return errors.New("Invalid configuration. Allowed values for storage: [mongodb, sqlite, postgres]")
+	}
+	taskQueue := viper.GetString("taskQueue")
+	if taskQueue != "" && taskQueue != "rabbitmq" && taskQueue != "memory" {
+		return errors.New("Invalid configuration. Allowed values for taskQueue: [rabbitmq, memory]")
+	}
+	if viper.GetString("taskRetryDelay") != "" && viper.GetDuration("taskRetryDelay") <= 0 {
+		return errors.New("Invalid configuration. taskRetryDelay must be a positive duration such as 30s")
+	}
+	if viper.GetString("publishTimeout") != "" && viper.GetDuration("publishTimeout") <= 0 {
+		return errors.New("Invalid configuration. publishTimeout must be a positive duration such as 5s")
+	}
+	if viper.GetString("RCONTimeout") != "" && viper.GetDuration("RCONTimeout") <= 0 {
+		return errors.New("Invalid configuration. RCONTimeout must be a positive duration such as 5s")
+	}
+	if _, err := gameserver.Targets(); err != nil {
+		return err
+	}
+	if viper.GetInt("RCONPoolSize") < 0 {
+		return errors.New("Invalid configuration. RCONPoolSize can not be negative")
+	}
+	if viper.GetString("RCONHealthCheckInterval") != "" && viper.GetDuration("RCONHealthCheckInterval") <= 0 {
+		return errors.New("Invalid configuration. RCONHealthCheckInterval must be a positive duration such as 30s")
+	}
+	if viper.GetString("shutdownTimeout") != "" && viper.GetDuration("shutdownTimeout") <= 0 {
+		return errors.New("Invalid configuration. shutdownTimeout must be a positive duration such as 25s")
+	}
+	if viper.GetDuration("expiry.warningBefore") < 0 {
+		return errors.New("Invalid configuration. expiry.warningBefore can not be negative")
+	}
+	if viper.GetInt("taskMaxRetries") < 0 {
+		return errors.New("Invalid configuration. taskMaxRetries can not be negative")
+	}
+	if viper.GetInt("workerConcurrency") < 0 || viper.GetInt("workerPrefetch") < 0 {
+		return errors.New("Invalid configuration. workerConcurrency and workerPrefetch can not be negative")
+	}
 	strategy := viper.GetString("dispatchingStrategy")
 	if strategy != "Broadcast" && strategy != "Random" {
 		return errors.New("Invalid configuration. Allowed values for dispatchingStrategy: [Broadcast, Random]")
@@ -108,6 +276,15 @@ func validateConfig() error {
 	if strategy == "Random" && viper.GetInt("randomDispatchingThreshold") > len(viper.GetStringSlice("ops")) {
 		return errors.New("Invalid configuration. Threshold value for random dispatching can not exceed total number of ops")
 	}
+	if _, err := privacy.LoadRetentionPolicies(); err != nil {
+		return err
+	}
+	if err := reconcile.ValidateCorrection(reconcile.Correction()); err != nil {
+		return errors.New("Invalid configuration. " + err.Error() + " for reconciliation.correct")
+	}
+	if viper.GetDuration("reconciliation.gracePeriod") < 0 {
+		return errors.New("Invalid configuration. reconciliation.gracePeriod can not be negative")
+	}
 	return nil
 }
 
@@ -127,17 +304,234 @@ func watchConfig(log *logrus.Logger) {
 	})
 }
 
-func aggregatingStats(cache *cache.Service) {
-	for range time.Tick(60 * time.Second) {
-		go func() {
-			err := cache.UpdateAggregateStats()
-			if err != nil {
+// aggregatingStats collects the aggregate stats every minute until ctx is done
+func aggregatingStats(ctx context.Context, cache *cache.Service) {
+	for wait(ctx, 60*time.Second) {
+		err := cache.UpdateAggregateStats()
+		if err != nil {
+			log.WithFields(logrus.Fields{
+				"err": err.Error(),
+			}).Error("Unable to aggregate stats")
+		} else {
+			log.Info("Aggregate stats data completed")
+		}
+	}
+}
+
+// relayingOutbox publishes pending outbox entries to the task queue every second until ctx is done.
+// Published entries are kept for a day for troubleshooting. They contain personal data,
+// so they are not kept longer
+func relayingOutbox(ctx context.Context, store db.RequestStore, publisher broker.Publisher) {
+	lastCleanup := time.Time{}
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+		published, err := broker.RelayOutbox(store, publisher)
+		if published > 0 {
+			log.WithField("published", published).Debug("Relayed outbox entries")
+		}
+		if err != nil {
+			log.WithFields(logrus.Fields{
+				"err": err.Error(),
+			}).Error("Unable to relay outbox entries. Retrying")
+		}
+		if time.Since(lastCleanup) < time.Hour {
+			continue
+		}
+		lastCleanup = time.Now()
+		if _, err := store.DeletePublishedOutbox(time.Now().Add(-24 * time.Hour)); err != nil {
+			log.WithFields(logrus.Fields{
+				"err": err.Error(),
+			}).Error("Unable to delete published outbox entries")
+		}
+	}
+}
+
+// expiringRequests deactivates expired memberships, lifts expired bans and warns players about
+// upcoming expiries until ctx is done. The interval is read on every run so that it can be changed live
+func expiringRequests(ctx context.Context, store db.RequestStore) {
+	for {
+		report, err := expiry.Run(store, time.Now())
+		if len(report.Expired) > 0 || len(report.Warned) > 0 || len(report.Unbanned) > 0 {
+			log.WithFields(logrus.Fields{
+				"expired":  report.Expired,
+				"warned":   report.Warned,
+				"unbanned": report.Unbanned,
+			}).Info("Processed expiring memberships and bans")
+		}
+		if err != nil {
+			log.WithFields(logrus.Fields{
+				"err": err.Error(),
+			}).Error("Unable to process expiring memberships and bans")
+		}
+		if !wait(ctx, expiry.Interval()) {
+			return
+		}
+	}
+}
+
+// pruningTaskLedger removes task records older than 30 days every hour until ctx is done. Tasks are
+// only delivered again after that long if they are replayed from the dead letter queue
+func pruningTaskLedger(ctx context.Context, store db.RequestStore) {
+	for wait(ctx, time.Hour) {
+		deleted, err := store.DeleteTaskRecords(time.Now().Add(-30 * 24 * time.Hour))
+		if err != nil {
+			log.WithFields(logrus.Fields{
+				"err": err.Error(),
+			}).Error("Unable to prune the task ledger")
+			continue
+		}
+		if deleted > 0 {
+			log.WithField("deleted", deleted).Debug("Pruned the task ledger")
+		}
+	}
+}
+
+// retainingRequests applies the configured retention policies at the configured interval until ctx
+// is done. The configuration is read on every run so that policies can be changed live
+func retainingRequests(ctx context.Context, store db.RequestStore, cache *cache.Service) {
+	for {
+		if viper.GetBool("retention.enabled") {
+			applyRetention(store, cache)
+		}
+		interval := viper.GetDuration("retention.interval")
+		if interval <= 0 {
+			interval = 24 * time.Hour
+		}
+		if !wait(ctx, interval) {
+			return
+		}
+	}
+}
+
+func applyRetention(store db.RequestStore, cache *cache.Service) {
+	policies, err := privacy.LoadRetentionPolicies()
+	if err != nil {
+		log.WithFields(logrus.Fields{
+			"err": err.Error(),
+		}).Error("Unable to load retention policies")
+		return
+	}
+	report, err := privacy.ApplyRetention(store, policies, viper.GetBool("retention.dryRun"))
+	for _, p := range report.Policies {
+		log.WithFields(logrus.Fields{
+			"status":   p.Status,
+			"action":   p.Action,
+			"cutoff":   p.Cutoff,
+			"affected": len(p.RequestIDs),
+			"dryRun":   report.DryRun,
+		}).Info("Retention policy applied")
+	}
+	if err != nil {
+		log.WithFields(logrus.Fields{
+			"err": err.Error(),
+		}).Error("Unable to apply retention policies")
+	}
+	// Requests may have been changed even if a later one failed
+	if report.DryRun || report.Affected() == 0 {
+		return
+	}
+	if err := cache.Resync(); err != nil {
+		log.WithFields(logrus.Fields{
+			"err": err.Error(),
+		}).Error("Unable to re-sync cache after applying retention policies")
+	}
+}
+
+// reconcilingGameServers compares the whitelist and bans of the game servers with the requests at
+// the configured interval and corrects the drift in the configured direction until ctx is done.
+// The configuration is read on every run so that it can be changed live
+func reconcilingGameServers(ctx context.Context, reconciler *reconcile.Reconciler, cache *cache.Service) {
+	for wait(ctx, reconcile.Interval()) {
+		if !reconcile.Enabled() {
+			continue
+		}
+		report, err := reconciler.Run(reconcile.Correction())
+		if err != nil {
+			log.WithFields(logrus.Fields{
+				"err": err.Error(),
+			}).Error("Unable to reconcile the game servers")
+			continue
+		}
+		for _, s := range report.Servers {
+			if s.Error != "" {
+				log.WithFields(logrus.Fields{
+					"server": s.Name,
+					"err":    s.Error,
+				}).Error("Unable to read the whitelist and bans of the game server")
+			}
+		}
+		fields := logrus.Fields{
+			"drift":     len(report.Drift),
+			"corrected": report.Corrected(),
+			"correct":   report.Correct,
+		}
+		if len(report.Drift) > 0 {
+			log.WithFields(fields).Warning("Game servers drifted from the requests")
+		} else {
+			log.WithFields(fields).Info("Game servers match the requests")
+		}
+		// Imported players change the stats
+		if report.Correct == reconcile.CorrectDatabase && report.Corrected() > 0 {
+			if err := cache.Resync(); err != nil {
 				log.WithFields(logrus.Fields{
 					"err": err.Error(),
-				}).Error("Unable to aggregate stats")
-			} else {
-				log.Info("Aggregate stats data completed")
+				}).Error("Unable to re-sync cache after reconciling the game servers")
 			}
-		}()
+		}
+	}
+}
+
+// backgroundJobs runs the background jobs of the server until they are stopped on shutdown
+type backgroundJobs struct {
+	ctx    context.Context
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+}
+
+func newBackgroundJobs() *backgroundJobs {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &backgroundJobs{ctx: ctx, cancel: cancel}
+}
+
+// Go runs the job in its own goroutine. The job has to return once ctx is done
+func (j *backgroundJobs) Go(job func(ctx context.Context)) {
+	j.wg.Add(1)
+	go func() {
+		defer j.wg.Done()
+		job(j.ctx)
+	}()
+}
+
+// Stop stops the jobs and waits for the runs in progress to finish. It gives up when ctx is done
+func (j *backgroundJobs) Stop(ctx context.Context) error {
+	j.cancel()
+	stopped := make(chan struct{})
+	go func() {
+		j.wg.Wait()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// wait waits for d to pass. Returns false if ctx is done first
+func wait(ctx context.Context, d time.Duration) bool {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return true
+	case <-ctx.Done():
+		return false
 	}
 }
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"flag"
+
+	"github.com/sirupsen/logrus"
+	"github.com/tywin1104/mc-gatekeeper/db"
+)
+
+// runMigrate applies the pending database migrations without starting the server.
+// With -status it only lists the migrations that have been applied
+func runMigrate(args []string) {
+	flags := flag.NewFlagSet("migrate", flag.ExitOnError)
+	status := flags.Bool("status", false, "list applied migrations without applying pending ones")
+	flags.Parse(args)
+
+	store, err := newRequestStore()
+	if err != nil {
+		log.Fatal("Unable to connect to the database: " + err.Error())
+	}
+	if *status {
+		applied, err := store.AppliedMigrations()
+		if err != nil {
+			log.Fatal("Unable to list migrations: " + err.Error())
+		}
+		for _, m := range applied {
+			log.WithFields(logrus.Fields{
+				"version":   m.Version,
+				"appliedAt": m.AppliedAt,
+			}).Info(m.Description)
+		}
+		return
+	}
+	if err = migrate(store); err != nil {
+		log.Fatal("Unable to migrate the database: " + err.Error())
+	}
+}
+
+// migrate applies the pending migrations and logs each one that was applied
+func migrate(store db.RequestStore) error {
+	applied, err := store.Migrate()
+	for _, m := range applied {
+		log.WithFields(logrus.Fields{
+			"version": m.Version,
+		}).Info("Applied migration: " + m.Description)
+	}
+	if err != nil {
+		return err
+	}
+	if len(applied) == 0 {
+		log.Info("Database is up to date")
+	}
+	return nil
+}
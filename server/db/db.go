@@ -3,6 +3,7 @@ package db
 import (
 	"context"
 	"fmt"
+	"sync"
 	"time"
 
 	"go.mongodb.org/mongo-driver/bson"
@@ -15,9 +16,12 @@ import (
 	"go.mongodb.org/mongo-driver/mongo"
 )
 
-// Service represents struct that deals with database level operations
+// Service is the MongoDB implementation of RequestStore
 type Service struct {
 	db *mongo.Client
+	// transactions is whether the deployment supports multi-document transactions, nil until checked
+	transactions   *bool
+	transactionsMu sync.Mutex
 }
 
 // NewService create new mongoDb service that handles database level operations
@@ -27,6 +31,13 @@ func NewService(db *mongo.Client) *Service {
 	}
 }
 
+// Close disconnects from mongodb
+func (s *Service) Close() error {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	return s.db.Disconnect(ctx)
+}
+
 // Ping checks for db connection
 func (s *Service) Ping() {
 	err := s.db.Ping(context.TODO(), readpref.Primary())
@@ -38,23 +49,52 @@ func (s *Service) Ping() {
 }
 
 // CreateRequest create new whitelistRequest
-func (s *Service) CreateRequest(newRequest types.WhitelistRequest) (primitive.ObjectID, error) {
+func (s *Service) CreateRequest(newRequest types.WhitelistRequest, outbox ...OutboxEntry) (primitive.ObjectID, error) {
 	collection := s.db.Database("mc-whitelist").Collection("requests")
 	newRequest.ID = primitive.NewObjectID()
 	// Set initial request status and attach timestamp
 	newRequest.Timestamp = time.Now()
 	newRequest.Status = "Pending"
-	_, err := collection.InsertOne(context.TODO(), newRequest)
+	newRequest.History = []types.StatusChange{{
+		Actor:     newRequest.Username,
+		NewStatus: newRequest.Status,
+		Source:    types.SourceApplication,
+		Timestamp: newRequest.Timestamp,
+	}}
+	err := s.withTransaction(func(ctx context.Context) error {
+		if _, err := collection.InsertOne(ctx, newRequest); err != nil {
+			return err
+		}
+		return s.insertOutbox(ctx, withSnapshot(outbox, newRequest))
+	})
 	if err != nil {
 		return primitive.ObjectID{}, err
 	}
 	return newRequest.ID, nil
 }
 
+// ImportRequest stores the request as given, keeping its status and history.
+// An ID is generated if the request does not have one
+func (s *Service) ImportRequest(request types.WhitelistRequest) (primitive.ObjectID, error) {
+	collection := s.db.Database("mc-whitelist").Collection("requests")
+	if request.ID.IsZero() {
+		request.ID = primitive.NewObjectID()
+	}
+	_, err := collection.InsertOne(context.TODO(), request)
+	if err != nil {
+		return primitive.ObjectID{}, err
+	}
+	return request.ID, nil
+}
+
 // GetRequests query for whitelistRequests in db
 func (s *Service) GetRequests(limit int64, filter interface{}) ([]types.WhitelistRequest, error) {
 	collection := s.db.Database("mc-whitelist").Collection("requests")
-	cur, err := collection.Find(context.TODO(), filter, options.Find().SetSort(map[string]int{"timestamp": -1}))
+	opts := options.Find().SetSort(map[string]int{"timestamp": -1})
+	if limit > 0 {
+		opts.SetLimit(limit)
+	}
+	cur, err := collection.Find(context.TODO(), filter, opts)
 	if err != nil {
 		return nil, err
 	}
@@ -73,20 +113,371 @@ func (s *Service) GetRequests(limit int64, filter interface{}) ([]types.Whitelis
 }
 
 // UpdateRequest perform partial update to the specified whitelistRequest in db
-func (s *Service) UpdateRequest(filter, update interface{}) (bson.M, error) {
+func (s *Service) UpdateRequest(filter, update interface{}, outbox ...OutboxEntry) (bson.M, error) {
 	collection := s.db.Database("mc-whitelist").Collection("requests")
-	upsert := true
 	after := options.After
 	opt := options.FindOneAndUpdateOptions{
 		ReturnDocument: &after,
-		Upsert:         &upsert,
 	}
 
-	result := collection.FindOneAndUpdate(context.TODO(), filter, update, &opt)
-	if result.Err() != nil {
-		return nil, result.Err()
+	var updatedRequest bson.M
+	err := s.withTransaction(func(ctx context.Context) error {
+		result := collection.FindOneAndUpdate(ctx, filter, update, &opt)
+		if result.Err() != nil {
+			return result.Err()
+		}
+		updatedRequest = bson.M{}
+		if err := result.Decode(&updatedRequest); err != nil {
+			return err
+		}
+		if len(outbox) == 0 {
+			return nil
+		}
+		var snapshot types.WhitelistRequest
+		if err := result.Decode(&snapshot); err != nil {
+			return err
+		}
+		return s.insertOutbox(ctx, withSnapshot(outbox, snapshot))
+	})
+	if err == mongo.ErrNoDocuments {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return updatedRequest, nil
+}
+
+// DeleteRequests permanently removes every whitelistRequest matching the filter
+func (s *Service) DeleteRequests(filter interface{}) (int64, error) {
+	collection := s.db.Database("mc-whitelist").Collection("requests")
+	result, err := collection.DeleteMany(context.TODO(), filter)
+	if err != nil {
+		return 0, err
+	}
+	return result.DeletedCount, nil
+}
+
+// QueryRequests returns one page of requests matching the query along with the total count
+func (s *Service) QueryRequests(query RequestQuery) (RequestPage, error) {
+	if err := query.normalize(); err != nil {
+		return RequestPage{}, err
+	}
+	collection := s.db.Database("mc-whitelist").Collection("requests")
+	conditions := []bson.M{query.filter()}
+	if query.Search != "" {
+		conditions = append(conditions, query.searchFilter())
+	}
+	total, err := collection.CountDocuments(context.TODO(), bson.M{"$and": conditions})
+	if err != nil {
+		return RequestPage{}, err
+	}
+
+	direction := -1
+	comparison := "$lt"
+	if query.Ascending {
+		direction = 1
+		comparison = "$gt"
+	}
+	opts := options.Find().
+		SetSort(bson.D{{Key: query.SortBy, Value: direction}, {Key: "_id", Value: direction}}).
+		SetLimit(query.PageSize)
+	if query.Cursor != "" {
+		value, id, err := query.decodeCursor()
+		if err != nil {
+			return RequestPage{}, err
+		}
+		// Continue after the last request of the previous page, breaking ties by ID
+		conditions = append(conditions, bson.M{"$or": []bson.M{
+			{query.SortBy: bson.M{comparison: value}},
+			{query.SortBy: value, "_id": bson.M{comparison: id}},
+		}})
+	} else {
+		opts.SetSkip((query.Page - 1) * query.PageSize)
+	}
+
+	cur, err := collection.Find(context.TODO(), bson.M{"$and": conditions}, opts)
+	if err != nil {
+		return RequestPage{}, err
+	}
+	defer cur.Close(context.TODO())
+	requests := make([]types.WhitelistRequest, 0)
+	for cur.Next(context.TODO()) {
+		var request types.WhitelistRequest
+		if err := cur.Decode(&request); err != nil {
+			return RequestPage{}, err
+		}
+		requests = append(requests, request)
+	}
+	return query.page(requests, total), nil
+}
+
+// Migrate applies the pending migrations to the requests collection
+func (s *Service) Migrate() ([]MigrationRecord, error) {
+	applied, err := s.AppliedMigrations()
+	if err != nil {
+		return nil, err
+	}
+	collection := s.db.Database("mc-whitelist").Collection("migrations")
+	return runMigrations(s.migrations(), applied, func(r MigrationRecord) error {
+		_, err := collection.InsertOne(context.TODO(), r)
+		return err
+	})
+}
+
+// AppliedMigrations returns the migrations recorded in the database
+func (s *Service) AppliedMigrations() ([]MigrationRecord, error) {
+	collection := s.db.Database("mc-whitelist").Collection("migrations")
+	cur, err := collection.Find(context.TODO(), bson.D{}, options.Find().SetSort(bson.M{"_id": 1}))
+	if err != nil {
+		return nil, err
+	}
+	defer cur.Close(context.TODO())
+	applied := make([]MigrationRecord, 0)
+	for cur.Next(context.TODO()) {
+		var r MigrationRecord
+		if err := cur.Decode(&r); err != nil {
+			return nil, err
+		}
+		applied = append(applied, r)
+	}
+	return applied, cur.Err()
+}
+
+func (s *Service) migrations() []migration {
+	return []migration{
+		{version: 1, description: "create request indexes", up: s.createRequestIndexes},
+		{version: 2, description: "backfill request version and history", up: s.backfillRequests},
+		{version: 3, description: "create request uuid index", up: s.createUUIDIndex},
+		{version: 4, description: "create outbox indexes", up: s.createOutboxIndexes},
+		{version: 5, description: "create task ledger indexes", up: s.createTaskLedgerIndexes},
+		{version: 6, description: "create request username hash index", up: s.createUsernameHashIndex},
+	}
+}
+
+// createRequestIndexes indexes the fields used to look up requests by applicant,
+// and to list and aggregate them by status and time
+func (s *Service) createRequestIndexes() error {
+	collection := s.db.Database("mc-whitelist").Collection("requests")
+	_, err := collection.Indexes().CreateMany(context.TODO(), []mongo.IndexModel{
+		{Keys: bson.D{{Key: "username", Value: 1}}},
+		{Keys: bson.D{{Key: "email", Value: 1}}},
+		{Keys: bson.D{{Key: "status", Value: 1}, {Key: "timestamp", Value: -1}}},
+		{Keys: bson.D{{Key: "timestamp", Value: -1}}},
+	})
+	return err
+}
+
+// createUUIDIndex indexes the Minecraft UUID that imported requests are matched by
+func (s *Service) createUUIDIndex() error {
+	collection := s.db.Database("mc-whitelist").Collection("requests")
+	_, err := collection.Indexes().CreateOne(context.TODO(), mongo.IndexModel{
+		Keys: bson.D{{Key: "uuid", Value: 1}},
+	})
+	return err
+}
+
+// createUsernameHashIndex indexes the hash that anonymised requests are matched by when the applicant applies again
+func (s *Service) createUsernameHashIndex() error {
+	collection := s.db.Database("mc-whitelist").Collection("requests")
+	_, err := collection.Indexes().CreateOne(context.TODO(), mongo.IndexModel{
+		Keys: bson.D{{Key: "usernameHash", Value: 1}},
+	})
+	return err
+}
+
+// createOutboxIndexes indexes the pending outbox entries the relay polls for.
+// This also creates the collection which can not happen inside a transaction
+func (s *Service) createOutboxIndexes() error {
+	collection := s.db.Database("mc-whitelist").Collection("outbox")
+	_, err := collection.Indexes().CreateOne(context.TODO(), mongo.IndexModel{
+		Keys: bson.D{{Key: "publishedAt", Value: 1}, {Key: "createdAt", Value: 1}},
+	})
+	return err
+}
+
+// createTaskLedgerIndexes indexes the task records by age so old ones can be pruned
+func (s *Service) createTaskLedgerIndexes() error {
+	collection := s.db.Database("mc-whitelist").Collection("taskLedger")
+	_, err := collection.Indexes().CreateOne(context.TODO(), mongo.IndexModel{
+		Keys: bson.D{{Key: "createdAt", Value: 1}},
+	})
+	return err
+}
+
+// backfillRequests adds the version and history fields to requests stored before they existed
+func (s *Service) backfillRequests() error {
+	collection := s.db.Database("mc-whitelist").Collection("requests")
+	cur, err := collection.Find(context.TODO(), bson.M{"$or": []bson.M{
+		{"history": bson.M{"$exists": false}},
+		{"version": bson.M{"$exists": false}},
+	}})
+	if err != nil {
+		return err
+	}
+	defer cur.Close(context.TODO())
+	for cur.Next(context.TODO()) {
+		var request types.WhitelistRequest
+		if err := cur.Decode(&request); err != nil {
+			return err
+		}
+		backfillRequest(&request)
+		_, err := collection.UpdateOne(context.TODO(), bson.M{"_id": request.ID}, bson.M{"$set": bson.M{
+			"history": request.History,
+			"version": request.Version,
+		}})
+		if err != nil {
+			return err
+		}
+	}
+	return cur.Err()
+}
+
+// SupportsTransactions returns whether the deployment supports multi-document transactions.
+// Transactions require a replica set or a sharded cluster
+func (s *Service) SupportsTransactions() (bool, error) {
+	s.transactionsMu.Lock()
+	defer s.transactionsMu.Unlock()
+	if s.transactions != nil {
+		return *s.transactions, nil
+	}
+	var result bson.M
+	err := s.db.Database("admin").RunCommand(context.TODO(), bson.D{{Key: "isMaster", Value: 1}}).Decode(&result)
+	if err != nil {
+		return false, err
+	}
+	_, replicaSet := result["setName"]
+	transactions := replicaSet || result["msg"] == "isdbgrid"
+	s.transactions = &transactions
+	return transactions, nil
+}
+
+// withTransaction runs f in a transaction if the deployment supports them. On a standalone
+// server, which is only allowed with mongodbStandalone, the writes of f are not atomic
+func (s *Service) withTransaction(f func(ctx context.Context) error) error {
+	transactions, err := s.SupportsTransactions()
+	if err != nil {
+		return err
+	}
+	if !transactions {
+		return f(context.TODO())
+	}
+	return s.db.UseSession(context.TODO(), func(sc mongo.SessionContext) error {
+		_, err := sc.WithTransaction(sc, func(sc mongo.SessionContext) (interface{}, error) {
+			return nil, f(sc)
+		})
+		return err
+	})
+}
+
+func (s *Service) insertOutbox(ctx context.Context, outbox []OutboxEntry) error {
+	if len(outbox) == 0 {
+		return nil
+	}
+	documents := make([]interface{}, len(outbox))
+	for i, entry := range outbox {
+		documents[i] = entry
+	}
+	_, err := s.db.Database("mc-whitelist").Collection("outbox").InsertMany(ctx, documents)
+	return err
+}
+
+// PendingOutbox returns up to limit entries that were not published yet, oldest first
+func (s *Service) PendingOutbox(limit int64) ([]OutboxEntry, error) {
+	collection := s.db.Database("mc-whitelist").Collection("outbox")
+	opts := options.Find().SetSort(bson.M{"createdAt": 1}).SetLimit(limit)
+	cur, err := collection.Find(context.TODO(), bson.M{"publishedAt": time.Time{}}, opts)
+	if err != nil {
+		return nil, err
+	}
+	defer cur.Close(context.TODO())
+	entries := make([]OutboxEntry, 0)
+	for cur.Next(context.TODO()) {
+		var entry OutboxEntry
+		if err := cur.Decode(&entry); err != nil {
+			return nil, err
+		}
+		entries = append(entries, entry)
+	}
+	return entries, cur.Err()
+}
+
+// MarkOutboxPublished records that the entry was published to the task queue
+func (s *Service) MarkOutboxPublished(id primitive.ObjectID, publishedAt time.Time) error {
+	return s.updateOutbox(id, bson.M{"$set": bson.M{"publishedAt": publishedAt}})
+}
+
+// MarkOutboxFailed records a failed attempt to publish the entry
+func (s *Service) MarkOutboxFailed(id primitive.ObjectID, reason string) error {
+	return s.updateOutbox(id, bson.M{"$set": bson.M{"lastError": reason}, "$inc": bson.M{"attempts": 1}})
+}
+
+func (s *Service) updateOutbox(id primitive.ObjectID, update bson.M) error {
+	collection := s.db.Database("mc-whitelist").Collection("outbox")
+	result, err := collection.UpdateOne(context.TODO(), bson.M{"_id": id}, update)
+	if err != nil {
+		return err
+	}
+	if result.MatchedCount == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+// DeletePublishedOutbox removes the entries published before the given time
+func (s *Service) DeletePublishedOutbox(before time.Time) (int64, error) {
+	collection := s.db.Database("mc-whitelist").Collection("outbox")
+	result, err := collection.DeleteMany(context.TODO(), bson.M{"publishedAt": bson.M{"$gt": time.Time{}, "$lt": before}})
+	if err != nil {
+		return 0, err
+	}
+	return result.DeletedCount, nil
+}
+
+// DeleteRequestOutbox removes every entry of the request, published or not
+func (s *Service) DeleteRequestOutbox(requestID primitive.ObjectID) (int64, error) {
+	collection := s.db.Database("mc-whitelist").Collection("outbox")
+	result, err := collection.DeleteMany(context.TODO(), bson.M{"request._id": requestID})
+	if err != nil {
+		return 0, err
+	}
+	return result.DeletedCount, nil
+}
+
+// TaskRecord returns the record of the task with the given key. Tasks without a record get an empty one
+func (s *Service) TaskRecord(key string) (TaskRecord, error) {
+	collection := s.db.Database("mc-whitelist").Collection("taskLedger")
+	var record TaskRecord
+	err := collection.FindOne(context.TODO(), bson.M{"_id": key}).Decode(&record)
+	if err == mongo.ErrNoDocuments {
+		return TaskRecord{Key: key}, nil
+	}
+	return record, err
+}
+
+// RecordTaskEffect records that a side effect of the task took place
+func (s *Service) RecordTaskEffect(key, effect string) error {
+	return s.upsertTaskRecord(key, bson.M{"$addToSet": bson.M{"effects": effect}})
+}
+
+// CompleteTask records that the task was fully processed
+func (s *Service) CompleteTask(key string, completedAt time.Time) error {
+	return s.upsertTaskRecord(key, bson.M{"$set": bson.M{"completedAt": completedAt}})
+}
+
+func (s *Service) upsertTaskRecord(key string, update bson.M) error {
+	collection := s.db.Database("mc-whitelist").Collection("taskLedger")
+	update["$setOnInsert"] = bson.M{"createdAt": time.Now()}
+	_, err := collection.UpdateOne(context.TODO(), bson.M{"_id": key}, update, options.Update().SetUpsert(true))
+	return err
+}
+
+// DeleteTaskRecords removes the records created before the given time
+func (s *Service) DeleteTaskRecords(before time.Time) (int64, error) {
+	collection := s.db.Database("mc-whitelist").Collection("taskLedger")
+	result, err := collection.DeleteMany(context.TODO(), bson.M{"createdAt": bson.M{"$lt": before}})
+	if err != nil {
+		return 0, err
 	}
-	updatedRequest := bson.M{}
-	decodeErr := result.Decode(&updatedRequest)
-	return updatedRequest, decodeErr
+	return result.DeletedCount, nil
 }
@@ -0,0 +1,22 @@
+// Package dbtest provides request stores for the tests of other packages
+package dbtest
+
+import (
+	"testing"
+
+	"github.com/tywin1104/mc-gatekeeper/db"
+)
+
+// NewSQLite returns an empty in-memory SQLite store with all migrations applied.
+// The caller closes the store
+func NewSQLite(t testing.TB) *db.SQLService {
+	t.Helper()
+	store, err := db.NewSQLService("sqlite3", ":memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = store.Migrate(); err != nil {
+		t.Fatal(err)
+	}
+	return store
+}
@@ -0,0 +1,359 @@
+package db
+
+import (
+	"fmt"
+	"reflect"
+	"regexp"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// The SQL backend stores each request as a document and evaluates the subset of
+// mongo query and update operators used across the application against it
+
+// toM converts the supported filter/update representations into a bson.M
+func toM(v interface{}) (bson.M, error) {
+	switch d := v.(type) {
+	case nil:
+		return bson.M{}, nil
+	case bson.M:
+		m := bson.M{}
+		for k, val := range d {
+			if k != "" {
+				m[k] = val
+			}
+		}
+		return m, nil
+	case map[string]interface{}:
+		return toM(bson.M(d))
+	case bson.D:
+		m := bson.M{}
+		for _, e := range d {
+			if e.Key != "" {
+				m[e.Key] = e.Value
+			}
+		}
+		return m, nil
+	}
+	return nil, fmt.Errorf("unsupported document type %T", v)
+}
+
+// isDocument reports whether the value is a nested document
+func isDocument(v interface{}) bool {
+	switch v.(type) {
+	case bson.M, bson.D, map[string]interface{}:
+		return true
+	}
+	return false
+}
+
+// toSlice converts array values into []interface{}
+func toSlice(v interface{}) ([]interface{}, bool) {
+	if v == nil {
+		return nil, false
+	}
+	if a, ok := v.(primitive.A); ok {
+		return []interface{}(a), true
+	}
+	rv := reflect.ValueOf(v)
+	if rv.Kind() != reflect.Slice || rv.Type().Elem().Kind() == reflect.Uint8 {
+		return nil, false
+	}
+	out := make([]interface{}, rv.Len())
+	for i := 0; i < rv.Len(); i++ {
+		out[i] = rv.Index(i).Interface()
+	}
+	return out, true
+}
+
+// normalize maps values onto a small set of comparable types
+func normalize(v interface{}) interface{} {
+	switch t := v.(type) {
+	case primitive.ObjectID:
+		return t.Hex()
+	case *primitive.ObjectID:
+		return t.Hex()
+	case primitive.DateTime:
+		// Split the milliseconds so that dates far from the epoch such as the zero time do not overflow
+		return time.Unix(int64(t)/1e3, int64(t)%1e3*int64(time.Millisecond))
+	case time.Time:
+		return t
+	case int:
+		return float64(t)
+	case int32:
+		return float64(t)
+	case int64:
+		return float64(t)
+	case float32:
+		return float64(t)
+	}
+	return v
+}
+
+// compare returns -1, 0 or 1 when the two values are of comparable types
+func compare(a, b interface{}) (int, bool) {
+	a, b = normalize(a), normalize(b)
+	switch x := a.(type) {
+	case float64:
+		y, ok := b.(float64)
+		if !ok {
+			return 0, false
+		}
+		if x < y {
+			return -1, true
+		} else if x > y {
+			return 1, true
+		}
+		return 0, true
+	case string:
+		y, ok := b.(string)
+		if !ok {
+			return 0, false
+		}
+		return strings.Compare(x, y), true
+	case time.Time:
+		y, ok := b.(time.Time)
+		if !ok {
+			return 0, false
+		}
+		if x.Before(y) {
+			return -1, true
+		} else if x.After(y) {
+			return 1, true
+		}
+		return 0, true
+	case bool:
+		y, ok := b.(bool)
+		if !ok {
+			return 0, false
+		}
+		if x == y {
+			return 0, true
+		}
+		return 1, true
+	case nil:
+		if b == nil {
+			return 0, true
+		}
+	}
+	return 0, false
+}
+
+func equals(a, b interface{}) bool {
+	c, ok := compare(a, b)
+	return ok && c == 0
+}
+
+// lookup resolves a dotted field path inside the document
+func lookup(doc bson.M, path string) (interface{}, bool) {
+	var current interface{} = doc
+	for _, part := range strings.Split(path, ".") {
+		m, err := toM(current)
+		if err != nil || !isDocument(current) {
+			return nil, false
+		}
+		v, ok := m[part]
+		if !ok {
+			return nil, false
+		}
+		current = v
+	}
+	return current, true
+}
+
+// matchDocument reports whether the document satisfies the mongo-style filter
+func matchDocument(doc bson.M, filter interface{}) (bool, error) {
+	f, err := toM(filter)
+	if err != nil {
+		return false, err
+	}
+	for key, cond := range f {
+		switch key {
+		case "$or", "$and":
+			clauses, ok := toSlice(cond)
+			if !ok {
+				return false, fmt.Errorf("%s requires an array", key)
+			}
+			matched := key == "$and"
+			for _, clause := range clauses {
+				ok, err := matchDocument(doc, clause)
+				if err != nil {
+					return false, err
+				}
+				if key == "$or" && ok {
+					matched = true
+					break
+				}
+				if key == "$and" && !ok {
+					matched = false
+					break
+				}
+			}
+			if !matched {
+				return false, nil
+			}
+			continue
+		}
+		value, exists := lookup(doc, key)
+		ok, err := matchCondition(value, exists, cond)
+		if err != nil {
+			return false, err
+		}
+		if !ok {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+// matchCondition evaluates a single field condition, either a literal or an operator document
+func matchCondition(value interface{}, exists bool, cond interface{}) (bool, error) {
+	if !isOperatorDocument(cond) {
+		return matchValue(value, exists, cond), nil
+	}
+	ops, _ := toM(cond)
+	for op, arg := range ops {
+		var ok bool
+		switch op {
+		case "$eq":
+			ok = matchValue(value, exists, arg)
+		case "$ne":
+			ok = !matchValue(value, exists, arg)
+		case "$in", "$nin":
+			candidates, isArray := toSlice(arg)
+			if !isArray {
+				return false, fmt.Errorf("%s requires an array", op)
+			}
+			for _, c := range candidates {
+				if matchValue(value, exists, c) {
+					ok = true
+					break
+				}
+			}
+			if op == "$nin" {
+				ok = !ok
+			}
+		case "$gt", "$gte", "$lt", "$lte":
+			if !exists {
+				break
+			}
+			c, comparable := compare(value, arg)
+			if !comparable {
+				break
+			}
+			ok = (op == "$gt" && c > 0) || (op == "$gte" && c >= 0) ||
+				(op == "$lt" && c < 0) || (op == "$lte" && c <= 0)
+		case "$exists":
+			want, _ := arg.(bool)
+			ok = exists == want
+		case "$regex":
+			pattern, _ := arg.(string)
+			if opts, found := ops["$options"].(string); found && strings.Contains(opts, "i") {
+				pattern = "(?i)" + pattern
+			}
+			re, err := regexp.Compile(pattern)
+			if err != nil {
+				return false, err
+			}
+			s, isString := value.(string)
+			ok = isString && re.MatchString(s)
+		case "$options":
+			ok = true
+		default:
+			return false, fmt.Errorf("unsupported query operator %s", op)
+		}
+		if !ok {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+// matchValue compares a literal against a field value, matching array fields by element
+func matchValue(value interface{}, exists bool, literal interface{}) bool {
+	if !exists {
+		return literal == nil
+	}
+	if elems, ok := toSlice(value); ok {
+		if _, literalIsArray := toSlice(literal); !literalIsArray {
+			for _, e := range elems {
+				if equals(e, literal) {
+					return true
+				}
+			}
+			return false
+		}
+	}
+	return equals(value, literal)
+}
+
+func isOperatorDocument(v interface{}) bool {
+	if !isDocument(v) {
+		return false
+	}
+	m, _ := toM(v)
+	for k := range m {
+		if !strings.HasPrefix(k, "$") {
+			return false
+		}
+	}
+	return len(m) > 0
+}
+
+// applyUpdate applies mongo-style update operators to the document in place
+func applyUpdate(doc bson.M, update interface{}) error {
+	u, err := toM(update)
+	if err != nil {
+		return err
+	}
+	for op, arg := range u {
+		fields, err := toM(arg)
+		if err != nil {
+			return fmt.Errorf("%s requires a document", op)
+		}
+		for path, value := range fields {
+			parent, key := resolveParent(doc, path)
+			switch op {
+			case "$set":
+				parent[key] = value
+			case "$unset":
+				delete(parent, key)
+			case "$inc":
+				current, _ := normalize(parent[key]).(float64)
+				delta, ok := normalize(value).(float64)
+				if !ok {
+					return fmt.Errorf("$inc requires a numeric value for %s", path)
+				}
+				if _, isFloat := value.(float64); isFloat {
+					parent[key] = current + delta
+				} else {
+					parent[key] = int64(current + delta)
+				}
+			case "$push":
+				existing, _ := toSlice(parent[key])
+				parent[key] = append(existing, value)
+			default:
+				return fmt.Errorf("unsupported update operator %s", op)
+			}
+		}
+	}
+	return nil
+}
+
+// resolveParent walks a dotted path, creating intermediate documents as needed
+func resolveParent(doc bson.M, path string) (bson.M, string) {
+	parts := strings.Split(path, ".")
+	current := doc
+	for _, part := range parts[:len(parts)-1] {
+		next, err := toM(current[part])
+		if err != nil || !isDocument(current[part]) {
+			next = bson.M{}
+		}
+		current[part] = next
+		current = next
+	}
+	return current, parts[len(parts)-1]
+}
@@ -0,0 +1,39 @@
+package db
+
+import "time"
+
+// TaskRecord tracks the side effects of a task across redeliveries. Tasks are identified
+// by their idempotency key, so a task that is delivered again finds its record
+type TaskRecord struct {
+	Key         string    `bson:"_id" json:"key"`
+	Effects     []string  `bson:"effects" json:"effects"`
+	CreatedAt   time.Time `bson:"createdAt" json:"createdAt"`
+	CompletedAt time.Time `bson:"completedAt" json:"completedAt"`
+}
+
+// Done returns whether the side effect of the task already took place
+func (r TaskRecord) Done(effect string) bool {
+	for _, e := range r.Effects {
+		if e == effect {
+			return true
+		}
+	}
+	return false
+}
+
+// Completed returns whether the task was fully processed
+func (r TaskRecord) Completed() bool {
+	return !r.CompletedAt.IsZero()
+}
+
+// TaskLedger durably records the progress of the tasks processed by the worker
+type TaskLedger interface {
+	// TaskRecord returns the record of the task with the given key. Tasks without a record get an empty one
+	TaskRecord(key string) (TaskRecord, error)
+	// RecordTaskEffect records that a side effect of the task took place
+	RecordTaskEffect(key, effect string) error
+	// CompleteTask records that the task was fully processed
+	CompleteTask(key string, completedAt time.Time) error
+	// DeleteTaskRecords removes the records created before the given time and returns how many were removed
+	DeleteTaskRecords(before time.Time) (int64, error)
+}
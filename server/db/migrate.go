@@ -0,0 +1,96 @@
+package db
+
+import (
+	"sort"
+	"time"
+
+	"github.com/tywin1104/mc-gatekeeper/types"
+)
+
+// MigrationRecord describes a migration that has been applied to the database
+type MigrationRecord struct {
+	Version     int       `bson:"_id" json:"version"`
+	Description string    `bson:"description" json:"description"`
+	AppliedAt   time.Time `bson:"appliedAt" json:"appliedAt"`
+}
+
+// migration is a single versioned change to the stored requests.
+// Migrations must be safe to re-run in case recording them fails
+type migration struct {
+	version     int
+	description string
+	up          func() error
+}
+
+// runMigrations applies the migrations that are not applied yet in version order
+// and records each of them right after it succeeds
+func runMigrations(migrations []migration, applied []MigrationRecord, record func(MigrationRecord) error) ([]MigrationRecord, error) {
+	done := map[int]bool{}
+	for _, m := range applied {
+		done[m.Version] = true
+	}
+	sort.Slice(migrations, func(i, j int) bool { return migrations[i].version < migrations[j].version })
+
+	newlyApplied := make([]MigrationRecord, 0)
+	for _, m := range migrations {
+		if done[m.version] {
+			continue
+		}
+		if err := m.up(); err != nil {
+			return newlyApplied, &MigrationError{Version: m.version, Description: m.description, Err: err}
+		}
+		r := MigrationRecord{Version: m.version, Description: m.description, AppliedAt: time.Now()}
+		if err := record(r); err != nil {
+			return newlyApplied, &MigrationError{Version: m.version, Description: m.description, Err: err}
+		}
+		newlyApplied = append(newlyApplied, r)
+	}
+	return newlyApplied, nil
+}
+
+// MigrationError reports the migration that failed to apply
+type MigrationError struct {
+	Version     int
+	Description string
+	Err         error
+}
+
+func (e *MigrationError) Error() string {
+	return "migration " + e.Description + " failed: " + e.Err.Error()
+}
+
+// backfillRequest fills in fields that did not exist when the request was stored.
+// It reports whether the request was changed
+func backfillRequest(request *types.WhitelistRequest) bool {
+	if len(request.History) > 0 {
+		return false
+	}
+	// Reconstruct the history from the timestamps kept on the request
+	request.History = []types.StatusChange{{
+		Actor:     request.Username,
+		NewStatus: types.StatusPending,
+		Source:    types.SourceApplication,
+		Timestamp: request.Timestamp,
+	}}
+	switch request.Status {
+	case types.StatusApproved, types.StatusDenied:
+		request.History = append(request.History, legacyDecision(request, types.StatusPending, request.Status, request.ProcessedTimestamp))
+	case types.StatusDeactivated, types.StatusBanned:
+		// Before the state machine these could only be reached from an approved request
+		request.History = append(request.History,
+			legacyDecision(request, types.StatusPending, types.StatusApproved, request.ProcessedTimestamp),
+			legacyDecision(request, types.StatusApproved, request.Status, request.LastUpdatedTimestamp))
+	}
+	return true
+}
+
+// legacyDecision is a status change reconstructed from a request stored without history.
+// Only the latest admin is known so every decision is attributed to them
+func legacyDecision(request *types.WhitelistRequest, from, to string, at time.Time) types.StatusChange {
+	return types.StatusChange{
+		Actor:     request.Admin,
+		OldStatus: from,
+		NewStatus: to,
+		Timestamp: at,
+	}
+}
@@ -0,0 +1,59 @@
+package db
+
+import (
+	"time"
+
+	"github.com/tywin1104/mc-gatekeeper/types"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// OutboxEntry is a task for the worker that is stored in the same transaction as the
+// request change it results from. The outbox relay publishes it to the task queue afterwards,
+// so a committed change is never left without its task
+type OutboxEntry struct {
+	ID       primitive.ObjectID `bson:"_id" json:"id"`
+	TaskType string             `bson:"taskType" json:"taskType"`
+	// Request is the snapshot of the request after the change. It is filled in by the store
+	Request     types.WhitelistRequest `bson:"request" json:"request"`
+	CreatedAt   time.Time              `bson:"createdAt" json:"createdAt"`
+	PublishedAt time.Time              `bson:"publishedAt" json:"publishedAt"`
+	Attempts    int                    `bson:"attempts" json:"attempts"`
+	LastError   string                 `bson:"lastError" json:"lastError"`
+	// IdempotencyKey replaces the key derived from the request, e.g. for manual tasks that are carried out every time
+	IdempotencyKey string            `bson:"idempotencyKey,omitempty" json:"idempotencyKey,omitempty"`
+	Metadata       map[string]string `bson:"metadata,omitempty" json:"metadata,omitempty"`
+}
+
+// NewOutboxEntry creates an outbox entry for a task of the given type
+func NewOutboxEntry(taskType string) OutboxEntry {
+	return OutboxEntry{
+		ID:        primitive.NewObjectID(),
+		TaskType:  taskType,
+		CreatedAt: time.Now(),
+	}
+}
+
+// OutboxStore gives the outbox relay access to the stored outbox entries
+type OutboxStore interface {
+	// PendingOutbox returns up to limit entries that were not published yet, oldest first
+	PendingOutbox(limit int64) ([]OutboxEntry, error)
+	// MarkOutboxPublished records that the entry was published to the task queue
+	MarkOutboxPublished(id primitive.ObjectID, publishedAt time.Time) error
+	// MarkOutboxFailed records a failed attempt to publish the entry
+	MarkOutboxFailed(id primitive.ObjectID, reason string) error
+	// DeletePublishedOutbox removes the entries published before the given time and returns how many were removed
+	DeletePublishedOutbox(before time.Time) (int64, error)
+	// DeleteRequestOutbox removes every entry of the request, published or not, and returns how many were removed.
+	// Their snapshots hold the personal data of the request
+	DeleteRequestOutbox(requestID primitive.ObjectID) (int64, error)
+}
+
+// withSnapshot returns the entries with the snapshot of the request they were stored with
+func withSnapshot(outbox []OutboxEntry, request types.WhitelistRequest) []OutboxEntry {
+	entries := make([]OutboxEntry, len(outbox))
+	for i, entry := range outbox {
+		entry.Request = request
+		entries[i] = entry
+	}
+	return entries
+}
@@ -0,0 +1,175 @@
+package db
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"regexp"
+	"time"
+
+	"github.com/tywin1104/mc-gatekeeper/types"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+const (
+	// DefaultPageSize is used when a query does not specify a page size
+	DefaultPageSize = 50
+	// MaxPageSize caps the number of requests returned by a single query
+	MaxPageSize = 500
+)
+
+// SortKeys lists the fields requests can be sorted by
+var SortKeys = map[string]bool{
+	"timestamp": true,
+	"username":  true,
+	"email":     true,
+	"status":    true,
+	"admin":     true,
+}
+
+// ErrInvalidCursor is returned when a pagination cursor can not be decoded
+var ErrInvalidCursor = errors.New("Invalid cursor")
+
+// RequestQuery describes a filtered, sorted and paginated lookup of whitelist requests.
+// Pagination is either page based (Page/PageSize) or cursor based (Cursor/PageSize)
+type RequestQuery struct {
+	Statuses  []string
+	Admin     string
+	From      time.Time
+	To        time.Time
+	Search    string
+	SortBy    string
+	Ascending bool
+	Page      int64
+	PageSize  int64
+	Cursor    string
+}
+
+// RequestPage is one page of requests matching a RequestQuery
+type RequestPage struct {
+	Requests   []types.WhitelistRequest `json:"requests"`
+	Total      int64                    `json:"total"`
+	Page       int64                    `json:"page,omitempty"`
+	PageSize   int64                    `json:"pageSize"`
+	NextCursor string                   `json:"nextCursor,omitempty"`
+}
+
+// cursor marks the position of the last request of a page in the sort order
+type cursor struct {
+	SortBy string `json:"k"`
+	Value  string `json:"v"`
+	ID     string `json:"id"`
+}
+
+// normalize fills in defaults and validates the query
+func (q *RequestQuery) normalize() error {
+	if q.SortBy == "" {
+		q.SortBy = "timestamp"
+	}
+	if !SortKeys[q.SortBy] {
+		return errors.New("Unsupported sort key " + q.SortBy)
+	}
+	if q.PageSize <= 0 {
+		q.PageSize = DefaultPageSize
+	}
+	if q.PageSize > MaxPageSize {
+		q.PageSize = MaxPageSize
+	}
+	if q.Cursor == "" && q.Page <= 0 {
+		q.Page = 1
+	}
+	if q.Cursor != "" {
+		q.Page = 0
+	}
+	return nil
+}
+
+// filter builds the mongo-style filter for every condition except free-text search and the cursor
+func (q *RequestQuery) filter() bson.M {
+	filter := bson.M{}
+	if len(q.Statuses) > 0 {
+		filter["status"] = bson.M{"$in": q.Statuses}
+	}
+	if q.Admin != "" {
+		filter["admin"] = q.Admin
+	}
+	timestamp := bson.M{}
+	if !q.From.IsZero() {
+		timestamp["$gte"] = q.From
+	}
+	if !q.To.IsZero() {
+		timestamp["$lte"] = q.To
+	}
+	if len(timestamp) > 0 {
+		filter["timestamp"] = timestamp
+	}
+	return filter
+}
+
+// searchFilter matches the free-text query against username and email, case insensitive
+func (q *RequestQuery) searchFilter() bson.M {
+	pattern := regexp.QuoteMeta(q.Search)
+	return bson.M{"$or": []bson.M{
+		{"username": bson.M{"$regex": pattern, "$options": "i"}},
+		{"email": bson.M{"$regex": pattern, "$options": "i"}},
+	}}
+}
+
+// decodeCursor returns the sort value and request ID encoded in the query cursor
+func (q *RequestQuery) decodeCursor() (interface{}, primitive.ObjectID, error) {
+	raw, err := base64.RawURLEncoding.DecodeString(q.Cursor)
+	if err != nil {
+		return nil, primitive.ObjectID{}, ErrInvalidCursor
+	}
+	var c cursor
+	if err = json.Unmarshal(raw, &c); err != nil || c.SortBy != q.SortBy {
+		return nil, primitive.ObjectID{}, ErrInvalidCursor
+	}
+	id, err := primitive.ObjectIDFromHex(c.ID)
+	if err != nil {
+		return nil, primitive.ObjectID{}, ErrInvalidCursor
+	}
+	if c.SortBy == "timestamp" {
+		t, err := time.Parse(time.RFC3339Nano, c.Value)
+		if err != nil {
+			return nil, primitive.ObjectID{}, ErrInvalidCursor
+		}
+		return t, id, nil
+	}
+	return c.Value, id, nil
+}
+
+// encodeCursor builds the cursor pointing after the given request
+func (q *RequestQuery) encodeCursor(request types.WhitelistRequest) string {
+	c := cursor{SortBy: q.SortBy, ID: request.ID.Hex()}
+	switch q.SortBy {
+	case "timestamp":
+		c.Value = request.Timestamp.Format(time.RFC3339Nano)
+	case "username":
+		c.Value = request.Username
+	case "email":
+		c.Value = request.Email
+	case "status":
+		c.Value = request.Status
+	case "admin":
+		c.Value = request.Admin
+	}
+	raw, _ := json.Marshal(c)
+	return base64.RawURLEncoding.EncodeToString(raw)
+}
+
+// page assembles the result page, attaching a cursor when more requests may follow
+func (q *RequestQuery) page(requests []types.WhitelistRequest, total int64) RequestPage {
+	page := RequestPage{
+		Requests: requests,
+		Total:    total,
+		Page:     q.Page,
+		PageSize: q.PageSize,
+	}
+	lastPage := q.Page > 0 && q.Page*q.PageSize >= total
+	if int64(len(requests)) == q.PageSize && !lastPage {
+		page.NextCursor = q.encodeCursor(requests[len(requests)-1])
+	}
+	return page
+}
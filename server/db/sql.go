@@ -0,0 +1,979 @@
+package db
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	// Register the supported SQL drivers
+	_ "github.com/lib/pq"
+	_ "github.com/mattn/go-sqlite3"
+
+	"github.com/tywin1104/mc-gatekeeper/types"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// Each request is kept as a JSON document alongside the columns that are
+// commonly filtered on, so that adding fields to types.WhitelistRequest does not
+// require a schema change
+const createRequestsTable = `CREATE TABLE IF NOT EXISTS requests (
+	id TEXT PRIMARY KEY,
+	username TEXT NOT NULL,
+	email TEXT NOT NULL,
+	status TEXT NOT NULL,
+	admin TEXT NOT NULL,
+	timestamp BIGINT NOT NULL,
+	document TEXT NOT NULL
+)`
+
+// Outbox entries are kept as a JSON document like requests. An entry is pending while published_at is 0
+const createOutboxTable = `CREATE TABLE IF NOT EXISTS outbox (
+	id TEXT PRIMARY KEY,
+	created_at BIGINT NOT NULL,
+	published_at BIGINT NOT NULL DEFAULT 0,
+	document TEXT NOT NULL
+)`
+
+// Task records keep their side effects as a JSON array. A task is completed once completed_at is set
+const createTaskLedgerTable = `CREATE TABLE IF NOT EXISTS task_ledger (
+	task_key TEXT PRIMARY KEY,
+	created_at BIGINT NOT NULL,
+	completed_at BIGINT NOT NULL DEFAULT 0,
+	effects TEXT NOT NULL
+)`
+
+const createMigrationsTable = `CREATE TABLE IF NOT EXISTS schema_migrations (
+	version INTEGER PRIMARY KEY,
+	description TEXT NOT NULL,
+	applied_at BIGINT NOT NULL
+)`
+
+// Filter fields that map onto a table column and can be evaluated by the database
+var requestColumns = map[string]string{
+	"_id":       "id",
+	"username":  "username",
+	"email":     "email",
+	"status":    "status",
+	"admin":     "admin",
+	"timestamp": "timestamp",
+	// Anonymised requests are looked up by the hash when the applicant applies again
+	"usernameHash": "username_hash",
+}
+
+// SQLService is the SQL (SQLite/Postgres) implementation of RequestStore
+type SQLService struct {
+	db     *sql.DB
+	driver string
+}
+
+// NewSQLService opens a connection to the SQL database. The schema is created by Migrate.
+// Supported drivers are "sqlite3" and "postgres"
+func NewSQLService(driver, dataSource string) (*SQLService, error) {
+	if driver != "sqlite3" && driver != "postgres" {
+		return nil, fmt.Errorf("unsupported sql driver %s", driver)
+	}
+	conn, err := sql.Open(driver, dataSource)
+	if err != nil {
+		return nil, err
+	}
+	if driver == "sqlite3" {
+		// SQLite only allows one writer at a time. Serialize access through a single connection
+		conn.SetMaxOpenConns(1)
+	}
+	if err = conn.Ping(); err != nil {
+		return nil, err
+	}
+	return &SQLService{db: conn, driver: driver}, nil
+}
+
+// Close the underlying database connection
+func (s *SQLService) Close() error {
+	return s.db.Close()
+}
+
+// Migrate applies the pending schema migrations
+func (s *SQLService) Migrate() ([]MigrationRecord, error) {
+	applied, err := s.AppliedMigrations()
+	if err != nil {
+		return nil, err
+	}
+	return runMigrations(s.migrations(), applied, func(r MigrationRecord) error {
+		_, err := s.db.Exec(s.rebind("INSERT INTO schema_migrations (version, description, applied_at) VALUES (?, ?, ?)"),
+			r.Version, r.Description, r.AppliedAt.UnixNano())
+		return err
+	})
+}
+
+// AppliedMigrations returns the migrations recorded in the database
+func (s *SQLService) AppliedMigrations() ([]MigrationRecord, error) {
+	if _, err := s.db.Exec(createMigrationsTable); err != nil {
+		return nil, err
+	}
+	rows, err := s.db.Query("SELECT version, description, applied_at FROM schema_migrations ORDER BY version")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	applied := make([]MigrationRecord, 0)
+	for rows.Next() {
+		var r MigrationRecord
+		var appliedAt int64
+		if err := rows.Scan(&r.Version, &r.Description, &appliedAt); err != nil {
+			return nil, err
+		}
+		r.AppliedAt = time.Unix(0, appliedAt)
+		applied = append(applied, r)
+	}
+	return applied, rows.Err()
+}
+
+func (s *SQLService) migrations() []migration {
+	return []migration{
+		{version: 1, description: "create requests table", up: s.execMigration(createRequestsTable)},
+		{version: 2, description: "create request indexes", up: s.execMigration(
+			"CREATE INDEX IF NOT EXISTS requests_username ON requests (username)",
+			"CREATE INDEX IF NOT EXISTS requests_email ON requests (email)",
+			"CREATE INDEX IF NOT EXISTS requests_status_timestamp ON requests (status, timestamp)",
+			"CREATE INDEX IF NOT EXISTS requests_timestamp ON requests (timestamp)",
+		)},
+		{version: 3, description: "backfill request version and history", up: s.backfillRequests},
+		{version: 4, description: "create outbox table", up: s.execMigration(
+			createOutboxTable,
+			"CREATE INDEX IF NOT EXISTS outbox_published_at_created_at ON outbox (published_at, created_at)",
+		)},
+		{version: 5, description: "create task ledger table", up: s.execMigration(
+			createTaskLedgerTable,
+			"CREATE INDEX IF NOT EXISTS task_ledger_created_at ON task_ledger (created_at)",
+		)},
+		{version: 6, description: "add username hash column", up: s.addUsernameHashColumn},
+	}
+}
+
+// execMigration returns a migration step that runs the statements in a single transaction
+func (s *SQLService) execMigration(statements ...string) func() error {
+	return func() error {
+		tx, err := s.db.Begin()
+		if err != nil {
+			return err
+		}
+		defer tx.Rollback()
+		for _, statement := range statements {
+			if _, err := tx.Exec(statement); err != nil {
+				return err
+			}
+		}
+		return tx.Commit()
+	}
+}
+
+// backfillRequests adds the history to requests stored before it existed.
+// Requests without a version decode as version 0 and are rewritten along with it
+func (s *SQLService) backfillRequests() error {
+	rows, err := s.db.Query("SELECT document FROM requests")
+	if err != nil {
+		return err
+	}
+	backfilled := make([]types.WhitelistRequest, 0)
+	for rows.Next() {
+		var document string
+		if err := rows.Scan(&document); err != nil {
+			rows.Close()
+			return err
+		}
+		request, _, err := decodeDocument(document)
+		if err != nil {
+			rows.Close()
+			return err
+		}
+		if backfillRequest(&request) {
+			backfilled = append(backfilled, request)
+		}
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return err
+	}
+	// Rows are updated after the query is closed as sqlite only has a single connection
+	for _, request := range backfilled {
+		document, err := json.Marshal(request)
+		if err != nil {
+			return err
+		}
+		_, err = s.db.Exec(s.rebind("UPDATE requests SET document = ? WHERE id = ?"), string(document), request.ID.Hex())
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// addUsernameHashColumn adds the indexed username_hash column and fills it in from the documents
+func (s *SQLService) addUsernameHashColumn() error {
+	err := s.execMigration(
+		"ALTER TABLE requests ADD COLUMN username_hash TEXT NOT NULL DEFAULT ''",
+		"CREATE INDEX IF NOT EXISTS requests_username_hash ON requests (username_hash)",
+	)()
+	if err != nil {
+		return err
+	}
+	rows, err := s.db.Query("SELECT document FROM requests")
+	if err != nil {
+		return err
+	}
+	hashes := map[string]string{}
+	for rows.Next() {
+		var document string
+		if err := rows.Scan(&document); err != nil {
+			rows.Close()
+			return err
+		}
+		request, _, err := decodeDocument(document)
+		if err != nil {
+			rows.Close()
+			return err
+		}
+		if request.UsernameHash != "" {
+			hashes[request.ID.Hex()] = request.UsernameHash
+		}
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return err
+	}
+	// Rows are updated after the query is closed as sqlite only has a single connection
+	for id, hash := range hashes {
+		if _, err = s.db.Exec(s.rebind("UPDATE requests SET username_hash = ? WHERE id = ?"), hash, id); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// rebind converts ? placeholders into the positional form used by postgres
+func (s *SQLService) rebind(query string) string {
+	if s.driver != "postgres" {
+		return query
+	}
+	var b strings.Builder
+	n := 0
+	for _, r := range query {
+		if r == '?' {
+			n++
+			b.WriteString("$" + strconv.Itoa(n))
+			continue
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
+
+// CreateRequest create new whitelistRequest
+func (s *SQLService) CreateRequest(newRequest types.WhitelistRequest, outbox ...OutboxEntry) (primitive.ObjectID, error) {
+	newRequest.ID = primitive.NewObjectID()
+	// Set initial request status and attach timestamp
+	newRequest.Timestamp = time.Now()
+	newRequest.Status = "Pending"
+	newRequest.History = []types.StatusChange{{
+		Actor:     newRequest.Username,
+		NewStatus: newRequest.Status,
+		Source:    types.SourceApplication,
+		Timestamp: newRequest.Timestamp,
+	}}
+	tx, err := s.db.Begin()
+	if err != nil {
+		return primitive.ObjectID{}, err
+	}
+	defer tx.Rollback()
+	if _, err = s.insert(tx, newRequest); err != nil {
+		return primitive.ObjectID{}, err
+	}
+	if err = s.insertOutbox(tx, withSnapshot(outbox, newRequest)); err != nil {
+		return primitive.ObjectID{}, err
+	}
+	if err = tx.Commit(); err != nil {
+		return primitive.ObjectID{}, err
+	}
+	return newRequest.ID, nil
+}
+
+// ImportRequest stores the request as given, keeping its status and history.
+// An ID is generated if the request does not have one
+func (s *SQLService) ImportRequest(request types.WhitelistRequest) (primitive.ObjectID, error) {
+	if request.ID.IsZero() {
+		request.ID = primitive.NewObjectID()
+	}
+	return s.insert(s.db, request)
+}
+
+// execer is implemented by both *sql.DB and *sql.Tx
+type execer interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+}
+
+func (s *SQLService) insert(db execer, request types.WhitelistRequest) (primitive.ObjectID, error) {
+	document, err := json.Marshal(request)
+	if err != nil {
+		return primitive.ObjectID{}, err
+	}
+	_, err = db.Exec(s.rebind(`INSERT INTO requests (id, username, email, status, admin, timestamp, username_hash, document)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?)`),
+		request.ID.Hex(), request.Username, request.Email, request.Status,
+		request.Admin, request.Timestamp.UnixNano(), request.UsernameHash, string(document))
+	if err != nil {
+		return primitive.ObjectID{}, err
+	}
+	return request.ID, nil
+}
+
+// GetRequests query for whitelistRequests in db
+func (s *SQLService) GetRequests(limit int64, filter interface{}) ([]types.WhitelistRequest, error) {
+	where, args, residual, err := s.translateFilter(filter)
+	if err != nil {
+		return nil, err
+	}
+	query := "SELECT document FROM requests" + where + " ORDER BY timestamp DESC"
+	// The limit can only be pushed down when the database evaluates the whole filter
+	if limit > 0 && len(residual) == 0 {
+		query += " LIMIT " + strconv.FormatInt(limit, 10)
+	}
+	rows, err := s.db.Query(s.rebind(query), args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	requests := make([]types.WhitelistRequest, 0)
+	for rows.Next() {
+		var document string
+		if err := rows.Scan(&document); err != nil {
+			return nil, err
+		}
+		request, doc, err := decodeDocument(document)
+		if err != nil {
+			return nil, err
+		}
+		ok, err := matchDocument(doc, residual)
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			continue
+		}
+		requests = append(requests, request)
+		if limit > 0 && int64(len(requests)) >= limit {
+			break
+		}
+	}
+	return requests, rows.Err()
+}
+
+// UpdateRequest perform partial update to the first whitelistRequest matching the filter
+func (s *SQLService) UpdateRequest(filter, update interface{}, outbox ...OutboxEntry) (bson.M, error) {
+	where, args, residual, err := s.translateFilter(filter)
+	if err != nil {
+		return nil, err
+	}
+	tx, err := s.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	query := "SELECT document FROM requests" + where + " ORDER BY timestamp DESC"
+	if s.driver == "postgres" {
+		query += " FOR UPDATE"
+	}
+	rows, err := tx.Query(s.rebind(query), args...)
+	if err != nil {
+		return nil, err
+	}
+	var doc bson.M
+	for rows.Next() {
+		var document string
+		if err := rows.Scan(&document); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		_, candidate, err := decodeDocument(document)
+		if err != nil {
+			rows.Close()
+			return nil, err
+		}
+		ok, err := matchDocument(candidate, residual)
+		if err != nil {
+			rows.Close()
+			return nil, err
+		}
+		if ok {
+			doc = candidate
+			break
+		}
+	}
+	rows.Close()
+	if doc == nil {
+		return nil, ErrNotFound
+	}
+
+	if err = applyUpdate(doc, update); err != nil {
+		return nil, err
+	}
+	// Round trip through bson to validate the result against the request schema
+	var updated types.WhitelistRequest
+	raw, err := bson.Marshal(doc)
+	if err != nil {
+		return nil, err
+	}
+	if err = bson.Unmarshal(raw, &updated); err != nil {
+		return nil, err
+	}
+	document, err := json.Marshal(updated)
+	if err != nil {
+		return nil, err
+	}
+	_, err = tx.Exec(s.rebind(`UPDATE requests SET username = ?, email = ?, status = ?, admin = ?, timestamp = ?,
+		username_hash = ?, document = ? WHERE id = ?`),
+		updated.Username, updated.Email, updated.Status, updated.Admin,
+		updated.Timestamp.UnixNano(), updated.UsernameHash, string(document), updated.ID.Hex())
+	if err != nil {
+		return nil, err
+	}
+	if err = s.insertOutbox(tx, withSnapshot(outbox, updated)); err != nil {
+		return nil, err
+	}
+	if err = tx.Commit(); err != nil {
+		return nil, err
+	}
+	return toDocument(updated)
+}
+
+// DeleteRequests permanently removes every whitelistRequest matching the filter. The requests are
+// matched and deleted in one transaction so that a request changed in between is not deleted
+func (s *SQLService) DeleteRequests(filter interface{}) (int64, error) {
+	where, args, residual, err := s.translateFilter(filter)
+	if err != nil {
+		return 0, err
+	}
+	tx, err := s.db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	query := "SELECT document FROM requests" + where
+	if s.driver == "postgres" {
+		query += " FOR UPDATE"
+	}
+	rows, err := tx.Query(s.rebind(query), args...)
+	if err != nil {
+		return 0, err
+	}
+	ids := []string{}
+	for rows.Next() {
+		var document string
+		if err := rows.Scan(&document); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		request, doc, err := decodeDocument(document)
+		if err != nil {
+			rows.Close()
+			return 0, err
+		}
+		ok, err := matchDocument(doc, residual)
+		if err != nil {
+			rows.Close()
+			return 0, err
+		}
+		if ok {
+			ids = append(ids, request.ID.Hex())
+		}
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return 0, err
+	}
+	if len(ids) == 0 {
+		return 0, nil
+	}
+	// Rows are deleted after the query is closed as sqlite only has a single connection
+	placeholders := make([]string, len(ids))
+	values := make([]interface{}, len(ids))
+	for i, id := range ids {
+		placeholders[i] = "?"
+		values[i] = id
+	}
+	result, err := tx.Exec(s.rebind("DELETE FROM requests WHERE id IN ("+strings.Join(placeholders, ", ")+")"), values...)
+	if err != nil {
+		return 0, err
+	}
+	deleted, err := result.RowsAffected()
+	if err != nil {
+		return 0, err
+	}
+	return deleted, tx.Commit()
+}
+
+// QueryRequests returns one page of requests matching the query along with the total count
+func (s *SQLService) QueryRequests(query RequestQuery) (RequestPage, error) {
+	if err := query.normalize(); err != nil {
+		return RequestPage{}, err
+	}
+	where, args, residual, err := s.translateFilter(query.filter())
+	if err != nil {
+		return RequestPage{}, err
+	}
+	if len(residual) > 0 {
+		return RequestPage{}, errors.New("query contains conditions that can not be evaluated in SQL")
+	}
+	conditions := []string{}
+	if where != "" {
+		conditions = append(conditions, strings.TrimPrefix(where, " WHERE "))
+	}
+	if query.Search != "" {
+		pattern := "%" + likeEscaper.Replace(strings.ToLower(query.Search)) + "%"
+		conditions = append(conditions, `(LOWER(username) LIKE ? ESCAPE '\' OR LOWER(email) LIKE ? ESCAPE '\')`)
+		args = append(args, pattern, pattern)
+	}
+
+	var total int64
+	countQuery := "SELECT COUNT(*) FROM requests" + whereClause(conditions)
+	if err = s.db.QueryRow(s.rebind(countQuery), args...).Scan(&total); err != nil {
+		return RequestPage{}, err
+	}
+
+	column := requestColumns[query.SortBy]
+	direction, comparison := "DESC", "<"
+	if query.Ascending {
+		direction, comparison = "ASC", ">"
+	}
+	pagination := " LIMIT " + strconv.FormatInt(query.PageSize, 10)
+	if query.Cursor != "" {
+		value, id, err := query.decodeCursor()
+		if err != nil {
+			return RequestPage{}, err
+		}
+		v, _ := columnValue(value)
+		// Continue after the last request of the previous page, breaking ties by ID
+		conditions = append(conditions, "("+column+" "+comparison+" ? OR ("+column+" = ? AND id "+comparison+" ?))")
+		args = append(args, v, v, id.Hex())
+	} else {
+		pagination += " OFFSET " + strconv.FormatInt((query.Page-1)*query.PageSize, 10)
+	}
+	selectQuery := "SELECT document FROM requests" + whereClause(conditions) +
+		" ORDER BY " + column + " " + direction + ", id " + direction + pagination
+	rows, err := s.db.Query(s.rebind(selectQuery), args...)
+	if err != nil {
+		return RequestPage{}, err
+	}
+	defer rows.Close()
+	requests := make([]types.WhitelistRequest, 0)
+	for rows.Next() {
+		var document string
+		if err := rows.Scan(&document); err != nil {
+			return RequestPage{}, err
+		}
+		request, _, err := decodeDocument(document)
+		if err != nil {
+			return RequestPage{}, err
+		}
+		requests = append(requests, request)
+	}
+	if err = rows.Err(); err != nil {
+		return RequestPage{}, err
+	}
+	return query.page(requests, total), nil
+}
+
+var likeEscaper = strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`)
+
+func whereClause(conditions []string) string {
+	if len(conditions) == 0 {
+		return ""
+	}
+	return " WHERE " + strings.Join(conditions, " AND ")
+}
+
+// translateFilter turns the column predicates of a mongo-style filter into a SQL where clause.
+// Predicates that can not be expressed in SQL are returned as a residual filter that is
+// evaluated against the decoded documents
+func (s *SQLService) translateFilter(filter interface{}) (string, []interface{}, bson.M, error) {
+	f, err := toM(filter)
+	if err != nil {
+		return "", nil, nil, err
+	}
+	clauses, args, residual := translateConditions(f)
+	return whereClause(clauses), args, residual, nil
+}
+
+// translateConditions translates the conditions of a filter document, returning the residual ones
+func translateConditions(f bson.M) ([]string, []interface{}, bson.M) {
+	clauses := []string{}
+	args := []interface{}{}
+	residual := bson.M{}
+	for key, cond := range f {
+		if key == "$or" {
+			clause, clauseArgs, ok := orPredicate(cond)
+			if !ok {
+				residual[key] = cond
+				continue
+			}
+			clauses = append(clauses, clause)
+			args = append(args, clauseArgs...)
+			continue
+		}
+		column, ok := requestColumns[key]
+		if !ok {
+			residual[key] = cond
+			continue
+		}
+		clause, clauseArgs, ok := columnPredicate(column, cond)
+		if !ok {
+			residual[key] = cond
+			continue
+		}
+		clauses = append(clauses, clause)
+		args = append(args, clauseArgs...)
+	}
+	return clauses, args, residual
+}
+
+// orPredicate translates a $or condition when every branch can be fully expressed in SQL
+func orPredicate(cond interface{}) (string, []interface{}, bool) {
+	branches, ok := toSlice(cond)
+	if !ok || len(branches) == 0 {
+		return "", nil, false
+	}
+	clauses := make([]string, 0, len(branches))
+	args := []interface{}{}
+	for _, branch := range branches {
+		f, err := toM(branch)
+		if err != nil {
+			return "", nil, false
+		}
+		branchClauses, branchArgs, residual := translateConditions(f)
+		if len(residual) > 0 {
+			return "", nil, false
+		}
+		if len(branchClauses) == 0 {
+			// An empty branch matches every request
+			branchClauses = []string{"1 = 1"}
+		}
+		clauses = append(clauses, "("+strings.Join(branchClauses, " AND ")+")")
+		args = append(args, branchArgs...)
+	}
+	return "(" + strings.Join(clauses, " OR ") + ")", args, true
+}
+
+// columnPredicate translates a condition on a single column when possible
+func columnPredicate(column string, cond interface{}) (string, []interface{}, bool) {
+	if !isOperatorDocument(cond) {
+		v, ok := columnValue(cond)
+		if !ok {
+			return "", nil, false
+		}
+		return column + " = ?", []interface{}{v}, true
+	}
+	ops, _ := toM(cond)
+	clauses := []string{}
+	args := []interface{}{}
+	for op, arg := range ops {
+		switch op {
+		case "$eq", "$ne", "$gt", "$gte", "$lt", "$lte":
+			v, ok := columnValue(arg)
+			if !ok {
+				return "", nil, false
+			}
+			operator := map[string]string{"$eq": "=", "$ne": "<>", "$gt": ">", "$gte": ">=", "$lt": "<", "$lte": "<="}[op]
+			clauses = append(clauses, column+" "+operator+" ?")
+			args = append(args, v)
+		case "$in", "$nin":
+			candidates, ok := toSlice(arg)
+			if !ok {
+				return "", nil, false
+			}
+			if len(candidates) == 0 {
+				if op == "$in" {
+					clauses = append(clauses, "1 = 0")
+				}
+				continue
+			}
+			placeholders := make([]string, len(candidates))
+			for i, c := range candidates {
+				v, ok := columnValue(c)
+				if !ok {
+					return "", nil, false
+				}
+				placeholders[i] = "?"
+				args = append(args, v)
+			}
+			operator := "IN"
+			if op == "$nin" {
+				operator = "NOT IN"
+			}
+			clauses = append(clauses, column+" "+operator+" ("+strings.Join(placeholders, ", ")+")")
+		default:
+			return "", nil, false
+		}
+	}
+	return strings.Join(clauses, " AND "), args, true
+}
+
+// columnValue converts a filter literal into the value stored in the column
+func columnValue(v interface{}) (interface{}, bool) {
+	switch t := normalize(v).(type) {
+	case string:
+		return t, true
+	case time.Time:
+		return t.UnixNano(), true
+	}
+	return nil, false
+}
+
+// decodeDocument parses a stored JSON document into both the typed request and
+// its bson representation that filters are evaluated against
+func decodeDocument(document string) (types.WhitelistRequest, bson.M, error) {
+	var request types.WhitelistRequest
+	if err := json.Unmarshal([]byte(document), &request); err != nil {
+		return types.WhitelistRequest{}, nil, err
+	}
+	doc, err := toDocument(request)
+	return request, doc, err
+}
+
+func toDocument(request types.WhitelistRequest) (bson.M, error) {
+	raw, err := bson.Marshal(request)
+	if err != nil {
+		return nil, err
+	}
+	doc := bson.M{}
+	err = bson.Unmarshal(raw, &doc)
+	return doc, err
+}
+
+func (s *SQLService) insertOutbox(db execer, outbox []OutboxEntry) error {
+	for _, entry := range outbox {
+		document, err := json.Marshal(entry)
+		if err != nil {
+			return err
+		}
+		_, err = db.Exec(s.rebind("INSERT INTO outbox (id, created_at, published_at, document) VALUES (?, ?, 0, ?)"),
+			entry.ID.Hex(), entry.CreatedAt.UnixNano(), string(document))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// PendingOutbox returns up to limit entries that were not published yet, oldest first
+func (s *SQLService) PendingOutbox(limit int64) ([]OutboxEntry, error) {
+	rows, err := s.db.Query(s.rebind("SELECT document FROM outbox WHERE published_at = 0 ORDER BY created_at LIMIT ?"), limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	entries := make([]OutboxEntry, 0)
+	for rows.Next() {
+		var document string
+		if err := rows.Scan(&document); err != nil {
+			return nil, err
+		}
+		var entry OutboxEntry
+		if err := json.Unmarshal([]byte(document), &entry); err != nil {
+			return nil, err
+		}
+		entries = append(entries, entry)
+	}
+	return entries, rows.Err()
+}
+
+// MarkOutboxPublished records that the entry was published to the task queue
+func (s *SQLService) MarkOutboxPublished(id primitive.ObjectID, publishedAt time.Time) error {
+	return s.updateOutbox(id, func(entry *OutboxEntry) {
+		entry.PublishedAt = publishedAt
+	})
+}
+
+// MarkOutboxFailed records a failed attempt to publish the entry
+func (s *SQLService) MarkOutboxFailed(id primitive.ObjectID, reason string) error {
+	return s.updateOutbox(id, func(entry *OutboxEntry) {
+		entry.Attempts++
+		entry.LastError = reason
+	})
+}
+
+func (s *SQLService) updateOutbox(id primitive.ObjectID, update func(entry *OutboxEntry)) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	var document string
+	err = tx.QueryRow(s.rebind("SELECT document FROM outbox WHERE id = ?"), id.Hex()).Scan(&document)
+	if err == sql.ErrNoRows {
+		return ErrNotFound
+	} else if err != nil {
+		return err
+	}
+	var entry OutboxEntry
+	if err = json.Unmarshal([]byte(document), &entry); err != nil {
+		return err
+	}
+	update(&entry)
+	updated, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	var publishedAt int64
+	if !entry.PublishedAt.IsZero() {
+		publishedAt = entry.PublishedAt.UnixNano()
+	}
+	_, err = tx.Exec(s.rebind("UPDATE outbox SET published_at = ?, document = ? WHERE id = ?"), publishedAt, string(updated), id.Hex())
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// DeletePublishedOutbox removes the entries published before the given time
+func (s *SQLService) DeletePublishedOutbox(before time.Time) (int64, error) {
+	result, err := s.db.Exec(s.rebind("DELETE FROM outbox WHERE published_at > 0 AND published_at < ?"), before.UnixNano())
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
+
+// DeleteRequestOutbox removes every entry of the request, published or not. The request of an entry is
+// only stored in its document, which is scanned. The outbox only holds the entries of about a day
+func (s *SQLService) DeleteRequestOutbox(requestID primitive.ObjectID) (int64, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+	rows, err := tx.Query("SELECT document FROM outbox")
+	if err != nil {
+		return 0, err
+	}
+	ids := []string{}
+	for rows.Next() {
+		var document string
+		if err := rows.Scan(&document); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		var entry OutboxEntry
+		if err := json.Unmarshal([]byte(document), &entry); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		if entry.Request.ID == requestID {
+			ids = append(ids, entry.ID.Hex())
+		}
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return 0, err
+	}
+	// Rows are deleted after the query is closed as sqlite only has a single connection
+	for _, id := range ids {
+		if _, err = tx.Exec(s.rebind("DELETE FROM outbox WHERE id = ?"), id); err != nil {
+			return 0, err
+		}
+	}
+	return int64(len(ids)), tx.Commit()
+}
+
+// TaskRecord returns the record of the task with the given key. Tasks without a record get an empty one
+func (s *SQLService) TaskRecord(key string) (TaskRecord, error) {
+	return s.scanTaskRecord(s.db.QueryRow(s.rebind("SELECT created_at, completed_at, effects FROM task_ledger WHERE task_key = ?"), key), key)
+}
+
+func (s *SQLService) scanTaskRecord(row *sql.Row, key string) (TaskRecord, error) {
+	record := TaskRecord{Key: key}
+	var createdAt, completedAt int64
+	var effects string
+	err := row.Scan(&createdAt, &completedAt, &effects)
+	if err == sql.ErrNoRows {
+		return record, nil
+	} else if err != nil {
+		return record, err
+	}
+	if err = json.Unmarshal([]byte(effects), &record.Effects); err != nil {
+		return record, err
+	}
+	record.CreatedAt = time.Unix(0, createdAt)
+	if completedAt > 0 {
+		record.CompletedAt = time.Unix(0, completedAt)
+	}
+	return record, nil
+}
+
+// RecordTaskEffect records that a side effect of the task took place
+func (s *SQLService) RecordTaskEffect(key, effect string) error {
+	return s.updateTaskRecord(key, func(record *TaskRecord) {
+		if !record.Done(effect) {
+			record.Effects = append(record.Effects, effect)
+		}
+	})
+}
+
+// CompleteTask records that the task was fully processed
+func (s *SQLService) CompleteTask(key string, completedAt time.Time) error {
+	return s.updateTaskRecord(key, func(record *TaskRecord) {
+		record.CompletedAt = completedAt
+	})
+}
+
+// updateTaskRecord changes the record of the task, creating it first if needed. The row is
+// created and locked before it is read, so concurrent updates of the same task do not get lost
+func (s *SQLService) updateTaskRecord(key string, update func(record *TaskRecord)) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	_, err = tx.Exec(s.rebind(`INSERT INTO task_ledger (task_key, created_at, completed_at, effects) VALUES (?, ?, 0, '[]')
+		ON CONFLICT (task_key) DO NOTHING`), key, time.Now().UnixNano())
+	if err != nil {
+		return err
+	}
+	query := "SELECT created_at, completed_at, effects FROM task_ledger WHERE task_key = ?"
+	if s.driver == "postgres" {
+		query += " FOR UPDATE"
+	}
+	record, err := s.scanTaskRecord(tx.QueryRow(s.rebind(query), key), key)
+	if err != nil {
+		return err
+	}
+	update(&record)
+	effects, err := json.Marshal(record.Effects)
+	if err != nil {
+		return err
+	}
+	var completedAt int64
+	if record.Completed() {
+		completedAt = record.CompletedAt.UnixNano()
+	}
+	_, err = tx.Exec(s.rebind("UPDATE task_ledger SET completed_at = ?, effects = ? WHERE task_key = ?"),
+		completedAt, string(effects), key)
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// DeleteTaskRecords removes the records created before the given time
+func (s *SQLService) DeleteTaskRecords(before time.Time) (int64, error) {
+	result, err := s.db.Exec(s.rebind("DELETE FROM task_ledger WHERE created_at < ?"), before.UnixNano())
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
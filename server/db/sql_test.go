@@ -0,0 +1,423 @@
+package db_test
+
+import (
+	"database/sql"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/tywin1104/mc-gatekeeper/db"
+	"github.com/tywin1104/mc-gatekeeper/db/dbtest"
+	"github.com/tywin1104/mc-gatekeeper/types"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+func TestSQLCreateAndGetRequest(t *testing.T) {
+	store := dbtest.NewSQLite(t)
+	defer store.Close()
+	id, err := store.CreateRequest(types.WhitelistRequest{
+		Username: "user1",
+		Email:    "user1@gmail.com",
+		Age:      19,
+		Gender:   "female",
+		Status:   "Approved",
+		Info:     map[string]interface{}{"applicationText": "I'd like to join the server"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	requests, err := store.GetRequests(1, bson.D{{Key: "_id", Value: id}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(requests) != 1 {
+		t.Fatalf("Expect to get 1 request, but got %d", len(requests))
+	}
+	// New requests always start as pending regardless of the given status
+	if requests[0].Status != "Pending" || requests[0].Username != "user1" {
+		t.Errorf("Unexpected request stored: %+v", requests[0])
+	}
+	if requests[0].Info["applicationText"] != "I'd like to join the server" {
+		t.Error("Application info was not stored")
+	}
+}
+
+func TestSQLGetRequestsFilter(t *testing.T) {
+	store := dbtest.NewSQLite(t)
+	defer store.Close()
+	for _, username := range []string{"user1", "user2", "user3"} {
+		if _, err := store.CreateRequest(types.WhitelistRequest{Username: username, Email: username + "@gmail.com", Age: 20}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	_, err := store.UpdateRequest(bson.M{"username": "user2"}, bson.M{"$set": bson.M{"status": "Approved"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	requests, err := store.GetRequests(-1, bson.D{{}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(requests) != 3 {
+		t.Errorf("Expect to get 3 requests, but got %d", len(requests))
+	}
+	requests, err = store.GetRequests(-1, bson.M{
+		"username": "user2",
+		"status":   bson.M{"$in": []string{"Pending", "Approved", "Banned"}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(requests) != 1 || requests[0].Status != "Approved" {
+		t.Errorf("Expect to find the approved request for user2, got %+v", requests)
+	}
+	// Filters on fields that are not stored as columns are evaluated on the documents
+	requests, err = store.GetRequests(-1, bson.M{"age": bson.M{"$gte": 20}, "timestamp": bson.M{"$lte": time.Now()}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(requests) != 3 {
+		t.Errorf("Expect to get 3 requests, but got %d", len(requests))
+	}
+	// Applications are matched by the username or the username hash of anonymised requests
+	_, err = store.UpdateRequest(bson.M{"username": "user3"}, bson.M{"$set": bson.M{"username": "", "usernameHash": "hash3"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	requests, err = store.GetRequests(-1, bson.M{
+		"$or": []bson.M{
+			{"username": "user1"},
+			{"usernameHash": bson.M{"$in": []string{"hash3"}}},
+		},
+		"status": bson.M{"$in": []string{"Pending", "Approved", "Banned"}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(requests) != 2 {
+		t.Errorf("Expect to find the requests of user1 and the anonymised user3, got %+v", requests)
+	}
+	// Branches with conditions on other fields are evaluated on the documents
+	requests, err = store.GetRequests(-1, bson.M{"$or": []bson.M{{"username": "user1"}, {"age": bson.M{"$lt": 20}}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(requests) != 1 || requests[0].Username != "user1" {
+		t.Errorf("Expect to find the request of user1, got %+v", requests)
+	}
+
+	deleted, err := store.DeleteRequests(bson.M{"status": "Pending", "age": 20})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if deleted != 2 {
+		t.Errorf("Expect to delete the 2 pending requests, deleted %d", deleted)
+	}
+	requests, err = store.GetRequests(-1, bson.D{{}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(requests) != 1 || requests[0].Username != "user2" {
+		t.Errorf("Expect only the approved request to be left, got %+v", requests)
+	}
+}
+
+func TestSQLUpdateRequest(t *testing.T) {
+	store := dbtest.NewSQLite(t)
+	defer store.Close()
+	id, err := store.CreateRequest(types.WhitelistRequest{Username: "user1", Email: "user1@gmail.com"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	updated, err := store.UpdateRequest(bson.D{{Key: "_id", Value: id}}, bson.M{
+		"$set": bson.M{"status": "Denied", "admin": "op1@gmail.com", "assignees": []string{"op1@gmail.com"}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if updated["status"] != "Denied" || updated["admin"] != "op1@gmail.com" {
+		t.Errorf("Unexpected updated document: %v", updated)
+	}
+	requests, err := store.GetRequests(-1, bson.M{"assignees": "op1@gmail.com"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(requests) != 1 || requests[0].Status != "Denied" {
+		t.Errorf("Update was not persisted: %+v", requests)
+	}
+
+	_, err = store.UpdateRequest(bson.M{"username": "unknown"}, bson.M{"$set": bson.M{"status": "Approved"}})
+	if err != db.ErrNotFound {
+		t.Errorf("Expect ErrNotFound for unmatched update, got %v", err)
+	}
+}
+
+func TestSQLQueryRequests(t *testing.T) {
+	store := dbtest.NewSQLite(t)
+	defer store.Close()
+	for _, username := range []string{"alice", "bob", "carol", "dave", "erin"} {
+		if _, err := store.CreateRequest(types.WhitelistRequest{Username: username, Email: username + "@gmail.com"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := store.UpdateRequest(bson.M{"username": "bob"}, bson.M{"$set": bson.M{"status": "Approved", "admin": "op1@gmail.com"}}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Page based pagination sorted by username
+	page, err := store.QueryRequests(db.RequestQuery{SortBy: "username", Ascending: true, Page: 2, PageSize: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if page.Total != 5 || len(page.Requests) != 2 || page.Requests[0].Username != "carol" {
+		t.Errorf("Unexpected second page: %+v", page)
+	}
+
+	// Cursor based pagination walks every request exactly once
+	seen := []string{}
+	query := db.RequestQuery{SortBy: "username", PageSize: 2}
+	for {
+		page, err := store.QueryRequests(query)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, request := range page.Requests {
+			seen = append(seen, request.Username)
+		}
+		if page.NextCursor == "" {
+			break
+		}
+		query.Cursor = page.NextCursor
+	}
+	if len(seen) != 5 || seen[0] != "erin" || seen[4] != "alice" {
+		t.Errorf("Unexpected cursor traversal: %v", seen)
+	}
+
+	// Filters and free-text search
+	page, err = store.QueryRequests(db.RequestQuery{Statuses: []string{"Approved"}, Admin: "op1@gmail.com"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if page.Total != 1 || page.Requests[0].Username != "bob" {
+		t.Errorf("Unexpected filtered page: %+v", page)
+	}
+	page, err = store.QueryRequests(db.RequestQuery{Search: "ARO"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if page.Total != 1 || page.Requests[0].Username != "carol" {
+		t.Errorf("Unexpected search result: %+v", page)
+	}
+
+	_, err = store.QueryRequests(db.RequestQuery{Cursor: "not-a-cursor"})
+	if err != db.ErrInvalidCursor {
+		t.Errorf("Expect ErrInvalidCursor, got %v", err)
+	}
+}
+
+func TestSQLConditionalUpdate(t *testing.T) {
+	store := dbtest.NewSQLite(t)
+	defer store.Close()
+	id, err := store.CreateRequest(types.WhitelistRequest{Username: "user1", Email: "user1@gmail.com"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	filter := bson.M{"_id": id, "version": int64(0)}
+	update := bson.M{"$set": bson.M{"status": "Approved"}, "$inc": bson.M{"version": 1}}
+	updated, err := store.UpdateRequest(filter, update)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if updated["version"] != int64(1) {
+		t.Errorf("Expect version to be incremented, got %v", updated["version"])
+	}
+	// A second decision based on the stale version must not apply
+	_, err = store.UpdateRequest(filter, bson.M{"$set": bson.M{"status": "Denied"}, "$inc": bson.M{"version": 1}})
+	if err != db.ErrNotFound {
+		t.Errorf("Expect ErrNotFound for stale version, got %v", err)
+	}
+	requests, err := store.GetRequests(1, bson.M{"_id": id})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if requests[0].Status != "Approved" || requests[0].Version != 1 {
+		t.Errorf("Stale update was applied: %+v", requests[0])
+	}
+}
+
+func TestSQLMigrate(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gatekeeper")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "gatekeeper.db")
+
+	// Simulate a database created before migrations with a request that has no history
+	legacy, err := sql.Open("sqlite3", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = legacy.Exec(`CREATE TABLE requests (id TEXT PRIMARY KEY, username TEXT NOT NULL, email TEXT NOT NULL,
+		status TEXT NOT NULL, admin TEXT NOT NULL, timestamp BIGINT NOT NULL, document TEXT NOT NULL)`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = legacy.Exec(`INSERT INTO requests VALUES ('5db85dc33260c4c15c26e95b', 'user1', 'user1@gmail.com', 'Banned', 'op1@gmail.com', 0,
+		'{"_id":"5db85dc33260c4c15c26e95b","username":"user1","email":"user1@gmail.com","status":"Banned","admin":"op1@gmail.com"}')`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = legacy.Exec(`INSERT INTO requests VALUES ('5db85dc33260c4c15c26e95c', '', '', 'Banned', 'op1@gmail.com', 0,
+		'{"_id":"5db85dc33260c4c15c26e95c","usernameHash":"hash2","status":"Banned","admin":"op1@gmail.com"}')`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	legacy.Close()
+
+	store, err := db.NewSQLService("sqlite3", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	applied, err := store.Migrate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(applied) != 6 {
+		t.Errorf("Expect 6 migrations to be applied, got %+v", applied)
+	}
+	requests, err := store.GetRequests(-1, bson.M{"username": "user1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	history := requests[0].History
+	if len(history) != 3 || history[1].NewStatus != "Approved" || history[2].NewStatus != "Banned" {
+		t.Errorf("Unexpected backfilled history: %+v", history)
+	}
+	// The username hash of anonymised requests is copied into its column
+	requests, err = store.GetRequests(-1, bson.M{"usernameHash": "hash2"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(requests) != 1 {
+		t.Errorf("Expect to find the anonymised request by its username hash, got %+v", requests)
+	}
+
+	// Applied migrations are recorded and not run again
+	applied, err = store.Migrate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(applied) != 0 {
+		t.Errorf("Expect no migrations to be applied again, got %+v", applied)
+	}
+	recorded, err := store.AppliedMigrations()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(recorded) != 6 || recorded[0].Version != 1 {
+		t.Errorf("Unexpected recorded migrations: %+v", recorded)
+	}
+}
+
+func TestSQLOutbox(t *testing.T) {
+	store := dbtest.NewSQLite(t)
+	defer store.Close()
+	id, err := store.CreateRequest(types.WhitelistRequest{Username: "user1"}, db.NewOutboxEntry("request.new"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = store.UpdateRequest(bson.M{"_id": id}, bson.M{"$set": bson.M{"status": "Approved"}}, db.NewOutboxEntry("request.approve"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// A failed update must not leave an outbox entry behind
+	_, err = store.UpdateRequest(bson.M{"username": "unknown"}, bson.M{"$set": bson.M{"status": "Denied"}}, db.NewOutboxEntry("request.deny"))
+	if err != db.ErrNotFound {
+		t.Fatalf("Expect ErrNotFound, got %v", err)
+	}
+
+	pending, err := store.PendingOutbox(10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(pending) != 2 || pending[0].TaskType != "request.new" || pending[1].TaskType != "request.approve" {
+		t.Fatalf("Expect the new request and the approval task in order, got %+v", pending)
+	}
+	// Entries carry the snapshot of the request after the change
+	if pending[0].Request.ID != id || pending[0].Request.Status != "Pending" || pending[1].Request.Status != "Approved" {
+		t.Errorf("Unexpected request snapshots %+v and %+v", pending[0].Request, pending[1].Request)
+	}
+
+	if err := store.MarkOutboxFailed(pending[0].ID, "broker unavailable"); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.MarkOutboxPublished(pending[1].ID, time.Now().Add(-time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	pending, _ = store.PendingOutbox(10)
+	if len(pending) != 1 || pending[0].Attempts != 1 || pending[0].LastError != "broker unavailable" {
+		t.Fatalf("Expect only the failed entry to be pending, got %+v", pending)
+	}
+	deleted, err := store.DeletePublishedOutbox(time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if deleted != 1 {
+		t.Errorf("Expect the published entry to be deleted, got %d", deleted)
+	}
+
+	if _, err = store.CreateRequest(types.WhitelistRequest{Username: "other"}, db.NewOutboxEntry("request.new")); err != nil {
+		t.Fatal(err)
+	}
+	deleted, err = store.DeleteRequestOutbox(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pending, _ = store.PendingOutbox(10)
+	if deleted != 1 || len(pending) != 1 || pending[0].Request.Username != "other" {
+		t.Errorf("Expect only the entry of the request to be deleted, got %d deleted and %+v pending", deleted, pending)
+	}
+}
+
+func TestSQLTaskLedger(t *testing.T) {
+	store := dbtest.NewSQLite(t)
+	defer store.Close()
+	record, err := store.TaskRecord("request.approve:1:2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if record.Key != "request.approve:1:2" || record.Completed() || record.Done("rcon") {
+		t.Fatalf("Expect an empty record for an unknown task, got %+v", record)
+	}
+
+	// Recording the same effect twice keeps it once
+	for _, effect := range []string{"rcon", "rcon", "email.decision"} {
+		if err := store.RecordTaskEffect("request.approve:1:2", effect); err != nil {
+			t.Fatal(err)
+		}
+	}
+	record, _ = store.TaskRecord("request.approve:1:2")
+	if len(record.Effects) != 2 || !record.Done("rcon") || !record.Done("email.decision") || record.Completed() {
+		t.Fatalf("Unexpected record %+v", record)
+	}
+	if err := store.CompleteTask("request.approve:1:2", time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	record, _ = store.TaskRecord("request.approve:1:2")
+	if !record.Completed() || len(record.Effects) != 2 {
+		t.Errorf("Expect the task to be completed with its effects, got %+v", record)
+	}
+
+	deleted, err := store.DeleteTaskRecords(time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if deleted != 1 {
+		t.Errorf("Expect the record to be deleted, got %d", deleted)
+	}
+}
@@ -0,0 +1,41 @@
+package db
+
+import (
+	"errors"
+
+	"github.com/tywin1104/mc-gatekeeper/types"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// ErrNotFound is returned when an update does not match any stored request
+var ErrNotFound = errors.New("Request not found")
+
+// RequestStore represents the persistence layer for whitelist requests.
+// Filters and updates are expressed as mongo-style documents (bson.M / bson.D)
+// so that every backend accepts the same queries from handlers and the worker
+type RequestStore interface {
+	OutboxStore
+	TaskLedger
+	// CreateRequest stores a new pending request and returns its generated ID.
+	// The outbox entries are stored in the same transaction
+	CreateRequest(newRequest types.WhitelistRequest, outbox ...OutboxEntry) (primitive.ObjectID, error)
+	// ImportRequest stores a request as given, keeping its status and history
+	ImportRequest(request types.WhitelistRequest) (primitive.ObjectID, error)
+	// GetRequests returns requests matching the filter, newest first.
+	// A limit that is not positive returns every matching request
+	GetRequests(limit int64, filter interface{}) ([]types.WhitelistRequest, error)
+	// UpdateRequest applies the update to the request matching the filter
+	// and returns the updated document. The outbox entries are stored in the same transaction
+	UpdateRequest(filter, update interface{}, outbox ...OutboxEntry) (bson.M, error)
+	// DeleteRequests permanently removes every request matching the filter and returns how many were removed
+	DeleteRequests(filter interface{}) (int64, error)
+	// QueryRequests returns one page of requests matching the query along with the total count
+	QueryRequests(query RequestQuery) (RequestPage, error)
+	// Migrate applies the pending migrations and returns the ones that were applied
+	Migrate() ([]MigrationRecord, error)
+	// AppliedMigrations returns the migrations recorded in the database
+	AppliedMigrations() ([]MigrationRecord, error)
+	// Close the connection to the database
+	Close() error
+}
@@ -0,0 +1,216 @@
+package expiry
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/spf13/viper"
+	"github.com/tywin1104/mc-gatekeeper/broker"
+	"github.com/tywin1104/mc-gatekeeper/db"
+	"github.com/tywin1104/mc-gatekeeper/types"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// Actor recorded in the history of requests deactivated by the scheduler
+const Actor = "system"
+
+// Defaults used when expiry.warningBefore or expiry.interval are not configured
+const (
+	defaultWarningBefore = 72 * time.Hour
+	defaultInterval      = time.Minute
+)
+
+// Report lists the requests the scheduler acted on in one run
+type Report struct {
+	Expired  []string `json:"expired"`
+	Warned   []string `json:"warned"`
+	Unbanned []string `json:"unbanned"`
+}
+
+// ParseDuration parses a duration that is either given in days such as "30d"
+// or in the format understood by time.ParseDuration
+func ParseDuration(s string) (time.Duration, error) {
+	var d time.Duration
+	if days := strings.TrimSuffix(s, "d"); days != s {
+		n, err := strconv.Atoi(days)
+		if err != nil {
+			return 0, fmt.Errorf("invalid duration %q", s)
+		}
+		d = time.Duration(n) * 24 * time.Hour
+	} else {
+		var err error
+		if d, err = time.ParseDuration(s); err != nil {
+			return 0, fmt.Errorf("invalid duration %q", s)
+		}
+	}
+	if d <= 0 {
+		return 0, fmt.Errorf("duration %q must be positive", s)
+	}
+	return d, nil
+}
+
+// WarningBefore returns how long before the expiry the player is warned. Zero disables the warning
+func WarningBefore() time.Duration {
+	if !viper.IsSet("expiry.warningBefore") {
+		return defaultWarningBefore
+	}
+	return viper.GetDuration("expiry.warningBefore")
+}
+
+// Interval returns how often the scheduler checks for expired memberships
+func Interval() time.Duration {
+	if interval := viper.GetDuration("expiry.interval"); interval > 0 {
+		return interval
+	}
+	return defaultInterval
+}
+
+// RestoreWhitelist returns whether players whose temporary ban was lifted are whitelisted again
+// when they were approved before the ban. Otherwise they are deactivated
+func RestoreWhitelist() bool {
+	return viper.GetBool("bans.restoreWhitelist")
+}
+
+// Run deactivates the approved requests whose membership expired, lifts the temporary bans
+// that ran out and warns the players whose membership expires within WarningBefore. The work
+// is done by the worker through the tasks stored in the outbox along with each change
+func Run(store db.RequestStore, now time.Time) (Report, error) {
+	report := Report{Expired: []string{}, Warned: []string{}, Unbanned: []string{}}
+	bans, err := store.GetRequests(-1, bson.M{
+		"status":      types.StatusBanned,
+		"bannedUntil": bson.M{"$gt": time.Time{}, "$lte": now},
+	})
+	if err != nil {
+		return report, err
+	}
+	for _, request := range bans {
+		ok, err := unban(store, request, now)
+		if err != nil {
+			return report, err
+		}
+		if ok {
+			report.Unbanned = append(report.Unbanned, request.ID.Hex())
+		}
+	}
+
+	expired, err := store.GetRequests(-1, bson.M{
+		"status":    types.StatusApproved,
+		"expiresAt": bson.M{"$gt": time.Time{}, "$lte": now},
+	})
+	if err != nil {
+		return report, err
+	}
+	for _, request := range expired {
+		ok, err := expire(store, request, now)
+		if err != nil {
+			return report, err
+		}
+		if ok {
+			report.Expired = append(report.Expired, request.ID.Hex())
+		}
+	}
+
+	warningBefore := WarningBefore()
+	if warningBefore <= 0 {
+		return report, nil
+	}
+	expiring, err := store.GetRequests(-1, bson.M{
+		"status":    types.StatusApproved,
+		"expiresAt": bson.M{"$gt": now, "$lte": now.Add(warningBefore)},
+	})
+	if err != nil {
+		return report, err
+	}
+	for _, request := range expiring {
+		if !request.ExpiryWarnedAt.IsZero() {
+			continue
+		}
+		ok, err := warn(store, request, now)
+		if err != nil {
+			return report, err
+		}
+		if ok {
+			report.Warned = append(report.Warned, request.ID.Hex())
+		}
+	}
+	return report, nil
+}
+
+// expire deactivates the request unless it was changed since it was read
+func expire(store db.RequestStore, request types.WhitelistRequest, now time.Time) (bool, error) {
+	_, err := store.UpdateRequest(bson.M{
+		"_id":     request.ID,
+		"status":  types.StatusApproved,
+		"version": request.Version,
+	}, bson.M{
+		"$set": bson.M{
+			"status":               types.StatusDeactivated,
+			"lastUpdatedTimestamp": now,
+		},
+		"$push": bson.M{"history": types.StatusChange{
+			Actor:     Actor,
+			OldStatus: types.StatusApproved,
+			NewStatus: types.StatusDeactivated,
+			Note:      "Membership expired",
+			Source:    types.SourceExpiry,
+			Timestamp: now,
+		}},
+		"$inc": bson.M{"version": 1},
+	}, db.NewOutboxEntry(broker.TaskDeactivation))
+	if err == db.ErrNotFound {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// unban lifts the ban unless the request was changed since it was read
+func unban(store db.RequestStore, request types.WhitelistRequest, now time.Time) (bool, error) {
+	newStatus := types.StatusDeactivated
+	if RestoreWhitelist() && request.StatusBeforeBan == types.StatusApproved {
+		newStatus = types.StatusApproved
+	}
+	_, err := store.UpdateRequest(bson.M{
+		"_id":     request.ID,
+		"status":  types.StatusBanned,
+		"version": request.Version,
+	}, bson.M{
+		"$set": bson.M{
+			"status":               newStatus,
+			"lastUpdatedTimestamp": now,
+			"banReason":            "",
+			"bannedUntil":          time.Time{},
+			"statusBeforeBan":      "",
+		},
+		"$push": bson.M{"history": types.StatusChange{
+			Actor:     Actor,
+			OldStatus: types.StatusBanned,
+			NewStatus: newStatus,
+			Note:      "Ban expired",
+			Source:    types.SourceExpiry,
+			Timestamp: now,
+		}},
+		"$inc": bson.M{"version": 1},
+	}, db.NewOutboxEntry(broker.TaskUnban))
+	if err == db.ErrNotFound {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// warn records the warning and stores the task that emails the player.
+// The version is not incremented so that ops deciding at the same time are not interrupted
+func warn(store db.RequestStore, request types.WhitelistRequest, now time.Time) (bool, error) {
+	_, err := store.UpdateRequest(bson.M{
+		"_id":     request.ID,
+		"status":  types.StatusApproved,
+		"version": request.Version,
+	}, bson.M{
+		"$set": bson.M{"expiryWarnedAt": now},
+	}, db.NewOutboxEntry(broker.TaskExpiryWarning))
+	if err == db.ErrNotFound {
+		return false, nil
+	}
+	return err == nil, err
+}
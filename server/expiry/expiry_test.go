@@ -0,0 +1,155 @@
+package expiry_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/spf13/viper"
+	"github.com/tywin1104/mc-gatekeeper/broker"
+	"github.com/tywin1104/mc-gatekeeper/db"
+	"github.com/tywin1104/mc-gatekeeper/db/dbtest"
+	"github.com/tywin1104/mc-gatekeeper/expiry"
+	"github.com/tywin1104/mc-gatekeeper/types"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// approve stores an approved request that expires at the given time
+func approve(t *testing.T, store db.RequestStore, username string, expiresAt time.Time) {
+	id, err := store.CreateRequest(types.WhitelistRequest{Username: username, Email: username + "@gmail.com"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = store.UpdateRequest(bson.M{"_id": id}, bson.M{
+		"$set": bson.M{"status": types.StatusApproved, "expiresAt": expiresAt},
+		"$inc": bson.M{"version": 1},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestParseDuration(t *testing.T) {
+	for input, want := range map[string]time.Duration{
+		"30d": 30 * 24 * time.Hour,
+		"72h": 72 * time.Hour,
+	} {
+		if got, err := expiry.ParseDuration(input); err != nil || got != want {
+			t.Errorf("Expect %s to be %s, got %s (%v)", input, want, got, err)
+		}
+	}
+	for _, invalid := range []string{"", "soon", "-1d", "0h"} {
+		if _, err := expiry.ParseDuration(invalid); err == nil {
+			t.Errorf("Expect %q to be rejected", invalid)
+		}
+	}
+}
+
+func TestRun(t *testing.T) {
+	viper.Set("expiry.warningBefore", "72h")
+	defer viper.Set("expiry.warningBefore", nil)
+	store := dbtest.NewSQLite(t)
+	defer store.Close()
+	now := time.Now()
+	approve(t, store, "expired", now.Add(-time.Minute))
+	approve(t, store, "expiring", now.Add(24*time.Hour))
+	approve(t, store, "later", now.Add(30*24*time.Hour))
+	approve(t, store, "permanent", time.Time{})
+
+	report, err := expiry.Run(store, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(report.Expired) != 1 || len(report.Warned) != 1 {
+		t.Fatalf("Expect one expired and one warned request, got %+v", report)
+	}
+	expired, _ := store.GetRequests(1, bson.M{"username": "expired"})
+	history := expired[0].History
+	if expired[0].Status != types.StatusDeactivated || history[len(history)-1].Source != types.SourceExpiry {
+		t.Errorf("Expect the expired request to be deactivated by the scheduler, got %+v", expired[0])
+	}
+	expiring, _ := store.GetRequests(1, bson.M{"username": "expiring"})
+	if expiring[0].Status != types.StatusApproved || expiring[0].ExpiryWarnedAt.IsZero() {
+		t.Errorf("Expect the expiring request to be warned, got %+v", expiring[0])
+	}
+
+	// Both changes come with their task for the worker
+	pending, err := store.PendingOutbox(10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(pending) != 2 || pending[0].TaskType != broker.TaskDeactivation || pending[1].TaskType != broker.TaskExpiryWarning {
+		t.Errorf("Expect a deactivation and an expiry warning task, got %+v", pending)
+	}
+
+	// Players are only warned once
+	report, err = expiry.Run(store, now.Add(time.Minute))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(report.Expired) != 0 || len(report.Warned) != 0 {
+		t.Errorf("Expect nothing to do on the second run, got %+v", report)
+	}
+}
+
+// ban stores a request banned until the given time
+func ban(t *testing.T, store db.RequestStore, username string, bannedUntil time.Time) {
+	approve(t, store, username, time.Time{})
+	_, err := store.UpdateRequest(bson.M{"username": username}, bson.M{
+		"$set": bson.M{
+			"status":          types.StatusBanned,
+			"banReason":       "griefing",
+			"bannedUntil":     bannedUntil,
+			"statusBeforeBan": types.StatusApproved,
+		},
+		"$inc": bson.M{"version": 1},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRunLiftsBans(t *testing.T) {
+	defer viper.Set("bans.restoreWhitelist", nil)
+	store := dbtest.NewSQLite(t)
+	defer store.Close()
+	now := time.Now()
+	ban(t, store, "lapsed", now.Add(-time.Minute))
+	ban(t, store, "serving", now.Add(time.Hour))
+	ban(t, store, "permanent", time.Time{})
+
+	// Players are deactivated unless their whitelist is restored
+	report, err := expiry.Run(store, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(report.Unbanned) != 1 {
+		t.Fatalf("Expect one ban to be lifted, got %+v", report)
+	}
+	lapsed, _ := store.GetRequests(1, bson.M{"username": "lapsed"})
+	if lapsed[0].Status != types.StatusDeactivated || !lapsed[0].BannedUntil.IsZero() || lapsed[0].BanReason != "" {
+		t.Errorf("Expect the lifted ban to deactivate the player and clear its terms, got %+v", lapsed[0])
+	}
+	for _, username := range []string{"serving", "permanent"} {
+		banned, _ := store.GetRequests(1, bson.M{"username": username})
+		if banned[0].Status != types.StatusBanned {
+			t.Errorf("Expect %s to stay banned, got %s", username, banned[0].Status)
+		}
+	}
+	pending, err := store.PendingOutbox(10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(pending) != 1 || pending[0].TaskType != broker.TaskUnban {
+		t.Errorf("Expect an unban task for the lifted ban, got %+v", pending)
+	}
+
+	viper.Set("bans.restoreWhitelist", true)
+	ban(t, store, "whitelisted", now.Add(-time.Minute))
+	if _, err = expiry.Run(store, now); err != nil {
+		t.Fatal(err)
+	}
+	whitelisted, _ := store.GetRequests(1, bson.M{"username": "whitelisted"})
+	if whitelisted[0].Status != types.StatusApproved {
+		t.Errorf("Expect the whitelist to be restored, got %s", whitelisted[0].Status)
+	}
+}
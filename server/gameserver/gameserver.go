@@ -0,0 +1,98 @@
+package gameserver
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/spf13/viper"
+)
+
+// DefaultName is the name of the game server configured through RCONServer, RCONPort and RCONPassword
+const DefaultName = "default"
+
+// Target is a game server whose whitelist is managed over RCON
+type Target struct {
+	Name     string `mapstructure:"name" json:"name"`
+	Host     string `mapstructure:"host" json:"host"`
+	Port     int    `mapstructure:"port" json:"port"`
+	Password string `mapstructure:"password" json:"-"`
+	// Group lets requests target several game servers at once, e.g. all servers behind one proxy
+	Group string `mapstructure:"group" json:"group,omitempty"`
+}
+
+// Targets returns the game servers configured in gameServers. Without gameServers the
+// single game server configured through RCONServer, RCONPort and RCONPassword is used
+func Targets() ([]Target, error) {
+	var targets []Target
+	if err := viper.UnmarshalKey("gameServers", &targets); err != nil {
+		return nil, fmt.Errorf("Invalid gameServers: %v", err)
+	}
+	if len(targets) == 0 {
+		return []Target{{
+			Name:     DefaultName,
+			Host:     viper.GetString("RCONServer"),
+			Port:     viper.GetInt("RCONPort"),
+			Password: viper.GetString("RCONPassword"),
+		}}, nil
+	}
+	names := map[string]bool{}
+	for _, target := range targets {
+		if target.Name == "" || target.Host == "" || target.Port <= 0 {
+			return nil, errors.New("Invalid gameServers. Every game server needs a name, host and port")
+		}
+		// Names are used as keys of the results stored with the request
+		if strings.ContainsAny(target.Name, ".$") {
+			return nil, fmt.Errorf("Invalid gameServers. Name %s can not contain . or $", target.Name)
+		}
+		if names[target.Name] {
+			return nil, fmt.Errorf("Invalid gameServers. Game server %s is configured twice", target.Name)
+		}
+		names[target.Name] = true
+	}
+	return targets, nil
+}
+
+// Resolve returns the game servers the names refer to. Names are names of game servers or groups.
+// Requests without names target all game servers. Names that are no longer configured are skipped
+func Resolve(names []string) ([]Target, error) {
+	targets, err := Targets()
+	if err != nil {
+		return nil, err
+	}
+	if len(names) == 0 {
+		return targets, nil
+	}
+	wanted := map[string]bool{}
+	for _, name := range names {
+		wanted[name] = true
+	}
+	resolved := []Target{}
+	for _, target := range targets {
+		if wanted[target.Name] || (target.Group != "" && wanted[target.Group]) {
+			resolved = append(resolved, target)
+		}
+	}
+	return resolved, nil
+}
+
+// Validate checks that every name refers to a configured game server or group
+func Validate(names []string) error {
+	targets, err := Targets()
+	if err != nil {
+		return err
+	}
+	known := map[string]bool{}
+	for _, target := range targets {
+		known[target.Name] = true
+		if target.Group != "" {
+			known[target.Group] = true
+		}
+	}
+	for _, name := range names {
+		if !known[name] {
+			return fmt.Errorf("Unknown game server %s", name)
+		}
+	}
+	return nil
+}
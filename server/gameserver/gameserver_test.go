@@ -0,0 +1,75 @@
+package gameserver_test
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/spf13/viper"
+	"github.com/tywin1104/mc-gatekeeper/gameserver"
+)
+
+func names(targets []gameserver.Target) []string {
+	out := []string{}
+	for _, target := range targets {
+		out = append(out, target.Name)
+	}
+	return out
+}
+
+func TestTargetsDefault(t *testing.T) {
+	viper.Set("RCONServer", "mc.example.com")
+	viper.Set("RCONPort", 25575)
+	defer viper.Set("RCONServer", nil)
+	defer viper.Set("RCONPort", nil)
+	targets, err := gameserver.Targets()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(targets) != 1 || targets[0].Name != gameserver.DefaultName || targets[0].Host != "mc.example.com" {
+		t.Errorf("Expect the RCON server to be the only target, got %+v", targets)
+	}
+}
+
+func TestResolve(t *testing.T) {
+	viper.Set("gameServers", []map[string]interface{}{
+		{"name": "survival", "host": "survival", "port": 25575, "password": "a", "group": "vanilla"},
+		{"name": "creative", "host": "creative", "port": 25575, "password": "b", "group": "vanilla"},
+		{"name": "modded", "host": "modded", "port": 25576, "password": "c"},
+	})
+	defer viper.Set("gameServers", nil)
+
+	for _, c := range []struct {
+		names []string
+		want  string
+	}{
+		{nil, "survival creative modded"},
+		{[]string{"vanilla"}, "survival creative"},
+		{[]string{"modded", "survival"}, "survival modded"},
+		{[]string{"removed"}, ""},
+	} {
+		targets, err := gameserver.Resolve(c.names)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := strings.Join(names(targets), " "); got != c.want {
+			t.Errorf("Expect %v to resolve to %q, got %v", c.names, c.want, got)
+		}
+	}
+	if err := gameserver.Validate([]string{"vanilla", "modded"}); err != nil {
+		t.Error(err)
+	}
+	if err := gameserver.Validate([]string{"lobby"}); err == nil {
+		t.Error("Expect unknown game servers to be rejected")
+	}
+}
+
+func TestTargetsInvalid(t *testing.T) {
+	viper.Set("gameServers", []map[string]interface{}{
+		{"name": "survival", "host": "survival", "port": 25575},
+		{"name": "survival", "host": "survival2", "port": 25575},
+	})
+	defer viper.Set("gameServers", nil)
+	if _, err := gameserver.Targets(); err == nil {
+		t.Error("Expect game servers with the same name to be rejected")
+	}
+}
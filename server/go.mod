@@ -13,7 +13,9 @@ require (
 	github.com/gomodule/redigo v2.0.0+incompatible
 	github.com/gorilla/context v1.1.1 // indirect
 	github.com/gorilla/mux v1.6.2
+	github.com/lib/pq v1.2.0
 	github.com/makiuchi-d/gozxing v0.0.0-20190830103442-eaff64b1ceb7
+	github.com/mattn/go-sqlite3 v1.11.0
 	github.com/prometheus/common v0.4.0
 	github.com/rs/cors v1.7.0
 	github.com/seeruk/minecraft-rcon v0.0.0-20190221212056-6ab996d90449
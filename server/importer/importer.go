@@ -0,0 +1,214 @@
+package importer
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/tywin1104/mc-gatekeeper/db"
+	"github.com/tywin1104/mc-gatekeeper/privacy"
+	"github.com/tywin1104/mc-gatekeeper/types"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// Names of the Minecraft server files that can be imported
+const (
+	WhitelistFile     = "whitelist.json"
+	BannedPlayersFile = "banned-players.json"
+	OpsFile           = "ops.json"
+)
+
+// Admin recorded on imported requests
+const importAdmin = "import"
+
+// Layout of the created field in banned-players.json
+const bannedTimeLayout = "2006-01-02 15:04:05 -0700"
+
+// ErrNothingToImport is returned when none of the server files contain players
+var ErrNothingToImport = errors.New("No players to import")
+
+// Player is an entry of whitelist.json or ops.json
+type Player struct {
+	UUID string `json:"uuid"`
+	Name string `json:"name"`
+}
+
+// BannedPlayer is an entry of banned-players.json
+type BannedPlayer struct {
+	Player
+	Created string `json:"created"`
+	Source  string `json:"source"`
+	Expires string `json:"expires"`
+	Reason  string `json:"reason"`
+}
+
+// Files holds the players listed in the files of a Minecraft server
+type Files struct {
+	Whitelist     []Player       `json:"whitelist"`
+	BannedPlayers []BannedPlayer `json:"bannedPlayers"`
+	Ops           []Player       `json:"ops"`
+	// Servers are the game servers the players are on. Empty for all game servers
+	Servers []string `json:"servers,omitempty"`
+}
+
+// PlayerResult is the outcome of importing one player
+type PlayerResult struct {
+	Name   string `json:"name"`
+	UUID   string `json:"uuid"`
+	Status string `json:"status,omitempty"`
+	Reason string `json:"reason,omitempty"`
+}
+
+// Report lists the players that were imported and the ones that were skipped
+type Report struct {
+	Imported []PlayerResult `json:"imported"`
+	Skipped  []PlayerResult `json:"skipped"`
+}
+
+// ReadDir reads the whitelist and banned players from the directory of a Minecraft server.
+// Missing files are treated as empty. Ops are only read if includeOps is set
+func ReadDir(dir string, includeOps bool) (Files, error) {
+	files := Files{}
+	if err := readFile(filepath.Join(dir, WhitelistFile), &files.Whitelist); err != nil {
+		return Files{}, err
+	}
+	if err := readFile(filepath.Join(dir, BannedPlayersFile), &files.BannedPlayers); err != nil {
+		return Files{}, err
+	}
+	if includeOps {
+		if err := readFile(filepath.Join(dir, OpsFile), &files.Ops); err != nil {
+			return Files{}, err
+		}
+	}
+	return files, nil
+}
+
+func readFile(path string, v interface{}) error {
+	content, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	if err = json.Unmarshal(content, v); err != nil {
+		return errors.New("Unable to parse " + filepath.Base(path) + ": " + err.Error())
+	}
+	return nil
+}
+
+// Import creates Approved requests for whitelisted players and ops, and Banned requests
+// for banned players. A banned player is only imported as banned even if also whitelisted.
+// Players that were imported before or already have a request are skipped, so the import
+// can be run again after the server files changed
+func Import(store db.RequestStore, files Files) (Report, error) {
+	if len(files.Whitelist)+len(files.BannedPlayers)+len(files.Ops) == 0 {
+		return Report{}, ErrNothingToImport
+	}
+	now := time.Now()
+	report := Report{Imported: []PlayerResult{}, Skipped: []PlayerResult{}}
+	seen := map[string]bool{}
+	importPlayer := func(request types.WhitelistRequest) error {
+		result := PlayerResult{Name: request.Username, UUID: request.UUID}
+		if request.Username == "" {
+			result.Reason = "Missing player name"
+			report.Skipped = append(report.Skipped, result)
+			return nil
+		}
+		key := request.UUID
+		if key == "" {
+			key = strings.ToLower(request.Username)
+		}
+		if seen[key] {
+			return nil
+		}
+		seen[key] = true
+		reason, err := existingRequest(store, request)
+		if err != nil {
+			return err
+		}
+		if reason != "" {
+			result.Reason = reason
+			report.Skipped = append(report.Skipped, result)
+			return nil
+		}
+		if _, err = store.ImportRequest(request); err != nil {
+			return err
+		}
+		result.Status = request.Status
+		report.Imported = append(report.Imported, result)
+		return nil
+	}
+
+	for _, p := range files.BannedPlayers {
+		bannedAt, err := time.Parse(bannedTimeLayout, p.Created)
+		if err != nil {
+			bannedAt = now
+		}
+		request := newRequest(p.Player, types.StatusBanned, bannedAt, files.Servers)
+		request.Note = p.Reason
+		request.History[0].Note = p.Reason
+		if err := importPlayer(request); err != nil {
+			return report, err
+		}
+	}
+	// Ops can join regardless of the whitelist
+	players := append(append([]Player{}, files.Whitelist...), files.Ops...)
+	for _, p := range players {
+		if err := importPlayer(newRequest(p, types.StatusApproved, now, files.Servers)); err != nil {
+			return report, err
+		}
+	}
+	return report, nil
+}
+
+func newRequest(player Player, status string, decidedAt time.Time, servers []string) types.WhitelistRequest {
+	return types.WhitelistRequest{
+		Username:             player.Name,
+		UUID:                 player.UUID,
+		Servers:              servers,
+		Status:               status,
+		Source:               types.SourceImported,
+		Admin:                importAdmin,
+		Timestamp:            decidedAt,
+		ProcessedTimestamp:   decidedAt,
+		LastUpdatedTimestamp: decidedAt,
+		Info:                 map[string]interface{}{},
+		History: []types.StatusChange{{
+			Actor:     importAdmin,
+			NewStatus: status,
+			Source:    types.SourceImported,
+			Timestamp: decidedAt,
+		}},
+	}
+}
+
+// existingRequest returns why the player must not be imported, or an empty string. Minecraft player
+// names are case insensitive, and bans of anonymised requests are matched by the hash of the username
+func existingRequest(store db.RequestStore, request types.WhitelistRequest) (string, error) {
+	conditions := []bson.M{
+		{"username": bson.M{"$regex": "^" + regexp.QuoteMeta(request.Username) + "$", "$options": "i"}},
+		{"usernameHash": bson.M{"$in": privacy.UsernameHashes(request.Username)}},
+	}
+	if request.UUID != "" {
+		conditions = append(conditions, bson.M{"uuid": request.UUID})
+	}
+	existing, err := store.GetRequests(-1, bson.M{"$or": conditions})
+	if err != nil {
+		return "", err
+	}
+	for _, e := range existing {
+		if e.Source == types.SourceImported {
+			return "Already imported", nil
+		}
+		switch e.Status {
+		case types.StatusPending, types.StatusApproved, types.StatusBanned:
+			return "Player already has a request with status " + e.Status, nil
+		}
+	}
+	return "", nil
+}
@@ -0,0 +1,94 @@
+package importer_test
+
+import (
+	"testing"
+
+	"github.com/tywin1104/mc-gatekeeper/db/dbtest"
+	"github.com/tywin1104/mc-gatekeeper/importer"
+	"github.com/tywin1104/mc-gatekeeper/privacy"
+	"github.com/tywin1104/mc-gatekeeper/types"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+func TestReadDir(t *testing.T) {
+	files, err := importer.ReadDir("testdata", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files.Whitelist) != 2 || len(files.BannedPlayers) != 1 || len(files.Ops) != 0 {
+		t.Errorf("Unexpected files: %+v", files)
+	}
+	if files.BannedPlayers[0].Reason != "Griefing" {
+		t.Errorf("Unexpected banned player: %+v", files.BannedPlayers[0])
+	}
+	files, err = importer.ReadDir("testdata", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files.Ops) != 1 {
+		t.Errorf("Expect ops to be read, got %+v", files.Ops)
+	}
+}
+
+func TestImport(t *testing.T) {
+	store := dbtest.NewSQLite(t)
+	defer store.Close()
+	// Dinnerbone applied through gatekeeper before the import
+	if _, err := store.CreateRequest(types.WhitelistRequest{Username: "Dinnerbone", Email: "dinnerbone@gmail.com"}); err != nil {
+		t.Fatal(err)
+	}
+	files, err := importer.ReadDir("testdata", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	report, err := importer.Import(store, files)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(report.Imported) != 2 || len(report.Skipped) != 1 || report.Skipped[0].Name != "Dinnerbone" {
+		t.Errorf("Unexpected report: %+v", report)
+	}
+	requests, err := store.GetRequests(-1, bson.M{"username": "jeb_"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The ban takes precedence over the whitelist
+	if len(requests) != 1 || requests[0].Status != "Banned" || requests[0].Note != "Griefing" {
+		t.Errorf("Expect jeb_ to be imported as banned, got %+v", requests)
+	}
+	if requests[0].Source != types.SourceImported || requests[0].UUID != "853c80ef-3c37-49fd-aa49-938b674adae6" {
+		t.Errorf("Expect the imported request to be marked, got %+v", requests[0])
+	}
+
+	// Importing the same files again does not create duplicates
+	report, err = importer.Import(store, files)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(report.Imported) != 0 || len(report.Skipped) != 3 {
+		t.Errorf("Unexpected report for re-run: %+v", report)
+	}
+	requests, err = store.GetRequests(-1, bson.D{{}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(requests) != 3 {
+		t.Errorf("Expect 3 requests after re-run, got %d", len(requests))
+	}
+
+	// Players are matched case insensitively and by the username hash of anonymised requests
+	if _, err = store.ImportRequest(types.WhitelistRequest{Status: "Banned", UsernameHash: privacy.HashUsername("Grumm")}); err != nil {
+		t.Fatal(err)
+	}
+	report, err = importer.Import(store, importer.Files{Whitelist: []importer.Player{{Name: "DINNERBONE"}, {Name: "grumm"}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(report.Imported) != 0 || len(report.Skipped) != 2 {
+		t.Errorf("Expect both players to be skipped, got %+v", report)
+	}
+
+	if _, err = importer.Import(store, importer.Files{}); err != importer.ErrNothingToImport {
+		t.Errorf("Expect ErrNothingToImport, got %v", err)
+	}
+}
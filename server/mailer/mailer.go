@@ -5,10 +5,8 @@ import (
 	"fmt"
 	"html/template"
 	"net/smtp"
-	"time"
 
 	"github.com/spf13/viper"
-	try "gopkg.in/matryer/try.v1"
 )
 
 const (
@@ -36,16 +34,6 @@ func Send(templateName string, templateData interface{}, subject string, recipen
 	content := "To: " + recipent + "\r\nSubject: " + subject + "\r\n" + mime + "\r\n" + body
 	SMTP := fmt.Sprintf("%s:%d", viper.GetString("SMTPServer"), viper.GetInt("SMTPPort"))
 
-	// Retry sending emails
-	err = try.Do(func(attempt int) (bool, error) {
-		e := smtp.SendMail(SMTP, smtp.PlainAuth("", viper.GetString("SMTPEmail"), viper.GetString("SMTPPassword"), viper.GetString("SMTPServer")), viper.GetString("SMTPEmail"), []string{recipent}, []byte(content))
-		if e != nil {
-			time.Sleep(5 * time.Second) // 5 seconds delay between retrys
-		}
-		return attempt < 3, e // try 3 times
-	})
-	if err != nil {
-		return err
-	}
-	return nil
+	// Failed tasks are retried by the worker with increasing delays, so fail fast here
+	return smtp.SendMail(SMTP, smtp.PlainAuth("", viper.GetString("SMTPEmail"), viper.GetString("SMTPPassword"), viper.GetString("SMTPServer")), viper.GetString("SMTPEmail"), []string{recipent}, []byte(content))
 }
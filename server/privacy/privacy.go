@@ -0,0 +1,216 @@
+package privacy
+
+import (
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/spf13/viper"
+	"github.com/tywin1104/mc-gatekeeper/broker"
+	"github.com/tywin1104/mc-gatekeeper/db"
+	"github.com/tywin1104/mc-gatekeeper/types"
+	"github.com/tywin1104/mc-gatekeeper/utils"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// Ways personal data can be removed
+const (
+	// ModeErase deletes the requests of the subject. Banned requests are anonymised instead
+	// so that the ban is still enforced when the player applies again
+	ModeErase = "erase"
+	// ModeAnonymise keeps every request for the stats but strips the personal data from it
+	ModeAnonymise = "anonymise"
+)
+
+// Actor recorded in the history of requests deactivated by an erasure
+const Actor = "system"
+
+// ErrEmptySubject is returned when neither an email nor a username identifies the subject
+var ErrEmptySubject = errors.New("Email or username is required")
+
+// ErrRequestChanged is returned when an approved request changed while it was deactivated for an erasure
+var ErrRequestChanged = errors.New("A request of the subject was changed during the erasure. Try again")
+
+// Subject identifies the person whose data is exported or erased
+type Subject struct {
+	Email    string `json:"email,omitempty"`
+	Username string `json:"username,omitempty"`
+}
+
+func (s Subject) filter() (bson.M, error) {
+	conditions := []bson.M{}
+	if s.Email != "" {
+		conditions = append(conditions, bson.M{"email": s.Email})
+	}
+	if s.Username != "" {
+		conditions = append(conditions, bson.M{"username": s.Username})
+	}
+	if len(conditions) == 0 {
+		return nil, ErrEmptySubject
+	}
+	return bson.M{"$or": conditions}, nil
+}
+
+// Export is everything stored about a subject
+type Export struct {
+	Subject     Subject                  `json:"subject"`
+	GeneratedAt time.Time                `json:"generatedAt"`
+	Requests    []types.WhitelistRequest `json:"requests"`
+}
+
+// ErasureReport summarises the outcome of an erasure
+type ErasureReport struct {
+	Deleted    int64 `json:"deleted"`
+	Anonymised int64 `json:"anonymised"`
+	// Deactivated counts the approved requests whose players are removed from the whitelist
+	Deactivated int64 `json:"deactivated"`
+}
+
+// ExportData collects every request that belongs to the subject
+func ExportData(store db.RequestStore, subject Subject) (Export, error) {
+	filter, err := subject.filter()
+	if err != nil {
+		return Export{}, err
+	}
+	requests, err := store.GetRequests(-1, filter)
+	if err != nil {
+		return Export{}, err
+	}
+	return Export{Subject: subject, GeneratedAt: time.Now(), Requests: requests}, nil
+}
+
+// EraseData removes the personal data of the subject from the store using the given mode.
+// Cached copies of the requests have to be re-synced by the caller
+func EraseData(store db.RequestStore, subject Subject, mode string) (ErasureReport, error) {
+	if mode != ModeErase && mode != ModeAnonymise {
+		return ErasureReport{}, errors.New("Invalid erasure mode " + mode)
+	}
+	filter, err := subject.filter()
+	if err != nil {
+		return ErasureReport{}, err
+	}
+	requests, err := store.GetRequests(-1, filter)
+	if err != nil {
+		return ErasureReport{}, err
+	}
+	report := ErasureReport{}
+	for _, request := range requests {
+		// The snapshots of the request in the outbox hold its personal data as well
+		if _, err := store.DeleteRequestOutbox(request.ID); err != nil {
+			return report, err
+		}
+		// Without a username the player could no longer be removed from the whitelist of the game servers
+		if request.Status == types.StatusApproved {
+			if request, err = deactivate(store, request); err != nil {
+				return report, err
+			}
+			report.Deactivated++
+		}
+		if mode == ModeErase && request.Status != types.StatusBanned {
+			n, err := store.DeleteRequests(bson.M{"_id": request.ID})
+			if err != nil {
+				return report, err
+			}
+			report.Deleted += n
+			continue
+		}
+		if err := Anonymise(store, request); err != nil {
+			return report, err
+		}
+		report.Anonymised++
+	}
+	return report, nil
+}
+
+// deactivate deactivates the approved request and stores the task that removes the player from the
+// whitelist of the game servers. The task carries the username, so it is still carried out once the
+// request is deleted or anonymised. Returns the deactivated request
+func deactivate(store db.RequestStore, request types.WhitelistRequest) (types.WhitelistRequest, error) {
+	now := time.Now()
+	_, err := store.UpdateRequest(bson.M{
+		"_id":     request.ID,
+		"status":  types.StatusApproved,
+		"version": request.Version,
+	}, bson.M{
+		"$set": bson.M{
+			"status":               types.StatusDeactivated,
+			"lastUpdatedTimestamp": now,
+		},
+		"$push": bson.M{"history": types.StatusChange{
+			Actor:     Actor,
+			OldStatus: types.StatusApproved,
+			NewStatus: types.StatusDeactivated,
+			Note:      "Personal data erased",
+			Source:    types.SourceErasure,
+			Timestamp: now,
+		}},
+		"$inc": bson.M{"version": 1},
+	}, db.NewOutboxEntry(broker.TaskDeactivation))
+	if err == db.ErrNotFound {
+		return request, ErrRequestChanged
+	} else if err != nil {
+		return request, err
+	}
+	requests, err := store.GetRequests(1, bson.M{"_id": request.ID})
+	if err != nil {
+		return request, err
+	}
+	if len(requests) == 0 {
+		return request, ErrRequestChanged
+	}
+	return requests[0], nil
+}
+
+// Anonymise replaces the request with a tombstone that holds no personal data.
+// The status, timestamps and decisions are kept along with a hash of the username
+// that is used to recognise banned players
+func Anonymise(store db.RequestStore, request types.WhitelistRequest) error {
+	return anonymise(store, bson.M{"_id": request.ID}, request)
+}
+
+// anonymise strips the personal data from the request if it matches the filter.
+// Returns db.ErrNotFound if it does not
+func anonymise(store db.RequestStore, filter bson.M, request types.WhitelistRequest) error {
+	history := make([]types.StatusChange, len(request.History))
+	for i, change := range request.History {
+		if change.Actor == request.Username {
+			change.Actor = ""
+		}
+		change.Note = ""
+		history[i] = change
+	}
+	usernameHash := request.UsernameHash
+	if request.Username != "" {
+		usernameHash = HashUsername(request.Username)
+	}
+	_, err := store.UpdateRequest(filter, bson.M{"$set": bson.M{
+		"username":        "",
+		"email":           "",
+		"age":             int64(0),
+		"gender":          "",
+		"note":            "",
+		"banReason":       "",
+		"info":            bson.M{},
+		"serverResults":   bson.M{},
+		"history":         history,
+		"usernameHash":    usernameHash,
+		"erasedTimestamp": time.Now(),
+	}})
+	return err
+}
+
+// HashUsername returns the hash stored on anonymised requests for the username. Player names
+// are case insensitive, so the hash is taken of the lower case name
+func HashUsername(username string) string {
+	return utils.HashUsername(strings.ToLower(username), viper.GetString("passphrase"))
+}
+
+// UsernameHashes returns the hashes an anonymised request of the username may carry. Requests
+// anonymised before hashes were taken of the lower case name carry the hash of the name as typed
+func UsernameHashes(username string) []string {
+	hashes := []string{HashUsername(username)}
+	if legacy := utils.HashUsername(username, viper.GetString("passphrase")); legacy != hashes[0] {
+		hashes = append(hashes, legacy)
+	}
+	return hashes
+}
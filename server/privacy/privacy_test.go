@@ -0,0 +1,148 @@
+package privacy_test
+
+import (
+	"testing"
+
+	"github.com/tywin1104/mc-gatekeeper/broker"
+	"github.com/tywin1104/mc-gatekeeper/db"
+	"github.com/tywin1104/mc-gatekeeper/db/dbtest"
+	"github.com/tywin1104/mc-gatekeeper/privacy"
+	"github.com/tywin1104/mc-gatekeeper/types"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// newTestStore returns a store holding two requests of user1 and one of user2
+func newTestStore(t *testing.T) *db.SQLService {
+	store := dbtest.NewSQLite(t)
+	for _, request := range []types.WhitelistRequest{
+		{Username: "user1", Email: "user1@gmail.com", Age: 19, Gender: "male"},
+		{Username: "user1", Email: "user1@gmail.com", Age: 19, Gender: "male"},
+		{Username: "user2", Email: "user2@gmail.com", Age: 30, Gender: "female"},
+	} {
+		if _, err := store.CreateRequest(request); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// One of user1's requests got the player banned
+	_, err := store.UpdateRequest(bson.M{"username": "user1"}, bson.M{"$set": bson.M{"status": "Banned", "note": "griefing"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return store
+}
+
+func TestExportData(t *testing.T) {
+	store := newTestStore(t)
+	defer store.Close()
+	export, err := privacy.ExportData(store, privacy.Subject{Email: "user1@gmail.com"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(export.Requests) != 2 {
+		t.Errorf("Expect to export 2 requests, got %d", len(export.Requests))
+	}
+	_, err = privacy.ExportData(store, privacy.Subject{})
+	if err != privacy.ErrEmptySubject {
+		t.Errorf("Expect ErrEmptySubject, got %v", err)
+	}
+}
+
+func TestEraseDataKeepsBanTombstone(t *testing.T) {
+	store := newTestStore(t)
+	defer store.Close()
+	report, err := privacy.EraseData(store, privacy.Subject{Username: "user1"}, privacy.ModeErase)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Deleted != 1 || report.Anonymised != 1 {
+		t.Errorf("Unexpected erasure report: %+v", report)
+	}
+	remaining, err := store.GetRequests(-1, bson.D{{}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(remaining) != 2 {
+		t.Fatalf("Expect 2 remaining requests, got %d", len(remaining))
+	}
+	tombstones, err := store.GetRequests(-1, bson.M{"usernameHash": privacy.HashUsername("user1")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(tombstones) != 1 {
+		t.Fatalf("Expect the banned request to be kept as a tombstone, got %+v", tombstones)
+	}
+	tombstone := tombstones[0]
+	if tombstone.Status != "Banned" || tombstone.Username != "" || tombstone.Email != "" || tombstone.Note != "" || tombstone.Age != 0 {
+		t.Errorf("Tombstone still holds personal data: %+v", tombstone)
+	}
+	if tombstone.ErasedTimestamp.IsZero() {
+		t.Error("Expect erasedTimestamp to be set")
+	}
+	for _, change := range tombstone.History {
+		if change.Actor == "user1" {
+			t.Errorf("History still references the applicant: %+v", change)
+		}
+	}
+}
+
+func TestEraseDataDeactivatesApprovedPlayers(t *testing.T) {
+	store := newTestStore(t)
+	defer store.Close()
+	_, err := store.UpdateRequest(bson.M{"username": "user2"}, bson.M{"$set": bson.M{"status": "Approved"}}, db.NewOutboxEntry(broker.TaskApproval))
+	if err != nil {
+		t.Fatal(err)
+	}
+	report, err := privacy.EraseData(store, privacy.Subject{Username: "user2"}, privacy.ModeErase)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Deleted != 1 || report.Deactivated != 1 {
+		t.Errorf("Unexpected erasure report: %+v", report)
+	}
+	// Only the deactivation is left in the outbox. It still names the player to remove from the whitelist
+	pending, err := store.PendingOutbox(10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(pending) != 1 || pending[0].TaskType != broker.TaskDeactivation || pending[0].Request.Username != "user2" {
+		t.Fatalf("Expect a single deactivation of user2 in the outbox, got %+v", pending)
+	}
+	if pending[0].Request.Status != types.StatusDeactivated {
+		t.Errorf("Expect the deactivation to carry the deactivated request, got %s", pending[0].Request.Status)
+	}
+}
+
+func TestAnonymiseMode(t *testing.T) {
+	store := newTestStore(t)
+	defer store.Close()
+	report, err := privacy.EraseData(store, privacy.Subject{Email: "user2@gmail.com"}, privacy.ModeAnonymise)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Deleted != 0 || report.Anonymised != 1 {
+		t.Errorf("Unexpected erasure report: %+v", report)
+	}
+	export, err := privacy.ExportData(store, privacy.Subject{Email: "user2@gmail.com"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(export.Requests) != 0 {
+		t.Errorf("Expect nothing to be left about the subject, got %+v", export.Requests)
+	}
+	if _, err = privacy.EraseData(store, privacy.Subject{Email: "user2@gmail.com"}, "shred"); err == nil {
+		t.Error("Expect an error for an unknown mode")
+	}
+}
+
+func TestHashUsernameIgnoresCase(t *testing.T) {
+	if privacy.HashUsername("User1") != privacy.HashUsername("user1") {
+		t.Error("Expect the hash to be the same for every capitalisation of the username")
+	}
+	// Requests anonymised before are still recognised by the hash of the name as typed
+	if hashes := privacy.UsernameHashes("User1"); len(hashes) != 2 || hashes[0] != privacy.HashUsername("user1") {
+		t.Errorf("Expect the hash of the lower case name and of the name as typed, got %v", hashes)
+	}
+	if hashes := privacy.UsernameHashes("user1"); len(hashes) != 1 {
+		t.Errorf("Expect a single hash for a lower case name, got %v", hashes)
+	}
+}
@@ -0,0 +1,154 @@
+package privacy
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/spf13/viper"
+	"github.com/tywin1104/mc-gatekeeper/db"
+	"github.com/tywin1104/mc-gatekeeper/expiry"
+	"github.com/tywin1104/mc-gatekeeper/types"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// What a retention policy does with requests older than its window
+const (
+	// ActionPurge permanently deletes the request
+	ActionPurge = "purge"
+	// ActionAnonymise keeps the request for the stats but strips the personal data from it
+	ActionAnonymise = "anonymise"
+)
+
+// RetentionPolicy defines how long requests of one status are kept
+type RetentionPolicy struct {
+	Status string        `json:"status"`
+	Action string        `json:"action"`
+	After  time.Duration `json:"after"`
+}
+
+// RetentionReport lists the requests affected by each retention policy
+type RetentionReport struct {
+	DryRun      bool           `json:"dryRun"`
+	GeneratedAt time.Time      `json:"generatedAt"`
+	Policies    []PolicyReport `json:"policies"`
+}
+
+// PolicyReport lists the requests affected by one retention policy
+type PolicyReport struct {
+	RetentionPolicy
+	Cutoff     time.Time `json:"cutoff"`
+	RequestIDs []string  `json:"requestIds"`
+}
+
+// Affected returns the total number of requests affected by the retention policies
+func (r RetentionReport) Affected() int {
+	n := 0
+	for _, p := range r.Policies {
+		n += len(p.RequestIDs)
+	}
+	return n
+}
+
+// LoadRetentionPolicies reads the retention policies from the configuration
+func LoadRetentionPolicies() ([]RetentionPolicy, error) {
+	var configured []struct {
+		Status string
+		Action string
+		After  string
+	}
+	if err := viper.UnmarshalKey("retention.policies", &configured); err != nil {
+		return nil, err
+	}
+	policies := make([]RetentionPolicy, 0, len(configured))
+	seen := map[string]bool{}
+	for _, c := range configured {
+		if !types.IsValidStatus(c.Status) || c.Status == types.StatusPending {
+			return nil, fmt.Errorf("Invalid retention policy. Status %q is not a fulfilled status", c.Status)
+		}
+		if seen[c.Status] {
+			return nil, fmt.Errorf("Invalid retention policy. Status %s has more than one policy", c.Status)
+		}
+		seen[c.Status] = true
+		if c.Action != ActionPurge && c.Action != ActionAnonymise {
+			return nil, fmt.Errorf("Invalid retention policy. Allowed values for action: [%s, %s]", ActionPurge, ActionAnonymise)
+		}
+		// Purging or anonymising approved requests would leave the player on the whitelist of the game
+		// servers without a username to deactivate them with
+		if c.Status == types.StatusApproved {
+			return nil, fmt.Errorf("Invalid retention policy. %s requests can not be purged or anonymised", c.Status)
+		}
+		// Purging banned requests would lift the ban
+		if c.Status == types.StatusBanned && c.Action == ActionPurge {
+			return nil, fmt.Errorf("Invalid retention policy. %s requests can only be anonymised", c.Status)
+		}
+		after, err := expiry.ParseDuration(c.After)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid retention policy for %s: %s", c.Status, err.Error())
+		}
+		policies = append(policies, RetentionPolicy{Status: c.Status, Action: c.Action, After: after})
+	}
+	return policies, nil
+}
+
+// ApplyRetention purges or anonymises the requests that are older than the window of their policy.
+// With dryRun the affected requests are only reported. Cached copies of the requests have to be
+// re-synced by the caller when requests were changed
+func ApplyRetention(store db.RequestStore, policies []RetentionPolicy, dryRun bool) (RetentionReport, error) {
+	now := time.Now()
+	report := RetentionReport{DryRun: dryRun, GeneratedAt: now, Policies: make([]PolicyReport, 0, len(policies))}
+	for _, policy := range policies {
+		policyReport := PolicyReport{RetentionPolicy: policy, Cutoff: now.Add(-policy.After), RequestIDs: []string{}}
+		requests, err := store.GetRequests(-1, bson.M{"status": policy.Status})
+		if err != nil {
+			return report, err
+		}
+		for _, request := range requests {
+			if lastActivity(request).After(policyReport.Cutoff) {
+				continue
+			}
+			// Requests that are already anonymised have nothing left to remove
+			if policy.Action == ActionAnonymise && !request.ErasedTimestamp.IsZero() {
+				continue
+			}
+			if !dryRun {
+				applied, err := applyPolicy(store, policy, request)
+				if err != nil {
+					report.Policies = append(report.Policies, policyReport)
+					return report, err
+				}
+				if !applied {
+					continue
+				}
+			}
+			policyReport.RequestIDs = append(policyReport.RequestIDs, request.ID.Hex())
+		}
+		report.Policies = append(report.Policies, policyReport)
+	}
+	return report, nil
+}
+
+// applyPolicy purges or anonymises the request unless it was changed since it was read, e.g. when
+// the player was approved again. Returns whether the policy was applied
+func applyPolicy(store db.RequestStore, policy RetentionPolicy, request types.WhitelistRequest) (bool, error) {
+	filter := bson.M{"_id": request.ID, "status": request.Status, "version": request.Version}
+	if policy.Action == ActionAnonymise {
+		err := anonymise(store, filter, request)
+		if err == db.ErrNotFound {
+			return false, nil
+		}
+		return err == nil, err
+	}
+	deleted, err := store.DeleteRequests(filter)
+	return deleted > 0, err
+}
+
+// lastActivity is the time the request was last submitted or decided on
+func lastActivity(request types.WhitelistRequest) time.Time {
+	latest := request.Timestamp
+	for _, t := range []time.Time{request.ProcessedTimestamp, request.LastUpdatedTimestamp} {
+		if t.After(latest) {
+			latest = t
+		}
+	}
+	return latest
+}
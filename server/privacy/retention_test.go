@@ -0,0 +1,133 @@
+package privacy_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/spf13/viper"
+	"github.com/tywin1104/mc-gatekeeper/db"
+	"github.com/tywin1104/mc-gatekeeper/privacy"
+	"github.com/tywin1104/mc-gatekeeper/types"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+func TestLoadRetentionPolicies(t *testing.T) {
+	viper.Set("retention.policies", []map[string]interface{}{
+		{"status": "Denied", "action": "purge", "after": "180d"},
+		{"status": "Deactivated", "action": "anonymise", "after": "8760h"},
+	})
+	defer viper.Set("retention.policies", nil)
+	policies, err := privacy.LoadRetentionPolicies()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(policies) != 2 || policies[0].After != 180*24*time.Hour || policies[1].After != 365*24*time.Hour {
+		t.Errorf("Unexpected policies: %+v", policies)
+	}
+
+	for _, invalid := range []map[string]interface{}{
+		{"status": "Pending", "action": "purge", "after": "180d"},
+		{"status": "Denied", "action": "shred", "after": "180d"},
+		{"status": "Banned", "action": "purge", "after": "180d"},
+		{"status": "Approved", "action": "purge", "after": "180d"},
+		{"status": "Approved", "action": "anonymise", "after": "180d"},
+		{"status": "Denied", "action": "purge", "after": "soon"},
+		{"status": "Denied", "action": "purge", "after": "-1d"},
+	} {
+		viper.Set("retention.policies", []map[string]interface{}{invalid})
+		if _, err := privacy.LoadRetentionPolicies(); err == nil {
+			t.Errorf("Expect policy %v to be rejected", invalid)
+		}
+	}
+}
+
+func TestApplyRetention(t *testing.T) {
+	store := newTestStore(t)
+	defer store.Close()
+	// user2 was denied a year ago
+	old := time.Now().AddDate(-1, 0, 0)
+	_, err := store.UpdateRequest(bson.M{"username": "user2"}, bson.M{"$set": bson.M{
+		"status": "Denied", "timestamp": old, "processedTimestamp": old,
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	policies := []privacy.RetentionPolicy{
+		{Status: "Denied", Action: privacy.ActionPurge, After: 180 * 24 * time.Hour},
+		// The banned request was decided just now and is kept
+		{Status: "Banned", Action: privacy.ActionAnonymise, After: time.Hour},
+	}
+
+	report, err := privacy.ApplyRetention(store, policies, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Affected() != 1 || len(report.Policies[0].RequestIDs) != 1 {
+		t.Errorf("Unexpected dry-run report: %+v", report)
+	}
+	requests, err := store.GetRequests(-1, bson.D{{}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(requests) != 3 {
+		t.Errorf("Dry run must not change requests, got %d requests", len(requests))
+	}
+
+	report, err = privacy.ApplyRetention(store, policies, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Affected() != 1 {
+		t.Errorf("Unexpected report: %+v", report)
+	}
+	requests, err = store.GetRequests(-1, bson.M{"username": "user2"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(requests) != 0 {
+		t.Errorf("Expect the denied request to be purged, got %+v", requests)
+	}
+}
+
+// changingStore changes every request it returns, as if it was decided on right after being read
+type changingStore struct {
+	db.RequestStore
+}
+
+func (s changingStore) GetRequests(limit int64, filter interface{}) ([]types.WhitelistRequest, error) {
+	requests, err := s.RequestStore.GetRequests(limit, filter)
+	for _, request := range requests {
+		_, err := s.RequestStore.UpdateRequest(bson.M{"_id": request.ID}, bson.M{
+			"$set": bson.M{"status": "Approved"},
+			"$inc": bson.M{"version": 1},
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	return requests, err
+}
+
+func TestApplyRetentionSkipsChangedRequests(t *testing.T) {
+	store := newTestStore(t)
+	defer store.Close()
+	old := time.Now().AddDate(-1, 0, 0)
+	_, err := store.UpdateRequest(bson.M{"username": "user2"}, bson.M{"$set": bson.M{
+		"status": "Denied", "timestamp": old, "processedTimestamp": old,
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	policies := []privacy.RetentionPolicy{{Status: "Denied", Action: privacy.ActionPurge, After: 180 * 24 * time.Hour}}
+
+	report, err := privacy.ApplyRetention(changingStore{store}, policies, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Affected() != 0 {
+		t.Errorf("Expect the request that was approved meanwhile to be kept, got %+v", report)
+	}
+	if requests, _ := store.GetRequests(-1, bson.M{"username": "user2"}); len(requests) != 1 {
+		t.Errorf("Expect user2 to be kept, got %+v", requests)
+	}
+}
@@ -2,13 +2,15 @@ package rcon
 
 import (
 	"bytes"
+	"context"
 	"encoding/binary"
 	"errors"
 	"fmt"
 	"io"
-	"math/rand"
 	"net"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/sirupsen/logrus"
@@ -16,12 +18,51 @@ import (
 )
 
 const (
-	packetIDBadAuth       = -1
-	payloadMaxSize        = 1460
-	serverdataAuth        = 3
-	serverdataExeccommand = 2
+	packetIDBadAuth           = -1
+	payloadMaxSize            = 1460
+	serverdataAuth            = 3
+	serverdataAuthResponse    = 2
+	serverdataExeccommand     = 2
+	serverdataResponseValue   = 0
+	packetHeaderSize          = 4 + 4 + 2
+	responsePacketMaxBodySize = 64 * 1024
+	// Defaults used when RCONTimeout, RCONPoolSize or RCONHealthCheckInterval are not configured
+	defaultTimeout             = 5 * time.Second
+	defaultPoolSize            = 1
+	defaultHealthCheckInterval = 30 * time.Second
+	// Reconnection attempts are spaced out from minBackoff up to maxBackoff while the game server is down
+	minBackoff = time.Second
+	maxBackoff = 30 * time.Second
 )
 
+// ErrUnexpectedPacketID is returned when the game server answers with a packet that belongs to no
+// command sent on the connection. The connection is out of sync and is reestablished
+var ErrUnexpectedPacketID = errors.New("RCON response does not match the request")
+
+// ErrClosed is returned for commands sent after the client was closed
+var ErrClosed = errors.New("RCON client is closed")
+
+// AuthError is returned when the game server rejects the RCON password
+type AuthError struct {
+	Address string
+}
+
+func (e *AuthError) Error() string {
+	return "RCON authentication failed for " + e.Address + ". Check RCONPassword"
+}
+
+// UnavailableError is returned when the game server can not be reached. Until RetryAt further
+// commands fail with the same error without contacting the game server
+type UnavailableError struct {
+	RetryAt time.Time
+	Err     error
+}
+
+func (e *UnavailableError) Error() string {
+	return fmt.Sprintf("Unable to reconnect to RCON server. Game server is down: %v. Next attempt at %s",
+		e.Err, e.RetryAt.Format(time.RFC3339))
+}
+
 type payload struct {
 	packetID   int32  // 4 bytes
 	packetType int32  // 4 bytes
@@ -30,13 +71,59 @@ type payload struct {
 
 // Client is an RCON client based around the Valve RCON Protocol, see more about the protocol in the
 // Valve Wiki: https://developer.valvesoftware.com/wiki/Source_RCON_Protocol
+// The client is safe for concurrent use. Every command gets a connection of its own from a small
+// pool, so commands never interleave on the wire
 type Client struct {
-	connection net.Conn
-	password   string
+	address  string
+	password string
+	timeout  time.Duration
+	// slots holds a token for every connection in use, idle holds the connections ready for reuse
+	slots chan struct{}
+	idle  chan *conn
+	done  chan struct{}
+
+	// mu guards the fields below
+	mu      sync.Mutex
+	closed  bool
+	backoff time.Duration
+	retryAt time.Time
+	lastErr error
+}
+
+// conn is an authenticated connection to the game server
+type conn struct {
+	net.Conn
+	// lastID is the ID of the latest packet sent. IDs increase so that responses to
+	// earlier packets can be told apart from the responses to the current command
+	lastID int32
 }
 
 var log = logrus.New()
 
+// Timeout returns how long to wait for the game server to answer a command
+func Timeout() time.Duration {
+	if timeout := viper.GetDuration("RCONTimeout"); timeout > 0 {
+		return timeout
+	}
+	return defaultTimeout
+}
+
+// PoolSize returns how many connections to the game server the client keeps at most
+func PoolSize() int {
+	if size := viper.GetInt("RCONPoolSize"); size > 0 {
+		return size
+	}
+	return defaultPoolSize
+}
+
+// HealthCheckInterval returns how often idle connections are checked
+func HealthCheckInterval() time.Duration {
+	if interval := viper.GetDuration("RCONHealthCheckInterval"); interval > 0 {
+		return interval
+	}
+	return defaultHealthCheckInterval
+}
+
 // Both requests and responses are sent as TCP packets. Their payload follows the following basic structure:
 // Field        	Type                               value
 // Size	         32-bit little-endian Signed Integer
@@ -45,105 +132,338 @@ var log = logrus.New()
 // Body	         Null-terminated ASCII String
 // 2-byte pad   Null-terminated ASCII String	        0x00
 func (p *payload) calculatePacketSize() int32 {
-	return int32(len(p.packetBody) + 4 + 4 + 2)
+	return int32(len(p.packetBody) + packetHeaderSize)
 }
 
-func connectRCON() (*Client, error) {
-	address := fmt.Sprintf("%s:%d", viper.GetString("RCONServer"), viper.GetInt("RCONPort"))
-
-	conn, err := net.DialTimeout("tcp", address, 5*time.Second)
+// NewClient contsurct a RCON client againest a running game server and
+// issue a ininial authentication using password
+func NewClient(host string, port int, pass string) (*Client, error) {
+	size := PoolSize()
+	c := &Client{
+		address:  net.JoinHostPort(host, strconv.Itoa(port)),
+		password: pass,
+		timeout:  Timeout(),
+		slots:    make(chan struct{}, size),
+		idle:     make(chan *conn, size),
+		done:     make(chan struct{}),
+	}
+	// Fail early on a wrong address or password
+	cn, err := c.dial(context.Background())
 	if err != nil {
 		return nil, err
 	}
+	c.idle <- cn
+	go c.checkHealth(HealthCheckInterval())
+	return c, nil
+}
 
-	client := new(Client)
-	client.connection = conn
-	client.password = viper.GetString("RCONPassword")
+// Close the connections to the game server. Connections in use are closed once their command completed
+func (c *Client) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed {
+		return nil
+	}
+	c.closed = true
+	close(c.done)
+	for {
+		select {
+		case cn := <-c.idle:
+			cn.Close()
+		default:
+			return nil
+		}
+	}
+}
 
-	err = client.sendAuthentication(client.password)
+// SendCommand issues command against running game server
+func (c *Client) SendCommand(command string) (string, error) {
+	return c.SendCommandContext(context.Background(), command)
+}
+
+// SendCommandContext issues command against running game server. The command is abandoned
+// when the context is done, waiting for a free connection included
+func (c *Client) SendCommandContext(ctx context.Context, command string) (string, error) {
+	cn, err := c.get(ctx)
 	if err != nil {
-		return nil, err
+		return "", err
+	}
+	response, sent, err := cn.execute(ctx, command, c.timeout)
+	if err != nil && !sent && ctx.Err() == nil {
+		// try to reconnect once to remote game server when the connection dropped before the command
+		// was written. Once written the game server may have run it, so it is not sent again here.
+		// Failed commands are retried by the worker with increasing delays
+		log.WithField("err", err.Error()).Info("Reconnect to RCON")
+		cn.Close()
+		if cn, err = c.dial(ctx); err != nil {
+			<-c.slots
+			return "", err
+		}
+		response, _, err = cn.execute(ctx, command, c.timeout)
+	}
+	c.put(cn, err == nil)
+	if err != nil && ctx.Err() != nil {
+		return "", ctx.Err()
 	}
-	return client, nil
+	return response, err
 }
 
-// NewClient contsurct a RCON client againest a running game server and
-// issue a ininial authentication using password
-func NewClient(host string, port int, pass string) (*Client, error) {
-	client, err := connectRCON()
+// get takes an idle connection or opens a new one once a slot of the pool is free
+func (c *Client) get(ctx context.Context) (*conn, error) {
+	select {
+	case c.slots <- struct{}{}:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case <-c.done:
+		return nil, ErrClosed
+	}
+	select {
+	case cn := <-c.idle:
+		return cn, nil
+	default:
+	}
+	cn, err := c.dial(ctx)
 	if err != nil {
+		<-c.slots
 		return nil, err
 	}
-	return client, nil
+	return cn, nil
 }
 
-func (c *Client) sendAuthentication(pass string) error {
-	payload := createPayload(serverdataAuth, pass)
+// put returns the connection to the pool. Broken connections are closed
+func (c *Client) put(cn *conn, healthy bool) {
+	c.mu.Lock()
+	if healthy && !c.closed {
+		c.idle <- cn
+	} else {
+		cn.Close()
+	}
+	c.mu.Unlock()
+	<-c.slots
+}
 
-	_, err := c.sendPayload(payload)
-	if err != nil {
-		return err
+// dial opens and authenticates a new connection. After a failed attempt further attempts are
+// refused until the backoff elapsed, which doubles with every failure up to maxBackoff
+func (c *Client) dial(ctx context.Context) (*conn, error) {
+	c.mu.Lock()
+	if time.Now().Before(c.retryAt) {
+		err := c.lastErr
+		c.mu.Unlock()
+		return nil, err
 	}
+	c.mu.Unlock()
 
-	return nil
-}
+	cn, err := connect(ctx, c.address, c.password, c.timeout)
 
-// SendCommand issues command against running game server
-func (c *Client) SendCommand(command string) (string, error) {
-	pl := createPayload(serverdataExeccommand, command)
-	var response *payload
-	response, err := c.sendPayload(pl)
+	c.mu.Lock()
+	defer c.mu.Unlock()
 	if err != nil {
-		// try to reconnect to remote game server when connection drops
-		reconnected := false
-		for i := 1; i <= 3; i++ {
-			log.Infof("Reconnect to RCON [%d/3]", i)
-			newClient, e := connectRCON()
-			if e != nil {
-				time.Sleep(5 * time.Second)
+		c.backoff *= 2
+		if c.backoff < minBackoff {
+			c.backoff = minBackoff
+		} else if c.backoff > maxBackoff {
+			c.backoff = maxBackoff
+		}
+		c.retryAt = time.Now().Add(c.backoff)
+		if _, ok := err.(*AuthError); !ok {
+			err = &UnavailableError{RetryAt: c.retryAt, Err: err}
+		}
+		c.lastErr = err
+		return nil, err
+	}
+	c.backoff = 0
+	c.retryAt = time.Time{}
+	return cn, nil
+}
+
+// checkHealth pings the idle connections on every interval and drops the broken ones, so that
+// commands do not find out about connections the game server closed in the meantime
+func (c *Client) checkHealth(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-c.done:
+			return
+		case <-ticker.C:
+		}
+		for i := 0; i < cap(c.idle); i++ {
+			select {
+			case c.slots <- struct{}{}:
+			default:
+				// All connections are busy, so there is nothing idle to check
 				continue
-			} else {
-				c.connection = newClient.connection
-				reconnected = true
-				response, e = c.sendPayload(pl)
-				if e != nil {
-					return "", e
+			}
+			select {
+			case cn := <-c.idle:
+				err := cn.ping(c.timeout)
+				if err != nil {
+					log.WithField("err", err.Error()).Info("Dropping broken RCON connection")
 				}
-				break
+				c.put(cn, err == nil)
+			default:
+				<-c.slots
 			}
 		}
-		if !reconnected {
-			return "", errors.New("Unable to reconnect to RCON server. Game server is down")
-		}
 	}
-
-	// Trim null bytes
-	response.packetBody = bytes.Trim(response.packetBody, "\x00")
-
-	return strings.TrimSpace(string(response.packetBody)), nil
 }
 
-func (c *Client) sendPayload(request *payload) (*payload, error) {
-	packet, err := createPacketFromPayload(request)
+// connect opens a connection to the game server and logs in with the password
+func connect(ctx context.Context, address, password string, timeout time.Duration) (*conn, error) {
+	dialer := net.Dialer{Timeout: timeout}
+	nc, err := dialer.DialContext(ctx, "tcp", address)
 	if err != nil {
 		return nil, err
 	}
-
-	_, err = c.connection.Write(packet)
-	if err != nil {
+	cn := &conn{Conn: nc}
+	if err = cn.authenticate(address, password, timeout); err != nil {
+		nc.Close()
 		return nil, err
 	}
+	return cn, nil
+}
+
+// authenticate logs in with the password. Source servers send an empty response value
+// ahead of the auth response, which is skipped
+func (cn *conn) authenticate(address, pass string, timeout time.Duration) error {
+	request := cn.createPayload(serverdataAuth, pass)
+	cn.SetDeadline(time.Now().Add(timeout))
+	defer cn.SetDeadline(time.Time{})
+	if err := cn.writePayload(request); err != nil {
+		return err
+	}
+	for {
+		response, err := createPayloadFromPacket(cn)
+		if err != nil {
+			return err
+		}
+		if response.packetType != serverdataAuthResponse {
+			continue
+		}
+		if response.packetID == packetIDBadAuth {
+			return &AuthError{Address: address}
+		}
+		if response.packetID != request.packetID {
+			return ErrUnexpectedPacketID
+		}
+		return nil
+	}
+}
 
-	response, err := createPayloadFromPacket(c.connection)
+// execute sends the command and reassembles its response. The game server splits long responses
+// (more than 4096 bytes on Minecraft) into several packets without marking the last one. Once the
+// first packet arrived an empty response value packet is sent as a sentinel: the server answers it
+// after the rest of the response, so every packet up to the answer to the sentinel belongs to the command.
+// sent tells whether the command was written to the connection
+func (cn *conn) execute(ctx context.Context, command string, timeout time.Duration) (string, bool, error) {
+	request := cn.createPayload(serverdataExeccommand, command)
+	defer cn.watch(ctx, timeout)()
+	if err := cn.writePayload(request); err != nil {
+		return "", false, err
+	}
+	var body bytes.Buffer
+	var sentinel *payload
+	for {
+		response, err := cn.readResponse(request.packetID)
+		if err != nil {
+			return "", true, err
+		}
+		if response.packetID == request.packetID {
+			body.Write(response.packetBody)
+			if sentinel == nil {
+				sentinel = cn.createPayload(serverdataResponseValue, "")
+				if err = cn.writePayload(sentinel); err != nil {
+					return "", true, err
+				}
+			}
+		} else if sentinel != nil && response.packetID == sentinel.packetID {
+			// Source servers answer the sentinel with two packets. The second one is
+			// skipped as a stale packet when the next command is sent
+			return strings.TrimSpace(string(bytes.Trim(body.Bytes(), "\x00"))), true, nil
+		} else {
+			return "", true, ErrUnexpectedPacketID
+		}
+	}
+}
+
+// ping checks that the game server still answers on the connection. An empty response value
+// packet is used since the game server answers it without running anything
+func (cn *conn) ping(timeout time.Duration) error {
+	request := cn.createPayload(serverdataResponseValue, "")
+	defer cn.watch(context.Background(), timeout)()
+	if err := cn.writePayload(request); err != nil {
+		return err
+	}
+	response, err := cn.readResponse(request.packetID)
 	if err != nil {
-		return nil, err
+		return err
+	}
+	if response.packetID != request.packetID {
+		return ErrUnexpectedPacketID
+	}
+	return nil
+}
+
+// watch sets the deadline of an exchange to the timeout or the deadline of the context, whichever
+// is earlier, and cuts the exchange short when the context is canceled. The returned function ends the watch
+func (cn *conn) watch(ctx context.Context, timeout time.Duration) func() {
+	deadline := time.Now().Add(timeout)
+	if d, ok := ctx.Deadline(); ok && d.Before(deadline) {
+		deadline = d
+	}
+	cn.SetDeadline(deadline)
+	if ctx.Done() == nil {
+		return func() { cn.SetDeadline(time.Time{}) }
 	}
+	stop := make(chan struct{})
+	finished := make(chan struct{})
+	go func() {
+		defer close(finished)
+		select {
+		case <-ctx.Done():
+			cn.SetDeadline(time.Now())
+		case <-stop:
+		}
+	}()
+	return func() {
+		close(stop)
+		<-finished
+		cn.SetDeadline(time.Time{})
+	}
+}
 
-	if response.packetID == packetIDBadAuth {
-		return nil, errors.New("Authentication unsuccessful")
+// readResponse reads the next packet that is not left over from an earlier exchange, e.g. one that timed out
+func (cn *conn) readResponse(firstID int32) (*payload, error) {
+	for {
+		response, err := createPayloadFromPacket(cn)
+		if err != nil {
+			return nil, err
+		}
+		if response.packetID > 0 && response.packetID < firstID {
+			log.WithField("packetID", response.packetID).Debug("Skipping stale RCON packet")
+			continue
+		}
+		return response, nil
 	}
+}
 
-	return response, nil
+// createPayload creates a payload with the next packet ID of the connection
+func (cn *conn) createPayload(packetType int, body string) *payload {
+	cn.lastID++
+	return &payload{
+		packetID:   cn.lastID,
+		packetType: int32(packetType),
+		packetBody: []byte(body),
+	}
+}
+
+func (cn *conn) writePayload(request *payload) error {
+	packet, err := createPacketFromPayload(request)
+	if err != nil {
+		return err
+	}
+	_, err = cn.Write(packet)
+	return err
 }
 
 // Write packet to the connection as payload struct
@@ -169,33 +489,27 @@ func createPacketFromPayload(payload *payload) ([]byte, error) {
 	return buf.Bytes(), nil
 }
 
-func createPayload(packetType int, body string) *payload {
-	return &payload{
-		packetID:   rand.Int31(),
-		packetType: int32(packetType),
-		packetBody: []byte(body),
-	}
-}
-
 // Read packet coming from the connection and construct the response object (also as a payload struct)
 func createPayloadFromPacket(packetReader io.Reader) (*payload, error) {
 	//read packet length
 	var packetLength int32
 	err := binary.Read(packetReader, binary.LittleEndian, &packetLength)
 	if err != nil {
-		return nil, errors.New("Unable to read packet length")
+		return nil, fmt.Errorf("Unable to read packet length: %v", err)
+	}
+	// check length before reading the rest of the packet
+	if packetLength < packetHeaderSize {
+		return nil, errors.New("packet too short")
+	}
+	if packetLength > responsePacketMaxBodySize+packetHeaderSize {
+		return nil, fmt.Errorf("packet of %d bytes exceeds the maximum size", packetLength)
 	}
 	buf := make([]byte, packetLength)
-	err = binary.Read(packetReader, binary.LittleEndian, &buf)
+	_, err = io.ReadFull(packetReader, buf)
 	if err != nil {
 		err = fmt.Errorf("read packet body fail: %v", err)
 		return nil, err
 	}
-	// check length
-	if packetLength < 4+4+2 {
-		err = errors.New("packet too short")
-		return nil, err
-	}
 	result := new(payload)
 	result.packetID = int32(binary.LittleEndian.Uint32(buf[:4]))
 	result.packetType = int32(binary.LittleEndian.Uint32(buf[4:8]))
@@ -0,0 +1,371 @@
+package rcon_test
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/spf13/viper"
+	"github.com/tywin1104/mc-gatekeeper/rcon"
+)
+
+type packet struct {
+	id, kind int32
+	body     string
+}
+
+func readPacket(r io.Reader) (packet, error) {
+	var size int32
+	if err := binary.Read(r, binary.LittleEndian, &size); err != nil {
+		return packet{}, err
+	}
+	buf := make([]byte, size)
+	if _, err := io.ReadFull(r, buf); err != nil {
+		return packet{}, err
+	}
+	return packet{
+		id:   int32(binary.LittleEndian.Uint32(buf[:4])),
+		kind: int32(binary.LittleEndian.Uint32(buf[4:8])),
+		body: string(buf[8 : size-2]),
+	}, nil
+}
+
+func writePacket(w io.Writer, p packet) error {
+	buf := make([]byte, 4+4+4+len(p.body)+2)
+	binary.LittleEndian.PutUint32(buf[0:], uint32(len(buf)-4))
+	binary.LittleEndian.PutUint32(buf[4:], uint32(p.id))
+	binary.LittleEndian.PutUint32(buf[8:], uint32(p.kind))
+	copy(buf[12:], p.body)
+	_, err := w.Write(buf)
+	return err
+}
+
+// fakeServer answers the packets it receives with the packets returned by respond. Answers are
+// written from their own goroutine, like the buffered TCP connection of a real game server
+func fakeServer(conn net.Conn, respond func(packet) []packet) {
+	out := make(chan packet, 64)
+	go func() {
+		for p := range out {
+			if writePacket(conn, p) != nil {
+				return
+			}
+		}
+	}()
+	go func() {
+		defer close(out)
+		for {
+			p, err := readPacket(conn)
+			if err != nil {
+				return
+			}
+			for _, answer := range respond(p) {
+				out <- answer
+			}
+		}
+	}()
+}
+
+// gameServer is a fake game server on a local port
+type gameServer struct {
+	net.Listener
+	mu    sync.Mutex
+	conns []net.Conn
+}
+
+// listen runs a fake game server that answers every connection with respond.
+// An empty address picks a free port
+func listen(t *testing.T, address string, respond func(packet) []packet) (*gameServer, string, int) {
+	if address == "" {
+		address = "127.0.0.1:0"
+	}
+	l, err := net.Listen("tcp", address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := &gameServer{Listener: l}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			server.mu.Lock()
+			server.conns = append(server.conns, conn)
+			server.mu.Unlock()
+			fakeServer(conn, respond)
+		}
+	}()
+	host, port, _ := net.SplitHostPort(l.Addr().String())
+	p, _ := strconv.Atoi(port)
+	return server, host, p
+}
+
+// Close stops the game server and drops its connections
+func (s *gameServer) Close() error {
+	err := s.Listener.Close()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, conn := range s.conns {
+		conn.Close()
+	}
+	return err
+}
+
+// minecraft behaves like a vanilla server with the given password. Responses are
+// split into packets of 4096 bytes and unknown packet types are answered with an error
+func minecraft(password string, responses map[string]string) func(packet) []packet {
+	return func(p packet) []packet {
+		switch p.kind {
+		case 3:
+			if p.body != password {
+				return []packet{{id: -1, kind: 2}}
+			}
+			return []packet{{id: p.id, kind: 2}}
+		case 2:
+			response := responses[p.body]
+			answers := []packet{}
+			for {
+				n := 4096
+				if len(response) < n {
+					n = len(response)
+				}
+				answers = append(answers, packet{id: p.id, kind: 0, body: response[:n]})
+				if response = response[n:]; response == "" {
+					return answers
+				}
+			}
+		}
+		return []packet{{id: p.id, kind: 0, body: "Unknown request 0"}}
+	}
+}
+
+func TestSendCommandReassemblesFragmentedResponse(t *testing.T) {
+	names := make([]string, 1000)
+	for i := range names {
+		names[i] = "player" + strings.Repeat("x", i%10)
+	}
+	list := "There are 1000 whitelisted players: " + strings.Join(names, ", ")
+	l, host, port := listen(t, "", minecraft("secret", map[string]string{
+		"whitelist list": list,
+		"list":           "There are 0 of a max of 20 players online:",
+	}))
+	defer l.Close()
+
+	c, err := rcon.NewClient(host, port, "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	response, err := c.SendCommand("whitelist list")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if response != list {
+		t.Errorf("Expect the whole response of %d bytes, got %d bytes", len(list), len(response))
+	}
+	// The next command gets its own response rather than the tail of the previous one
+	response, err = c.SendCommand("list")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if response != "There are 0 of a max of 20 players online:" {
+		t.Errorf("Unexpected response %q", response)
+	}
+}
+
+func TestSendCommandSkipsStalePackets(t *testing.T) {
+	mc := minecraft("secret", map[string]string{"list": "online"})
+	l, host, port := listen(t, "", func(p packet) []packet {
+		answers := mc(p)
+		if p.kind == 2 && p.body == "list" {
+			// Source servers answer the sentinel with an extra packet
+			answers = append([]packet{{id: 1, kind: 0, body: "stale"}}, answers...)
+		}
+		return answers
+	})
+	defer l.Close()
+	c, err := rcon.NewClient(host, port, "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	response, err := c.SendCommand("list")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if response != "online" {
+		t.Errorf("Expect the stale packet to be skipped, got %q", response)
+	}
+}
+
+func TestAuthError(t *testing.T) {
+	l, host, port := listen(t, "", minecraft("secret", nil))
+	defer l.Close()
+	_, err := rcon.NewClient(host, port, "wrong")
+	authErr, ok := err.(*rcon.AuthError)
+	if !ok || authErr.Address != net.JoinHostPort(host, strconv.Itoa(port)) {
+		t.Errorf("Expect an AuthError, got %v", err)
+	}
+}
+
+func TestSendCommandContext(t *testing.T) {
+	// The server accepts the login but never answers a command
+	l, host, port := listen(t, "", func(p packet) []packet {
+		if p.kind == 3 {
+			return []packet{{id: p.id, kind: 2}}
+		}
+		return nil
+	})
+	defer l.Close()
+	c, err := rcon.NewClient(host, port, "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if _, err = c.SendCommandContext(ctx, "list"); err != context.DeadlineExceeded {
+		t.Errorf("Expect the command to be abandoned with the context, got %v", err)
+	}
+
+	// Without a context deadline the command gives up after RCONTimeout
+	viper.Set("RCONTimeout", "50ms")
+	defer viper.Set("RCONTimeout", nil)
+	c, err = rcon.NewClient(host, port, "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if _, err = c.SendCommand("list"); err == nil {
+		t.Error("Expect the command to time out")
+	}
+}
+
+func TestConcurrentCommands(t *testing.T) {
+	viper.Set("RCONPoolSize", 3)
+	defer viper.Set("RCONPoolSize", nil)
+	responses := map[string]string{}
+	for i := 0; i < 20; i++ {
+		responses[fmt.Sprintf("whitelist add player%d", i)] = fmt.Sprintf("Added player%d to the whitelist", i)
+	}
+	l, host, port := listen(t, "", minecraft("secret", responses))
+	defer l.Close()
+	c, err := rcon.NewClient(host, port, "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			response, err := c.SendCommand(fmt.Sprintf("whitelist add player%d", i))
+			if err != nil {
+				t.Error(err)
+			} else if response != fmt.Sprintf("Added player%d to the whitelist", i) {
+				t.Errorf("Expect every command to get its own response, got %q for player%d", response, i)
+			}
+		}(i)
+	}
+	wg.Wait()
+}
+
+func TestReconnectWithBackoff(t *testing.T) {
+	respond := minecraft("secret", map[string]string{"list": "online"})
+	server, host, port := listen(t, "", respond)
+	c, err := rcon.NewClient(host, port, "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	// The game server goes down and drops the connection. A command written to the dropped
+	// connection fails without being sent again
+	server.Close()
+	if _, err = c.SendCommand("list"); err == nil {
+		t.Fatal("Expect the command to fail when the connection dropped")
+	}
+	_, err = c.SendCommand("list")
+	unavailable, ok := err.(*rcon.UnavailableError)
+	if !ok || !unavailable.RetryAt.After(time.Now()) {
+		t.Fatalf("Expect the command to fail while the game server is down, got %v", err)
+	}
+	// Further commands fail without contacting the game server until the backoff elapsed
+	_, err = c.SendCommand("list")
+	if again, ok := err.(*rcon.UnavailableError); !ok || !again.RetryAt.Equal(unavailable.RetryAt) {
+		t.Fatalf("Expect the reconnection to be backed off, got %v", err)
+	}
+
+	server, _, _ = listen(t, net.JoinHostPort(host, strconv.Itoa(port)), respond)
+	defer server.Close()
+	time.Sleep(time.Until(unavailable.RetryAt))
+	response, err := c.SendCommand("list")
+	if err != nil || response != "online" {
+		t.Errorf("Expect the client to reconnect once the backoff elapsed, got %q (%v)", response, err)
+	}
+}
+
+func TestCommandIsNotSentTwice(t *testing.T) {
+	viper.Set("RCONTimeout", "100ms")
+	defer viper.Set("RCONTimeout", nil)
+	var mu sync.Mutex
+	sent := 0
+	mc := minecraft("secret", nil)
+	// The game server runs the command but the answer never arrives
+	server, host, port := listen(t, "", func(p packet) []packet {
+		if p.kind == 2 && p.body == "whitelist add player" {
+			mu.Lock()
+			sent++
+			mu.Unlock()
+			return nil
+		}
+		return mc(p)
+	})
+	defer server.Close()
+	c, err := rcon.NewClient(host, port, "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if _, err = c.SendCommand("whitelist add player"); err == nil {
+		t.Fatal("Expect the command to time out")
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if sent != 1 {
+		t.Errorf("Expect the command to be sent once, sent %d times", sent)
+	}
+}
+
+func TestHealthCheck(t *testing.T) {
+	viper.Set("RCONHealthCheckInterval", "20ms")
+	defer viper.Set("RCONHealthCheckInterval", nil)
+	pings := make(chan struct{}, 100)
+	mc := minecraft("secret", nil)
+	server, host, port := listen(t, "", func(p packet) []packet {
+		if p.kind == 0 {
+			pings <- struct{}{}
+		}
+		return mc(p)
+	})
+	defer server.Close()
+	c, err := rcon.NewClient(host, port, "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	select {
+	case <-pings:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Expect idle connections to be checked")
+	}
+}
@@ -0,0 +1,173 @@
+package rcon
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+var (
+	// formattingCode matches the colour and style codes such as §a that servers and plugins add to responses
+	formattingCode = regexp.MustCompile("§.")
+	// banEntry matches an entry of the ban list, e.g. "Steve was banned by Server: Griefing"
+	banEntry = regexp.MustCompile(`(\w{1,16}) was banned by `)
+)
+
+// Outcomes of a command on the game server
+const (
+	// OutcomeSuccess means the command changed the game server
+	OutcomeSuccess = "success"
+	// OutcomeNoop means the game server was already in the wanted state, e.g. the player was whitelisted before
+	OutcomeNoop = "noop"
+	// OutcomeFailure means the game server rejected the command, e.g. for an unknown player. Sending it again does not help
+	OutcomeFailure = "failure"
+)
+
+// Result is the interpreted response to a command
+type Result struct {
+	Outcome string
+	// Reason describes a no-op or failure, e.g. "unknown player"
+	Reason   string
+	Response string
+}
+
+// responsePattern classifies the responses that contain match, in lower case
+type responsePattern struct {
+	match   string
+	outcome string
+	reason  string
+}
+
+// commandPatterns holds the known responses of vanilla and Bukkit based servers by command.
+// Responses to commands that are not listed here, or that match no pattern, count as success
+var commandPatterns = map[string][]responsePattern{
+	"whitelist add": {
+		{"already whitelisted", OutcomeNoop, "already whitelisted"},
+		{"does not exist", OutcomeFailure, "unknown player"},
+		{"could not add", OutcomeFailure, "unknown player"},
+	},
+	"whitelist remove": {
+		{"not whitelisted", OutcomeNoop, "not whitelisted"},
+		{"does not exist", OutcomeFailure, "unknown player"},
+		{"could not remove", OutcomeFailure, "unknown player"},
+	},
+	"ban": {
+		{"already banned", OutcomeNoop, "already banned"},
+		{"does not exist", OutcomeFailure, "unknown player"},
+		{"could not ban", OutcomeFailure, "unknown player"},
+	},
+	"pardon": {
+		{"isn't banned", OutcomeNoop, "not banned"},
+		{"is not banned", OutcomeNoop, "not banned"},
+		// Older servers answer this for players that are not banned
+		{"could not unban", OutcomeNoop, "not banned"},
+	},
+	"kick": {
+		{"no player was found", OutcomeNoop, "player not online"},
+		{"can't be found", OutcomeNoop, "player not online"},
+		{"cannot be found", OutcomeNoop, "player not online"},
+	},
+}
+
+// commonPatterns apply to the responses of all commands
+var commonPatterns = []responsePattern{
+	{"unknown or incomplete command", OutcomeFailure, "unknown command"},
+	{"unknown command", OutcomeFailure, "unknown command"},
+	{"do not have permission", OutcomeFailure, "permission denied"},
+}
+
+// ParseResult interprets the response of the game server to the command. Minecraft answers
+// rejected commands with plain text, such as "That player does not exist", instead of an error
+func ParseResult(command, response string) Result {
+	result := Result{Outcome: OutcomeSuccess, Response: StripFormatting(response)}
+	text := strings.ToLower(result.Response)
+	patterns := commonPatterns
+	for name, p := range commandPatterns {
+		if strings.HasPrefix(command, name+" ") {
+			patterns = append(append([]responsePattern{}, p...), commonPatterns...)
+			break
+		}
+	}
+	for _, p := range patterns {
+		if strings.Contains(text, p.match) {
+			result.Outcome, result.Reason = p.outcome, p.reason
+			break
+		}
+	}
+	return result
+}
+
+// StripFormatting removes the colour and style codes from a response
+func StripFormatting(response string) string {
+	return formattingCode.ReplaceAllString(response, "")
+}
+
+// ParseWhitelist returns the players in the response to "whitelist list", e.g.
+// "There are 2 whitelisted players: Steve, Alex" or "There are no whitelisted players"
+func ParseWhitelist(response string) ([]string, error) {
+	response = strings.TrimSpace(StripFormatting(response))
+	i := strings.Index(response, ":")
+	if i < 0 {
+		if strings.Contains(response, "no whitelisted players") {
+			return []string{}, nil
+		}
+		return nil, fmt.Errorf("Unexpected response to whitelist list: %q", response)
+	}
+	return splitPlayers(response[i+1:]), nil
+}
+
+// ParseBanlist returns the players in the response to "banlist players". Recent servers list
+// one "<player> was banned by <source>: <reason>" entry per ban, older ones the names after the header.
+// Entries are not always separated in responses sent over RCON, so a reason that ends with a
+// letter or digit runs into the next name, e.g. "GriefingSteve". Such names are matched against
+// the known banned players, the one whose name ends the merged name is taken. Names that match
+// no known player or more than one can not be told apart from the reason and are returned as an error
+func ParseBanlist(response string, banned []string) ([]string, error) {
+	response = strings.TrimSpace(StripFormatting(response))
+	if strings.Contains(response, "There are no bans") || strings.Contains(response, "no banned players") {
+		return []string{}, nil
+	}
+	i := strings.Index(response, ":")
+	if i < 0 {
+		return nil, fmt.Errorf("Unexpected response to banlist: %q", response)
+	}
+	list := response[i+1:]
+	entries := banEntry.FindAllStringSubmatchIndex(list, -1)
+	if len(entries) == 0 {
+		return splitPlayers(list), nil
+	}
+	players := make([]string, 0, len(entries))
+	for _, entry := range entries {
+		start, end := entry[2], entry[3]
+		player := list[start:end]
+		// A name right after a space may carry the end of the reason of the entry before.
+		// Names only hold 16 characters, longer runs of the reason are cut off before the match
+		if start > 0 && (list[start-1] == ' ' || isWordChar(list[start-1])) {
+			matches := []string{}
+			for _, name := range banned {
+				if strings.HasSuffix(strings.ToLower(player), strings.ToLower(name)) {
+					matches = append(matches, name)
+				}
+			}
+			if len(matches) != 1 {
+				return nil, fmt.Errorf("Ambiguous entry %q in the banlist, the reason may run into the name", player)
+			}
+			player = player[len(player)-len(matches[0]):]
+		}
+		players = append(players, player)
+	}
+	return players, nil
+}
+
+// isWordChar returns whether c may be part of a player name
+func isWordChar(c byte) bool {
+	return c == '_' || '0' <= c && c <= '9' || 'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z'
+}
+
+// splitPlayers splits a list of player names such as "Steve, Alex and Notch"
+func splitPlayers(list string) []string {
+	list = strings.Replace(list, " and ", ",", -1)
+	return append([]string{}, strings.FieldsFunc(list, func(r rune) bool {
+		return r == ',' || r == '\n' || r == ' '
+	})...)
+}
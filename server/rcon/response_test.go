@@ -0,0 +1,82 @@
+package rcon_test
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/tywin1104/mc-gatekeeper/rcon"
+)
+
+func TestParseWhitelist(t *testing.T) {
+	for response, want := range map[string][]string{
+		"There are 2 whitelisted players: Steve, Alex":             {"Steve", "Alex"},
+		"There are 3 whitelisted player(s): Steve, Alex and Notch": {"Steve", "Alex", "Notch"},
+		"There are 1 (out of 2 seen) whitelisted players:\nSteve":  {"Steve"},
+		"§6There are 1 whitelisted players: §aSteve":               {"Steve"},
+		"There are no whitelisted players":                         {},
+		"There are 0 whitelisted players: ":                        {},
+	} {
+		got, err := rcon.ParseWhitelist(response)
+		if err != nil || !reflect.DeepEqual(got, want) {
+			t.Errorf("Expect %v for %q, got %v (%v)", want, response, got, err)
+		}
+	}
+	if _, err := rcon.ParseWhitelist("Unknown command"); err == nil {
+		t.Error("Expect unexpected responses to be rejected")
+	}
+}
+
+func TestParseBanlist(t *testing.T) {
+	banned := []string{"Steve", "Alex"}
+	for response, want := range map[string][]string{
+		"There are 2 ban(s):Steve was banned by Server: Banned by an operator.Alex was banned by Notch: Griefing.": {"Steve", "Alex"},
+		"There are 1 ban(s):\nSteve was banned by Rcon: Spam":                                                      {"Steve"},
+		"There are 2 total banned players:\nSteve, Alex":                                                           {"Steve", "Alex"},
+		"There are no bans": {},
+		// The reason of the first entry runs into the name of the second
+		"There are 2 ban(s):Steve was banned by Notch: GriefingAlex was banned by Notch: Spam":     {"Steve", "Alex"},
+		"There are 2 ban(s):Steve was banned by Notch: for griefingalex was banned by Notch: Spam": {"Steve", "alex"},
+	} {
+		got, err := rcon.ParseBanlist(response, banned)
+		if err != nil || !reflect.DeepEqual(got, want) {
+			t.Errorf("Expect %v for %q, got %v (%v)", want, response, got, err)
+		}
+	}
+	if _, err := rcon.ParseBanlist("Unknown command", banned); err == nil {
+		t.Error("Expect unexpected responses to be rejected")
+	}
+	for _, known := range [][]string{{"Steve"}, {"Steve", "Alex", "gAlex"}} {
+		if _, err := rcon.ParseBanlist("There are 2 ban(s):Steve was banned by Notch: GriefingAlex was banned by Notch: Spam", known); err == nil {
+			t.Errorf("Expect merged names that do not match exactly one of %v to be rejected", known)
+		}
+	}
+}
+
+func TestParseResult(t *testing.T) {
+	for _, c := range []struct {
+		command, response string
+		outcome, reason   string
+	}{
+		{"whitelist add Steve", "Added Steve to the whitelist", rcon.OutcomeSuccess, ""},
+		{"whitelist add Steve", "Player is already whitelisted", rcon.OutcomeNoop, "already whitelisted"},
+		{"whitelist add Stvee", "That player does not exist", rcon.OutcomeFailure, "unknown player"},
+		{"whitelist add Stvee", "§cCould not add Stvee to the whitelist", rcon.OutcomeFailure, "unknown player"},
+		{"whitelist remove Steve", "Removed Steve from the whitelist", rcon.OutcomeSuccess, ""},
+		{"whitelist remove Steve", "Player is not whitelisted", rcon.OutcomeNoop, "not whitelisted"},
+		{"ban Steve Griefing", "Banned Steve: Griefing", rcon.OutcomeSuccess, ""},
+		{"ban Steve", "Nothing changed. The player is already banned", rcon.OutcomeNoop, "already banned"},
+		{"ban Stvee", "That player does not exist", rcon.OutcomeFailure, "unknown player"},
+		{"pardon Steve", "Unbanned Steve", rcon.OutcomeSuccess, ""},
+		{"pardon Steve", "Nothing changed. The player isn't banned", rcon.OutcomeNoop, "not banned"},
+		{"kick Steve", "Kicked Steve: Kicked by an operator", rcon.OutcomeSuccess, ""},
+		{"kick Steve", "No player was found", rcon.OutcomeNoop, "player not online"},
+		{"whitelist add Steve", "Unknown or incomplete command, see below for error", rcon.OutcomeFailure, "unknown command"},
+		{"whitelist add Steve", "", rcon.OutcomeSuccess, ""},
+		{"say hello", "That player does not exist", rcon.OutcomeSuccess, ""},
+	} {
+		result := rcon.ParseResult(c.command, c.response)
+		if result.Outcome != c.outcome || result.Reason != c.reason {
+			t.Errorf("Expect %s (%s) for %q answered with %q, got %+v", c.outcome, c.reason, c.command, c.response, result)
+		}
+	}
+}
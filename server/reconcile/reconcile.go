@@ -0,0 +1,516 @@
+package reconcile
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/spf13/viper"
+	"github.com/tywin1104/mc-gatekeeper/broker"
+	"github.com/tywin1104/mc-gatekeeper/db"
+	"github.com/tywin1104/mc-gatekeeper/gameserver"
+	"github.com/tywin1104/mc-gatekeeper/importer"
+	"github.com/tywin1104/mc-gatekeeper/privacy"
+	"github.com/tywin1104/mc-gatekeeper/rcon"
+	"github.com/tywin1104/mc-gatekeeper/types"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// Actor recorded in the history of requests changed by the reconciliation
+const Actor = "system"
+
+// Directions in which drift is corrected
+const (
+	// CorrectNone only reports the drift
+	CorrectNone = "none"
+	// CorrectServer changes the game servers to match the requests
+	CorrectServer = "server"
+	// CorrectDatabase changes the requests to match the game servers and imports the players added in-game
+	CorrectDatabase = "database"
+)
+
+// Kinds of drift between a game server and the requests
+const (
+	// MissingFromWhitelist is an approved player who is not on the whitelist of the game server
+	MissingFromWhitelist = "missingFromWhitelist"
+	// UnexpectedOnWhitelist is a player on the whitelist of the game server without an approved request
+	UnexpectedOnWhitelist = "unexpectedOnWhitelist"
+	// MissingFromBanlist is a banned player who is not banned on the game server
+	MissingFromBanlist = "missingFromBanlist"
+	// UnexpectedOnBanlist is a player banned on the game server without a banned request
+	UnexpectedOnBanlist = "unexpectedOnBanlist"
+)
+
+// Defaults used when reconciliation.interval or reconciliation.gracePeriod are not configured
+const (
+	defaultInterval    = time.Hour
+	defaultGracePeriod = 10 * time.Minute
+)
+
+// GameServers sends commands to the configured game servers by name
+type GameServers interface {
+	SendCommand(server, command string) (string, error)
+}
+
+// Drift is a player whose state on a game server differs from the requests
+type Drift struct {
+	Server    string `json:"server"`
+	Player    string `json:"player"`
+	Kind      string `json:"kind"`
+	RequestID string `json:"requestId,omitempty"`
+	Corrected bool   `json:"corrected"`
+	// Error tells why the drift could not be corrected
+	Error string `json:"error,omitempty"`
+}
+
+// ServerReport is the state found on one game server
+type ServerReport struct {
+	Name        string `json:"name"`
+	Whitelisted int    `json:"whitelisted"`
+	Banned      int    `json:"banned"`
+	// Error tells why the lists of the game server could not be read. The game server is skipped
+	Error string `json:"error,omitempty"`
+}
+
+// Report is the drift found in one reconciliation
+type Report struct {
+	StartedAt  time.Time      `json:"startedAt"`
+	FinishedAt time.Time      `json:"finishedAt"`
+	Correct    string         `json:"correct"`
+	Servers    []ServerReport `json:"servers"`
+	Drift      []Drift        `json:"drift"`
+}
+
+// Corrected returns the number of drifts that were corrected
+func (r Report) Corrected() int {
+	corrected := 0
+	for _, d := range r.Drift {
+		if d.Corrected {
+			corrected++
+		}
+	}
+	return corrected
+}
+
+// Enabled returns whether the game servers are reconciled periodically
+func Enabled() bool {
+	return viper.GetBool("reconciliation.enabled")
+}
+
+// Interval returns how often the game servers are reconciled
+func Interval() time.Duration {
+	if interval := viper.GetDuration("reconciliation.interval"); interval > 0 {
+		return interval
+	}
+	return defaultInterval
+}
+
+// GracePeriod returns how long players are skipped after their request changed, so that
+// the worker can carry out the change on the game servers first
+func GracePeriod() time.Duration {
+	if !viper.IsSet("reconciliation.gracePeriod") {
+		return defaultGracePeriod
+	}
+	return viper.GetDuration("reconciliation.gracePeriod")
+}
+
+// Correction returns the configured direction in which drift is corrected
+func Correction() string {
+	if correct := viper.GetString("reconciliation.correct"); correct != "" {
+		return correct
+	}
+	return CorrectNone
+}
+
+// ValidateCorrection checks that correct is a known direction
+func ValidateCorrection(correct string) error {
+	switch correct {
+	case CorrectNone, CorrectServer, CorrectDatabase:
+		return nil
+	}
+	return fmt.Errorf("Invalid correction %s. Allowed values: [%s, %s, %s]", correct, CorrectNone, CorrectServer, CorrectDatabase)
+}
+
+// Reconciler compares the whitelist and ban list of the game servers with the requests
+type Reconciler struct {
+	store   db.RequestStore
+	servers GameServers
+	// running keeps runs from overlapping, mu guards last
+	running sync.Mutex
+	mu      sync.Mutex
+	last    *Report
+}
+
+// New creates a reconciler that reads the lists of the game servers through servers
+func New(store db.RequestStore, servers GameServers) *Reconciler {
+	return &Reconciler{store: store, servers: servers}
+}
+
+// LastReport returns the report of the last run, if any
+func (r *Reconciler) LastReport() (Report, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.last == nil {
+		return Report{}, false
+	}
+	return *r.last, true
+}
+
+// Run lists the whitelist and bans of every game server, reports the drift from the approved
+// and banned requests and corrects it in the given direction. Players whose request changed
+// within the GracePeriod are skipped. Changes to requests are carried out on the game servers
+// by the worker through the tasks stored in the outbox along with each change
+func (r *Reconciler) Run(correct string) (Report, error) {
+	if err := ValidateCorrection(correct); err != nil {
+		return Report{}, err
+	}
+	r.running.Lock()
+	defer r.running.Unlock()
+	now := time.Now()
+	report := Report{StartedAt: now, Correct: correct, Servers: []ServerReport{}, Drift: []Drift{}}
+	s, err := loadState(r.store, now)
+	if err != nil {
+		return report, err
+	}
+	for _, target := range s.targets {
+		serverReport, drift := r.compare(target, s)
+		report.Servers = append(report.Servers, serverReport)
+		report.Drift = append(report.Drift, drift...)
+	}
+	sort.Slice(report.Drift, func(i, j int) bool {
+		a, b := report.Drift[i], report.Drift[j]
+		if a.Server != b.Server {
+			return a.Server < b.Server
+		}
+		if a.Kind != b.Kind {
+			return a.Kind < b.Kind
+		}
+		return a.Player < b.Player
+	})
+	switch correct {
+	case CorrectServer:
+		r.correctServers(report.Drift, s)
+	case CorrectDatabase:
+		r.correctDatabase(report.Drift, s, now)
+	}
+	report.FinishedAt = time.Now()
+	r.mu.Lock()
+	r.last = &report
+	r.mu.Unlock()
+	return report, nil
+}
+
+// state holds the requests the game servers are compared with
+type state struct {
+	targets []gameserver.Target
+	// requests are the approved and banned requests of players that were not changed recently,
+	// by ID, along with the game servers they target
+	requests map[string]types.WhitelistRequest
+	servers  map[string]map[string]bool
+	// approved holds the approved requests by lower case username
+	approved map[string]types.WhitelistRequest
+	// recent holds the lower case usernames of the requests changed within the grace period
+	recent map[string]bool
+	// anonymisedBans holds the username hashes of banned requests whose personal data was removed
+	anonymisedBans map[string]bool
+	// banned holds the usernames of all banned requests, to tell them apart in the banlists
+	banned []string
+	// whitelisted holds the players on the whitelist of each game server by name, by lower case username
+	whitelisted map[string]map[string]string
+}
+
+func loadState(store db.RequestStore, now time.Time) (*state, error) {
+	targets, err := gameserver.Targets()
+	if err != nil {
+		return nil, err
+	}
+	s := &state{
+		targets:        targets,
+		requests:       map[string]types.WhitelistRequest{},
+		servers:        map[string]map[string]bool{},
+		approved:       map[string]types.WhitelistRequest{},
+		recent:         map[string]bool{},
+		anonymisedBans: map[string]bool{},
+		whitelisted:    map[string]map[string]string{},
+	}
+	recent, err := store.GetRequests(-1, bson.M{"lastUpdatedTimestamp": bson.M{"$gt": now.Add(-GracePeriod())}})
+	if err != nil {
+		return nil, err
+	}
+	for _, request := range recent {
+		s.recent[strings.ToLower(request.Username)] = true
+	}
+	requests, err := store.GetRequests(-1, bson.M{
+		"status": bson.M{"$in": []string{types.StatusApproved, types.StatusBanned}},
+	})
+	if err != nil {
+		return nil, err
+	}
+	for _, request := range requests {
+		if request.Username == "" {
+			if request.Status == types.StatusBanned && request.UsernameHash != "" {
+				s.anonymisedBans[request.UsernameHash] = true
+			}
+			continue
+		}
+		if request.Status == types.StatusBanned {
+			s.banned = append(s.banned, request.Username)
+		}
+		if s.recent[strings.ToLower(request.Username)] {
+			continue
+		}
+		resolved, err := gameserver.Resolve(request.Servers)
+		if err != nil {
+			return nil, err
+		}
+		servers := map[string]bool{}
+		for _, target := range resolved {
+			servers[target.Name] = true
+		}
+		id := request.ID.Hex()
+		s.requests[id] = request
+		s.servers[id] = servers
+		if request.Status == types.StatusApproved {
+			s.approved[strings.ToLower(request.Username)] = request
+		}
+	}
+	return s, nil
+}
+
+// isAnonymisedBan returns whether the player was banned by a request whose personal data was removed
+func (s *state) isAnonymisedBan(player string) bool {
+	for _, hash := range privacy.UsernameHashes(player) {
+		if s.anonymisedBans[hash] {
+			return true
+		}
+	}
+	return false
+}
+
+// covers returns whether servers include every game server the request targets
+func (s *state) covers(request types.WhitelistRequest, servers []string) bool {
+	found := map[string]bool{}
+	for _, server := range servers {
+		found[server] = true
+	}
+	for server := range s.servers[request.ID.Hex()] {
+		if !found[server] {
+			return false
+		}
+	}
+	return true
+}
+
+// compare lists the whitelist and bans of the game server and returns the drift from the requests
+func (r *Reconciler) compare(target gameserver.Target, s *state) (ServerReport, []Drift) {
+	report := ServerReport{Name: target.Name}
+	whitelist, err := r.list(target.Name, "whitelist list", rcon.ParseWhitelist)
+	if err != nil {
+		report.Error = err.Error()
+		return report, nil
+	}
+	banlist, err := r.list(target.Name, "banlist players", func(response string) ([]string, error) {
+		return rcon.ParseBanlist(response, s.banned)
+	})
+	if err != nil {
+		report.Error = err.Error()
+		return report, nil
+	}
+	report.Whitelisted, report.Banned = len(whitelist), len(banlist)
+	s.whitelisted[target.Name] = whitelist
+
+	drift := []Drift{}
+	// Banned players may stay on the whitelist, the ban keeps them out
+	expectedOnWhitelist, expectedOnBanlist := map[string]bool{}, map[string]bool{}
+	for id, request := range s.requests {
+		if !s.servers[id][target.Name] {
+			continue
+		}
+		username := strings.ToLower(request.Username)
+		expectedOnWhitelist[username] = true
+		if request.Status == types.StatusBanned {
+			expectedOnBanlist[username] = true
+			if _, ok := banlist[username]; !ok {
+				drift = append(drift, Drift{Server: target.Name, Player: request.Username, Kind: MissingFromBanlist, RequestID: id})
+			}
+		} else if _, ok := whitelist[username]; !ok {
+			drift = append(drift, Drift{Server: target.Name, Player: request.Username, Kind: MissingFromWhitelist, RequestID: id})
+		}
+	}
+	for username, player := range whitelist {
+		if !expectedOnWhitelist[username] && !s.recent[username] {
+			drift = append(drift, Drift{Server: target.Name, Player: player, Kind: UnexpectedOnWhitelist})
+		}
+	}
+	for username, player := range banlist {
+		if !expectedOnBanlist[username] && !s.recent[username] && !s.isAnonymisedBan(player) {
+			drift = append(drift, Drift{Server: target.Name, Player: player, Kind: UnexpectedOnBanlist})
+		}
+	}
+	return report, drift
+}
+
+// list sends the command to the game server and returns the players in the response by lower case name.
+// Minecraft player names are case insensitive
+func (r *Reconciler) list(server, command string, parse func(string) ([]string, error)) (map[string]string, error) {
+	response, err := r.servers.SendCommand(server, command)
+	if err != nil {
+		return nil, err
+	}
+	names, err := parse(response)
+	if err != nil {
+		return nil, err
+	}
+	players := make(map[string]string, len(names))
+	for _, name := range names {
+		players[strings.ToLower(name)] = name
+	}
+	return players, nil
+}
+
+// correctServers sends the commands that bring the game servers in line with the requests
+func (r *Reconciler) correctServers(drift []Drift, s *state) {
+	for i, d := range drift {
+		var command string
+		switch d.Kind {
+		case MissingFromWhitelist:
+			command = "whitelist add " + d.Player
+		case UnexpectedOnWhitelist:
+			command = "whitelist remove " + d.Player
+		case MissingFromBanlist:
+			command = "ban " + d.Player
+			if reason := s.requests[d.RequestID].BanReason; reason != "" {
+				command += " " + reason
+			}
+		case UnexpectedOnBanlist:
+			command = "pardon " + d.Player
+		}
+		response, err := r.servers.SendCommand(d.Server, command)
+		if err != nil {
+			drift[i].Error = err.Error()
+			continue
+		}
+		if result := rcon.ParseResult(command, response); result.Outcome == rcon.OutcomeFailure {
+			drift[i].Error = "Game server rejected the command: " + result.Reason
+			continue
+		}
+		drift[i].Corrected = true
+	}
+}
+
+// correctDatabase changes the requests to match the game servers. The drift of a player is
+// corrected across all game servers at once. Requests are only changed if the player drifted on
+// every game server the request targets, players added in-game are imported for the game
+// servers they were found on
+func (r *Reconciler) correctDatabase(drift []Drift, s *state, now time.Time) {
+	groups := map[string][]int{}
+	keys := []string{}
+	for i, d := range drift {
+		key := d.Kind + "/" + strings.ToLower(d.Player)
+		if _, ok := groups[key]; !ok {
+			keys = append(keys, key)
+		}
+		groups[key] = append(groups[key], i)
+	}
+	for _, key := range keys {
+		indexes := groups[key]
+		servers := make([]string, len(indexes))
+		for i, index := range indexes {
+			servers[i] = drift[index].Server
+		}
+		reason := r.correctRequest(drift[indexes[0]], servers, s, now)
+		for _, index := range indexes {
+			drift[index].Corrected = reason == ""
+			drift[index].Error = reason
+		}
+	}
+}
+
+// correctRequest changes or imports the request of the drifted player. It returns why the drift
+// could not be corrected, or an empty string
+func (r *Reconciler) correctRequest(d Drift, servers []string, s *state, now time.Time) string {
+	switch d.Kind {
+	case MissingFromWhitelist, MissingFromBanlist:
+		request := s.requests[d.RequestID]
+		if !s.covers(request, servers) {
+			return "Player is on the other game servers of the request"
+		}
+		if d.Kind == MissingFromWhitelist {
+			return transition(r.store, request, types.StatusDeactivated, "Not whitelisted on the game servers", now)
+		}
+		// A pardoned player who is still whitelisted plays again, so the request is approved. Deactivating
+		// it would remove the player from the whitelist, which the game servers never asked for
+		for _, server := range servers {
+			if _, ok := s.whitelisted[server][strings.ToLower(d.Player)]; !ok {
+				return "Player is neither banned nor whitelisted on the game servers"
+			}
+		}
+		return transition(r.store, request, types.StatusApproved, "Pardoned on the game servers", now)
+	case UnexpectedOnBanlist:
+		if request, ok := s.approved[strings.ToLower(d.Player)]; ok && s.covers(request, servers) {
+			return transition(r.store, request, types.StatusBanned, "Banned on the game servers", now)
+		}
+		return importPlayer(r.store, importer.Files{BannedPlayers: []importer.BannedPlayer{{Player: importer.Player{Name: d.Player}}}}, servers, s)
+	default:
+		return importPlayer(r.store, importer.Files{Whitelist: []importer.Player{{Name: d.Player}}}, servers, s)
+	}
+}
+
+// importPlayer imports the player added in-game on the game servers
+func importPlayer(store db.RequestStore, files importer.Files, servers []string, s *state) string {
+	if len(servers) < len(s.targets) {
+		files.Servers = servers
+	}
+	report, err := importer.Import(store, files)
+	if err != nil {
+		return err.Error()
+	}
+	if len(report.Skipped) > 0 {
+		return report.Skipped[0].Reason
+	}
+	return ""
+}
+
+// transition changes the status of the request unless it was changed since it was read.
+// It returns why the request could not be changed, or an empty string
+func transition(store db.RequestStore, request types.WhitelistRequest, newStatus, note string, now time.Time) string {
+	taskType, err := broker.TaskTypeForTransition(request.Status, newStatus)
+	if err != nil {
+		return err.Error()
+	}
+	set := bson.M{
+		"status":               newStatus,
+		"lastUpdatedTimestamp": now,
+	}
+	if request.Status == types.StatusBanned {
+		set["banReason"] = ""
+		set["bannedUntil"] = time.Time{}
+		set["statusBeforeBan"] = ""
+	} else if newStatus == types.StatusBanned {
+		set["statusBeforeBan"] = request.Status
+	}
+	_, err = store.UpdateRequest(bson.M{
+		"_id":     request.ID,
+		"status":  request.Status,
+		"version": request.Version,
+	}, bson.M{
+		"$set": set,
+		"$push": bson.M{"history": types.StatusChange{
+			Actor:     Actor,
+			OldStatus: request.Status,
+			NewStatus: newStatus,
+			Note:      note,
+			Source:    types.SourceReconciliation,
+			Timestamp: now,
+		}},
+		"$inc": bson.M{"version": 1},
+	}, db.NewOutboxEntry(taskType))
+	if err == db.ErrNotFound {
+		return "Request was changed during the reconciliation"
+	} else if err != nil {
+		return err.Error()
+	}
+	return ""
+}
@@ -0,0 +1,285 @@
+package reconcile_test
+
+import (
+	"errors"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/spf13/viper"
+	"github.com/tywin1104/mc-gatekeeper/broker"
+	"github.com/tywin1104/mc-gatekeeper/db"
+	"github.com/tywin1104/mc-gatekeeper/db/dbtest"
+	"github.com/tywin1104/mc-gatekeeper/privacy"
+	"github.com/tywin1104/mc-gatekeeper/reconcile"
+	"github.com/tywin1104/mc-gatekeeper/types"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// gameServers answers the list commands with fixed responses and records all other commands
+type gameServers struct {
+	responses map[string]string
+	sent      []string
+}
+
+func (g *gameServers) SendCommand(server, command string) (string, error) {
+	if response, ok := g.responses[server+"/"+command]; ok {
+		return response, nil
+	}
+	if command == "whitelist list" || command == "banlist players" {
+		return "", errors.New("game server is down")
+	}
+	g.sent = append(g.sent, server+"/"+command)
+	if strings.HasSuffix(command, " Denied") {
+		return "That player does not exist", nil
+	}
+	return "", nil
+}
+
+// decide stores a request of the player with the given status, last changed at the given time
+func decide(t *testing.T, store db.RequestStore, username, status string, changedAt time.Time) {
+	id, err := store.CreateRequest(types.WhitelistRequest{Username: username, Email: username + "@gmail.com"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = store.UpdateRequest(bson.M{"_id": id}, bson.M{
+		"$set": bson.M{"status": status, "lastUpdatedTimestamp": changedAt},
+		"$inc": bson.M{"version": 1},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// setUp stores requests that drift from the default game server in every possible way
+func setUp(t *testing.T) (*db.SQLService, *gameServers) {
+	viper.Set("gameServers", nil)
+	viper.Set("reconciliation.gracePeriod", "10m")
+	store := dbtest.NewSQLite(t)
+	longAgo := time.Now().Add(-time.Hour)
+	decide(t, store, "Steve", types.StatusApproved, longAgo)
+	decide(t, store, "Alex", types.StatusApproved, longAgo)
+	decide(t, store, "Griefer", types.StatusBanned, longAgo)
+	decide(t, store, "Denied", types.StatusDenied, longAgo)
+	// Just approved, the worker has yet to whitelist the player
+	decide(t, store, "Newcomer", types.StatusApproved, time.Now())
+	servers := &gameServers{responses: map[string]string{
+		"default/whitelist list":  "There are 3 whitelisted players: steve, Notch, Denied",
+		"default/banlist players": "There are 1 ban(s):Herobrine was banned by Server: Banned by an operator.",
+	}}
+	return store, servers
+}
+
+func driftKinds(report reconcile.Report) []string {
+	kinds := []string{}
+	for _, d := range report.Drift {
+		kinds = append(kinds, d.Kind+" "+d.Player)
+	}
+	sort.Strings(kinds)
+	return kinds
+}
+
+func TestRunReportsDrift(t *testing.T) {
+	defer viper.Set("reconciliation.gracePeriod", nil)
+	store, servers := setUp(t)
+	defer store.Close()
+	r := reconcile.New(store, servers)
+	if _, ok := r.LastReport(); ok {
+		t.Error("Expect no report before the first run")
+	}
+
+	report, err := r.Run(reconcile.CorrectNone)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{
+		"missingFromBanlist Griefer",
+		"missingFromWhitelist Alex",
+		"unexpectedOnBanlist Herobrine",
+		"unexpectedOnWhitelist Denied",
+		"unexpectedOnWhitelist Notch",
+	}
+	if got := driftKinds(report); !reflect.DeepEqual(got, want) {
+		t.Errorf("Expect drift %v, got %v", want, got)
+	}
+	if report.Corrected() != 0 || len(servers.sent) != 0 {
+		t.Errorf("Expect the drift to be reported only, got %+v and commands %v", report, servers.sent)
+	}
+	if last, ok := r.LastReport(); !ok || len(last.Drift) != len(report.Drift) {
+		t.Errorf("Expect the report to be kept, got %+v", last)
+	}
+	if _, err = r.Run("sometimes"); err == nil {
+		t.Error("Expect unknown directions to be rejected")
+	}
+}
+
+func TestRunCorrectsServers(t *testing.T) {
+	defer viper.Set("reconciliation.gracePeriod", nil)
+	store, servers := setUp(t)
+	defer store.Close()
+
+	report, err := reconcile.New(store, servers).Run(reconcile.CorrectServer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Players the game server does not know can not be removed
+	if report.Corrected() != len(report.Drift)-1 {
+		t.Errorf("Expect all drift but Denied to be corrected, got %+v", report)
+	}
+	sort.Strings(servers.sent)
+	want := []string{
+		"default/ban Griefer",
+		"default/pardon Herobrine",
+		"default/whitelist add Alex",
+		"default/whitelist remove Denied",
+		"default/whitelist remove Notch",
+	}
+	if !reflect.DeepEqual(servers.sent, want) {
+		t.Errorf("Expect commands %v, got %v", want, servers.sent)
+	}
+}
+
+func TestRunCorrectsDatabase(t *testing.T) {
+	defer viper.Set("reconciliation.gracePeriod", nil)
+	store, servers := setUp(t)
+	defer store.Close()
+	// Pardoned in-game but still whitelisted
+	decide(t, store, "Pardoned", types.StatusBanned, time.Now().Add(-time.Hour))
+	servers.responses["default/whitelist list"] = "There are 4 whitelisted players: steve, Notch, Denied, Pardoned"
+
+	report, err := reconcile.New(store, servers).Run(reconcile.CorrectDatabase)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(servers.sent) != 0 {
+		t.Errorf("Expect the game server to be left alone, got %v", servers.sent)
+	}
+	// Griefer is neither banned nor whitelisted, so there is no status the request can be changed to
+	for _, d := range report.Drift {
+		if d.Corrected == (d.Player == "Griefer") {
+			t.Errorf("Expect all drift but Griefer to be corrected, got %+v", d)
+		}
+	}
+	for username, status := range map[string]string{
+		"Alex":      types.StatusDeactivated,
+		"Griefer":   types.StatusBanned,
+		"Pardoned":  types.StatusApproved,
+		"Notch":     types.StatusApproved,
+		"Herobrine": types.StatusBanned,
+	} {
+		requests, _ := store.GetRequests(-1, bson.M{"username": username, "status": status})
+		if len(requests) != 1 {
+			t.Errorf("Expect %s to be %s", username, status)
+		}
+	}
+	alex, _ := store.GetRequests(1, bson.M{"username": "Alex"})
+	history := alex[0].History
+	if history[len(history)-1].Source != types.SourceReconciliation {
+		t.Errorf("Expect the change to be recorded as reconciliation, got %+v", history)
+	}
+
+	// Status changes come with their task for the worker
+	pending, err := store.PendingOutbox(10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	taskTypes := []string{}
+	for _, entry := range pending {
+		taskTypes = append(taskTypes, entry.TaskType)
+	}
+	sort.Strings(taskTypes)
+	if want := []string{broker.TaskDeactivation, broker.TaskUnban}; !reflect.DeepEqual(taskTypes, want) {
+		t.Errorf("Expect tasks %v, got %v", want, taskTypes)
+	}
+}
+
+func TestRunAcrossGameServers(t *testing.T) {
+	defer viper.Set("gameServers", nil)
+	defer viper.Set("reconciliation.gracePeriod", nil)
+	store, servers := setUp(t)
+	defer store.Close()
+	viper.Set("gameServers", []map[string]interface{}{
+		{"name": "survival", "host": "localhost", "port": 25575},
+		{"name": "creative", "host": "localhost", "port": 25576},
+	})
+	servers.responses = map[string]string{
+		"survival/whitelist list":  "There are 3 whitelisted players: Steve, Griefer, Notch",
+		"survival/banlist players": "There are 1 ban(s):Griefer was banned by Server: Griefing",
+	}
+
+	report, err := reconcile.New(store, servers).Run(reconcile.CorrectDatabase)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Servers[1].Error == "" {
+		t.Errorf("Expect the game server that is down to be reported, got %+v", report.Servers)
+	}
+	// Alex may still be whitelisted on creative, Notch is imported for survival only
+	alex, _ := store.GetRequests(1, bson.M{"username": "Alex"})
+	if alex[0].Status != types.StatusApproved {
+		t.Errorf("Expect requests to be left alone while a game server is down, got %s", alex[0].Status)
+	}
+	notch, _ := store.GetRequests(1, bson.M{"username": "Notch"})
+	if len(notch) != 1 || !reflect.DeepEqual(notch[0].Servers, []string{"survival"}) {
+		t.Errorf("Expect Notch to be imported for survival only, got %+v", notch)
+	}
+}
+
+func TestRunMatchesMergedBans(t *testing.T) {
+	defer viper.Set("reconciliation.gracePeriod", nil)
+	store, servers := setUp(t)
+	defer store.Close()
+	// The reason of the ban of Herobrine runs into the name of Griefer
+	servers.responses["default/banlist players"] = "There are 2 ban(s):Herobrine was banned by Server: GriefingGriefer was banned by Server: Griefing"
+
+	report, err := reconcile.New(store, servers).Run(reconcile.CorrectDatabase)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, d := range report.Drift {
+		if d.Player == "Griefer" || d.Player == "GriefingGriefer" {
+			t.Errorf("Expect Griefer to be found on the banlist, got %+v", d)
+		}
+	}
+	griefer, _ := store.GetRequests(-1, bson.M{"username": "Griefer"})
+	if len(griefer) != 1 || griefer[0].Status != types.StatusBanned {
+		t.Errorf("Expect Griefer to stay banned, got %+v", griefer)
+	}
+	if merged, _ := store.GetRequests(-1, bson.M{"username": "GriefingGriefer"}); len(merged) != 0 {
+		t.Errorf("Expect no request for the merged name, got %+v", merged)
+	}
+
+	// A merged name that matches no banned player is not corrected
+	servers.responses["default/banlist players"] = "There are 2 ban(s):Griefer was banned by Server: GriefingEntity303 was banned by Server: Griefing"
+	report, err = reconcile.New(store, servers).Run(reconcile.CorrectDatabase)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Servers[0].Error == "" || len(report.Drift) != 0 {
+		t.Errorf("Expect the banlist to be reported as ambiguous, got %+v", report)
+	}
+}
+
+func TestRunRecognisesAnonymisedBans(t *testing.T) {
+	defer viper.Set("reconciliation.gracePeriod", nil)
+	store, servers := setUp(t)
+	defer store.Close()
+	// The applicant typed the name in another capitalisation than the game server lists it
+	decide(t, store, "HEROBRINE", types.StatusBanned, time.Now().Add(-time.Hour))
+	banned, _ := store.GetRequests(1, bson.M{"username": "HEROBRINE"})
+	if err := privacy.Anonymise(store, banned[0]); err != nil {
+		t.Fatal(err)
+	}
+
+	report, err := reconcile.New(store, servers).Run(reconcile.CorrectNone)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, d := range report.Drift {
+		if d.Player == "Herobrine" {
+			t.Errorf("Expect the ban of the anonymised request to be expected, got %+v", d)
+		}
+	}
+}
@@ -3,11 +3,18 @@ package server
 import (
 	"encoding/json"
 	"errors"
+	"fmt"
+	"math"
 	"net/http"
+	"strings"
 	"time"
 
 	"github.com/sirupsen/logrus"
 	"github.com/spf13/viper"
+	"github.com/tywin1104/mc-gatekeeper/broker"
+	"github.com/tywin1104/mc-gatekeeper/db"
+	"github.com/tywin1104/mc-gatekeeper/expiry"
+	"github.com/tywin1104/mc-gatekeeper/gameserver"
 	"github.com/tywin1104/mc-gatekeeper/types"
 	"github.com/tywin1104/mc-gatekeeper/utils"
 	"go.mongodb.org/mongo-driver/bson"
@@ -15,27 +22,84 @@ import (
 )
 
 // Update the request object's metadata and add corresponding task to broker
-func (svc *Service) updateRequestByID(requestID string, reqBody []byte, admin string) (types.WhitelistRequest, int, error) {
+// The status transition is recorded in the request history on behalf of the admin
+func (svc *Service) updateRequestByID(request types.WhitelistRequest, reqBody []byte, admin, source string) (types.WhitelistRequest, int, error) {
 	log := svc.logger
+	requestID := request.ID.Hex()
 	var requestedChange bson.M
-	json.Unmarshal(reqBody, &requestedChange)
+	if err := json.Unmarshal(reqBody, &requestedChange); err != nil || requestedChange == nil {
+		return types.WhitelistRequest{}, http.StatusBadRequest, errors.New("Unable to unmarshal request body")
+	}
+	// The update only applies if the request is still at the version the client saw
+	v, ok := requestedChange["version"]
+	if !ok {
+		return types.WhitelistRequest{}, http.StatusPreconditionRequired, errors.New("The version of the request is required")
+	}
+	version, isNumber := v.(float64)
+	if !isNumber || version != math.Trunc(version) {
+		return types.WhitelistRequest{}, http.StatusBadRequest, errors.New("Invalid version")
+	}
+	seenVersion := int64(version)
+	delete(requestedChange, "version")
+	if seenVersion != request.Version {
+		return types.WhitelistRequest{}, http.StatusConflict, &versionConflictError{current: request}
+	}
+	statusCode, err := validateRequestedChange(request, requestedChange)
+	if err != nil {
+		return types.WhitelistRequest{}, statusCode, err
+	}
+	now := time.Now()
+	statusCode, err = applyExpiry(request, requestedChange, now)
+	if err != nil {
+		return types.WhitelistRequest{}, statusCode, err
+	}
+	statusCode, err = applyBan(request, requestedChange, now)
+	if err != nil {
+		return types.WhitelistRequest{}, statusCode, err
+	}
 	// Update the admin field to be the op'e email behind adm email token
 	requestedChange["admin"] = admin
+	update := bson.M{}
 	// update timestamp metadata according to different type of status change
-	if newStatus, ok := requestedChange["status"]; ok {
-		if newStatus == "Approved" || newStatus == "Denied" {
-			requestedChange["processedTimestamp"] = time.Now()
-			requestedChange["lastUpdatedTimestamp"] = time.Now()
-		} else if newStatus == "Deactivated" || newStatus == "Banned" {
-			requestedChange["lastUpdatedTimestamp"] = time.Now()
+	newStatus, transition := requestedChange["status"].(string)
+	if transition {
+		if newStatus == types.StatusApproved || newStatus == types.StatusDenied {
+			requestedChange["processedTimestamp"] = now
+			requestedChange["lastUpdatedTimestamp"] = now
+		} else if newStatus == types.StatusDeactivated || newStatus == types.StatusBanned {
+			requestedChange["lastUpdatedTimestamp"] = now
 		}
+		note, _ := requestedChange["note"].(string)
+		update["$push"] = bson.M{"history": types.StatusChange{
+			Actor:     admin,
+			OldStatus: request.Status,
+			NewStatus: newStatus,
+			Note:      note,
+			Source:    source,
+			Timestamp: now,
+		}}
+	}
+	update["$set"] = requestedChange
+	update["$inc"] = bson.M{"version": 1}
+	// Only status transitions result in work for the worker. The task is stored in the
+	// outbox along with the change and published to the broker by the outbox relay
+	outbox := []db.OutboxEntry{}
+	if transition {
+		taskType, err := broker.TaskTypeForTransition(request.Status, newStatus)
+		if err != nil {
+			return types.WhitelistRequest{}, http.StatusBadRequest, err
+		}
+		outbox = append(outbox, db.NewOutboxEntry(taskType))
 	}
 
-	_id, _ := primitive.ObjectIDFromHex(requestID)
-	updatedRequest, err := svc.dbService.UpdateRequest(bson.D{{"_id", _id}}, bson.M{
-		"$set": requestedChange,
-	})
-	if err != nil {
+	updatedRequest, err := svc.dbService.UpdateRequest(bson.M{
+		"_id":     request.ID,
+		"version": versionCondition(seenVersion),
+	}, update, outbox...)
+	if err == db.ErrNotFound {
+		// Someone else updated the request in the meantime
+		return types.WhitelistRequest{}, http.StatusConflict, svc.newVersionConflictError(request)
+	} else if err != nil {
 		log.WithFields(logrus.Fields{
 			"err":             err.Error(),
 			"requestID":       requestID,
@@ -43,22 +107,239 @@ func (svc *Service) updateRequestByID(requestID string, reqBody []byte, admin st
 		}).Error("Unable to update request")
 		return types.WhitelistRequest{}, http.StatusInternalServerError, errors.New("Unable to update request")
 	}
-	// Add updated request to the broker for worker to process
 	// convert bson.M to struct
 	var updatedRequestObj types.WhitelistRequest
 	bsonBytes, _ := bson.Marshal(updatedRequest)
 	bson.Unmarshal(bsonBytes, &updatedRequestObj)
+	return updatedRequestObj, http.StatusOK, nil
+}
 
-	// Publish the updatedRequestObj to broker
-	err = svc.broker.Publish(updatedRequestObj)
-	if err != nil {
-		log.WithFields(logrus.Fields{
-			"error":             err.Error(),
-			"updatedReqeustObj": updatedRequestObj,
-		}).Error("Unable to publish message to broker")
-		return types.WhitelistRequest{}, http.StatusInternalServerError, errors.New("Unable to update request")
+// versionCondition matches the given request version. Requests stored before
+// versioning was introduced have no version field and are treated as version 0
+func versionCondition(version int64) interface{} {
+	if version == 0 {
+		return bson.M{"$in": []interface{}{int64(0), nil}}
 	}
-	return updatedRequestObj, http.StatusOK, nil
+	return version
+}
+
+// versionConflictError is returned when the request was updated by someone else
+// after the client last saw it
+type versionConflictError struct {
+	current types.WhitelistRequest
+}
+
+func (e *versionConflictError) Error() string {
+	if e.current.Status == "" {
+		return "Request was updated by someone else. Reload and try again"
+	}
+	msg := fmt.Sprintf("Request was updated by someone else and is now %s at version %d", strings.ToLower(e.current.Status), e.current.Version)
+	if change := e.statusChange(); change.Actor != "" {
+		msg += fmt.Sprintf(". It was %s by %s", strings.ToLower(change.NewStatus), change.Actor)
+	}
+	return msg + ". Reload and try again"
+}
+
+// statusChange returns the change that set the current status of the conflicting request. Later
+// changes that kept the status, e.g. edits of the note, are skipped
+func (e *versionConflictError) statusChange() types.StatusChange {
+	for i := len(e.current.History) - 1; i >= 0; i-- {
+		if change := e.current.History[i]; change.NewStatus == e.current.Status {
+			return change
+		}
+	}
+	return types.StatusChange{}
+}
+
+// newVersionConflictError reloads the request to report who updated it first
+func (svc *Service) newVersionConflictError(request types.WhitelistRequest) error {
+	current, err := svc.dbService.GetRequests(1, bson.M{"_id": request.ID})
+	if err != nil || len(current) == 0 {
+		svc.logger.WithFields(logrus.Fields{
+			"requestID": request.ID.Hex(),
+		}).Warn("Unable to reload request after version conflict")
+		return &versionConflictError{}
+	}
+	return &versionConflictError{current: current[0]}
+}
+
+// writeUpdateError responds with the error returned by updateRequestByID.
+// Version conflicts include the current status and version and who set the status
+func writeUpdateError(w http.ResponseWriter, err error, statusCode int) {
+	conflict, ok := err.(*versionConflictError)
+	if !ok {
+		http.Error(w, err.Error(), statusCode)
+		return
+	}
+	change := conflict.statusChange()
+	msg := map[string]interface{}{
+		"message":   conflict.Error(),
+		"status":    conflict.current.Status,
+		"version":   conflict.current.Version,
+		"decidedBy": change.Actor,
+		"decidedAt": change.Timestamp,
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusConflict)
+	json.NewEncoder(w).Encode(msg)
+}
+
+// Fields of a request that can be changed through the PATCH endpoints
+var patchableFields = map[string]bool{
+	"status":      true,
+	"note":        true,
+	"expiresAt":   true,
+	"expiresIn":   true,
+	"banReason":   true,
+	"banDuration": true,
+	"servers":     true,
+}
+
+// validateRequestedChange only allows whitelisted fields to be patched and
+// enforces the status transition table for status changes
+func validateRequestedChange(request types.WhitelistRequest, requestedChange bson.M) (int, error) {
+	for field := range requestedChange {
+		if !patchableFields[field] {
+			return http.StatusBadRequest, fmt.Errorf("Field %s can not be updated", field)
+		}
+	}
+	if note, ok := requestedChange["note"]; ok {
+		if _, isString := note.(string); !isString {
+			return http.StatusBadRequest, errors.New("Invalid note")
+		}
+	}
+	if servers, ok := requestedChange["servers"]; ok {
+		names, err := serverNames(servers)
+		if err != nil {
+			return http.StatusBadRequest, err
+		}
+		requestedChange["servers"] = names
+	}
+	newStatus, ok := requestedChange["status"]
+	if !ok {
+		return http.StatusOK, nil
+	}
+	status, isString := newStatus.(string)
+	if !isString || !types.IsValidStatus(status) {
+		return http.StatusBadRequest, fmt.Errorf("Invalid status %v", newStatus)
+	}
+	if !types.CanTransition(request.Status, status) {
+		return http.StatusConflict, fmt.Errorf("Illegal status transition from %s to %s", request.Status, status)
+	}
+	return http.StatusOK, nil
+}
+
+// serverNames validates the game servers targeted by a requested change. The names
+// are decoded from a JSON list of names of game servers or groups
+func serverNames(servers interface{}) ([]string, error) {
+	list, ok := servers.([]interface{})
+	if !ok {
+		return nil, errors.New("Invalid servers. Expected a list of game server names")
+	}
+	names := make([]string, 0, len(list))
+	for _, server := range list {
+		name, isString := server.(string)
+		if !isString {
+			return nil, errors.New("Invalid servers. Expected a list of game server names")
+		}
+		names = append(names, name)
+	}
+	if err := gameserver.Validate(names); err != nil {
+		return nil, err
+	}
+	return names, nil
+}
+
+// applyExpiry turns expiresAt (RFC 3339 or null) or expiresIn (such as "30d" or "72h") of the
+// requested change into the expiry of the membership. An expiry can be set when approving and
+// changed while the request is approved. Any other status change clears it
+func applyExpiry(request types.WhitelistRequest, requestedChange bson.M, now time.Time) (int, error) {
+	expiresAt, hasExpiresAt := requestedChange["expiresAt"]
+	expiresIn, hasExpiresIn := requestedChange["expiresIn"]
+	delete(requestedChange, "expiresIn")
+	newStatus, transition := requestedChange["status"].(string)
+	if !hasExpiresAt && !hasExpiresIn {
+		if transition {
+			requestedChange["expiresAt"] = time.Time{}
+			requestedChange["expiryWarnedAt"] = time.Time{}
+		}
+		return http.StatusOK, nil
+	}
+	if hasExpiresAt && hasExpiresIn {
+		return http.StatusBadRequest, errors.New("Only one of expiresAt and expiresIn can be given")
+	}
+	status := request.Status
+	if transition {
+		status = newStatus
+	}
+	if status != types.StatusApproved {
+		return http.StatusBadRequest, errors.New("An expiry can only be set for approved requests")
+	}
+	// A null expiresAt makes the membership permanent
+	until := time.Time{}
+	if hasExpiresIn {
+		s, _ := expiresIn.(string)
+		d, err := expiry.ParseDuration(s)
+		if err != nil {
+			return http.StatusBadRequest, fmt.Errorf("Invalid expiresIn: %s", err.Error())
+		}
+		until = now.Add(d)
+	} else if expiresAt != nil {
+		s, _ := expiresAt.(string)
+		t, err := time.Parse(time.RFC3339, s)
+		if err != nil {
+			return http.StatusBadRequest, errors.New("Invalid expiresAt. Expected a RFC 3339 timestamp")
+		}
+		if !t.After(now) {
+			return http.StatusBadRequest, errors.New("expiresAt must be in the future")
+		}
+		until = t
+	}
+	requestedChange["expiresAt"] = until
+	requestedChange["expiryWarnedAt"] = time.Time{}
+	return http.StatusOK, nil
+}
+
+// applyBan turns banReason and banDuration (such as "7d" or "12h") of the requested change into
+// the terms of the ban. Bans without a duration are permanent. Lifting a ban clears its terms
+func applyBan(request types.WhitelistRequest, requestedChange bson.M, now time.Time) (int, error) {
+	reason, hasReason := requestedChange["banReason"]
+	duration, hasDuration := requestedChange["banDuration"]
+	delete(requestedChange, "banDuration")
+	newStatus, transition := requestedChange["status"].(string)
+	if !transition || newStatus != types.StatusBanned {
+		if hasReason || hasDuration {
+			return http.StatusBadRequest, errors.New("A ban reason and duration can only be given when banning")
+		}
+		if transition && request.Status == types.StatusBanned {
+			requestedChange["banReason"] = ""
+			requestedChange["bannedUntil"] = time.Time{}
+			requestedChange["statusBeforeBan"] = ""
+		}
+		return http.StatusOK, nil
+	}
+	banReason := ""
+	if hasReason {
+		s, isString := reason.(string)
+		if !isString {
+			return http.StatusBadRequest, errors.New("Invalid banReason")
+		}
+		// The reason ends up in the ban command sent to the game server
+		banReason = strings.Join(strings.Fields(s), " ")
+	}
+	until := time.Time{}
+	if hasDuration {
+		s, _ := duration.(string)
+		d, err := expiry.ParseDuration(s)
+		if err != nil {
+			return http.StatusBadRequest, fmt.Errorf("Invalid banDuration: %s", err.Error())
+		}
+		until = now.Add(d)
+	}
+	requestedChange["banReason"] = banReason
+	requestedChange["bannedUntil"] = until
+	requestedChange["statusBeforeBan"] = request.Status
+	return http.StatusOK, nil
 }
 
 // Get request object from db by encrypted and url-encoded request ID
@@ -0,0 +1,168 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+
+	"github.com/gorilla/mux"
+	"github.com/sirupsen/logrus"
+	"github.com/tywin1104/mc-gatekeeper/broker"
+)
+
+// deadLetterSummary describes a dead letter in the list of dead letters
+type deadLetterSummary struct {
+	MessageID  string `json:"messageId"`
+	Reason     string `json:"reason"`
+	DeathCount int64  `json:"deathCount"`
+	TaskType   string `json:"taskType,omitempty"`
+	RequestID  string `json:"requestId,omitempty"`
+	Username   string `json:"username,omitempty"`
+	Status     string `json:"status,omitempty"`
+}
+
+// Page size of the dead letter list when no limit is given, and the largest one allowed
+const (
+	defaultDeadLetterLimit = 50
+	maxDeadLetterLimit     = 500
+)
+
+// HandleGetDeadLetters lists the tasks the worker failed to process for authenticated admin user.
+// The list is paged with the offset and limit URL parameters
+func (svc *Service) HandleGetDeadLetters() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		offset, limit := 0, defaultDeadLetterLimit
+		var err error
+		if v := r.URL.Query().Get("offset"); v != "" {
+			if offset, err = strconv.Atoi(v); err != nil || offset < 0 {
+				http.Error(w, "Invalid offset", http.StatusBadRequest)
+				return
+			}
+		}
+		if v := r.URL.Query().Get("limit"); v != "" {
+			if limit, err = strconv.Atoi(v); err != nil || limit < 1 || limit > maxDeadLetterLimit {
+				http.Error(w, fmt.Sprintf("Invalid limit. Allowed values: 1 to %d", maxDeadLetterLimit), http.StatusBadRequest)
+				return
+			}
+		}
+		deadLetters, err := svc.broker.DeadLetters(offset, limit)
+		if err != nil {
+			http.Error(w, "Unable to get dead letters", http.StatusInternalServerError)
+			svc.logger.WithFields(logrus.Fields{
+				"err": err.Error(),
+			}).Error("Unable to get dead letters")
+			return
+		}
+		summaries := make([]deadLetterSummary, 0, len(deadLetters))
+		for _, d := range deadLetters {
+			summary := deadLetterSummary{
+				MessageID:  d.MessageID,
+				Reason:     d.Reason,
+				DeathCount: d.DeathCount,
+			}
+			// Messages that cannot be decoded are still listed so they can be discarded
+			if task, err := d.Task(); err == nil {
+				summary.TaskType = task.Type
+				summary.RequestID = task.Request.ID.Hex()
+				summary.Username = task.Request.Username
+				summary.Status = task.Request.Status
+			}
+			summaries = append(summaries, summary)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(map[string]interface{}{"deadLetters": summaries, "offset": offset, "limit": limit})
+	}
+}
+
+// HandleGetDeadLetter returns a dead letter with the decoded task for authenticated admin user
+func (svc *Service) HandleGetDeadLetter() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		d, err := svc.broker.DeadLetter(mux.Vars(r)["messageId"])
+		if err == broker.ErrDeadLetterNotFound {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		} else if err != nil {
+			http.Error(w, "Unable to get dead letter", http.StatusInternalServerError)
+			svc.logger.WithFields(logrus.Fields{
+				"err": err.Error(),
+			}).Error("Unable to get dead letter")
+			return
+		}
+		msg := map[string]interface{}{"deadLetter": d}
+		if task, err := d.Task(); err == nil {
+			msg["task"] = task
+		} else {
+			msg["body"] = string(d.Body)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(msg)
+	}
+}
+
+// HandleReplayDeadLetters moves the given dead letters back to the task queue for authenticated admin user
+func (svc *Service) HandleReplayDeadLetters() http.HandlerFunc {
+	return svc.handleDeadLetterAction("replay", svc.broker.ReplayDeadLetters)
+}
+
+// HandleDiscardDeadLetters deletes the given dead letters for authenticated admin user
+func (svc *Service) HandleDiscardDeadLetters() http.HandlerFunc {
+	return svc.handleDeadLetterAction("discard", svc.broker.DiscardDeadLetters)
+}
+
+// handleDeadLetterAction applies action to the dead letters listed in the request body
+func (svc *Service) handleDeadLetterAction(name string, action func(ids []string) ([]string, error)) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var body struct {
+			IDs []string `json:"ids"`
+		}
+		reqBody, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			http.Error(w, "Unable to read request body", http.StatusBadRequest)
+			return
+		}
+		if err = json.Unmarshal(reqBody, &body); err != nil {
+			http.Error(w, "Unable to unmarshal request body", http.StatusBadRequest)
+			return
+		}
+		if len(body.IDs) == 0 {
+			http.Error(w, "No dead letter ids given", http.StatusBadRequest)
+			return
+		}
+		done, err := action(body.IDs)
+		if err != nil {
+			svc.logger.WithFields(logrus.Fields{
+				"err":    err.Error(),
+				"action": name,
+				"done":   done,
+			}).Error("Unable to " + name + " dead letters")
+			http.Error(w, "Unable to "+name+" dead letters", http.StatusInternalServerError)
+			return
+		}
+		notFound := []string{}
+		for _, id := range body.IDs {
+			if !contains(done, id) {
+				notFound = append(notFound, id)
+			}
+		}
+		svc.logger.WithFields(logrus.Fields{
+			"action": name,
+			"ids":    done,
+		}).Info("Applied action to dead letters")
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(map[string]interface{}{"message": "success", "ids": done, "notFound": notFound})
+	}
+}
+
+func contains(ids []string, id string) bool {
+	for _, i := range ids {
+		if i == id {
+			return true
+		}
+	}
+	return false
+}
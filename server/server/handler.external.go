@@ -5,10 +5,15 @@ import (
 	"errors"
 	"io/ioutil"
 	"net/http"
+	"time"
 
 	"github.com/gorilla/mux"
 	"github.com/sirupsen/logrus"
 	"github.com/spf13/viper"
+	"github.com/tywin1104/mc-gatekeeper/broker"
+	"github.com/tywin1104/mc-gatekeeper/db"
+	"github.com/tywin1104/mc-gatekeeper/gameserver"
+	"github.com/tywin1104/mc-gatekeeper/privacy"
 	"github.com/tywin1104/mc-gatekeeper/types"
 	"github.com/tywin1104/mc-gatekeeper/utils"
 	"go.mongodb.org/mongo-driver/bson"
@@ -34,28 +39,65 @@ func (svc *Service) HandleGetRequestByID() http.HandlerFunc {
 			"age":       request.Age,
 			"_id":       request.ID.Hex(),
 			"gender":    request.Gender,
+			"history":   publicHistory(request.History),
+			"version":   request.Version,
 		}}
 		w.WriteHeader(http.StatusOK)
 		json.NewEncoder(w).Encode(msg)
 	}
 }
 
+// publicHistory trims the status history down to what can be shown to the applicant
+func publicHistory(history []types.StatusChange) []map[string]interface{} {
+	trimmed := make([]map[string]interface{}, 0, len(history))
+	for _, change := range history {
+		trimmed = append(trimmed, map[string]interface{}{
+			"status":    change.NewStatus,
+			"timestamp": change.Timestamp,
+		})
+	}
+	return trimmed
+}
+
+// applicationForm holds the fields of a request the applicant fills in. All other fields,
+// such as the status, version and expiry, are owned by the server
+type applicationForm struct {
+	Username string                 `json:"username"`
+	Email    string                 `json:"email"`
+	Age      int64                  `json:"age"`
+	Gender   string                 `json:"gender"`
+	Info     map[string]interface{} `json:"info"`
+	Servers  []string               `json:"servers"`
+}
+
+func (f applicationForm) request() types.WhitelistRequest {
+	return types.WhitelistRequest{
+		Username: f.Username,
+		Email:    f.Email,
+		Age:      f.Age,
+		Gender:   f.Gender,
+		Info:     f.Info,
+		Servers:  f.Servers,
+	}
+}
+
 // HandleCreateRequest create new request
 func (svc *Service) HandleCreateRequest() http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		log := svc.logger
 		// Validate request body
-		var newRequest types.WhitelistRequest
+		var form applicationForm
 		reqBody, err := ioutil.ReadAll(r.Body)
 		if err != nil {
 			http.Error(w, "Unable to read request body", http.StatusBadRequest)
 			return
 		}
-		err = json.Unmarshal(reqBody, &newRequest)
+		err = json.Unmarshal(reqBody, &form)
 		if err != nil {
 			http.Error(w, "Unable to unmarshal request body", http.StatusInternalServerError)
 			return
 		}
+		newRequest := form.request()
 
 		// Validate new request
 		statusCode, err := svc.validateCreateRequest(&newRequest)
@@ -65,7 +107,9 @@ func (svc *Service) HandleCreateRequest() http.HandlerFunc {
 		}
 
 		// Add to db
-		newRequestID, err := svc.dbService.CreateRequest(newRequest)
+		// The task for the worker is stored in the outbox along with the new request
+		// and published to the broker by the outbox relay
+		newRequestID, err := svc.dbService.CreateRequest(newRequest, db.NewOutboxEntry(broker.TaskNewRequest))
 		if err != nil {
 			http.Error(w, "Unable to create new request", http.StatusInternalServerError)
 			log.WithFields(logrus.Fields{
@@ -74,20 +118,6 @@ func (svc *Service) HandleCreateRequest() http.HandlerFunc {
 			}).Error("Unable to create new request")
 			return
 		}
-		// Add new whitelist request to the message queue for worker to process
-		// Need to fill in the ID field as it is generated from the db side
-		newRequest.ID = newRequestID
-		// Set initial status to be pending
-		newRequest.Status = "Pending"
-		err = svc.broker.Publish(newRequest)
-		if err != nil {
-			http.Error(w, "Unable to create new request", http.StatusInternalServerError)
-			log.WithFields(logrus.Fields{
-				"error":      err.Error(),
-				"newRequest": newRequest,
-			}).Error("Unable to publish message to broker")
-			return
-		}
 
 		w.WriteHeader(http.StatusCreated)
 		msg := map[string]interface{}{"message": "success", "created": newRequestID}
@@ -112,9 +142,9 @@ func (svc *Service) HandlePatchRequestByID() http.HandlerFunc {
 			http.Error(w, "Tokens do not match", http.StatusBadRequest)
 			return
 		}
-		// Only update a request if its status is still pending
-		if request.Status != "Pending" {
-			http.Error(w, "Request is already fulfilled", http.StatusBadRequest)
+		// Ops can only decide on requests that are still pending. The response tells who decided first
+		if request.Status != types.StatusPending {
+			writeUpdateError(w, &versionConflictError{current: request}, http.StatusConflict)
 			return
 		}
 		reqBody, err := ioutil.ReadAll(r.Body)
@@ -123,9 +153,9 @@ func (svc *Service) HandlePatchRequestByID() http.HandlerFunc {
 			return
 		}
 		// Update the request in db and add new task to broker
-		updatedRequest, statusCode, err := svc.updateRequestByID(request.ID.Hex(), reqBody, opEmail)
+		updatedRequest, statusCode, err := svc.updateRequestByID(request, reqBody, opEmail, types.SourceEmail)
 		if err != nil {
-			http.Error(w, err.Error(), statusCode)
+			writeUpdateError(w, err, statusCode)
 			return
 		}
 		w.Header().Set("Content-Type", "application/json")
@@ -136,10 +166,22 @@ func (svc *Service) HandlePatchRequestByID() http.HandlerFunc {
 }
 
 func (svc *Service) validateCreateRequest(newRequest *types.WhitelistRequest) (int, error) {
+	// Anonymised requests have an empty username, which must never match an applicant
+	if newRequest.Username == "" {
+		return http.StatusBadRequest, errors.New("Username is required")
+	}
+	// Applicants may pick the game servers they apply for
+	if err := gameserver.Validate(newRequest.Servers); err != nil {
+		return http.StatusBadRequest, err
+	}
 	// Prevent new request from a approved or pending username
+	// Bans of anonymised requests are matched by the hash of the username
 	foundRequests, err := svc.dbService.GetRequests(-1, bson.M{
-		"username": newRequest.Username,
-		"status":   bson.M{"$in": []string{"Pending", "Approved", "Banned"}},
+		"$or": []bson.M{
+			{"username": newRequest.Username},
+			{"usernameHash": bson.M{"$in": privacy.UsernameHashes(newRequest.Username)}},
+		},
+		"status": bson.M{"$in": []string{"Pending", "Approved", "Banned"}},
 	})
 	if err != nil {
 		svc.logger.WithFields(logrus.Fields{
@@ -161,6 +203,9 @@ func (svc *Service) validateCreateRequest(newRequest *types.WhitelistRequest) (i
 			return http.StatusUnprocessableEntity, errors.New(message)
 		} else if foundRequest.Status == "Banned" {
 			message = "The user has been banned from the server"
+			if !foundRequest.BannedUntil.IsZero() {
+				message += " until " + foundRequest.BannedUntil.UTC().Format(time.RFC3339)
+			}
 			return http.StatusForbidden, errors.New(message)
 		}
 	}
@@ -2,43 +2,110 @@ package server
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io/ioutil"
 	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/gorilla/mux"
 	"github.com/sirupsen/logrus"
+	"github.com/tywin1104/mc-gatekeeper/broker"
+	"github.com/tywin1104/mc-gatekeeper/db"
+	"github.com/tywin1104/mc-gatekeeper/gameserver"
+	"github.com/tywin1104/mc-gatekeeper/importer"
+	"github.com/tywin1104/mc-gatekeeper/types"
 	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/bson/primitive"
 )
 
 // HandleGetRequests handle get requests from authenticated admin user
+// The result is filtered, sorted and paginated on the server side. Without query parameters
+// the first page of the newest requests is returned
 func (svc *Service) HandleGetRequests() http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		log := svc.logger
-		var msg map[string]interface{}
-		// Try to fetch value from cache first
-		cachedRequests, err := svc.cache.GetAllRequests()
-		if err != nil {
-			log.Debug("Fetch result from db")
-			requests, err := svc.dbService.GetRequests(-1, bson.D{{}})
-			if err != nil {
-				http.Error(w, "Unable to get all requests", http.StatusInternalServerError)
-				log.WithFields(logrus.Fields{
-					"err": err.Error(),
-				}).Error("Unable to get all requests")
-				return
+		svc.handleQueryRequests(w, r)
+	}
+}
+
+// handleQueryRequests serves one page of requests matching the query parameters
+func (svc *Service) handleQueryRequests(w http.ResponseWriter, r *http.Request) {
+	query, err := parseRequestQuery(r.URL.Query())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	page, err := svc.dbService.QueryRequests(query)
+	if err == db.ErrInvalidCursor {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	} else if err != nil {
+		http.Error(w, "Unable to query requests", http.StatusInternalServerError)
+		svc.logger.WithFields(logrus.Fields{
+			"err":   err.Error(),
+			"query": r.URL.RawQuery,
+		}).Error("Unable to query requests")
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(page)
+}
+
+// parseRequestQuery builds the db query from URL parameters:
+// page, pageSize, cursor, status (comma separated), admin, from, to (RFC3339), sort, order (asc|desc) and q
+func parseRequestQuery(values url.Values) (db.RequestQuery, error) {
+	var query db.RequestQuery
+	var err error
+	if page := values.Get("page"); page != "" {
+		query.Page, err = strconv.ParseInt(page, 10, 64)
+		if err != nil || query.Page < 1 {
+			return db.RequestQuery{}, errors.New("Invalid page")
+		}
+	}
+	if pageSize := values.Get("pageSize"); pageSize != "" {
+		query.PageSize, err = strconv.ParseInt(pageSize, 10, 64)
+		if err != nil || query.PageSize < 1 {
+			return db.RequestQuery{}, errors.New("Invalid pageSize")
+		}
+	}
+	query.Cursor = values.Get("cursor")
+	for _, status := range values["status"] {
+		for _, s := range strings.Split(status, ",") {
+			if s = strings.TrimSpace(s); s != "" {
+				query.Statuses = append(query.Statuses, s)
 			}
-			msg = map[string]interface{}{"requests": requests}
-		} else {
-			log.Debug("Got cached results")
-			msg = map[string]interface{}{"requests": cachedRequests}
 		}
-		w.Header().Set("Content-Type", "application/json")
-		w.WriteHeader(http.StatusOK)
-		json.NewEncoder(w).Encode(msg)
 	}
+	query.Admin = values.Get("admin")
+	if from := values.Get("from"); from != "" {
+		query.From, err = parseTimestamp(from)
+		if err != nil {
+			return db.RequestQuery{}, errors.New("Invalid from timestamp")
+		}
+	}
+	if to := values.Get("to"); to != "" {
+		query.To, err = parseTimestamp(to)
+		if err != nil {
+			return db.RequestQuery{}, errors.New("Invalid to timestamp")
+		}
+	}
+	query.SortBy = values.Get("sort")
+	if query.SortBy != "" && !db.SortKeys[query.SortBy] {
+		return db.RequestQuery{}, errors.New("Invalid sort key")
+	}
+	switch values.Get("order") {
+	case "", "desc":
+	case "asc":
+		query.Ascending = true
+	default:
+		return db.RequestQuery{}, errors.New("Invalid order")
+	}
+	query.Search = strings.TrimSpace(values.Get("q"))
+	return query, nil
 }
 
 // HandleInternalPatchRequestByID handle patch request from authenticated admin user
@@ -59,9 +126,9 @@ func (svc *Service) HandleInternalPatchRequestByID() http.HandlerFunc {
 			return
 		}
 		if len(foundRequests) > 0 {
-			updatedRequest, statusCode, err := svc.updateRequestByID(requestID, reqBody, "admin")
+			updatedRequest, statusCode, err := svc.updateRequestByID(foundRequests[0], reqBody, "admin", types.SourceDashboard)
 			if err != nil {
-				http.Error(w, err.Error(), statusCode)
+				writeUpdateError(w, err, statusCode)
 				return
 			}
 			w.Header().Set("Content-Type", "application/json")
@@ -76,6 +143,150 @@ func (svc *Service) HandleInternalPatchRequestByID() http.HandlerFunc {
 	}
 }
 
+// HandleImportPlayers creates requests for the players whitelisted or banned on an existing
+// Minecraft server for authenticated admin user
+func (svc *Service) HandleImportPlayers() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var files importer.Files
+		reqBody, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			http.Error(w, "Unable to read request body", http.StatusBadRequest)
+			return
+		}
+		if err = json.Unmarshal(reqBody, &files); err != nil {
+			http.Error(w, "Unable to unmarshal request body", http.StatusBadRequest)
+			return
+		}
+		if err = gameserver.Validate(files.Servers); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		report, err := importer.Import(svc.dbService, files)
+		if err == importer.ErrNothingToImport {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		// Players imported before a failure are kept, so always re-sync the cache
+		if len(report.Imported) > 0 {
+			svc.resyncCache()
+		}
+		if err != nil {
+			svc.logger.WithFields(logrus.Fields{
+				"err": err.Error(),
+			}).Error("Unable to import players")
+			http.Error(w, "Unable to import players", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(map[string]interface{}{"message": "success", "report": report})
+	}
+}
+
+// HandleGetRequestHistory returns the status history of a request for authenticated admin user
+func (svc *Service) HandleGetRequestHistory() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		_id, err := primitive.ObjectIDFromHex(mux.Vars(r)["requestId"])
+		if err != nil {
+			http.Error(w, "Invalid requestId", http.StatusBadRequest)
+			return
+		}
+		foundRequests, err := svc.dbService.GetRequests(1, bson.M{"_id": _id})
+		if err != nil {
+			http.Error(w, "Unable to get request", http.StatusInternalServerError)
+			svc.logger.WithFields(logrus.Fields{
+				"err":       err.Error(),
+				"requestID": _id.Hex(),
+			}).Error("Unable to get request")
+			return
+		}
+		if len(foundRequests) == 0 {
+			http.Error(w, "Resource not found", http.StatusNotFound)
+			return
+		}
+		history := foundRequests[0].History
+		if history == nil {
+			history = []types.StatusChange{}
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(map[string]interface{}{"history": history})
+	}
+}
+
+// HandleEnqueueTask enqueues a task such as resending the confirmation email for a request
+// for authenticated admin user
+func (svc *Service) HandleEnqueueTask() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		_id, err := primitive.ObjectIDFromHex(mux.Vars(r)["requestId"])
+		if err != nil {
+			http.Error(w, "Invalid requestId", http.StatusBadRequest)
+			return
+		}
+		var body struct {
+			Type string `json:"type"`
+		}
+		reqBody, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			http.Error(w, "Unable to read request body", http.StatusBadRequest)
+			return
+		}
+		if err = json.Unmarshal(reqBody, &body); err != nil {
+			http.Error(w, "Unable to unmarshal request body", http.StatusBadRequest)
+			return
+		}
+		requiredStatus, ok := broker.ManualTasks[body.Type]
+		if !ok {
+			http.Error(w, "Invalid task type. Allowed values: ["+broker.TaskResendConfirmation+", "+broker.TaskRedispatch+", "+broker.TaskReapplyWhitelist+"]", http.StatusBadRequest)
+			return
+		}
+		foundRequests, err := svc.dbService.GetRequests(1, bson.M{"_id": _id})
+		if err != nil {
+			http.Error(w, "Unable to get request", http.StatusInternalServerError)
+			svc.logger.WithFields(logrus.Fields{
+				"err":       err.Error(),
+				"requestID": _id.Hex(),
+			}).Error("Unable to get request")
+			return
+		}
+		if len(foundRequests) == 0 {
+			http.Error(w, "Resource not found", http.StatusNotFound)
+			return
+		}
+		request := foundRequests[0]
+		if request.Status != requiredStatus {
+			http.Error(w, "Task "+body.Type+" requires status "+requiredStatus+", request is "+request.Status, http.StatusConflict)
+			return
+		}
+		entry := db.NewOutboxEntry(body.Type)
+		// Every manual task is carried out, even if the same one was enqueued before
+		entry.IdempotencyKey = broker.NewTask(body.Type, request).IdempotencyKey + ":" + strconv.FormatInt(entry.CreatedAt.UnixNano(), 10)
+		entry.Metadata = map[string]string{"actor": "admin"}
+		// The task is stored in the outbox and published to the broker by the outbox relay.
+		// The status is matched again in case the request was changed in the meantime
+		_, err = svc.dbService.UpdateRequest(bson.M{"_id": _id, "status": requiredStatus},
+			bson.M{"$set": bson.M{"status": requiredStatus}}, entry)
+		if err == db.ErrNotFound {
+			http.Error(w, "Task "+body.Type+" requires status "+requiredStatus+", request was changed", http.StatusConflict)
+			return
+		}
+		if err != nil {
+			http.Error(w, "Unable to enqueue task", http.StatusInternalServerError)
+			svc.logger.WithFields(logrus.Fields{
+				"err":       err.Error(),
+				"type":      body.Type,
+				"requestID": _id.Hex(),
+			}).Error("Unable to store task in the outbox")
+			return
+		}
+		entry.Request = request
+		task := broker.OutboxTask(entry)
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusAccepted)
+		json.NewEncoder(w).Encode(map[string]interface{}{"message": "success", "task": task})
+	}
+}
+
 func parseTimestamp(timestamp interface{}) (time.Time, error) {
 	timestampStr := fmt.Sprintf("%v", timestamp)
 	t, err := time.Parse(time.RFC3339, timestampStr)
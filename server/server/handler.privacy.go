@@ -0,0 +1,203 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+
+	"github.com/gorilla/mux"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+	"github.com/tywin1104/mc-gatekeeper/privacy"
+	"github.com/tywin1104/mc-gatekeeper/types"
+	"github.com/tywin1104/mc-gatekeeper/utils"
+)
+
+// HandleExportData exports everything stored about an email and/or username for authenticated admin user
+func (svc *Service) HandleExportData() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		subject := privacy.Subject{
+			Email:    r.URL.Query().Get("email"),
+			Username: r.URL.Query().Get("username"),
+		}
+		svc.exportData(w, subject)
+	}
+}
+
+// HandleEraseData erases or anonymises everything stored about an email and/or username
+// for authenticated admin user
+func (svc *Service) HandleEraseData() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var body struct {
+			privacy.Subject
+			Mode string `json:"mode"`
+		}
+		reqBody, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			http.Error(w, "Unable to read request body", http.StatusBadRequest)
+			return
+		}
+		if err = json.Unmarshal(reqBody, &body); err != nil {
+			http.Error(w, "Unable to unmarshal request body", http.StatusBadRequest)
+			return
+		}
+		if body.Mode == "" {
+			body.Mode = privacy.ModeErase
+		}
+		if body.Mode != privacy.ModeErase && body.Mode != privacy.ModeAnonymise {
+			http.Error(w, "Invalid mode. Allowed values: [erase, anonymise]", http.StatusBadRequest)
+			return
+		}
+		svc.eraseData(w, body.Subject, body.Mode)
+	}
+}
+
+// HandleApplicantExportData exports the applicant's data with the link to their request status page
+// and the applicant key from the confirmation email
+func (svc *Service) HandleApplicantExportData() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		request, statusCode, err := svc.getApplicantRequest(r)
+		if err != nil {
+			http.Error(w, err.Error(), statusCode)
+			return
+		}
+		svc.exportData(w, privacy.Subject{Email: request.Email})
+	}
+}
+
+// HandleApplicantEraseData erases the applicant's data with the link to their request status page
+// and the applicant key from the confirmation email
+func (svc *Service) HandleApplicantEraseData() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		request, statusCode, err := svc.getApplicantRequest(r)
+		if err != nil {
+			http.Error(w, err.Error(), statusCode)
+			return
+		}
+		if request.Email == "" {
+			http.Error(w, "The data of this request is already erased", http.StatusGone)
+			return
+		}
+		svc.eraseData(w, privacy.Subject{Email: request.Email}, privacy.ModeErase)
+	}
+}
+
+// getApplicantRequest returns the request of the encrypted request ID if the key query parameter is its
+// applicant key. The request ID token alone is not enough as the action emails to the ops carry it as well
+func (svc *Service) getApplicantRequest(r *http.Request) (types.WhitelistRequest, int, error) {
+	request, statusCode, err := svc.getRequestByEncryptedID(mux.Vars(r)["requestIdEncoded"])
+	if err != nil {
+		return types.WhitelistRequest{}, statusCode, err
+	}
+	if !utils.ValidApplicantKey(request.ID.Hex(), r.URL.Query().Get("key"), viper.GetString("passphrase")) {
+		svc.logger.WithFields(logrus.Fields{
+			"ID": request.ID.Hex(),
+		}).Warn("Invalid applicant key")
+		return types.WhitelistRequest{}, http.StatusForbidden, errors.New("Invalid applicant key")
+	}
+	return request, http.StatusOK, nil
+}
+
+func (svc *Service) exportData(w http.ResponseWriter, subject privacy.Subject) {
+	export, err := privacy.ExportData(svc.dbService, subject)
+	if err == privacy.ErrEmptySubject {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	} else if err != nil {
+		svc.logger.WithFields(logrus.Fields{
+			"err": err.Error(),
+		}).Error("Unable to export data")
+		http.Error(w, "Unable to export data", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Content-Disposition", `attachment; filename="export.json"`)
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(export)
+}
+
+func (svc *Service) eraseData(w http.ResponseWriter, subject privacy.Subject, mode string) {
+	log := svc.logger
+	export, err := privacy.ExportData(svc.dbService, subject)
+	if err == privacy.ErrEmptySubject {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	} else if err != nil {
+		log.WithFields(logrus.Fields{
+			"err": err.Error(),
+		}).Error("Unable to find the data to erase")
+		http.Error(w, "Unable to erase data", http.StatusInternalServerError)
+		return
+	}
+	// Dead-lettered tasks carry the request with its personal data. They are discarded before the
+	// requests are erased, so that a failure here can be retried with the same subject
+	requestIDs := make([]string, len(export.Requests))
+	for i, request := range export.Requests {
+		requestIDs[i] = request.ID.Hex()
+	}
+	discarded := []string{}
+	if len(requestIDs) > 0 {
+		if discarded, err = svc.broker.DiscardRequestDeadLetters(requestIDs); err != nil {
+			log.WithFields(logrus.Fields{
+				"err":       err.Error(),
+				"discarded": discarded,
+			}).Error("Unable to discard the dead letters of the erased requests")
+			http.Error(w, "Unable to erase data", http.StatusInternalServerError)
+			return
+		}
+	}
+	report, err := privacy.EraseData(svc.dbService, subject, mode)
+	// Part of the data may be erased even if it failed halfway, so always re-sync the cache
+	svc.resyncCache()
+	if err != nil {
+		log.WithFields(logrus.Fields{
+			"err":    err.Error(),
+			"report": report,
+		}).Error("Unable to erase data")
+		http.Error(w, "Unable to erase data", http.StatusInternalServerError)
+		return
+	}
+	log.WithFields(logrus.Fields{
+		"mode":        mode,
+		"deleted":     report.Deleted,
+		"anonymised":  report.Anonymised,
+		"deactivated": report.Deactivated,
+		"deadLetters": len(discarded),
+	}).Info("Personal data erased")
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]interface{}{"message": "success", "report": report})
+}
+
+// resyncCache rebuilds the cached requests and stats after requests were removed or anonymised
+func (svc *Service) resyncCache() {
+	if err := svc.cache.Resync(); err != nil {
+		svc.logger.WithFields(logrus.Fields{
+			"err": err.Error(),
+		}).Error("Unable to re-sync cache")
+	}
+}
+
+// HandleRetentionReport reports which requests the configured retention policies would
+// purge or anonymise right now without changing anything
+func (svc *Service) HandleRetentionReport() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		policies, err := privacy.LoadRetentionPolicies()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		report, err := privacy.ApplyRetention(svc.dbService, policies, true)
+		if err != nil {
+			svc.logger.WithFields(logrus.Fields{
+				"err": err.Error(),
+			}).Error("Unable to generate retention report")
+			http.Error(w, "Unable to generate retention report", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(report)
+	}
+}
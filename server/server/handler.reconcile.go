@@ -0,0 +1,62 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/sirupsen/logrus"
+	"github.com/tywin1104/mc-gatekeeper/reconcile"
+)
+
+// HandleGetReconciliation returns the report of the last reconciliation with the game servers
+// for authenticated admin user
+func (svc *Service) HandleGetReconciliation() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if svc.reconciler == nil {
+			http.Error(w, "Reconciliation is not available", http.StatusServiceUnavailable)
+			return
+		}
+		report, ok := svc.reconciler.LastReport()
+		if !ok {
+			http.Error(w, "No reconciliation has run yet", http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(report)
+	}
+}
+
+// HandleRunReconciliation reconciles the game servers with the requests now for authenticated admin user.
+// The drift is corrected in the direction given by the correct query parameter, or the configured one
+func (svc *Service) HandleRunReconciliation() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if svc.reconciler == nil {
+			http.Error(w, "Reconciliation is not available", http.StatusServiceUnavailable)
+			return
+		}
+		correct := r.URL.Query().Get("correct")
+		if correct == "" {
+			correct = reconcile.Correction()
+		}
+		if err := reconcile.ValidateCorrection(correct); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		report, err := svc.reconciler.Run(correct)
+		if err != nil {
+			svc.logger.WithFields(logrus.Fields{
+				"err": err.Error(),
+			}).Error("Unable to reconcile the game servers")
+			http.Error(w, "Unable to reconcile the game servers", http.StatusInternalServerError)
+			return
+		}
+		// Imported players change the stats
+		if report.Correct == reconcile.CorrectDatabase && report.Corrected() > 0 {
+			svc.resyncCache()
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(report)
+	}
+}
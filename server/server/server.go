@@ -1,6 +1,7 @@
 package server
 
 import (
+	"context"
 	"fmt"
 	"net/http"
 	"sync"
@@ -14,21 +15,25 @@ import (
 	"github.com/tywin1104/mc-gatekeeper/broker"
 	"github.com/tywin1104/mc-gatekeeper/cache"
 	"github.com/tywin1104/mc-gatekeeper/db"
+	"github.com/tywin1104/mc-gatekeeper/reconcile"
 	"github.com/tywin1104/mc-gatekeeper/server/sse"
 )
 
 // Service represents struct that deals with database level operations
 type Service struct {
-	dbService *db.Service
+	dbService db.RequestStore
 	router    *mux.Router
-	broker    *broker.Service
+	broker    broker.TaskQueue
 	sseServer *sse.Broker
 	logger    *logrus.Entry
 	cache     *cache.Service
+	http      *http.Server
+	// reconciler compares the game servers with the requests. Nil until set with SetReconciler
+	reconciler *reconcile.Reconciler
 }
 
 // NewService create new mongoDb service that handles database level operations
-func NewService(db *db.Service, broker *broker.Service, cache *cache.Service, sseServer *sse.Broker, logger *logrus.Entry) *Service {
+func NewService(db db.RequestStore, broker broker.TaskQueue, cache *cache.Service, sseServer *sse.Broker, logger *logrus.Entry) *Service {
 	return &Service{
 		dbService: db,
 		router:    mux.NewRouter().StrictSlash(true),
@@ -39,6 +44,11 @@ func NewService(db *db.Service, broker *broker.Service, cache *cache.Service, ss
 	}
 }
 
+// SetReconciler enables the endpoints that report and correct the drift between the game servers and the requests
+func (svc *Service) SetReconciler(reconciler *reconcile.Reconciler) {
+	svc.reconciler = reconciler
+}
+
 // Listen opens up the http port for REST API and register all routes
 func (svc *Service) Listen(port string, wg *sync.WaitGroup) {
 	svc.routes()
@@ -46,7 +56,7 @@ func (svc *Service) Listen(port string, wg *sync.WaitGroup) {
 	// Configure CORS
 	c := cors.New(cors.Options{
 		AllowedOrigins: []string{"*"},
-		AllowedMethods: []string{"GET", "POST", "PATCH"},
+		AllowedMethods: []string{"GET", "POST", "PATCH", "DELETE"},
 		AllowedHeaders: []string{"*"},
 	})
 
@@ -68,13 +78,24 @@ func (svc *Service) Listen(port string, wg *sync.WaitGroup) {
 	})
 	endpoint := "health"
 	go waitForHTTPServer(wg, port[1:], endpoint, svc.logger)
+	svc.http = &http.Server{Addr: port, Handler: wrappedH}
+	// Stats streams never become idle, end them so that Shutdown does not wait for them
+	svc.http.RegisterOnShutdown(svc.sseServer.Close)
 	go func() {
-		if err := http.ListenAndServe(port, wrappedH); err != nil {
+		if err := svc.http.ListenAndServe(); err != nil && err != http.ErrServerClosed {
 			svc.logger.Fatal(err)
 		}
 	}()
 }
 
+// Shutdown stops accepting connections and waits for the requests in progress until ctx is done
+func (svc *Service) Shutdown(ctx context.Context) error {
+	if svc.http == nil {
+		return nil
+	}
+	return svc.http.Shutdown(ctx)
+}
+
 func waitForHTTPServer(wg *sync.WaitGroup, port, endpoint string, log *logrus.Entry) {
 	var client http.Client
 	for {
@@ -94,6 +115,8 @@ func (svc *Service) routes() {
 	external.Handle("/stats/events", svc.sseServer).Methods("GET")
 	external.HandleFunc("/{requestIdEncoded}", svc.HandleGetRequestByID()).Methods("GET")
 	external.HandleFunc("/{requestIdEncoded}", svc.HandlePatchRequestByID()).Methods("PATCH").Queries("adm", "{adm}")
+	external.HandleFunc("/{requestIdEncoded}", svc.HandleApplicantEraseData()).Methods("DELETE")
+	external.HandleFunc("/{requestIdEncoded}/export", svc.HandleApplicantExportData()).Methods("GET")
 
 	// Endpoint to authenticate admin user
 	auth := svc.router.PathPrefix("/api/v1/auth").Subrouter()
@@ -105,11 +128,68 @@ func (svc *Service) routes() {
 		negroni.HandlerFunc(svc.GetAuthMiddleware().HandlerWithNext),
 		negroni.Wrap(svc.HandleGetRequests()),
 	)).Methods("GET")
+	internal.Handle("/import", negroni.New(
+		negroni.HandlerFunc(svc.GetAuthMiddleware().HandlerWithNext),
+		negroni.Wrap(svc.HandleImportPlayers()),
+	)).Methods("POST")
+	internal.Handle("/{requestId}/tasks", negroni.New(
+		negroni.HandlerFunc(svc.GetAuthMiddleware().HandlerWithNext),
+		negroni.Wrap(svc.HandleEnqueueTask()),
+	)).Methods("POST")
+	internal.Handle("/{requestId}/history", negroni.New(
+		negroni.HandlerFunc(svc.GetAuthMiddleware().HandlerWithNext),
+		negroni.Wrap(svc.HandleGetRequestHistory()),
+	)).Methods("GET")
 	internal.Handle("/{requestId}", negroni.New(
 		negroni.HandlerFunc(svc.GetAuthMiddleware().HandlerWithNext),
 		negroni.Wrap(svc.HandleInternalPatchRequestByID()),
 	)).Methods("PATCH")
 
+	// Endpoints to export and erase personal data on request of the applicant
+	internalPrivacy := svc.router.PathPrefix("/api/v1/internal/privacy").Subrouter()
+	internalPrivacy.Handle("/export", negroni.New(
+		negroni.HandlerFunc(svc.GetAuthMiddleware().HandlerWithNext),
+		negroni.Wrap(svc.HandleExportData()),
+	)).Methods("GET")
+	internalPrivacy.Handle("/erase", negroni.New(
+		negroni.HandlerFunc(svc.GetAuthMiddleware().HandlerWithNext),
+		negroni.Wrap(svc.HandleEraseData()),
+	)).Methods("POST")
+	internalPrivacy.Handle("/retention", negroni.New(
+		negroni.HandlerFunc(svc.GetAuthMiddleware().HandlerWithNext),
+		negroni.Wrap(svc.HandleRetentionReport()),
+	)).Methods("GET")
+
+	// Endpoints to inspect and replay the tasks the worker failed to process
+	internalDeadLetters := svc.router.PathPrefix("/api/v1/internal/deadletters").Subrouter()
+	internalDeadLetters.Handle("/", negroni.New(
+		negroni.HandlerFunc(svc.GetAuthMiddleware().HandlerWithNext),
+		negroni.Wrap(svc.HandleGetDeadLetters()),
+	)).Methods("GET")
+	internalDeadLetters.Handle("/replay", negroni.New(
+		negroni.HandlerFunc(svc.GetAuthMiddleware().HandlerWithNext),
+		negroni.Wrap(svc.HandleReplayDeadLetters()),
+	)).Methods("POST")
+	internalDeadLetters.Handle("/discard", negroni.New(
+		negroni.HandlerFunc(svc.GetAuthMiddleware().HandlerWithNext),
+		negroni.Wrap(svc.HandleDiscardDeadLetters()),
+	)).Methods("POST")
+	internalDeadLetters.Handle("/{messageId}", negroni.New(
+		negroni.HandlerFunc(svc.GetAuthMiddleware().HandlerWithNext),
+		negroni.Wrap(svc.HandleGetDeadLetter()),
+	)).Methods("GET")
+
+	// Endpoints to report and correct the drift between the game servers and the requests
+	internalReconciliation := svc.router.PathPrefix("/api/v1/internal/reconciliation").Subrouter()
+	internalReconciliation.Handle("/", negroni.New(
+		negroni.HandlerFunc(svc.GetAuthMiddleware().HandlerWithNext),
+		negroni.Wrap(svc.HandleGetReconciliation()),
+	)).Methods("GET")
+	internalReconciliation.Handle("/", negroni.New(
+		negroni.HandlerFunc(svc.GetAuthMiddleware().HandlerWithNext),
+		negroni.Wrap(svc.HandleRunReconciliation()),
+	)).Methods("POST")
+
 	// Server health endpoint
 	svc.router.HandleFunc("/health", svc.HandleHealthCheck()).Methods("GET")
 	// Recaptcha verification endpoint
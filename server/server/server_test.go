@@ -309,7 +309,7 @@ func TestGetRequestByIDExternalFail(t *testing.T) {
 func TestUpdateRequestByID(t *testing.T) {
 	dbClient.Database("mc-whitelist").Collection("requests").DeleteMany(context.TODO(), bson.M{})
 	dbClient.Database("mc-whitelist").Collection("requests").InsertOne(context.TODO(), newRequest1)
-	var jsonStr = []byte(`{"status": "Approved"}`)
+	var jsonStr = []byte(`{"status": "Approved", "version": 0}`)
 
 	req, err := http.NewRequest("PATCH", "/api/v1/requests/", bytes.NewBuffer(jsonStr))
 	if err != nil {
@@ -344,10 +344,37 @@ func TestUpdateRequestByID(t *testing.T) {
 	}
 }
 
+func TestUpdateRequestByIDWithoutVersion(t *testing.T) {
+	dbClient.Database("mc-whitelist").Collection("requests").DeleteMany(context.TODO(), bson.M{})
+	dbClient.Database("mc-whitelist").Collection("requests").InsertOne(context.TODO(), newRequest1)
+	var jsonStr = []byte(`{"status": "Approved"}`)
+
+	req, err := http.NewRequest("PATCH", "/api/v1/requests/", bytes.NewBuffer(jsonStr))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req = mux.SetURLVars(req, map[string]string{
+		"requestIdEncoded": "MP4QqcxRRN7CIJYcmpO81XldXzY30aIvflB00D_Qh6E-TVkBab9ygcmaOortaa4WUwFMuw==",
+	})
+	q := req.URL.Query()
+	q.Add("adm", "Xt-mlteCyiQe7sSS0HnLUOGJSgIW0lpi_SkYz7sahK411cgi5ecE8uQ=")
+	req.URL.RawQuery = q.Encode()
+
+	req.Header.Set("Content-Type", "application/json")
+	rr := httptest.NewRecorder()
+	handler := http.HandlerFunc(s.HandlePatchRequestByID())
+	handler.ServeHTTP(rr, req)
+	// Without the version the op saw, a decision could overwrite the decision of another op
+	if status := rr.Code; status != http.StatusPreconditionRequired {
+		t.Errorf("handler returned wrong status code: got %v want %v",
+			status, http.StatusPreconditionRequired)
+	}
+}
+
 func TestUpdateRequestByIDMatchingFailed(t *testing.T) {
 	dbClient.Database("mc-whitelist").Collection("requests").DeleteMany(context.TODO(), bson.M{})
 	dbClient.Database("mc-whitelist").Collection("requests").InsertOne(context.TODO(), newRequest3)
-	var jsonStr = []byte(`{"status": "Approved"}`)
+	var jsonStr = []byte(`{"status": "Approved", "version": 0}`)
 
 	req, err := http.NewRequest("PATCH", "/api/v1/requests/", bytes.NewBuffer(jsonStr))
 	if err != nil {
@@ -375,7 +402,7 @@ func TestUpdateRequestByIDMatchingFailed(t *testing.T) {
 func TestUpdateRequestByIDWrongAdmToken(t *testing.T) {
 	dbClient.Database("mc-whitelist").Collection("requests").DeleteMany(context.TODO(), bson.M{})
 	dbClient.Database("mc-whitelist").Collection("requests").InsertOne(context.TODO(), newRequest3)
-	var jsonStr = []byte(`{"status": "Approved"}`)
+	var jsonStr = []byte(`{"status": "Approved", "version": 0}`)
 
 	req, err := http.NewRequest("PATCH", "/api/v1/requests/", bytes.NewBuffer(jsonStr))
 	if err != nil {
@@ -402,7 +429,7 @@ func TestUpdateRequestByIDWrongAdmToken(t *testing.T) {
 func TestUpdateRequestByIDWrongEncodedID(t *testing.T) {
 	dbClient.Database("mc-whitelist").Collection("requests").DeleteMany(context.TODO(), bson.M{})
 	dbClient.Database("mc-whitelist").Collection("requests").InsertOne(context.TODO(), newRequest3)
-	var jsonStr = []byte(`{"status": "Approved"}`)
+	var jsonStr = []byte(`{"status": "Approved", "version": 0}`)
 
 	req, err := http.NewRequest("PATCH", "/api/v1/requests/", bytes.NewBuffer(jsonStr))
 	if err != nil {
@@ -431,7 +458,7 @@ func TestVerificationFail(t *testing.T) {
 	// adm token for op1 + encoded id for newRequest1 should fail
 	dbClient.Database("mc-whitelist").Collection("requests").DeleteMany(context.TODO(), bson.M{})
 	dbClient.Database("mc-whitelist").Collection("requests").InsertOne(context.TODO(), newRequest2)
-	var jsonStr = []byte(`{"status": "Approved"}`)
+	var jsonStr = []byte(`{"status": "Approved", "version": 0}`)
 
 	req, err := http.NewRequest("PATCH", "/api/v1/verify/", bytes.NewBuffer(jsonStr))
 	if err != nil {
@@ -464,7 +491,7 @@ func TestVerification(t *testing.T) {
 	// adm token for op1 + encoded id for newRequest1 should pass
 	dbClient.Database("mc-whitelist").Collection("requests").DeleteMany(context.TODO(), bson.M{})
 	dbClient.Database("mc-whitelist").Collection("requests").InsertOne(context.TODO(), newRequest1)
-	var jsonStr = []byte(`{"status": "Approved"}`)
+	var jsonStr = []byte(`{"status": "Approved", "version": 0}`)
 
 	req, err := http.NewRequest("PATCH", "/api/v1/verify/", bytes.NewBuffer(jsonStr))
 	if err != nil {
@@ -639,7 +666,7 @@ func TestInternalUpdateRequest(t *testing.T) {
 	//Set Authorization Bearer header
 	tokenStr := fmt.Sprintf("%v", token)
 	rr2 := httptest.NewRecorder()
-	jsonStr = []byte(`{"status": "Denied"}`)
+	jsonStr = []byte(`{"status": "Denied", "version": 0}`)
 	req2, err := http.NewRequest("PATCH", "/api/v1/internal/requests/", bytes.NewBuffer(jsonStr))
 	req2 = mux.SetURLVars(req2, map[string]string{
 		"requestId": "5dc4dc43f7310f4c2a005673",
@@ -691,7 +718,7 @@ func TestInternalUpdateRequestFail(t *testing.T) {
 	//Set Authorization Bearer header
 	tokenStr := fmt.Sprintf("%v", token)
 	rr2 := httptest.NewRecorder()
-	jsonStr = []byte(`{"status": "Denied"}`)
+	jsonStr = []byte(`{"status": "Denied", "version": 0}`)
 	req2, err := http.NewRequest("PATCH", "/api/v1/internal/requests/", bytes.NewBuffer(jsonStr))
 	req2 = mux.SetURLVars(req2, map[string]string{
 		"requestId": "5dc4dc43f7310f4c2a005676",
@@ -705,8 +732,9 @@ func TestInternalUpdateRequestFail(t *testing.T) {
 		negroni.HandlerFunc(s.GetAuthMiddleware().HandlerWithNext),
 		negroni.Wrap(s.HandleInternalPatchRequestByID()),
 	).ServeHTTP(rr2, req2)
-	if status := rr2.Code; status != http.StatusBadRequest {
+	// Denied requests can not be denied again
+	if status := rr2.Code; status != http.StatusConflict {
 		t.Errorf("handler returned wrong status code: got %v want %v",
-			status, http.StatusBadRequest)
+			status, http.StatusConflict)
 	}
 }
@@ -3,6 +3,7 @@ package sse
 import (
 	"fmt"
 	"net/http"
+	"sync"
 
 	"github.com/sirupsen/logrus"
 )
@@ -21,6 +22,10 @@ type Broker struct {
 	// Client connections registry
 	clients map[chan []byte]bool
 	logger  *logrus.Entry
+
+	// done is closed when the server shuts down to end the open streams
+	done      chan struct{}
+	closeOnce sync.Once
 }
 
 // NewServer instantiate a broker as SSE server
@@ -32,6 +37,7 @@ func NewServer(logger *logrus.Entry) (broker *Broker) {
 		closingClients: make(chan chan []byte),
 		clients:        make(map[chan []byte]bool),
 		logger:         logger,
+		done:           make(chan struct{}),
 	}
 
 	return
@@ -76,9 +82,15 @@ func (broker *Broker) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
 
 	for {
 
+		var event []byte
+		select {
+		case event = <-messageChan:
+		case <-broker.done:
+			return
+		}
 		// Write to the ResponseWriter
 		// Server Sent Events compatible
-		fmt.Fprintf(rw, "data: %s\n\n", <-messageChan)
+		fmt.Fprintf(rw, "data: %s\n\n", event)
 
 		// Flush the data immediatly instead of buffering it for later.
 		flusher.Flush()
@@ -86,6 +98,13 @@ func (broker *Broker) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
 
 }
 
+// Close ends the streams of all connected clients so that the http server can shut down
+func (broker *Broker) Close() {
+	broker.closeOnce.Do(func() {
+		close(broker.done)
+	})
+}
+
 // Listen starts to listen for clients connection related event
 // and send stats to the client when it first connects
 func (broker *Broker) Listen(onListenerJoinCallback func() error) {
@@ -115,7 +134,10 @@ func (broker *Broker) Listen(onListenerJoinCallback func() error) {
 			// We got a new event from the outside!
 			// Send event to all connected clients
 			for clientMessageChan := range broker.clients {
-				clientMessageChan <- event
+				select {
+				case clientMessageChan <- event:
+				case <-broker.done:
+				}
 			}
 		}
 	}
@@ -0,0 +1,41 @@
+package types
+
+// Statuses a whitelist request can be in
+const (
+	StatusPending     = "Pending"
+	StatusApproved    = "Approved"
+	StatusDenied      = "Denied"
+	StatusDeactivated = "Deactivated"
+	StatusBanned      = "Banned"
+)
+
+// transitions is the central table of allowed status changes.
+// A status without entries is final. Lifting a ban deactivates the player or restores the whitelist
+var transitions = map[string][]string{
+	StatusPending:     {StatusApproved, StatusDenied},
+	StatusApproved:    {StatusDeactivated, StatusBanned},
+	StatusDeactivated: {StatusApproved, StatusBanned},
+	StatusDenied:      {},
+	StatusBanned:      {StatusDeactivated, StatusApproved},
+}
+
+// IsValidStatus reports whether the status is known
+func IsValidStatus(status string) bool {
+	_, ok := transitions[status]
+	return ok
+}
+
+// CanTransition reports whether a request may move from one status to another
+func CanTransition(from, to string) bool {
+	for _, allowed := range transitions[from] {
+		if allowed == to {
+			return true
+		}
+	}
+	return false
+}
+
+// AllowedTransitions returns the statuses a request may move to from the given status
+func AllowedTransitions(from string) []string {
+	return append([]string{}, transitions[from]...)
+}
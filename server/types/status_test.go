@@ -0,0 +1,37 @@
+package types_test
+
+import (
+	"testing"
+
+	"github.com/tywin1104/mc-gatekeeper/types"
+)
+
+func TestCanTransition(t *testing.T) {
+	allowed := [][2]string{
+		{types.StatusPending, types.StatusApproved},
+		{types.StatusPending, types.StatusDenied},
+		{types.StatusApproved, types.StatusDeactivated},
+		{types.StatusApproved, types.StatusBanned},
+		{types.StatusDeactivated, types.StatusApproved},
+		{types.StatusBanned, types.StatusDeactivated},
+		{types.StatusBanned, types.StatusApproved},
+	}
+	for _, transition := range allowed {
+		if !types.CanTransition(transition[0], transition[1]) {
+			t.Errorf("Expect transition %s -> %s to be allowed", transition[0], transition[1])
+		}
+	}
+	illegal := [][2]string{
+		{types.StatusDenied, types.StatusBanned},
+		{types.StatusDenied, types.StatusDenied},
+		{types.StatusPending, types.StatusBanned},
+		{types.StatusBanned, types.StatusPending},
+		{types.StatusApproved, "Whatever"},
+		{"Whatever", types.StatusApproved},
+	}
+	for _, transition := range illegal {
+		if types.CanTransition(transition[0], transition[1]) {
+			t.Errorf("Expect transition %s -> %s to be rejected", transition[0], transition[1])
+		}
+	}
+}
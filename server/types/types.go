@@ -21,4 +21,72 @@ type WhitelistRequest struct {
 	Note                 string                 `bson:"note" json:"note" json:",omitempty"`
 	Info                 map[string]interface{} `bson:"info" json:"info" json:",omitempty"`
 	Assignees            []string               `bson:"assignees" json:"assignees" json:",omitempty"`
+	History              []StatusChange         `bson:"history" json:"history" json:",omitempty"`
+	// Version is incremented on every update and guards against concurrent decisions
+	Version int64 `bson:"version" json:"version"`
+	// UUID is the Minecraft account UUID of the player when known
+	UUID string `bson:"uuid,omitempty" json:"uuid,omitempty"`
+	// Source tells how the request was created. Empty for applications submitted by the player
+	Source string `bson:"source,omitempty" json:"source,omitempty"`
+	// UsernameHash identifies the applicant of an anonymised request so that bans stay enforced
+	UsernameHash    string    `bson:"usernameHash,omitempty" json:"usernameHash,omitempty"`
+	ErasedTimestamp time.Time `bson:"erasedTimestamp" json:"erasedTimestamp"`
+	// ExpiresAt is when an approved player is deactivated again. Zero for permanent membership
+	ExpiresAt time.Time `bson:"expiresAt" json:"expiresAt"`
+	// ExpiryWarnedAt is when the player was warned about the upcoming expiry
+	ExpiryWarnedAt time.Time `bson:"expiryWarnedAt" json:"expiryWarnedAt"`
+	// BanReason is passed to the game server and shown to the banned player
+	BanReason string `bson:"banReason,omitempty" json:"banReason,omitempty"`
+	// BannedUntil is when a temporary ban is lifted. Zero for permanent bans
+	BannedUntil time.Time `bson:"bannedUntil" json:"bannedUntil"`
+	// StatusBeforeBan is the status the request had when the player was banned
+	StatusBeforeBan string `bson:"statusBeforeBan,omitempty" json:"statusBeforeBan,omitempty"`
+	// Servers are the names or groups of the game servers the request applies to. Empty for all game servers
+	Servers []string `bson:"servers,omitempty" json:"servers,omitempty"`
+	// ServerResults holds the outcome of the latest command on each game server by server name
+	ServerResults map[string]ServerResult `bson:"serverResults,omitempty" json:"serverResults,omitempty"`
+	// Failure tells ops that the game servers rejected the commands of the latest task, e.g.
+	// "ApprovalFailed: unknown player". Cleared when the next task issues its commands
+	Failure string `bson:"failure,omitempty" json:"failure,omitempty"`
+}
+
+// ServerResult is the outcome of a command carrying out a status change on one game server
+type ServerResult struct {
+	Status    string    `bson:"status" json:"status"`
+	Command   string    `bson:"command" json:"command"`
+	Error     string    `bson:"error,omitempty" json:"error,omitempty"`
+	Timestamp time.Time `bson:"timestamp" json:"timestamp"`
+	// Outcome is the interpreted response of the game server: success, noop or failure
+	Outcome string `bson:"outcome,omitempty" json:"outcome,omitempty"`
+	// Reason describes a no-op or failure, e.g. "unknown player"
+	Reason   string `bson:"reason,omitempty" json:"reason,omitempty"`
+	Response string `bson:"response,omitempty" json:"response,omitempty"`
+}
+
+// Sources of a status change
+const (
+	// SourceApplication is the player submitting the application
+	SourceApplication = "application"
+	// SourceEmail is an op deciding through the action link sent by email
+	SourceEmail = "email"
+	// SourceDashboard is the admin acting from the management dashboard
+	SourceDashboard = "dashboard"
+	// SourceImported marks requests created from the files of an existing Minecraft server
+	SourceImported = "imported"
+	// SourceExpiry is the scheduler deactivating a player whose membership expired or lifting an expired ban
+	SourceExpiry = "expiry"
+	// SourceReconciliation is the reconciliation with the game servers correcting the request
+	SourceReconciliation = "reconciliation"
+	// SourceErasure is the erasure of the applicant's data deactivating their membership
+	SourceErasure = "erasure"
+)
+
+// StatusChange is an append-only record of one status transition of a whitelist request
+type StatusChange struct {
+	Actor     string    `bson:"actor" json:"actor"`
+	OldStatus string    `bson:"oldStatus" json:"oldStatus"`
+	NewStatus string    `bson:"newStatus" json:"newStatus"`
+	Note      string    `bson:"note" json:"note"`
+	Source    string    `bson:"source" json:"source"`
+	Timestamp time.Time `bson:"timestamp" json:"timestamp"`
 }
@@ -0,0 +1,28 @@
+package utils
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+)
+
+// HashUsername derives a keyed hash of the username that can be stored in place of it.
+// The same username and passphrase always result in the same hash
+func HashUsername(username, passphrase string) string {
+	mac := hmac.New(sha256.New, []byte(passphrase))
+	mac.Write([]byte(username))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// ApplicantKey derives the key that proves to be the applicant of the request. Unlike the request ID
+// token it is only sent to the applicant, so ops who were emailed about the request do not know it
+func ApplicantKey(requestID, passphrase string) string {
+	mac := hmac.New(sha256.New, []byte(passphrase))
+	mac.Write([]byte("applicant:" + requestID))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// ValidApplicantKey returns whether key is the applicant key of the request
+func ValidApplicantKey(requestID, key, passphrase string) bool {
+	return hmac.Equal([]byte(key), []byte(ApplicantKey(requestID, passphrase)))
+}
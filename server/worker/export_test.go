@@ -0,0 +1,11 @@
+package worker
+
+// SetCache replaces the cache the worker keeps up to date
+func (worker *Worker) SetCache(cache statsCache) {
+	worker.cache = cache
+}
+
+// SetGameServer replaces the connection to the game server with the given name
+func (worker *Worker) SetGameServer(name string, server gameServer) {
+	worker.rconClients[name] = server
+}
@@ -1,219 +1,376 @@
 package worker
 
 import (
-	"bytes"
-	"encoding/json"
+	"context"
 	"errors"
+	"fmt"
+	"hash/fnv"
 	"math/rand"
 	"os"
+	"strings"
 	"sync"
 	"time"
 
 	"github.com/sirupsen/logrus"
 	"github.com/spf13/viper"
-	"github.com/streadway/amqp"
+	"github.com/tywin1104/mc-gatekeeper/broker"
 	"github.com/tywin1104/mc-gatekeeper/cache"
 	"github.com/tywin1104/mc-gatekeeper/db"
+	"github.com/tywin1104/mc-gatekeeper/gameserver"
 	"github.com/tywin1104/mc-gatekeeper/mailer"
 	"github.com/tywin1104/mc-gatekeeper/rcon"
 	"github.com/tywin1104/mc-gatekeeper/types"
 	"github.com/tywin1104/mc-gatekeeper/utils"
 	"go.mongodb.org/mongo-driver/bson"
-	try "gopkg.in/matryer/try.v1"
 )
 
+// defaultConcurrency is used when workerConcurrency is not configured
+const defaultConcurrency = 4
+
+// Side effects recorded in the task ledger so that they are not repeated when a task is delivered again
+const (
+	effectStats             = "stats"
+	effectConfirmationEmail = "email.confirmation"
+	effectExpiryEmail       = "email.expiry"
+	effectDecisionEmail     = "email.decision"
+	effectBanEmail          = "email.ban"
+	effectRCON              = "rcon"
+	effectPardon            = "rcon.pardon"
+	// effectClearFailure clears the failure of an earlier task before the first command of the task
+	effectClearFailure = "failure.clear"
+	// effectOpEmail is followed by the email address of the op
+	effectOpEmail = "email.op:"
+)
+
+// failureLabels prefix the failure recorded on the request when the game servers rejected the commands of a task
+var failureLabels = map[string]string{
+	broker.TaskApproval:         "ApprovalFailed",
+	broker.TaskReapplyWhitelist: "ApprovalFailed",
+	broker.TaskBan:              "BanFailed",
+	broker.TaskUnban:            "UnbanFailed",
+	broker.TaskDeactivation:     "DeactivationFailed",
+}
+
+// rejectedError is returned by fanOut when game servers rejected the command, e.g. for an unknown
+// player. Sending the command again does not help, so the task is not retried
+type rejectedError struct {
+	reason string
+}
+
+func (e *rejectedError) Error() string {
+	return e.reason
+}
+
+// errNoUsername is returned by fanOut for anonymised requests. Without a username the commands
+// would not apply to any player. The ban of an anonymised request only stops applying to new applications
+var errNoUsername = &rejectedError{"The request has no username"}
+
+// statsCache is the part of the cache the worker keeps up to date. Implemented by *cache.Service
+type statsCache interface {
+	UpdateAllRequests() error
+	UpdateRealTimeStats(request types.WhitelistRequest) error
+}
+
+// gameServer sends commands to one game server. Implemented by *rcon.Client
+type gameServer interface {
+	SendCommandContext(ctx context.Context, command string) (string, error)
+	Close() error
+}
+
 // Worker defines message queue worker
 type Worker struct {
-	dbService        *db.Service
-	cache            *cache.Service
-	logger           *logrus.Entry
-	rconClient       *rcon.Client
-	conn             *amqp.Connection
-	channel          *amqp.Channel
-	rabbitCloseError chan *amqp.Error
-	delivery         <-chan amqp.Delivery
+	dbService db.RequestStore
+	cache     statsCache
+	logger    *logrus.Entry
+	// rconClients holds a client for each game server by name
+	rconClients map[string]gameServer
+	queue       broker.Consumer
+	handlers    map[string]TaskHandler
+	// stopping is closed by Stop, stopped once the tasks in progress are done
+	stopping chan struct{}
+	stopOnce sync.Once
+	stopped  chan struct{}
+	// ctx is passed to the task handlers. It is canceled when Stop gives up waiting for the
+	// tasks in progress, so that commands still waiting for a game server are abandoned
+	ctx    context.Context
+	cancel context.CancelFunc
+}
+
+// Concurrency returns how many tasks the worker processes at the same time
+func Concurrency() int {
+	if concurrency := viper.GetInt("workerConcurrency"); concurrency > 0 {
+		return concurrency
+	}
+	return defaultConcurrency
 }
 
 // NewWorker creates a worker to constantly listen and handle messages in the queue
-func NewWorker(db *db.Service, cache *cache.Service, logger *logrus.Entry, rabbitCloseError chan *amqp.Error) (*Worker, error) {
-	// Initialize rcon client to interact with game server
-	var rconClient *rcon.Client
-	if viper.GetString("environment") == "test" {
-		// For testing environment do not connect to a running game server
-		rconClient = nil
-	} else {
-		var err error
-		rconClient, err = rcon.NewClient(viper.GetString("RCONServer"), viper.GetInt("RCONPort"), viper.GetString("RCONPassword"))
+func NewWorker(db db.RequestStore, cache *cache.Service, queue broker.Consumer, logger *logrus.Entry) (*Worker, error) {
+	// Initialize rcon clients to interact with the game servers
+	rconClients := map[string]gameServer{}
+	// For testing environment do not connect to a running game server
+	if viper.GetString("environment") != "test" {
+		targets, err := gameserver.Targets()
 		if err != nil {
 			return nil, err
 		}
+		for _, target := range targets {
+			client, err := rcon.NewClient(target.Host, target.Port, target.Password)
+			if err != nil {
+				for _, c := range rconClients {
+					c.Close()
+				}
+				return nil, fmt.Errorf("Unable to connect to game server %s: %v", target.Name, err)
+			}
+			rconClients[target.Name] = client
+		}
 	}
-	return &Worker{
-		dbService:        db,
-		cache:            cache,
-		logger:           logger,
-		rconClient:       rconClient,
-		rabbitCloseError: rabbitCloseError,
-	}, nil
-}
-
-func (worker *Worker) failOnError(err error, msg string) {
-	if err != nil {
-		worker.logger.WithFields(logrus.Fields{
-			"err": err,
-		}).Fatal(msg)
+	worker := &Worker{
+		dbService:   db,
+		cache:       cache,
+		logger:      logger,
+		rconClients: rconClients,
+		queue:       queue,
+		handlers:    map[string]TaskHandler{},
+		stopping:    make(chan struct{}),
+		stopped:     make(chan struct{}),
 	}
-}
-
-func (w *Worker) GetConn() *amqp.Connection {
-	return w.conn
-}
-func (w *Worker) GetChannel() *amqp.Channel {
-	return w.channel
-}
-
-// Close connection and channel associated with the worker
-func (worker *Worker) Close() {
-	worker.channel.Close()
-	worker.conn.Close()
+	worker.ctx, worker.cancel = context.WithCancel(context.Background())
+	worker.registerHandlers()
+	return worker, nil
 }
 
 // Start the worker to process the messages pushed into the queue
 func (worker *Worker) Start(wg *sync.WaitGroup) {
 	log := worker.logger
-
-	// Start will only perform initial setup
-	// If in the future the initial connection got closed,
-	// reconnect callback function will be executed and conn/chan/chan *Error will be reset
-	conn, err := amqp.Dial(viper.GetString("rabbitMQConn"))
-	worker.failOnError(err, "Failed to connect to RabbitMQ")
-	worker.conn = conn
-	worker.conn.NotifyClose(worker.rabbitCloseError)
-
-	ch, err := conn.Channel()
-	worker.failOnError(err, "Failed to open a channel")
-	worker.channel = ch
-	args := make(amqp.Table)
-	// Dead letter exchange name
-	args["x-dead-letter-exchange"] = "dead.letter.ex"
-	// Default message ttl 24 hours
-	args["x-message-ttl"] = int32(8.64e+7)
-
-	_, err = ch.QueueDeclare(
-		viper.GetString("taskQueueName"), // name
-		true,                             // durable
-		false,                            // delete when unused
-		false,                            // exclusive
-		false,                            // no-wait
-		args,                             // arguments
-	)
-	worker.failOnError(err, "Failed to declare a queue")
-
-	err = ch.Qos(
-		1,     // prefetch count
-		0,     // prefetch size
-		false, // global
-	)
-	worker.failOnError(err, "Failed to set QoS")
-
-	forever := make(chan bool)
-	// Set initial delivery channel from the initial connection
-	worker.updateDeliveryChannel()
-	go worker.runLoop()
+	deliveries, err := worker.queue.Consume()
+	if err != nil {
+		log.WithFields(logrus.Fields{
+			"err": err.Error(),
+		}).Fatal("Failed to register a consumer")
+	}
 	log.Info("Worker started. Listening for messages..")
 	wg.Done()
+	worker.runLoop(deliveries)
+}
 
-	<-forever
-}
-
-// Update the messages fetching origin to be from the channel of the new connection
-// Is called whenver a new connection is established and the old one is closed
-func (worker *Worker) updateDeliveryChannel() {
-	msgs, err := worker.channel.Consume(
-		viper.GetString("taskQueueName"), // queue
-		"",                               // consumer
-		false,                            // auto-ack
-		false,                            // exclusive
-		false,                            // no-local
-		false,                            // no-wait
-		nil,                              // args
-	)
-	worker.failOnError(err, "Failed to register a consumer")
-	worker.delivery = msgs
-}
-
-func (worker *Worker) reconnect() {
-	worker.logger.Warning("Worker connection with message queue closed unexpectedly. About to reconnect")
-	worker.rabbitCloseError = make(chan *amqp.Error)
-	err := try.Do(func(attempt int) (bool, error) {
-		if attempt > 1 {
-			worker.logger.Infof("Trying to connect to RabbitMQ [%d/3]\n", attempt)
-		}
-		var e error
-		conn, e := amqp.Dial(viper.GetString("rabbitMQConn"))
-		if e != nil {
-			time.Sleep(5 * time.Second)
-		} else {
-			worker.conn = conn
-		}
-		return attempt < 3, e
+// Stop stops taking new tasks from the queue and waits for the tasks in progress to finish.
+// Tasks that were received but not started yet are requeued. It gives up when ctx is done,
+// abandoning the commands of the tasks in progress
+func (worker *Worker) Stop(ctx context.Context) error {
+	worker.stopOnce.Do(func() {
+		close(worker.stopping)
 	})
-	if err != nil {
-		worker.logger.WithFields(logrus.Fields{
-			"err": err.Error(),
-		}).Fatal("Unable to reconnect to message queue")
+	select {
+	case <-worker.stopped:
+	case <-ctx.Done():
+		worker.cancel()
+		return ctx.Err()
+	}
+	for _, client := range worker.rconClients {
+		client.Close()
 	}
+	return nil
+}
+
+// TaskHandler processes one type of task. Every handler has to settle the delivery.
+// Commands sent to the game servers are abandoned when ctx is done
+type TaskHandler func(ctx context.Context, d broker.Delivery, task broker.Task)
+
+// Handle registers the handler for a task type, replacing any previous handler
+func (worker *Worker) Handle(taskType string, handler TaskHandler) {
+	worker.handlers[taskType] = handler
+}
+
+func (worker *Worker) registerHandlers() {
+	worker.Handle(broker.TaskNewRequest, worker.processNewRequest)
+	worker.Handle(broker.TaskApproval, worker.processApproval)
+	worker.Handle(broker.TaskDenial, worker.processDenial)
+	worker.Handle(broker.TaskDeactivation, worker.processDeactivate)
+	worker.Handle(broker.TaskBan, worker.processBan)
+	worker.Handle(broker.TaskUnban, worker.processUnban)
+	worker.Handle(broker.TaskResendConfirmation, worker.processResendConfirmation)
+	worker.Handle(broker.TaskRedispatch, worker.processRedispatch)
+	worker.Handle(broker.TaskReapplyWhitelist, worker.processReapplyWhitelist)
+	worker.Handle(broker.TaskExpiryWarning, worker.processExpiryWarning)
+}
 
-	ch, err := worker.conn.Channel()
-	worker.failOnError(err, "Failed to open a channel")
-	worker.channel = ch
-	// Update worker's delivery from newly created channel of new connection
-	worker.updateDeliveryChannel()
-	worker.logger.Info("Worker-message queue connection established. Continue to process messages")
-	worker.conn.NotifyClose(worker.rabbitCloseError)
+// taskDelivery is a decoded delivery waiting for its turn in a shard of the worker pool
+type taskDelivery struct {
+	d    broker.Delivery
+	task broker.Task
 }
-func (worker *Worker) runLoop() {
+
+// runLoop processes deliveries until the queue is closed or the worker is stopped. Tasks are
+// spread over Concurrency goroutines by request ID, so the tasks of one request are still
+// processed one after another in the order they were delivered
+func (worker *Worker) runLoop(deliveries <-chan broker.Delivery) {
+	defer close(worker.stopped)
+	shards := make([]chan taskDelivery, Concurrency())
+	var wg sync.WaitGroup
+	for i := range shards {
+		// Deliveries in flight are bounded by the prefetch, so the loop below rarely blocks
+		// on a busy shard while the others are idle
+		shards[i] = make(chan taskDelivery, broker.Prefetch())
+		wg.Add(1)
+		go func(tasks <-chan taskDelivery) {
+			defer wg.Done()
+			for t := range tasks {
+				select {
+				case <-worker.stopping:
+					t.d.Nack(true)
+				default:
+					worker.dispatch(t.d, t.task)
+				}
+			}
+		}(shards[i])
+	}
+receive:
 	for {
 		select {
-		case rabbitErr := <-worker.rabbitCloseError:
-			if rabbitErr != nil {
-				worker.reconnect()
-			}
-			break
-		case d := <-worker.delivery:
-			log := worker.logger
-			if d.Body == nil {
-				break
+		case d, ok := <-deliveries:
+			if !ok {
+				break receive
 			}
-			whitelistRequest, err := deserialize(d.Body)
-			if err != nil {
-				log.WithFields(logrus.Fields{
-					"messageBody": d.Body,
-					"err":         err,
-				}).Error("Unable to decode message into whitelistRequest")
-				// Unable to decode this message, put to the dead-letter queue
-				d.Nack(false, false)
-			} else {
-				// Concrete actions to do when receiving task from message queue
-				// From the message body to determine which type of work to do
-				switch whitelistRequest.Status {
-				case "Approved":
-					worker.processApproval(d, whitelistRequest)
-				case "Denied":
-					worker.processDenial(d, whitelistRequest)
-				case "Pending":
-					worker.processNewRequest(d, whitelistRequest)
-				case "Deactivated":
-					worker.processDeactivate(d, whitelistRequest)
-				case "Banned":
-					worker.processBan(d, whitelistRequest)
-				}
+			task, ok := worker.decode(d)
+			if !ok {
+				continue
 			}
+			shards[shardFor(task.Request.ID.Hex(), len(shards))] <- taskDelivery{d, task}
+		case <-worker.stopping:
+			break receive
 		}
 	}
+	for _, shard := range shards {
+		close(shard)
+	}
+	wg.Wait()
+	worker.logger.Info("Worker stopped")
+}
+
+// shardFor maps a request ID onto one of n shards
+func shardFor(requestID string, n int) int {
+	h := fnv.New32a()
+	h.Write([]byte(requestID))
+	return int(h.Sum32() % uint32(n))
+}
+
+// decode decodes the task of the delivery. Tasks that can not be handled by
+// this worker are put to the dead-letter queue right away
+func (worker *Worker) decode(d broker.Delivery) (broker.Task, bool) {
+	log := worker.logger
+	task, err := broker.DecodeTask(d.Body)
+	if err != nil {
+		log.WithFields(logrus.Fields{
+			"messageBody": string(d.Body),
+			"err":         err,
+		}).Error("Unable to decode message into task")
+		d.Reject("Unable to decode message into task: " + err.Error())
+		return broker.Task{}, false
+	}
+	if task.Version > broker.TaskSchemaVersion {
+		log.WithFields(logrus.Fields{
+			"type":    task.Type,
+			"version": task.Version,
+		}).Error("Unsupported task schema version")
+		d.Reject(fmt.Sprintf("Unsupported task schema version %d", task.Version))
+		return broker.Task{}, false
+	}
+	if task.IdempotencyKey == "" {
+		// The task ledger needs a key to recognize the task when it is delivered again
+		task.IdempotencyKey = broker.NewTask(task.Type, task.Request).IdempotencyKey
+	}
+	return task, true
+}
+
+// dispatch hands the task to the handler of its type. Tasks that were already
+// processed before they were delivered again are acknowledged right away
+func (worker *Worker) dispatch(d broker.Delivery, task broker.Task) {
+	log := worker.logger
+	handler, ok := worker.handlers[task.Type]
+	if !ok {
+		log.WithFields(logrus.Fields{
+			"type": task.Type,
+		}).Error("Unknown task type")
+		d.Reject("Unknown task type " + task.Type)
+		return
+	}
+	record, err := worker.dbService.TaskRecord(task.IdempotencyKey)
+	if err != nil {
+		log.WithFields(logrus.Fields{
+			"key": task.IdempotencyKey,
+			"err": err.Error(),
+		}).Error("Unable to read the task ledger")
+		worker.retry(d, task.Request, "Unable to read the task ledger: "+err.Error())
+		return
+	}
+	if record.Completed() {
+		log.WithFields(logrus.Fields{
+			"key": task.IdempotencyKey,
+		}).Info("Task was already processed. Skipping")
+		d.Ack()
+		return
+	}
+	// Tasks carry the request as it was when they were published. A retried task can come back
+	// after later changes of the request were processed, e.g. an approval after a ban, so tasks
+	// that were overtaken by a change are skipped
+	current, err := worker.dbService.GetRequests(1, bson.M{"_id": task.Request.ID})
+	if err != nil {
+		log.WithFields(logrus.Fields{
+			"ID":  task.Request.ID,
+			"err": err.Error(),
+		}).Error("Unable to read the request of the task")
+		worker.retry(d, task.Request, "Unable to read the request of the task: "+err.Error())
+		return
+	}
+	if len(current) == 1 && current[0].Version > task.Request.Version {
+		log.WithFields(logrus.Fields{
+			"key":            task.IdempotencyKey,
+			"version":        task.Request.Version,
+			"currentVersion": current[0].Version,
+		}).Info("Request was changed after the task was published. Skipping")
+		worker.ack(d, task)
+		return
+	}
+	handler(worker.ctx, d, task)
+}
+
+// once performs a side effect of the task unless the task ledger shows that it already
+// took place in an earlier delivery. The effect is recorded once it succeeded
+func (worker *Worker) once(task broker.Task, effect string, f func() error) error {
+	log := worker.logger.WithFields(logrus.Fields{
+		"key":    task.IdempotencyKey,
+		"effect": effect,
+	})
+	record, err := worker.dbService.TaskRecord(task.IdempotencyKey)
+	if err != nil {
+		return err
+	}
+	if record.Done(effect) {
+		log.Info("Side effect already took place. Skipping")
+		return nil
+	}
+	if err = f(); err != nil {
+		return err
+	}
+	if err = worker.dbService.RecordTaskEffect(task.IdempotencyKey, effect); err != nil {
+		log.WithField("err", err.Error()).Warning("Unable to record side effect in the task ledger")
+	}
+	return nil
+}
+
+// ack acknowledges the delivery and records the task as completed in the task ledger
+func (worker *Worker) ack(d broker.Delivery, task broker.Task) {
+	if err := worker.dbService.CompleteTask(task.IdempotencyKey, time.Now()); err != nil {
+		worker.logger.WithFields(logrus.Fields{
+			"key": task.IdempotencyKey,
+			"err": err.Error(),
+		}).Warning("Unable to record completed task in the task ledger")
+	}
+	d.Ack()
 }
 
-func (worker *Worker) updateCache(request types.WhitelistRequest) {
+func (worker *Worker) updateCache(task broker.Task) {
 	// Update the cache for all requests. Best effort only
 	err := worker.cache.UpdateAllRequests()
 	if err != nil {
@@ -222,8 +379,10 @@ func (worker *Worker) updateCache(request types.WhitelistRequest) {
 		}).Warning("Unable to refresh all requests in cache")
 	}
 
-	// Update Stats value in cache
-	err = worker.cache.UpdateRealTimeStats(request)
+	// Update Stats value in cache. The counters must only change once per task
+	err = worker.once(task, effectStats, func() error {
+		return worker.cache.UpdateRealTimeStats(task.Request)
+	})
 	if err != nil {
 		worker.logger.WithFields(logrus.Fields{
 			"err": err.Error(),
@@ -231,31 +390,40 @@ func (worker *Worker) updateCache(request types.WhitelistRequest) {
 	}
 }
 
-// Nack if decision email is not sent. Ack if sent.
-func (worker *Worker) processApproval(d amqp.Delivery, request types.WhitelistRequest) {
+// Retry if the whitelist cmd can not be issued. Ack otherwise
+func (worker *Worker) processApproval(ctx context.Context, d broker.Delivery, task broker.Task) {
+	request := task.Request
 	worker.logger.WithFields(logrus.Fields{
 		"username": request.Username,
 		"ID":       request.ID,
 		"Type":     "Approval Task",
 	}).Info("Received new task")
 
-	worker.updateCache(request)
+	worker.updateCache(task)
 	// Concrete whitelist action on the game server
-	err := worker.issueRCON("whitelist add " + request.Username)
+	err := worker.fanOut(ctx, task, effectRCON, "whitelist add "+request.Username)
+	// The player is not told about an approval that did not take effect. Ops see the failure on the request
+	if _, ok := err.(*rejectedError); ok {
+		worker.ack(d, task)
+		return
+	}
 	if err != nil {
 		worker.logger.WithFields(logrus.Fields{
 			"username": request.Username,
 			"err":      err.Error(),
 		}).Error("Unable to issue whitelist cmd on the game server")
-		d.Nack(false, false)
+		worker.retry(d, request, "Unable to issue whitelist cmd on the game server: "+err.Error())
 		return
 	}
-	worker.emailDecision(request)
-	d.Ack(false)
+	worker.once(task, effectDecisionEmail, func() error {
+		return worker.emailDecision(request)
+	})
+	worker.ack(d, task)
 }
 
 // Nack if decision email is not sent. Ack if sent.
-func (worker *Worker) processDenial(d amqp.Delivery, request types.WhitelistRequest) {
+func (worker *Worker) processDenial(ctx context.Context, d broker.Delivery, task broker.Task) {
+	request := task.Request
 	// Need to send update status back to the user
 	// Put message to dead letter queue for later investigation if unable to send decision email
 	worker.logger.WithFields(logrus.Fields{
@@ -264,79 +432,246 @@ func (worker *Worker) processDenial(d amqp.Delivery, request types.WhitelistRequ
 		"Type":     "Denial Task",
 	}).Info("Received new task")
 
-	worker.updateCache(request)
-	worker.emailDecision(request)
-	d.Ack(false)
+	worker.updateCache(task)
+	worker.once(task, effectDecisionEmail, func() error {
+		return worker.emailDecision(request)
+	})
+	worker.ack(d, task)
+}
+
+// Ban will ban a user from the server with the reason given by the admin and prevent
+// applications coming from that user while the ban lasts. Temporary bans are lifted by the scheduler
+func (worker *Worker) processBan(ctx context.Context, d broker.Delivery, task broker.Task) {
+	request := task.Request
+	worker.logger.WithFields(logrus.Fields{
+		"username":    request.Username,
+		"ID":          request.ID,
+		"bannedUntil": request.BannedUntil,
+		"Type":        "Ban Task",
+	}).Info("Received new task")
+	worker.updateCache(task)
+	err := worker.fanOut(ctx, task, effectRCON, banCommand(request))
+	if _, ok := err.(*rejectedError); ok {
+		worker.ack(d, task)
+		return
+	}
+	if err != nil {
+		worker.logger.WithFields(logrus.Fields{
+			"username": request.Username,
+			"err":      err.Error(),
+		}).Error("Unable to ban user on the game server")
+		worker.retry(d, request, "Unable to ban user on the game server: "+err.Error())
+		return
+	}
+	if viper.GetBool("bans.emailPlayer") {
+		err = worker.once(task, effectBanEmail, func() error {
+			return worker.emailBan(request)
+		})
+		if err != nil {
+			worker.retry(d, request, "Unable to send ban email: "+err.Error())
+			return
+		}
+	}
+	worker.ack(d, task)
+}
+
+// banCommand returns the ban command for the player, followed by the reason if there is one
+func banCommand(request types.WhitelistRequest) string {
+	if request.BanReason == "" {
+		return "ban " + request.Username
+	}
+	return "ban " + request.Username + " " + request.BanReason
 }
 
-// Ban will permanately ban a user from the server and woll prevent
-// applications coming from that user
-func (worker *Worker) processBan(d amqp.Delivery, request types.WhitelistRequest) {
+// Lift the ban of a user. Users whose whitelist was restored are added to the whitelist
+// again, deactivated users are removed from it
+func (worker *Worker) processUnban(ctx context.Context, d broker.Delivery, task broker.Task) {
+	request := task.Request
 	worker.logger.WithFields(logrus.Fields{
 		"username": request.Username,
 		"ID":       request.ID,
-		"Type":     "Ban Task",
+		"status":   request.Status,
+		"Type":     "Unban Task",
 	}).Info("Received new task")
-	worker.updateCache(request)
-	err := worker.issueRCON("ban " + request.Username)
+	worker.updateCache(task)
+	err := worker.fanOut(ctx, task, effectPardon, "pardon "+request.Username)
+	if err == nil {
+		command := "whitelist remove " + request.Username
+		if request.Status == types.StatusApproved {
+			command = "whitelist add " + request.Username
+		}
+		err = worker.fanOut(ctx, task, effectRCON, command)
+	}
+	if _, ok := err.(*rejectedError); ok {
+		worker.ack(d, task)
+		return
+	}
 	if err != nil {
 		worker.logger.WithFields(logrus.Fields{
 			"username": request.Username,
 			"err":      err.Error(),
-		}).Error("Unable to ban user on the game server")
-		d.Nack(false, false)
+		}).Error("Unable to unban user on the game server")
+		worker.retry(d, request, "Unable to unban user on the game server: "+err.Error())
 		return
 	}
-	d.Ack(false)
+	worker.ack(d, task)
 }
 
 // Deactivate a user will un-whitelist that username. But allow further applications
 // from the same user
-func (worker *Worker) processDeactivate(d amqp.Delivery, request types.WhitelistRequest) {
+func (worker *Worker) processDeactivate(ctx context.Context, d broker.Delivery, task broker.Task) {
+	request := task.Request
 	worker.logger.WithFields(logrus.Fields{
 		"username": request.Username,
 		"ID":       request.ID,
 		"Type":     "Deactivate Task",
 	}).Info("Received new task")
-	worker.updateCache(request)
-	err := worker.issueRCON("whitelist remove " + request.Username)
+	worker.updateCache(task)
+	err := worker.fanOut(ctx, task, effectRCON, "whitelist remove "+request.Username)
+	if _, ok := err.(*rejectedError); ok {
+		worker.ack(d, task)
+		return
+	}
 	if err != nil {
 		worker.logger.WithFields(logrus.Fields{
 			"username": request.Username,
 			"err":      err.Error(),
 		}).Error("Unable to deactivate user on the game server")
-		d.Nack(false, false)
+		worker.retry(d, request, "Unable to deactivate user on the game server: "+err.Error())
 		return
 	}
-	d.Ack(false)
+	worker.ack(d, task)
 
 }
 
-//Nack: successful ops emails less than threshold; confirmation email does not count
-func (worker *Worker) processNewRequest(d amqp.Delivery, request types.WhitelistRequest) {
+//Retry: successful ops emails less than threshold; confirmation email does not count
+func (worker *Worker) processNewRequest(ctx context.Context, d broker.Delivery, task broker.Task) {
+	request := task.Request
 	worker.logger.WithFields(logrus.Fields{
 		"username": request.Username,
 		"ID":       request.ID,
 		"Type":     "New Reqeust Task",
 	}).Info("Received new task")
 
-	worker.updateCache(request)
+	worker.updateCache(task)
 	// Need to handle new request
-	// Send application confirmation email to user
-	worker.emailConfirmation(request)
+	// Send application confirmation email to user. Only once if dispatching to the ops is retried
+	worker.once(task, effectConfirmationEmail, func() error {
+		return worker.emailConfirmation(request)
+	})
 
 	// Send approval request emails to op(s)
-	successCount, err := worker.emailToOps(request, viper.GetInt("minRequiredReceiver"))
+	successCount, err := worker.emailToOps(task, viper.GetInt("minRequiredReceiver"))
 	if err != nil {
 		// If success count for sending ops emails less than minimum quoram, put to dead letter queue
 		worker.logger.WithFields(logrus.Fields{
 			"message":      request,
 			"successCount": successCount,
 		}).Error("Failed to dispatch action emails to required number of ops")
-		d.Nack(false, false)
+		worker.retry(d, request, "Failed to dispatch action emails to required number of ops: "+err.Error())
+		return
+	}
+	worker.ack(d, task)
+}
+
+// Resend the confirmation email of a pending request. Retry if it can not be sent
+func (worker *Worker) processResendConfirmation(ctx context.Context, d broker.Delivery, task broker.Task) {
+	request := task.Request
+	worker.logger.WithFields(logrus.Fields{
+		"username": request.Username,
+		"ID":       request.ID,
+		"Type":     "Resend Confirmation Task",
+	}).Info("Received new task")
+	err := worker.once(task, effectConfirmationEmail, func() error {
+		return worker.emailConfirmation(request)
+	})
+	if err != nil {
+		worker.retry(d, request, "Unable to send confirmation email: "+err.Error())
+		return
+	}
+	worker.ack(d, task)
+}
+
+// Send the action emails of a pending request to the ops again
+// Retry: successful ops emails less than threshold
+func (worker *Worker) processRedispatch(ctx context.Context, d broker.Delivery, task broker.Task) {
+	request := task.Request
+	worker.logger.WithFields(logrus.Fields{
+		"username": request.Username,
+		"ID":       request.ID,
+		"Type":     "Redispatch Task",
+	}).Info("Received new task")
+	successCount, err := worker.emailToOps(task, viper.GetInt("minRequiredReceiver"))
+	if err != nil {
+		worker.logger.WithFields(logrus.Fields{
+			"message":      request,
+			"successCount": successCount,
+		}).Error("Failed to dispatch action emails to required number of ops")
+		worker.retry(d, request, "Failed to dispatch action emails to required number of ops: "+err.Error())
+		return
+	}
+	worker.ack(d, task)
+}
+
+// Add an approved player to the whitelist again, e.g. after the game server lost its whitelist
+func (worker *Worker) processReapplyWhitelist(ctx context.Context, d broker.Delivery, task broker.Task) {
+	request := task.Request
+	worker.logger.WithFields(logrus.Fields{
+		"username": request.Username,
+		"ID":       request.ID,
+		"Type":     "Reapply Whitelist Task",
+	}).Info("Received new task")
+	err := worker.fanOut(ctx, task, effectRCON, "whitelist add "+request.Username)
+	if _, ok := err.(*rejectedError); ok {
+		worker.ack(d, task)
+		return
+	}
+	if err != nil {
+		worker.logger.WithFields(logrus.Fields{
+			"username": request.Username,
+			"err":      err.Error(),
+		}).Error("Unable to issue whitelist cmd on the game server")
+		worker.retry(d, request, "Unable to issue whitelist cmd on the game server: "+err.Error())
+		return
+	}
+	worker.ack(d, task)
+}
+
+// Warn the player that their membership expires soon. Retry if the email can not be sent
+func (worker *Worker) processExpiryWarning(ctx context.Context, d broker.Delivery, task broker.Task) {
+	request := task.Request
+	worker.logger.WithFields(logrus.Fields{
+		"username":  request.Username,
+		"ID":        request.ID,
+		"expiresAt": request.ExpiresAt,
+		"Type":      "Expiry Warning Task",
+	}).Info("Received new task")
+	err := worker.once(task, effectExpiryEmail, func() error {
+		return worker.emailExpiryWarning(request)
+	})
+	if err != nil {
+		worker.retry(d, request, "Unable to send expiry warning email: "+err.Error())
 		return
 	}
-	d.Ack(false)
+	worker.ack(d, task)
+}
+
+// retry schedules the task to be processed again later. Once all retries are used up
+// the task is moved to the dead letter queue
+func (worker *Worker) retry(d broker.Delivery, request types.WhitelistRequest, reason string) {
+	deadLettered, err := d.Retry(reason)
+	log := worker.logger.WithFields(logrus.Fields{
+		"username": request.Username,
+		"ID":       request.ID,
+		"retries":  d.Retries(),
+	})
+	if err != nil {
+		log.WithField("err", err.Error()).Error("Unable to schedule task for retry")
+	} else if deadLettered {
+		log.Error("Task failed after all retries. Moved to dead letter queue")
+	} else {
+		log.WithField("delay", broker.RetryDelay(d.Retries()+1).String()).Warning("Task scheduled for retry")
+	}
 }
 
 func (worker *Worker) emailDecision(whitelistRequest types.WhitelistRequest) error {
@@ -373,8 +708,37 @@ func (worker *Worker) emailDecision(whitelistRequest types.WhitelistRequest) err
 }
 
 func (worker *Worker) emailConfirmation(whitelistRequest types.WhitelistRequest) error {
-	log := worker.logger
-	subject := viper.GetString("confirmationEmailTitle")
+	// Only the applicant gets the key to export or erase their data
+	return worker.sendPlayerEmail(whitelistRequest, "./mailer/templates/confirmation.html", viper.GetString("confirmationEmailTitle"), map[string]string{
+		"applicantKey": utils.ApplicantKey(whitelistRequest.ID.Hex(), viper.GetString("passphrase")),
+	})
+}
+
+func (worker *Worker) emailExpiryWarning(whitelistRequest types.WhitelistRequest) error {
+	return worker.sendPlayerEmail(whitelistRequest, "./mailer/templates/expiry.html", viper.GetString("expiryWarningEmailTitle"), map[string]string{
+		"expiresAt": whitelistRequest.ExpiresAt.Format("January 2, 2006 15:04 MST"),
+	})
+}
+
+func (worker *Worker) emailBan(whitelistRequest types.WhitelistRequest) error {
+	duration := "permanently"
+	if !whitelistRequest.BannedUntil.IsZero() {
+		duration = "until " + whitelistRequest.BannedUntil.Format("January 2, 2006 15:04 MST")
+	}
+	reason := whitelistRequest.BanReason
+	if reason == "" {
+		reason = "No reason was given"
+	}
+	return worker.sendPlayerEmail(whitelistRequest, "./mailer/templates/ban.html", viper.GetString("banEmailTitle"), map[string]string{
+		"duration": duration,
+		"reason":   reason,
+	})
+}
+
+// sendPlayerEmail sends the template to the applicant of the request. The link to the status page
+// of the request is added to the template data
+func (worker *Worker) sendPlayerEmail(whitelistRequest types.WhitelistRequest, template, subject string, data map[string]string) error {
+	log := worker.logger.WithField("template", template)
 	requestIDToken, err := utils.EncodeAndEncrypt(whitelistRequest.ID.Hex(), viper.GetString("passphrase"))
 	if err != nil {
 		log.WithFields(logrus.Fields{
@@ -382,26 +746,28 @@ func (worker *Worker) emailConfirmation(whitelistRequest types.WhitelistRequest)
 		}).Error("Failed to encode requestID Token")
 		return err
 	}
-	confirmationLink := os.Getenv("FRONTEND_DEPLOYED_URL") + "status/" + requestIDToken
-	err = mailer.Send("./mailer/templates/confirmation.html", map[string]string{"link": confirmationLink}, subject, whitelistRequest.Email)
+	data["link"] = os.Getenv("FRONTEND_DEPLOYED_URL") + "status/" + requestIDToken
+	err = mailer.Send(template, data, subject, whitelistRequest.Email)
 	if err != nil {
 		log.WithFields(logrus.Fields{
 			"recipent": whitelistRequest.Email,
 			"err":      err,
 			"ID":       whitelistRequest.ID.Hex(),
-		}).Error("Failed to send confirmation email")
+		}).Error("Failed to send email")
 	} else {
 		log.WithFields(logrus.Fields{
 			"recipent": whitelistRequest.Email,
-		}).Info("Confirmation email sent")
+		}).Info("Email sent")
 	}
 	return err
 }
 
-func (worker *Worker) emailToOps(whitelistRequest types.WhitelistRequest, quoram int) (int, error) {
+// emailToOps sends the action emails to the target ops. Ops who received it in an earlier
+// delivery of the task are skipped and count towards the quoram
+func (worker *Worker) emailToOps(task broker.Task, quoram int) (int, error) {
 	log := worker.logger
+	whitelistRequest := task.Request
 	subject := "[Action Required] Whitelist request from " + whitelistRequest.Username
-	successCount := 0
 	requestIDToken, err := utils.EncodeAndEncrypt(whitelistRequest.ID.Hex(), viper.GetString("passphrase"))
 	if err != nil {
 		log.WithFields(logrus.Fields{
@@ -409,12 +775,25 @@ func (worker *Worker) emailToOps(whitelistRequest types.WhitelistRequest, quoram
 		}).Error("Failed to encode requestID Token")
 		return 0, err
 	}
+	record, err := worker.dbService.TaskRecord(task.IdempotencyKey)
+	if err != nil {
+		return 0, err
+	}
 	// ops who received the action emails successfully will be added to the assignees
 	// and attach as the metadata for the request db object
 	assignees := []string{}
+	for _, effect := range record.Effects {
+		if strings.HasPrefix(effect, effectOpEmail) {
+			assignees = append(assignees, strings.TrimPrefix(effect, effectOpEmail))
+		}
+	}
+	successCount := len(assignees)
 	// Get target ops to send action emails according to the configured dispatching strategy
 	ops := worker.getTargetOps()
 	for _, op := range ops {
+		if record.Done(effectOpEmail + op) {
+			continue
+		}
 		opEmailToken, err := utils.EncodeAndEncrypt(op, viper.GetString("passphrase"))
 		if err != nil {
 			log.WithFields(logrus.Fields{
@@ -437,6 +816,12 @@ func (worker *Worker) emailToOps(whitelistRequest types.WhitelistRequest, quoram
 			}).Info("Action email sent to op")
 			assignees = append(assignees, op)
 			successCount++
+			if err := worker.dbService.RecordTaskEffect(task.IdempotencyKey, effectOpEmail+op); err != nil {
+				log.WithFields(logrus.Fields{
+					"recipent": op,
+					"err":      err,
+				}).Warning("Unable to record action email in the task ledger")
+			}
 		}
 	}
 	// Attach assignee info to the db request object to keep track of each request
@@ -467,28 +852,140 @@ func (worker *Worker) getTargetOps() []string {
 		return ops
 	}
 	n := viper.GetInt("randomDispatchingThreshold")
-	// Choose random n out of all ops as the target request handlers
+	// Choose random n out of all ops as the target request handlers. The slice is shuffled
+	// on a copy since viper may hand out the configured slice itself
+	ops = append([]string{}, ops...)
 	rand.Seed(time.Now().UnixNano())
 	rand.Shuffle(len(ops), func(i, j int) { ops[i], ops[j] = ops[j], ops[i] })
 	return ops[:n]
 }
 
-// issue  command againest a user on the game server with retries
-func (worker *Worker) issueRCON(command string) error {
-	_, err := worker.rconClient.SendCommand(command)
-
+// fanOut issues the command on every game server the request applies to. Game servers where
+// the command took place in an earlier delivery of the task are skipped. The outcome on each
+// game server is recorded on the request. The error lists the game servers where the command failed.
+// If game servers only rejected the command, the failure is recorded on the request and a *rejectedError is returned.
+// Requests without a username are rejected before any command is sent
+func (worker *Worker) fanOut(ctx context.Context, task broker.Task, effect, command string) error {
+	if task.Request.Username == "" {
+		worker.logger.WithFields(logrus.Fields{
+			"ID":      task.Request.ID,
+			"command": command,
+		}).Warning("Request has no username. Not issuing the command")
+		return errNoUsername
+	}
+	targets, err := gameserver.Resolve(task.Request.Servers)
 	if err != nil {
 		return err
 	}
-	worker.logger.WithFields(logrus.Fields{
-		"command": command,
-	}).Info("Command has been issued successfully on the game server")
+	// The failure of an earlier task no longer applies
+	worker.once(task, effectClearFailure, func() error {
+		return worker.recordFailure(task.Request, "")
+	})
+	failed, rejected := []string{}, []string{}
+	for _, target := range targets {
+		name := target.Name
+		err := worker.once(task, effect+":"+name, func() error {
+			result, err := worker.issueRCON(ctx, name, command)
+			worker.recordServerResult(task.Request, name, command, result, err)
+			if err == nil && result.Outcome == rcon.OutcomeFailure {
+				// Not recorded as done, so the command is sent again if the task is retried for other game servers
+				return &rejectedError{result.Reason}
+			}
+			return err
+		})
+		if rejectedErr, ok := err.(*rejectedError); ok {
+			reason := rejectedErr.reason
+			if len(targets) > 1 {
+				reason += " on " + name
+			}
+			rejected = append(rejected, reason)
+		} else if err != nil {
+			failed = append(failed, name+": "+err.Error())
+		}
+	}
+	if len(rejected) > 0 {
+		failure := failureLabels[task.Type] + ": " + strings.Join(rejected, "; ")
+		if err := worker.recordFailure(task.Request, failure); err != nil {
+			worker.logger.WithFields(logrus.Fields{
+				"ID":  task.Request.ID,
+				"err": err.Error(),
+			}).Warning("Unable to record the failure on the request")
+		}
+		if len(failed) == 0 {
+			return &rejectedError{failure}
+		}
+	}
+	if len(failed) > 0 {
+		return errors.New(strings.Join(failed, "; "))
+	}
 	return nil
 }
-func deserialize(b []byte) (types.WhitelistRequest, error) {
-	var msg types.WhitelistRequest
-	buf := bytes.NewBuffer(b)
-	decoder := json.NewDecoder(buf)
-	err := decoder.Decode(&msg)
-	return msg, err
+
+// recordServerResult stores the outcome of the command on the game server with the request. Best effort only
+func (worker *Worker) recordServerResult(request types.WhitelistRequest, server, command string, cmdResult rcon.Result, cmdErr error) {
+	result := types.ServerResult{
+		Status:    request.Status,
+		Command:   command,
+		Timestamp: time.Now(),
+		Outcome:   cmdResult.Outcome,
+		Reason:    cmdResult.Reason,
+		Response:  cmdResult.Response,
+	}
+	if cmdErr != nil {
+		result.Error = cmdErr.Error()
+	}
+	_, err := worker.dbService.UpdateRequest(bson.M{"_id": request.ID}, bson.M{
+		"$set": bson.M{"serverResults." + server: result},
+	})
+	if err != nil {
+		worker.logger.WithFields(logrus.Fields{
+			"ID":     request.ID,
+			"server": server,
+			"err":    err.Error(),
+		}).Warning("Unable to record the result of the command on the request")
+	}
+}
+
+// recordFailure stores the failure of the task with the request so that ops can see it. An empty failure clears it
+func (worker *Worker) recordFailure(request types.WhitelistRequest, failure string) error {
+	_, err := worker.dbService.UpdateRequest(bson.M{"_id": request.ID}, bson.M{
+		"$set": bson.M{"failure": failure},
+	})
+	return err
+}
+
+// issue  command againest a user on the game server with retries
+func (worker *Worker) issueRCON(ctx context.Context, server, command string) (rcon.Result, error) {
+	response, err := worker.SendCommandContext(ctx, server, command)
+	if err != nil {
+		return rcon.Result{}, err
+	}
+	result := rcon.ParseResult(command, response)
+	log := worker.logger.WithFields(logrus.Fields{
+		"server":   server,
+		"command":  command,
+		"outcome":  result.Outcome,
+		"reason":   result.Reason,
+		"response": result.Response,
+	})
+	if result.Outcome == rcon.OutcomeFailure {
+		log.Warning("Game server rejected the command")
+	} else {
+		log.Info("Command has been issued successfully on the game server")
+	}
+	return result, nil
+}
+
+// SendCommand sends the command to the game server with the given name and returns its response
+func (worker *Worker) SendCommand(server, command string) (string, error) {
+	return worker.SendCommandContext(context.Background(), server, command)
+}
+
+// SendCommandContext is SendCommand abandoning the command when ctx is done
+func (worker *Worker) SendCommandContext(ctx context.Context, server, command string) (string, error) {
+	client, ok := worker.rconClients[server]
+	if !ok {
+		return "", fmt.Errorf("Not connected to game server %s", server)
+	}
+	return client.SendCommandContext(ctx, command)
 }
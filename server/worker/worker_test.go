@@ -2,6 +2,8 @@ package worker_test
 
 import (
 	"context"
+	"errors"
+	"reflect"
 	"sync"
 	"testing"
 	"time"
@@ -9,10 +11,16 @@ import (
 	"github.com/sirupsen/logrus"
 	"github.com/spf13/viper"
 	"github.com/streadway/amqp"
+	"github.com/tywin1104/mc-gatekeeper/broker"
 	"github.com/tywin1104/mc-gatekeeper/cache"
 	"github.com/tywin1104/mc-gatekeeper/db"
+	"github.com/tywin1104/mc-gatekeeper/db/dbtest"
+	"github.com/tywin1104/mc-gatekeeper/gameserver"
 	"github.com/tywin1104/mc-gatekeeper/server/sse"
+	"github.com/tywin1104/mc-gatekeeper/types"
 	"github.com/tywin1104/mc-gatekeeper/worker"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
 	"go.mongodb.org/mongo-driver/mongo"
 	"go.mongodb.org/mongo-driver/mongo/options"
 )
@@ -20,6 +28,7 @@ import (
 var log = logrus.New()
 var rabbitCloseError chan *amqp.Error
 var testWorker *worker.Worker
+var taskQueue *broker.Service
 
 func TestMain(m *testing.M) {
 	// Mock the main application using the test configuration file
@@ -45,7 +54,10 @@ func TestMain(m *testing.M) {
 	cache := cache.NewService(dbSvc, sseServer)
 	workerLogger := log.WithField("origin", "worker")
 	rabbitCloseError = make(chan *amqp.Error)
-	testWorker, err = worker.NewWorker(dbSvc, cache, workerLogger, rabbitCloseError)
+	taskQueue = broker.NewService(log, rabbitCloseError)
+	go taskQueue.WatchForReconnect()
+	defer taskQueue.Close()
+	testWorker, err = worker.NewWorker(dbSvc, cache, taskQueue, workerLogger)
 	if err != nil {
 		log.Fatal("Unable to start worker: " + err.Error())
 	}
@@ -53,23 +65,154 @@ func TestMain(m *testing.M) {
 	wg.Add(1)
 	go testWorker.Start(&wg)
 	wg.Wait()
-	defer testWorker.Close()
 	m.Run()
 }
 
 func TestWorkerReconnect(t *testing.T) {
-	oldConn := testWorker.GetConn()
+	// The worker consumes through the task queue which owns the connection
+	oldConn := taskQueue.GetConn()
 
-	oldChannel := testWorker.GetChannel()
+	oldChannel := taskQueue.GetChannel()
 	// establish the rabbitmq reconnection by sending
 	// an error and thus calling the error callback
 	rabbitCloseError <- amqp.ErrClosed
 	// Short wait for the reconnection to be established
 	time.Sleep(3 * time.Second)
-	newConn := testWorker.GetConn()
-	newChannel := testWorker.GetChannel()
+	newConn := taskQueue.GetConn()
+	newChannel := taskQueue.GetChannel()
 	// Should expect the new connection/channel to be different from the old connection/channel
 	if oldConn == newConn || oldChannel == newChannel {
 		t.Error("RabbitMQ connection and channel do not change after reconnect")
 	}
 }
+
+// flakyGameServer fails the first command and records all commands it receives
+type flakyGameServer struct {
+	mu       sync.Mutex
+	commands []string
+}
+
+func (g *flakyGameServer) SendCommandContext(ctx context.Context, command string) (string, error) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.commands = append(g.commands, command)
+	if len(g.commands) == 1 {
+		return "", errors.New("connection refused")
+	}
+	return "", nil
+}
+
+func (g *flakyGameServer) Close() error {
+	return nil
+}
+
+func (g *flakyGameServer) sent() []string {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return append([]string{}, g.commands...)
+}
+
+type noCache struct{}
+
+func (noCache) UpdateAllRequests() error                                 { return nil }
+func (noCache) UpdateRealTimeStats(request types.WhitelistRequest) error { return nil }
+
+// startWorker starts a worker that consumes from the queue and sends commands to the game server
+func startWorker(t *testing.T, store db.RequestStore, queue broker.Consumer, server *flakyGameServer) *worker.Worker {
+	w, err := worker.NewWorker(store, nil, queue, log.WithField("origin", "worker"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.SetCache(noCache{})
+	w.SetGameServer(gameserver.DefaultName, server)
+	wg := sync.WaitGroup{}
+	wg.Add(1)
+	go w.Start(&wg)
+	wg.Wait()
+	return w
+}
+
+// decideRequest changes the status of the request and returns the task for the change
+func decideRequest(t *testing.T, store db.RequestStore, id primitive.ObjectID, status, taskType string) broker.Task {
+	_, err := store.UpdateRequest(bson.M{"_id": id}, bson.M{
+		"$set": bson.M{"status": status},
+		"$inc": bson.M{"version": 1},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	requests, err := store.GetRequests(1, bson.M{"_id": id})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return broker.NewTask(taskType, requests[0])
+}
+
+func TestRetriedTaskDoesNotOvertakeLaterChange(t *testing.T) {
+	viper.Set("taskRetryDelay", "200ms")
+	defer viper.Set("taskRetryDelay", nil)
+	store := dbtest.NewSQLite(t)
+	defer store.Close()
+	queue, _ := broker.NewMemoryQueue("")
+	defer queue.Close()
+	servers := &flakyGameServer{}
+	w := startWorker(t, store, queue, servers)
+	defer w.Stop(context.Background())
+
+	id, err := store.CreateRequest(types.WhitelistRequest{Username: "Steve", Email: "steve@gmail.com"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The approval fails on the game server and is retried after the player was banned
+	if err = queue.Publish(decideRequest(t, store, id, types.StatusApproved, broker.TaskApproval)); err != nil {
+		t.Fatal(err)
+	}
+	for deadline := time.Now().Add(time.Second); len(servers.sent()) == 0; time.Sleep(10 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("Expect the approval to be processed")
+		}
+	}
+	if err = queue.Publish(decideRequest(t, store, id, types.StatusBanned, broker.TaskBan)); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(time.Second)
+
+	want := []string{"whitelist add Steve", "ban Steve"}
+	if got := servers.sent(); !reflect.DeepEqual(got, want) {
+		t.Errorf("Expect commands %v, got %v", want, got)
+	}
+}
+
+func TestAnonymisedRequestSendsNoCommand(t *testing.T) {
+	store := dbtest.NewSQLite(t)
+	defer store.Close()
+	queue, _ := broker.NewMemoryQueue("")
+	defer queue.Close()
+	servers := &flakyGameServer{}
+	w := startWorker(t, store, queue, servers)
+	defer w.Stop(context.Background())
+
+	id, err := store.CreateRequest(types.WhitelistRequest{Status: types.StatusApproved})
+	if err != nil {
+		t.Fatal(err)
+	}
+	task := decideRequest(t, store, id, types.StatusDeactivated, broker.TaskDeactivation)
+	if err = queue.Publish(task); err != nil {
+		t.Fatal(err)
+	}
+	for deadline := time.Now().Add(time.Second); ; time.Sleep(10 * time.Millisecond) {
+		record, err := store.TaskRecord(task.IdempotencyKey)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if record.Completed() {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("Expect the deactivation to be completed")
+		}
+	}
+	if got := servers.sent(); len(got) != 0 {
+		t.Errorf("Expect no commands for a request without username, got %v", got)
+	}
+}